@@ -0,0 +1,234 @@
+// Package apikey manages the API keys of the server to server consumers. Only the digests of the keys are stored
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// keyPrefix makes the keys recognizable, e.g. by secret scanners
+	keyPrefix = "mm_"
+	idBytes   = 8
+	keyBytes  = 32
+)
+
+var (
+	// ErrNotFound is returned when the key doesn't exist
+	ErrNotFound = errors.New("api key not found")
+	// ErrRevoked is returned when the key has been revoked
+	ErrRevoked = errors.New("api key revoked")
+	// ErrInvalid is returned when the key is malformed or doesn't match the digest
+	ErrInvalid = errors.New("invalid api key")
+)
+
+// RateLimit allows the key Requests requests per Window seconds. It replaces the limit of the route group
+type RateLimit struct {
+	Requests int `json:"requests"`
+	Window   int `json:"window,omitempty"`
+	Burst    int `json:"burst,omitempty"`
+}
+
+// Key is a stored API key. The key itself is only known by the consumer, it's <prefix><id>.<secret> and the digest of the secret is stored
+type Key struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Digest    string     `json:"digest,omitempty"`
+	Scopes    []string   `json:"scopes"`
+	RateLimit *RateLimit `json:"rateLimit,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// Revoked reports whether the key has been revoked
+func (k *Key) Revoked() bool {
+	return k.RevokedAt != nil
+}
+
+// HasScope reports whether the key is granted the scope
+func (k *Key) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Public returns the key without the digest, which is safe to reply
+func (k Key) Public() Key {
+	k.Digest = ""
+	return k
+}
+
+// Store persists the keys
+type Store interface {
+	Get(ctx context.Context, id string) (*Key, error)
+	List(ctx context.Context) ([]*Key, error)
+	// Save creates or replaces the key
+	Save(ctx context.Context, k *Key) error
+}
+
+// Manager creates, authenticates and revokes the keys of a store
+type Manager struct {
+	store Store
+	now   func() time.Time
+}
+
+// NewManager creates the manager of the keys in the store
+func NewManager(store Store) *Manager {
+	return &Manager{
+		store: store,
+		now:   time.Now,
+	}
+}
+
+func digest(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int, encode func([]byte) string) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "fail to generate random bytes")
+	}
+	return encode(b), nil
+}
+
+// Create generates a key with the scopes. The returned string is the key, which can't be recovered later
+func (m *Manager) Create(ctx context.Context, name string, scopes []string, limit *RateLimit) (string, *Key, error) {
+	if name == "" {
+		return "", nil, errors.New("an api key needs a name")
+	}
+	id, err := randomString(idBytes, hex.EncodeToString)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomString(keyBytes, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return "", nil, err
+	}
+	k := &Key{
+		ID:        id,
+		Name:      name,
+		Digest:    digest(secret),
+		Scopes:    normalizeScopes(scopes),
+		RateLimit: limit,
+		CreatedAt: m.now().UTC(),
+	}
+	if err = m.store.Save(ctx, k); err != nil {
+		return "", nil, errors.WithMessagef(err, "fail to save api key(%s)", id)
+	}
+	return keyPrefix + id + "." + secret, k, nil
+}
+
+// List returns every key, including the revoked ones
+func (m *Manager) List(ctx context.Context) ([]*Key, error) {
+	return m.store.List(ctx)
+}
+
+// Get returns the key of the id
+func (m *Manager) Get(ctx context.Context, id string) (*Key, error) {
+	return m.store.Get(ctx, id)
+}
+
+// SetScopes replaces the scopes and the rate limit of the key. The rate limit is left unchanged if it's nil
+func (m *Manager) SetScopes(ctx context.Context, id string, scopes []string, limit *RateLimit) (*Key, error) {
+	k, err := m.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if k.Revoked() {
+		return nil, ErrRevoked
+	}
+	k.Scopes = normalizeScopes(scopes)
+	if limit != nil {
+		k.RateLimit = limit
+	}
+	if err = m.store.Save(ctx, k); err != nil {
+		return nil, errors.WithMessagef(err, "fail to save api key(%s)", id)
+	}
+	return k, nil
+}
+
+// Revoke revokes the key. The key is kept to be listed
+func (m *Manager) Revoke(ctx context.Context, id string) (*Key, error) {
+	k, err := m.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if k.Revoked() {
+		return k, nil
+	}
+	now := m.now().UTC()
+	k.RevokedAt = &now
+	if err = m.store.Save(ctx, k); err != nil {
+		return nil, errors.WithMessagef(err, "fail to save api key(%s)", id)
+	}
+	return k, nil
+}
+
+// Authenticate returns the key of the key string if it matches the digest and isn't revoked
+func (m *Manager) Authenticate(ctx context.Context, key string) (*Key, error) {
+	id, secret, ok := parse(key)
+	if !ok {
+		return nil, ErrInvalid
+	}
+	k, err := m.store.Get(ctx, id)
+	if err == ErrNotFound {
+		return nil, ErrInvalid
+	} else if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(digest(secret)), []byte(k.Digest)) != 1 {
+		return nil, ErrInvalid
+	}
+	if k.Revoked() {
+		return nil, ErrRevoked
+	}
+	return k, nil
+}
+
+// IsManaged reports whether the key string has the format of a managed key
+func IsManaged(key string) bool {
+	_, _, ok := parse(key)
+	return ok
+}
+
+func parse(key string) (id string, secret string, ok bool) {
+	if !strings.HasPrefix(key, keyPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(key, keyPrefix), ".", 2)
+	if len(parts) != 2 || len(parts[0]) != hex.EncodedLen(idBytes) || parts[1] == "" {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(parts[0]); err != nil {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// normalizeScopes drops the empty and duplicated scopes. It never returns nil, so that a key without scopes is allowed nothing
+func normalizeScopes(scopes []string) []string {
+	normalized := make([]string, 0, len(scopes))
+	seen := make(map[string]bool, len(scopes))
+	for _, s := range scopes {
+		s = strings.TrimSpace(s)
+		if s == "" || seen[s] {
+			continue
+		}
+		seen[s] = true
+		normalized = append(normalized, s)
+	}
+	return normalized
+}
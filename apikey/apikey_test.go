@@ -0,0 +1,98 @@
+package apikey
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "apikeys.json")
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(store)
+
+	key, created, err := m.Create(ctx, "newsletter", []string{"v0", " ", "v0"}, &RateLimit{Requests: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsManaged(key) || !strings.HasPrefix(key, keyPrefix+created.ID+".") {
+		t.Fatalf("key(%s) is not in the format of the managed keys", key)
+	}
+	if strings.Contains(created.Digest, key[strings.Index(key, ".")+1:]) {
+		t.Fatal("the secret is stored")
+	}
+	if !reflect.DeepEqual(created.Scopes, []string{"v0"}) {
+		t.Fatalf("scopes are %v", created.Scopes)
+	}
+
+	k, err := m.Authenticate(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.ID != created.ID || k.RateLimit.Requests != 10 {
+		t.Fatalf("authenticated key is %+v", k)
+	}
+	if _, err = m.Authenticate(ctx, key+"x"); err != ErrInvalid {
+		t.Fatalf("a wrong secret is authenticated with %v", err)
+	}
+	if _, err = m.Authenticate(ctx, keyPrefix+"0123456789abcdef.secret"); err != ErrInvalid {
+		t.Fatalf("an unknown key is authenticated with %v", err)
+	}
+
+	if k, err = m.SetScopes(ctx, created.ID, []string{"v1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !k.HasScope("v1") || k.HasScope("v0") || k.RateLimit == nil {
+		t.Fatalf("scopes are not replaced: %+v", k)
+	}
+
+	if _, err = m.Revoke(ctx, created.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.Authenticate(ctx, key); err != ErrRevoked {
+		t.Fatalf("a revoked key is authenticated with %v", err)
+	}
+	if _, err = m.SetScopes(ctx, created.ID, nil, nil); err != ErrRevoked {
+		t.Fatalf("scopes of a revoked key are set with %v", err)
+	}
+	if _, err = m.Revoke(ctx, "unknown"); err != ErrNotFound {
+		t.Fatalf("an unknown key is revoked with %v", err)
+	}
+
+	// the keys survive a restart
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewManager(reopened).List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].ID != created.ID || !keys[0].Revoked() || !keys[0].HasScope("v1") {
+		t.Fatalf("reopened keys are %+v", keys)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, key := range []string{
+		"",
+		"secret",
+		"mm_0123456789abcdef",
+		"mm_0123456789abcdef.",
+		"mm_0123456789abcdeg.secret",
+		"mm_0123.secret",
+	} {
+		if IsManaged(key) {
+			t.Errorf("%q is taken as a managed key", key)
+		}
+	}
+	if !IsManaged("mm_0123456789abcdef.secret") {
+		t.Error("a managed key is not recognized")
+	}
+}
@@ -0,0 +1,119 @@
+package apikey
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultFile is the file of the keys of FileStore
+const DefaultFile = "./configs/apikeys.json"
+
+// FileStore keeps the keys in a JSON file. The keys are read once, so the file can't be shared by the replicas
+type FileStore struct {
+	path string
+	mu   sync.RWMutex
+	keys map[string]*Key
+}
+
+// NewFileStore reads the keys in the file, default DefaultFile. A missing file has no keys
+func NewFileStore(path string) (*FileStore, error) {
+	if path == "" {
+		path = DefaultFile
+	}
+	s := &FileStore{
+		path: path,
+		keys: make(map[string]*Key),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "fail to read the api keys(%s)", path)
+	}
+	var keys []*Key
+	if err = json.Unmarshal(data, &keys); err != nil {
+		return nil, errors.Wrapf(err, "the api keys(%s) are malformed", path)
+	}
+	for _, k := range keys {
+		s.keys[k.ID] = k
+	}
+	return s, nil
+}
+
+// Get returns a copy of the key
+func (s *FileStore) Get(ctx context.Context, id string) (*Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.keys[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	copied := *k
+	return &copied, nil
+}
+
+// List returns the copies of the keys sorted by the creation time
+func (s *FileStore) List(ctx context.Context) ([]*Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sorted(), nil
+}
+
+func (s *FileStore) sorted() []*Key {
+	keys := make([]*Key, 0, len(s.keys))
+	for _, k := range s.keys {
+		copied := *k
+		keys = append(keys, &copied)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys
+}
+
+// Save replaces the file with the key atomically. The key is not saved if the file can't be written
+func (s *FileStore) Save(ctx context.Context, k *Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, existed := s.keys[k.ID]
+	copied := *k
+	s.keys[k.ID] = &copied
+	if err := s.write(); err != nil {
+		if existed {
+			s.keys[k.ID] = previous
+		} else {
+			delete(s.keys, k.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) write() error {
+	data, err := json.MarshalIndent(s.sorted(), "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "fail to marshal the api keys")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), "."+filepath.Base(s.path)+".*")
+	if err != nil {
+		return errors.Wrapf(err, "fail to write the api keys(%s)", s.path)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	return errors.Wrapf(err, "fail to write the api keys(%s)", s.path)
+}
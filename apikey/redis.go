@@ -0,0 +1,87 @@
+package apikey
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+const redisNamespace = "mm-apigateway.apikey"
+
+// Rediser is the part of a redis client used by RedisStore
+type Rediser interface {
+	Get(ctx context.Context, key string) *redis.StringCmd
+	Set(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.StatusCmd
+	SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd
+	SMembers(ctx context.Context, key string) *redis.StringSliceCmd
+}
+
+// RedisStore keeps every key in a redis string and their ids in a set, which are shared by the replicas
+type RedisStore struct {
+	Rdb Rediser
+}
+
+func redisKey(id string) string {
+	return fmt.Sprintf("%s.%s", redisNamespace, id)
+}
+
+func redisIDsKey() string {
+	return fmt.Sprintf("%s.ids", redisNamespace)
+}
+
+// Get reads the key from redis
+func (s RedisStore) Get(ctx context.Context, id string) (*Key, error) {
+	data, err := s.Rdb.Get(ctx, redisKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "fail to read api key(%s)", id)
+	}
+	k := &Key{}
+	if err = json.Unmarshal(data, k); err != nil {
+		return nil, errors.Wrapf(err, "api key(%s) is malformed", id)
+	}
+	return k, nil
+}
+
+// List reads every key in the set of the ids, sorted by the creation time
+func (s RedisStore) List(ctx context.Context) ([]*Key, error) {
+	ids, err := s.Rdb.SMembers(ctx, redisIDsKey()).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to read the api key ids")
+	}
+	keys := make([]*Key, 0, len(ids))
+	for _, id := range ids {
+		k, err := s.Get(ctx, id)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+// Save writes the key without an expiry and adds the id to the set
+func (s RedisStore) Save(ctx context.Context, k *Key) error {
+	data, err := json.Marshal(k)
+	if err != nil {
+		return errors.Wrapf(err, "fail to marshal api key(%s)", k.ID)
+	}
+	if err = s.Rdb.Set(ctx, redisKey(k.ID), data, 0).Err(); err != nil {
+		return errors.Wrapf(err, "fail to write api key(%s)", k.ID)
+	}
+	if err = s.Rdb.SAdd(ctx, redisIDsKey(), k.ID).Err(); err != nil {
+		return errors.Wrapf(err, "fail to index api key(%s)", k.ID)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+// Package audit records who did what to whom as structured events in pluggable sinks
+package audit
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Operations of the events
+const (
+	OpMemberCreate          = "member.create"
+	OpMemberUpdate          = "member.update"
+	OpMemberDelete          = "member.delete"
+	OpMemberDisable         = "member.delete.disable"
+	OpMemberRevokeTokens    = "member.delete.revokeTokens"
+	OpMemberDeleteFirebase  = "member.delete.firebaseUser"
+	OpMemberPublishDelete   = "member.delete.publish"
+	OpMemberDeleteConfirmed = "member.delete.confirmed"
+	OpMemberRestore         = "member.restore"
+	OpMemberVerifyEmail     = "member.verifyEmail"
+	OpGraphQLAuthorize      = "graphql.authorize"
+)
+
+// Outcomes of the events
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeAllowed = "allowed"
+	OutcomeDenied  = "denied"
+)
+
+const redacted = "[REDACTED]"
+
+// DefaultRedactedFields are the member fields whose values are personal data
+var DefaultRedactedFields = []string{"address", "birthday", "district", "email", "name", "nickname", "phone"}
+
+// Event is an audited action of the actor. Target is the firebaseId of the member acted on, and Resource is the GraphQL field or the API acted through
+type Event struct {
+	Time          time.Time              `json:"time"`
+	RequestID     string                 `json:"requestId,omitempty"`
+	ClientIP      string                 `json:"clientIp,omitempty"`
+	Actor         string                 `json:"actor,omitempty"`
+	ActorProvider string                 `json:"actorProvider,omitempty"`
+	Target        string                 `json:"target,omitempty"`
+	Resource      string                 `json:"resource,omitempty"`
+	Operation     string                 `json:"operation"`
+	Changes       map[string]interface{} `json:"changes,omitempty"`
+	Outcome       string                 `json:"outcome"`
+	Reason        string                 `json:"reason,omitempty"`
+}
+
+// Sink writes the events somewhere
+type Sink interface {
+	Write(ctx context.Context, e Event) error
+	Close() error
+}
+
+// Request is the requester of the actions audited in a context
+type Request struct {
+	ID            string
+	ClientIP      string
+	Actor         string
+	ActorProvider string
+}
+
+type requestKey struct{}
+
+// WithRequest returns the context carrying the requester
+func WithRequest(ctx context.Context, r Request) context.Context {
+	return context.WithValue(ctx, requestKey{}, r)
+}
+
+// RequestFrom returns the requester in the context
+func RequestFrom(ctx context.Context) Request {
+	r, _ := ctx.Value(requestKey{}).(Request)
+	return r
+}
+
+// Detach returns a background context carrying the requester of ctx, for the actions outliving the request
+func Detach(ctx context.Context) context.Context {
+	return WithRequest(context.Background(), RequestFrom(ctx))
+}
+
+// Auditor redacts the events and writes them to every sink. A nil Auditor discards the events
+type Auditor struct {
+	sinks    []Sink
+	redactor Redactor
+	now      func() time.Time
+}
+
+// New creates the auditor writing to the sinks. The values of the redacted fields in the changes are never written
+func New(redactedFields []string, sinks ...Sink) *Auditor {
+	return &Auditor{
+		sinks:    sinks,
+		redactor: NewRedactor(redactedFields),
+		now:      time.Now,
+	}
+}
+
+// Record completes the event with the requester in the context and writes it. The failures of the sinks are logged, they don't fail the action
+func (a *Auditor) Record(ctx context.Context, e Event) {
+	if a == nil {
+		return
+	}
+	r := RequestFrom(ctx)
+	if e.Time.IsZero() {
+		e.Time = a.now().UTC()
+	}
+	if e.RequestID == "" {
+		e.RequestID = r.ID
+	}
+	if e.ClientIP == "" {
+		e.ClientIP = r.ClientIP
+	}
+	if e.Actor == "" {
+		e.Actor, e.ActorProvider = r.Actor, r.ActorProvider
+	}
+	e.Changes = a.redactor.Redact(e.Changes)
+	for _, s := range a.sinks {
+		if err := s.Write(ctx, e); err != nil {
+			log.WithFields(log.Fields{
+				"operation": e.Operation,
+				"requestId": e.RequestID,
+			}).Errorf("audit event is not written: %v", err)
+		}
+	}
+}
+
+// Outcome returns OutcomeSuccess if err is nil, otherwise OutcomeFailure and the error as the reason
+func Outcome(err error) (outcome string, reason string) {
+	if err != nil {
+		return OutcomeFailure, err.Error()
+	}
+	return OutcomeSuccess, ""
+}
+
+// Redactor is the set of the fields whose changed values are personal data
+type Redactor map[string]bool
+
+// NewRedactor creates the redactor of the fields
+func NewRedactor(fields []string) Redactor {
+	r := make(Redactor, len(fields))
+	for _, f := range fields {
+		r[f] = true
+	}
+	return r
+}
+
+// Redact returns a copy of the changes with the values of the redacted fields replaced
+func (r Redactor) Redact(changes map[string]interface{}) map[string]interface{} {
+	if len(changes) == 0 {
+		return nil
+	}
+	redactedChanges := make(map[string]interface{}, len(changes))
+	for k, v := range changes {
+		if r[k] {
+			v = redacted
+		}
+		redactedChanges[k] = v
+	}
+	return redactedChanges
+}
+
+// Close closes every sink
+func (a *Auditor) Close() error {
+	if a == nil {
+		return nil
+	}
+	var first error
+	for _, s := range a.sinks {
+		if err := s.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
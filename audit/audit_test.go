@@ -0,0 +1,64 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordToFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditor := New(DefaultRedactedFields, sink)
+
+	ctx := WithRequest(context.Background(), Request{
+		ID:            "req-1",
+		ClientIP:      "10.0.0.1",
+		Actor:         "staff-uid",
+		ActorProvider: "firebase",
+	})
+	auditor.Record(Detach(ctx), Event{
+		Operation: OpMemberUpdate,
+		Target:    "member-uid",
+		Changes: map[string]interface{}{
+			"phone": "0912345678",
+			"city":  "Taipei",
+		},
+		Outcome: OutcomeSuccess,
+	})
+	if err = auditor.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "0912345678") {
+		t.Fatalf("a redacted value is written: %s", data)
+	}
+	var e Event
+	if err = json.Unmarshal(data, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.RequestID != "req-1" || e.ClientIP != "10.0.0.1" || e.Actor != "staff-uid" || e.ActorProvider != "firebase" || e.Time.IsZero() {
+		t.Fatalf("event is not completed with the request: %+v", e)
+	}
+	if e.Changes["phone"] != redacted || e.Changes["city"] != "Taipei" {
+		t.Fatalf("changes are %v", e.Changes)
+	}
+}
+
+func TestNilAuditor(t *testing.T) {
+	var auditor *Auditor
+	auditor.Record(context.Background(), Event{Operation: OpMemberDelete})
+	if err := auditor.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
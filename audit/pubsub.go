@@ -0,0 +1,62 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/mirror-media/mm-apigateway/messaging"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// PubSub publishes the events to a topic of the broker. The operation and the outcome are in the attributes to filter the subscriptions
+type PubSub struct {
+	publisher messaging.Publisher
+	topic     string
+	pending   sync.WaitGroup
+}
+
+// NewPubSub creates the sink of the topic
+func NewPubSub(publisher messaging.Publisher, topic string) *PubSub {
+	return &PubSub{
+		publisher: publisher,
+		topic:     topic,
+	}
+}
+
+// Write publishes the event. It's published in the background and logged if it fails, so the action isn't blocked by the broker
+func (s *PubSub) Write(ctx context.Context, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "fail to marshal the audit event")
+	}
+	msg := &messaging.Message{
+		Data: data,
+		Attributes: map[string]string{
+			"operation": e.Operation,
+			"outcome":   e.Outcome,
+		},
+	}
+	s.pending.Add(1)
+	go func() {
+		defer s.pending.Done()
+		// the event may be published after the request is done
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if _, err := s.publisher.Publish(ctx, s.topic, msg); err != nil {
+			log.WithFields(log.Fields{
+				"operation": e.Operation,
+				"requestId": e.RequestID,
+			}).Errorf("audit event is not published to %s: %v", s.topic, err)
+		}
+	}()
+	return nil
+}
+
+// Close waits for the pending events. The broker is closed by its owner
+func (s *PubSub) Close() error {
+	s.pending.Wait()
+	return nil
+}
@@ -0,0 +1,52 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Writer writes the events as JSON lines, e.g. to stdout or to a file
+type Writer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+// NewStdout writes the events to stdout
+func NewStdout() *Writer {
+	return &Writer{w: os.Stdout}
+}
+
+// NewFile appends the events to the file, which is created if it doesn't exist
+func NewFile(path string) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to open the audit file(%s)", path)
+	}
+	return &Writer{w: f, closer: f}, nil
+}
+
+// Write writes the event in a line
+func (s *Writer) Write(ctx context.Context, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "fail to marshal the audit event")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(data, '\n'))
+	return errors.Wrap(err, "fail to write the audit event")
+}
+
+// Close closes the file
+func (s *Writer) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
@@ -0,0 +1,532 @@
+// Package cache caches the upstream responses in redis. Concurrent misses of a key are coalesced, stale entries are served while a single goroutine refreshes them, and upstream errors are cached briefly
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+// Rediser is the subset of the redis client used by the cache
+type Rediser interface {
+	Set(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.StatusCmd
+	SetNX(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.BoolCmd
+	Get(ctx context.Context, key string) *redis.StringCmd
+	Del(ctx context.Context, keys ...string) *redis.IntCmd
+	SMembers(ctx context.Context, key string) *redis.StringSliceCmd
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd
+}
+
+// unlockScript deletes the refresh lock of KEYS[1] if its token is ARGV[1], so that the lock taken by another replica after this one has expired isn't removed
+const unlockScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`
+
+// variantScript adds the variant key ARGV[1] to the set of KEYS[1], which is kept as long as its longest lived variant of ARGV[2] milliseconds
+const variantScript = `
+redis.call("SADD", KEYS[1], ARGV[1])
+if redis.call("PTTL", KEYS[1]) < tonumber(ARGV[2]) then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`
+
+// PubSuber is the subset of the redis client used to invalidate the memory tier of the other gateway replicas
+type PubSuber interface {
+	Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd
+	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+}
+
+// InvalidationChannel is the redis channel where the keys stored or purged by a replica are published
+const InvalidationChannel = "mm-apigateway.cache.invalidate"
+
+// Result tells how an entry was obtained
+type Result string
+
+const (
+	// Hit means the entry is fresh
+	Hit Result = "HIT"
+	// Stale means the entry has passed its soft ttl and is being refreshed in the background
+	Stale Result = "STALE"
+	// Miss means the entry was loaded from the upstream
+	Miss Result = "MISS"
+	// Negative means the entry is a cached upstream error
+	Negative Result = "NEGATIVE"
+)
+
+const (
+	defaultRefreshTimeout = 10 * time.Second
+	refreshLockSuffix     = ".refresh"
+	// variantsSuffix is the suffix of the set of the variant keys of a key, so that they are purged with the key
+	variantsSuffix = ".variants"
+)
+
+// Entry is a cached upstream response
+type Entry struct {
+	Status     int         `json:"status"`
+	Header     http.Header `json:"header,omitempty"`
+	StoredAt   time.Time   `json:"storedAt"`
+	SoftExpiry time.Time   `json:"softExpiry"`
+	HardExpiry time.Time   `json:"hardExpiry"`
+	// Negative marks an upstream error
+	Negative bool `json:"negative,omitempty"`
+	// Vary are the request headers the response varies on. The entry of the key only points to the variants if it's VaryOnly
+	Vary     []string `json:"vary,omitempty"`
+	VaryOnly bool     `json:"varyOnly,omitempty"`
+	// Uncacheable marks a response which is not stored, either by the loader or by the Cache-Control of the upstream
+	Uncacheable bool `json:"-"`
+	varyValues  string
+	Body        []byte `json:"-"`
+}
+
+// Fresh reports whether the entry is within its soft ttl
+func (e *Entry) Fresh(now time.Time) bool {
+	return now.Before(e.SoftExpiry)
+}
+
+// Age is how long the entry has been cached
+func (e *Entry) Age(now time.Time) time.Duration {
+	if e.StoredAt.IsZero() || now.Before(e.StoredAt) {
+		return 0
+	}
+	return now.Sub(e.StoredAt)
+}
+
+// marshal encodes the entry as a line of JSON metadata followed by the raw body
+func (e *Entry) marshal() ([]byte, error) {
+	meta, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, len(meta)+1+len(e.Body))
+	b = append(b, meta...)
+	b = append(b, '\n')
+	return append(b, e.Body...), nil
+}
+
+func unmarshalEntry(b []byte) (*Entry, error) {
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		return nil, errors.New("entry has no metadata")
+	}
+	var e Entry
+	if err := json.Unmarshal(b[:i], &e); err != nil {
+		return nil, errors.Wrap(err, "entry has malformed metadata")
+	}
+	e.Body = b[i+1:]
+	return &e, nil
+}
+
+// Options describes how long the entries of a key live
+type Options struct {
+	// SoftTTL is how long an entry is served without being refreshed
+	SoftTTL time.Duration
+	// HardTTL is how long an entry is kept. An entry between SoftTTL and HardTTL is served stale while it's refreshed. HardTTL is raised to SoftTTL if it's shorter
+	HardTTL time.Duration
+	// NegativeTTL is how long an upstream error is cached. Errors are not cached if it's not positive
+	NegativeTTL time.Duration
+	// RefreshTimeout bounds a load, default 10s
+	RefreshTimeout time.Duration
+	// RequestHeader selects the variant of a response with a Vary header
+	RequestHeader http.Header
+}
+
+// Loader fetches a fresh response from the upstream. An error or a status of 5xx is treated as an upstream error. The Cache-Control of the response header overrides SoftTTL, and a no-store, no-cache or private response is not stored
+type Loader func(ctx context.Context) (*Entry, error)
+
+// MemoryOptions describes the in-process tier in front of redis
+type MemoryOptions struct {
+	// MaxBytes limits the total size of the keys and bodies kept in memory
+	MaxBytes int64
+	// TTL bounds how long an entry is kept in memory, so that a missed invalidation doesn't diverge for long
+	TTL time.Duration
+	// KeyPrefixes are the prefixes of the keys kept in memory
+	KeyPrefixes []string
+}
+
+// TierStats are the counters of a cache tier
+type TierStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions,omitempty"`
+	Entries   int    `json:"entries,omitempty"`
+	Bytes     int64  `json:"bytes,omitempty"`
+}
+
+// Stats are the counters of every tier
+type Stats struct {
+	Memory *TierStats `json:"memory,omitempty"`
+	Redis  TierStats  `json:"redis"`
+}
+
+// Cache coordinates the loads of the keys
+type Cache struct {
+	rdb   Rediser
+	group singleflight.Group
+	now   func() time.Time
+
+	memory         *memoryTier
+	memoryPrefixes []string
+	pubsub         PubSuber
+	instanceID     string
+
+	redisHits   uint64
+	redisMisses uint64
+}
+
+// New creates a cache on top of the redis client
+func New(rdb Rediser) *Cache {
+	return &Cache{
+		rdb: rdb,
+		now: time.Now,
+	}
+}
+
+// EnableMemoryTier keeps the entries of the keys with the prefixes in memory as well. The memory tier of every replica is invalidated through the redis channel until the context is done
+func (c *Cache) EnableMemoryTier(ctx context.Context, ps PubSuber, opts MemoryOptions) error {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return errors.Wrap(err, "fail to generate the instance id")
+	}
+	c.instanceID = hex.EncodeToString(id)
+	c.memory = newMemoryTier(opts.MaxBytes, opts.TTL)
+	c.memoryPrefixes = opts.KeyPrefixes
+	c.pubsub = ps
+
+	sub := ps.Subscribe(ctx, InvalidationChannel)
+	if _, err := sub.Receive(ctx); err != nil {
+		_ = sub.Close()
+		return errors.Wrap(err, "fail to subscribe the invalidation channel")
+	}
+	go func() {
+		defer sub.Close()
+		ch := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				origin, key := splitInvalidation(msg.Payload)
+				if origin != c.instanceID {
+					c.memory.remove(key)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Stats returns the counters of the tiers
+func (c *Cache) Stats() Stats {
+	s := Stats{
+		Redis: TierStats{
+			Hits:   atomic.LoadUint64(&c.redisHits),
+			Misses: atomic.LoadUint64(&c.redisMisses),
+		},
+	}
+	if c.memory != nil {
+		m := c.memory.stats()
+		s.Memory = &m
+	}
+	return s
+}
+
+func (c *Cache) inMemory(key string) bool {
+	if c.memory == nil {
+		return false
+	}
+	for _, prefix := range c.memoryPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidate drops the key from the memory tier of every replica
+func (c *Cache) invalidate(ctx context.Context, keys ...string) {
+	for _, key := range keys {
+		if !c.inMemory(key) {
+			continue
+		}
+		c.memory.remove(key)
+		if err := c.pubsub.Publish(ctx, InvalidationChannel, c.instanceID+" "+key).Err(); err != nil {
+			log.WithField("key", key).Warnf("publishing invalidation encountered error: %v", err)
+		}
+	}
+}
+
+func splitInvalidation(payload string) (origin, key string) {
+	i := strings.IndexByte(payload, ' ')
+	if i < 0 {
+		return "", payload
+	}
+	return payload[:i], payload[i+1:]
+}
+
+// Fetch returns the entry of the key, loading it with the loader if it's not cached. Concurrent misses of the same key share a single load
+func (c *Cache) Fetch(ctx context.Context, key string, opts Options, load Loader) (*Entry, Result, error) {
+	opts = opts.withDefaults()
+
+	storageKey := key
+	e := c.lookup(ctx, key)
+	if e != nil && e.VaryOnly {
+		storageKey = variantKey(key, varySignature(e.Vary, opts.RequestHeader))
+		e = c.lookup(ctx, storageKey)
+	}
+	if e != nil {
+		switch {
+		case e.Negative:
+			return e, Negative, nil
+		case e.Fresh(c.now()):
+			return e, Hit, nil
+		default:
+			go c.refresh(key, storageKey, opts, load)
+			return e, Stale, nil
+		}
+	}
+
+	v, err, _ := c.group.Do(storageKey, func() (interface{}, error) {
+		return c.load(key, opts, load)
+	})
+	if err != nil {
+		return nil, Miss, err
+	}
+	e = v.(*Entry)
+	// the shared load may have been made for a requester of another variant
+	if len(e.Vary) > 0 && e.varyValues != varySignature(e.Vary, opts.RequestHeader) {
+		if e, err = c.load(key, opts, load); err != nil {
+			return nil, Miss, err
+		}
+	}
+	if e.Negative {
+		return e, Negative, nil
+	}
+	return e, Miss, nil
+}
+
+// lookup reads the entry of the storage key from the memory tier, then from redis
+func (c *Cache) lookup(ctx context.Context, key string) *Entry {
+	inMemory := c.inMemory(key)
+	if inMemory {
+		if e, ok := c.memory.get(key, c.now()); ok {
+			return e
+		}
+	}
+
+	e, err := c.get(ctx, key)
+	if err != nil && err != redis.Nil {
+		log.WithField("key", key).Warnf("reading cache encountered error: %v", err)
+	}
+	if e == nil {
+		atomic.AddUint64(&c.redisMisses, 1)
+		return nil
+	}
+	atomic.AddUint64(&c.redisHits, 1)
+	if now := c.now(); inMemory && e.Fresh(now) {
+		c.memory.set(key, e, now)
+	}
+	return e
+}
+
+// Purge removes the keys and their variants from the cache
+func (c *Cache) Purge(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		variants, err := c.rdb.SMembers(ctx, key+variantsSuffix).Result()
+		if err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "fail to read the variants of %s", key)
+		}
+		purged := append([]string{key, key + variantsSuffix}, variants...)
+		c.invalidate(ctx, purged...)
+		// the variants may live in other slots of a redis cluster than the key
+		for _, k := range purged {
+			if err := c.rdb.Del(ctx, k).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Cache) get(ctx context.Context, key string) (*Entry, error) {
+	cmd := c.rdb.Get(ctx, key)
+	if cmd == nil {
+		return nil, redis.Nil
+	}
+	b, err := cmd.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalEntry(b)
+}
+
+// refresh reloads a stale entry unless another goroutine or gateway replica is already refreshing it. A failed refresh keeps the stale entry
+func (c *Cache) refresh(key string, storageKey string, opts Options, load Loader) {
+	logger := log.WithField("key", storageKey)
+	ctx, cancel := context.WithTimeout(context.Background(), opts.RefreshTimeout)
+	defer cancel()
+
+	lock := storageKey + refreshLockSuffix
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		logger.Warnf("generating refresh lock token encountered error: %v", err)
+		return
+	}
+	token := hex.EncodeToString(b)
+	acquired, err := c.rdb.SetNX(ctx, lock, token, opts.RefreshTimeout).Result()
+	if err != nil {
+		logger.Warnf("acquiring refresh lock encountered error: %v", err)
+		return
+	} else if !acquired {
+		return
+	}
+	defer func() {
+		if err := c.rdb.Eval(context.Background(), unlockScript, []string{lock}, token).Err(); err != nil {
+			logger.Warnf("releasing refresh lock encountered error: %v", err)
+		}
+	}()
+
+	_, err, _ = c.group.Do(storageKey, func() (interface{}, error) {
+		e, err := c.loadEntry(load, opts)
+		if err == nil && e.Negative {
+			err = fmt.Errorf("upstream replied %d", e.Status)
+		}
+		if err != nil {
+			return nil, errors.WithMessage(err, "refresh failed, stale entry is kept")
+		}
+		c.store(key, e)
+		return e, nil
+	})
+	if err != nil {
+		logger.Warn(err)
+	}
+}
+
+// load fetches the entry and stores it, or stores a negative entry if the upstream fails
+func (c *Cache) load(key string, opts Options, load Loader) (*Entry, error) {
+	e, err := c.loadEntry(load, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.store(key, e)
+	return e, nil
+}
+
+func (c *Cache) loadEntry(load Loader, opts Options) (*Entry, error) {
+	// the load is detached from the requester so that the coalesced requests don't fail when the first one is cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), opts.RefreshTimeout)
+	defer cancel()
+	e, err := load(ctx)
+	now := c.now()
+	if err != nil {
+		if opts.NegativeTTL <= 0 {
+			return nil, err
+		}
+		log.Warnf("upstream failed, the error is cached for %s: %v", opts.NegativeTTL, err)
+		return &Entry{
+			Status:     http.StatusBadGateway,
+			StoredAt:   now,
+			SoftExpiry: now.Add(opts.NegativeTTL),
+			HardExpiry: now.Add(opts.NegativeTTL),
+			Negative:   true,
+		}, nil
+	}
+	e.StoredAt = now
+	e.Negative = e.Status >= http.StatusInternalServerError
+	if e.Negative {
+		e.SoftExpiry = now.Add(opts.NegativeTTL)
+		e.HardExpiry = e.SoftExpiry
+		return e, nil
+	}
+
+	softTTL := opts.SoftTTL
+	cc := ParseCacheControl(e.Header)
+	if cc.MaxAge != nil {
+		softTTL = *cc.MaxAge
+	}
+	e.SoftExpiry = now.Add(softTTL)
+	// the stale window of the route is kept when the upstream sets its own freshness
+	e.HardExpiry = e.SoftExpiry.Add(opts.HardTTL - opts.SoftTTL)
+	e.Vary = varyNames(e.Header)
+	e.varyValues = varySignature(e.Vary, opts.RequestHeader)
+	e.Uncacheable = e.Uncacheable || !cc.Cacheable()
+	for _, name := range e.Vary {
+		if name == "*" {
+			e.Uncacheable = true
+		}
+	}
+	return e, nil
+}
+
+// store writes the entry of the key. The entry of a response with a Vary header is written to the key of its variant, and the key itself points to the variants
+func (c *Cache) store(key string, e *Entry) {
+	if e.Uncacheable {
+		return
+	}
+	if len(e.Vary) > 0 {
+		marker := &Entry{
+			StoredAt:   e.StoredAt,
+			SoftExpiry: e.HardExpiry,
+			HardExpiry: e.HardExpiry,
+			Vary:       e.Vary,
+			VaryOnly:   true,
+		}
+		c.set(key, marker)
+		variant := variantKey(key, e.varyValues)
+		if ttl := e.HardExpiry.Sub(c.now()); ttl > 0 {
+			if err := c.rdb.Eval(context.Background(), variantScript, []string{key + variantsSuffix}, variant, ttl.Milliseconds()).Err(); err != nil {
+				log.WithField("key", key).Warnf("indexing variant encountered error: %v", err)
+			}
+		}
+		key = variant
+	}
+	c.set(key, e)
+}
+
+func (c *Cache) set(key string, e *Entry) {
+	now := c.now()
+	ttl := e.HardExpiry.Sub(now)
+	if ttl <= 0 {
+		return
+	}
+	b, err := e.marshal()
+	if err == nil {
+		err = c.rdb.Set(context.Background(), key, b, ttl).Err()
+	}
+	if err != nil {
+		log.WithField("key", key).Warnf("setting cache encountered error: %v", err)
+		return
+	}
+	c.invalidate(context.Background(), key)
+	if c.inMemory(key) {
+		c.memory.set(key, e, now)
+	}
+}
+
+func (o Options) withDefaults() Options {
+	if o.HardTTL < o.SoftTTL {
+		o.HardTTL = o.SoftTTL
+	}
+	if o.RefreshTimeout <= 0 {
+		o.RefreshTimeout = defaultRefreshTimeout
+	}
+	return o
+}
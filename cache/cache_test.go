@@ -0,0 +1,208 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func newTestCache(t *testing.T) (*Cache, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	return New(redis.NewClient(&redis.Options{Addr: mr.Addr()})), mr
+}
+
+// countingLoader replies the body to every load and counts the loads
+func countingLoader(loads *int32, status int, body string) Loader {
+	return func(ctx context.Context) (*Entry, error) {
+		atomic.AddInt32(loads, 1)
+		return &Entry{Status: status, Body: []byte(body)}, nil
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition is not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFetchCoalescesConcurrentMisses(t *testing.T) {
+	c, _ := newTestCache(t)
+	var loads int32
+	release := make(chan struct{})
+	load := func(ctx context.Context) (*Entry, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return &Entry{Status: http.StatusOK, Body: []byte("posts")}, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]string, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			e, result, err := c.Fetch(context.Background(), "post.a", Options{SoftTTL: time.Minute}, load)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			results[i] = string(result) + " " + string(e.Body)
+		}(i)
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&loads) == 1 })
+	// let the other requests join the load
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if loads != 1 {
+		t.Fatalf("upstream is loaded %d times", loads)
+	}
+	for _, r := range results {
+		if r != "MISS posts" {
+			t.Fatalf("results are %v", results)
+		}
+	}
+	if e, result, _ := c.Fetch(context.Background(), "post.a", Options{SoftTTL: time.Minute}, load); result != Hit || string(e.Body) != "posts" {
+		t.Fatalf("cached entry is %s %+v", result, e)
+	}
+}
+
+func TestFetchServesStaleWhileRevalidating(t *testing.T) {
+	c, mr := newTestCache(t)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	opts := Options{SoftTTL: time.Minute, HardTTL: 2 * time.Minute}
+	ctx := context.Background()
+
+	var loads int32
+	if _, result, _ := c.Fetch(ctx, "post.a", opts, countingLoader(&loads, http.StatusOK, "v1")); result != Miss {
+		t.Fatalf("first fetch is %s", result)
+	}
+
+	// a failed refresh keeps the stale entry
+	now = now.Add(90 * time.Second)
+	e, result, err := c.Fetch(ctx, "post.a", opts, countingLoader(&loads, http.StatusBadGateway, "down"))
+	if err != nil || result != Stale || string(e.Body) != "v1" {
+		t.Fatalf("stale fetch is %s %+v: %v", result, e, err)
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&loads) == 2 && !mr.Exists("post.a"+refreshLockSuffix) })
+	if e, result, _ = c.Fetch(ctx, "post.a", opts, countingLoader(&loads, http.StatusOK, "v2")); result != Stale || string(e.Body) != "v1" {
+		t.Fatalf("failed refresh replaced the entry: %s %+v", result, e)
+	}
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&loads) == 3 && !mr.Exists("post.a"+refreshLockSuffix) })
+	if e, result, _ = c.Fetch(ctx, "post.a", opts, countingLoader(&loads, http.StatusOK, "v3")); result != Hit || string(e.Body) != "v2" {
+		t.Fatalf("refreshed entry is %s %+v", result, e)
+	}
+}
+
+func TestFetchRefreshesOnceAcrossReplicas(t *testing.T) {
+	c, mr := newTestCache(t)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	opts := Options{SoftTTL: time.Minute, HardTTL: 2 * time.Minute}
+	ctx := context.Background()
+
+	var loads int32
+	c.Fetch(ctx, "post.a", opts, countingLoader(&loads, http.StatusOK, "v1"))
+	// another replica is refreshing the entry
+	mr.Set("post.a"+refreshLockSuffix, "1")
+	now = now.Add(90 * time.Second)
+	if _, result, _ := c.Fetch(ctx, "post.a", opts, countingLoader(&loads, http.StatusOK, "v2")); result != Stale {
+		t.Fatalf("fetch is %s", result)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Fatalf("entry refreshed by another replica is loaded %d times", n)
+	}
+}
+
+func TestRefreshKeepsTheLockOfAnotherReplica(t *testing.T) {
+	c, mr := newTestCache(t)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	opts := Options{SoftTTL: time.Minute, HardTTL: 2 * time.Minute}
+	ctx := context.Background()
+
+	var loads int32
+	c.Fetch(ctx, "post.a", opts, countingLoader(&loads, http.StatusOK, "v1"))
+	now = now.Add(90 * time.Second)
+	release := make(chan struct{})
+	slow := func(ctx context.Context) (*Entry, error) {
+		<-release
+		return &Entry{Status: http.StatusOK, Body: []byte("v2")}, nil
+	}
+	if _, result, _ := c.Fetch(ctx, "post.a", opts, slow); result != Stale {
+		t.Fatalf("fetch is %s", result)
+	}
+	lock := "post.a" + refreshLockSuffix
+	waitFor(t, func() bool { return mr.Exists(lock) })
+	// the lock expires during the refresh and another replica takes it
+	mr.Set(lock, "another replica")
+	close(release)
+	waitFor(t, func() bool {
+		e, _ := c.get(ctx, "post.a")
+		return e != nil && string(e.Body) == "v2"
+	})
+	time.Sleep(50 * time.Millisecond)
+	if v, err := mr.Get(lock); err != nil || v != "another replica" {
+		t.Fatalf("lock of another replica is %q: %v", v, err)
+	}
+}
+
+func TestFetchCachesUpstreamErrors(t *testing.T) {
+	c, mr := newTestCache(t)
+	ctx := context.Background()
+	var loads int32
+	failing := func(ctx context.Context) (*Entry, error) {
+		atomic.AddInt32(&loads, 1)
+		return nil, errors.New("connection refused")
+	}
+
+	// the errors aren't cached without a negative ttl
+	if _, _, err := c.Fetch(ctx, "post.a", Options{SoftTTL: time.Minute}, failing); err == nil {
+		t.Fatal("error is not returned")
+	}
+	if mr.Exists("post.a") {
+		t.Fatal("error is cached without a negative ttl")
+	}
+
+	opts := Options{SoftTTL: time.Minute, NegativeTTL: 10 * time.Second}
+	for i := 0; i < 2; i++ {
+		e, result, err := c.Fetch(ctx, "post.a", opts, failing)
+		if err != nil || result != Negative || e.Status != http.StatusBadGateway {
+			t.Fatalf("fetch %d is %s %+v: %v", i, result, e, err)
+		}
+	}
+	if loads != 2 {
+		t.Fatalf("upstream is loaded %d times", loads)
+	}
+
+	// a 5xx reply is cached as an error too
+	mr.FastForward(11 * time.Second)
+	for i := 0; i < 2; i++ {
+		e, result, err := c.Fetch(ctx, "post.a", opts, countingLoader(&loads, http.StatusServiceUnavailable, "down"))
+		if err != nil || result != Negative || e.Status != http.StatusServiceUnavailable {
+			t.Fatalf("fetch %d is %s %+v: %v", i, result, e, err)
+		}
+	}
+	if loads != 3 {
+		t.Fatalf("upstream is loaded %d times", loads)
+	}
+	if ttl := mr.TTL("post.a"); ttl <= 0 || ttl > 10*time.Second {
+		t.Fatalf("ttl of the error is %v", ttl)
+	}
+}
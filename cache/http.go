@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StoredHeaders are the upstream headers kept with an entry
+var StoredHeaders = []string{"Cache-Control", "Content-Type", "Expires", "Last-Modified", "Vary"}
+
+// FilterHeader returns the StoredHeaders of h
+func FilterHeader(h http.Header) http.Header {
+	filtered := make(http.Header, len(StoredHeaders))
+	for _, name := range StoredHeaders {
+		if values, ok := h[name]; ok {
+			filtered[name] = values
+		}
+	}
+	return filtered
+}
+
+// CacheControl is the parsed Cache-Control header of a response
+type CacheControl struct {
+	NoStore bool
+	NoCache bool
+	Private bool
+	// MaxAge is the s-maxage if it's present, otherwise the max-age. It's nil if neither is present
+	MaxAge *time.Duration
+}
+
+// ParseCacheControl parses the Cache-Control header
+func ParseCacheControl(h http.Header) CacheControl {
+	var cc CacheControl
+	var maxAge, sMaxAge *time.Duration
+	for _, value := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg := directive, ""
+			if i := strings.IndexByte(directive, '='); i >= 0 {
+				name, arg = directive[:i], strings.Trim(strings.TrimSpace(directive[i+1:]), `"`)
+			}
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "no-store":
+				cc.NoStore = true
+			case "no-cache":
+				cc.NoCache = true
+			case "private":
+				cc.Private = true
+			case "max-age":
+				if seconds, err := strconv.Atoi(arg); err == nil {
+					d := time.Duration(seconds) * time.Second
+					maxAge = &d
+				}
+			case "s-maxage":
+				if seconds, err := strconv.Atoi(arg); err == nil {
+					d := time.Duration(seconds) * time.Second
+					sMaxAge = &d
+				}
+			}
+		}
+	}
+	cc.MaxAge = maxAge
+	if sMaxAge != nil {
+		cc.MaxAge = sMaxAge
+	}
+	return cc
+}
+
+// Cacheable reports whether a shared cache may store the response
+func (cc CacheControl) Cacheable() bool {
+	if cc.NoStore || cc.NoCache || cc.Private {
+		return false
+	}
+	return cc.MaxAge == nil || *cc.MaxAge > 0
+}
+
+// varyNames returns the canonical names of the request headers the response varies on
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, value := range h.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// varySignature digests the values of the vary headers of the request
+func varySignature(names []string, h http.Header) string {
+	if len(names) == 0 {
+		return ""
+	}
+	digest := sha1.New()
+	for _, name := range names {
+		digest.Write([]byte(name))
+		digest.Write([]byte{':'})
+		digest.Write([]byte(strings.Join(h.Values(name), ",")))
+		digest.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(digest.Sum(nil))[:16]
+}
+
+func variantKey(key string, signature string) string {
+	return key + "|" + signature
+}
+
+// ETag returns a strong entity tag of the body
+func ETag(body []byte) string {
+	sum := sha1.Sum(body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// NotModified reports whether the conditional headers of the request are satisfied by the etag and the last modified time of the response. If-None-Match takes precedence over If-Modified-Since
+func NotModified(req http.Header, etag string, lastModified string) bool {
+	if inm := req.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims := req.Get("If-Modified-Since")
+	if ims == "" || lastModified == "" {
+		return false
+	}
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+	return !modified.After(since)
+}
@@ -0,0 +1,156 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	tests := []struct {
+		header    []string
+		maxAge    string
+		cacheable bool
+	}{
+		{header: nil, cacheable: true},
+		{header: []string{"public, max-age=60"}, maxAge: "1m0s", cacheable: true},
+		{header: []string{`max-age="30"`}, maxAge: "30s", cacheable: true},
+		{header: []string{"max-age=60, s-maxage=600"}, maxAge: "10m0s", cacheable: true},
+		{header: []string{"s-maxage=600", "max-age=60"}, maxAge: "10m0s", cacheable: true},
+		{header: []string{"max-age=0"}, maxAge: "0s", cacheable: false},
+		{header: []string{"max-age=abc"}, cacheable: true},
+		{header: []string{"No-Store"}, cacheable: false},
+		{header: []string{"no-cache"}, cacheable: false},
+		{header: []string{"private, max-age=60"}, maxAge: "1m0s", cacheable: false},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.header, "; "), func(t *testing.T) {
+			cc := ParseCacheControl(http.Header{"Cache-Control": tt.header})
+			maxAge := ""
+			if cc.MaxAge != nil {
+				maxAge = cc.MaxAge.String()
+			}
+			if maxAge != tt.maxAge || cc.Cacheable() != tt.cacheable {
+				t.Fatalf("max age is %q and cacheable is %v, want %q and %v", maxAge, cc.Cacheable(), tt.maxAge, tt.cacheable)
+			}
+		})
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	etag := ETag([]byte("posts"))
+	lastModified := "Mon, 01 Mar 2021 00:00:00 GMT"
+	tests := []struct {
+		name string
+		req  http.Header
+		etag string
+		lm   string
+		want bool
+	}{
+		{name: "no condition", req: http.Header{}, etag: etag, lm: lastModified},
+		{name: "matching etag", req: http.Header{"If-None-Match": {etag}}, etag: etag, want: true},
+		{name: "one of the etags", req: http.Header{"If-None-Match": {`"other", ` + etag}}, etag: etag, want: true},
+		{name: "weak etag", req: http.Header{"If-None-Match": {"W/" + etag}}, etag: etag, want: true},
+		{name: "any etag", req: http.Header{"If-None-Match": {"*"}}, etag: etag, want: true},
+		{name: "other etag", req: http.Header{"If-None-Match": {`"other"`}}, etag: etag},
+		{name: "etag takes precedence", req: http.Header{"If-None-Match": {`"other"`}, "If-Modified-Since": {lastModified}}, etag: etag, lm: lastModified},
+		{name: "not modified since", req: http.Header{"If-Modified-Since": {"Tue, 02 Mar 2021 00:00:00 GMT"}}, lm: lastModified, want: true},
+		{name: "modified at the time", req: http.Header{"If-Modified-Since": {lastModified}}, lm: lastModified, want: true},
+		{name: "modified since", req: http.Header{"If-Modified-Since": {"Sun, 28 Feb 2021 00:00:00 GMT"}}, lm: lastModified},
+		{name: "no last modified", req: http.Header{"If-Modified-Since": {lastModified}}},
+		{name: "malformed time", req: http.Header{"If-Modified-Since": {"yesterday"}}, lm: lastModified},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NotModified(tt.req, tt.etag, tt.lm); got != tt.want {
+				t.Fatalf("not modified is %v", got)
+			}
+		})
+	}
+}
+
+func TestETag(t *testing.T) {
+	if ETag([]byte("a")) != ETag([]byte("a")) || ETag([]byte("a")) == ETag([]byte("b")) {
+		t.Fatal("etag doesn't identify the body")
+	}
+	if tag := ETag(nil); !strings.HasPrefix(tag, `"`) || !strings.HasSuffix(tag, `"`) {
+		t.Fatalf("etag(%s) is not quoted", tag)
+	}
+}
+
+func TestVary(t *testing.T) {
+	names := varyNames(http.Header{"Vary": {"accept-encoding, X-Member", "Accept-Language"}})
+	if strings.Join(names, ",") != "Accept-Encoding,Accept-Language,X-Member" {
+		t.Fatalf("vary names are %v", names)
+	}
+	tests := []struct {
+		name string
+		a    http.Header
+		b    http.Header
+		same bool
+	}{
+		{name: "same values", a: http.Header{"X-Member": {"1"}}, b: http.Header{"X-Member": {"1"}}, same: true},
+		{name: "other headers", a: http.Header{"X-Member": {"1"}}, b: http.Header{"X-Member": {"1"}, "Cookie": {"a"}}, same: true},
+		{name: "different values", a: http.Header{"X-Member": {"1"}}, b: http.Header{"X-Member": {"0"}}},
+		{name: "missing header", a: http.Header{"X-Member": {"1"}}, b: http.Header{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := varySignature(names, tt.a) == varySignature(names, tt.b); same != tt.same {
+				t.Fatalf("signatures are the same(%v)", same)
+			}
+		})
+	}
+}
+
+func TestFetchStoresTheVariants(t *testing.T) {
+	c, mr := newTestCache(t)
+	ctx := context.Background()
+	load := func(member string) Loader {
+		return func(ctx context.Context) (*Entry, error) {
+			return &Entry{
+				Status: http.StatusOK,
+				Header: http.Header{"Vary": {"X-Member"}, "Cache-Control": {"max-age=30"}},
+				Body:   []byte(member),
+			}, nil
+		}
+	}
+	for _, member := range []string{"1", "0"} {
+		opts := Options{SoftTTL: time.Minute, RequestHeader: http.Header{"X-Member": {member}}}
+		if e, result, err := c.Fetch(ctx, "post.a", opts, load(member)); err != nil || result != Miss || string(e.Body) != member {
+			t.Fatalf("variant %s is %s %+v: %v", member, result, e, err)
+		}
+	}
+	for _, member := range []string{"1", "0"} {
+		opts := Options{SoftTTL: time.Minute, RequestHeader: http.Header{"X-Member": {member}}}
+		e, result, err := c.Fetch(ctx, "post.a", opts, load("unexpected"))
+		if err != nil || result != Hit || string(e.Body) != member {
+			t.Fatalf("cached variant %s is %s %+v: %v", member, result, e, err)
+		}
+		// the max-age of the upstream overrides the soft ttl
+		if ttl := e.SoftExpiry.Sub(e.StoredAt); ttl != 30*time.Second {
+			t.Fatalf("soft ttl of variant %s is %v", member, ttl)
+		}
+	}
+	// the key, its variants and the set of its variants
+	if keys := mr.Keys(); len(keys) != 4 {
+		t.Fatalf("keys are %v", keys)
+	}
+	if err := c.Purge(ctx, "post.a"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Fatalf("keys left by the purge are %v", keys)
+	}
+
+	// a response varying on every header isn't stored
+	loadAny := func(ctx context.Context) (*Entry, error) {
+		return &Entry{Status: http.StatusOK, Header: http.Header{"Vary": {"*"}}}, nil
+	}
+	c.Fetch(ctx, "post.b", Options{SoftTTL: time.Minute}, loadAny)
+	if mr.Exists("post.b") {
+		t.Fatal("response varying on every header is stored")
+	}
+}
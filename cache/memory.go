@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// itemOverhead approximates the bytes taken by the bookkeeping of an item
+const itemOverhead = 128
+
+type memoryItem struct {
+	key    string
+	entry  *Entry
+	expiry time.Time
+	size   int64
+}
+
+// memoryTier is an in-process LRU of entries limited by the total size of the keys and bodies
+type memoryTier struct {
+	mu       sync.Mutex
+	maxBytes int64
+	ttl      time.Duration
+	bytes    int64
+	ll       *list.List
+	items    map[string]*list.Element
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+func newMemoryTier(maxBytes int64, ttl time.Duration) *memoryTier {
+	return &memoryTier{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (m *memoryTier) get(key string, now time.Time) (*Entry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.items[key]
+	if !ok {
+		m.misses++
+		return nil, false
+	}
+	item := el.Value.(*memoryItem)
+	if !now.Before(item.expiry) {
+		m.removeElement(el)
+		m.misses++
+		return nil, false
+	}
+	m.ll.MoveToFront(el)
+	m.hits++
+	return item.entry, true
+}
+
+func (m *memoryTier) set(key string, e *Entry, now time.Time) {
+	size := int64(len(key)+len(e.Body)) + itemOverhead
+	if size > m.maxBytes {
+		return
+	}
+	expiry := now.Add(m.ttl)
+	if e.SoftExpiry.Before(expiry) {
+		expiry = e.SoftExpiry
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.items[key]; ok {
+		m.removeElement(el)
+	}
+	m.items[key] = m.ll.PushFront(&memoryItem{
+		key:    key,
+		entry:  e,
+		expiry: expiry,
+		size:   size,
+	})
+	m.bytes += size
+	for m.bytes > m.maxBytes {
+		m.removeElement(m.ll.Back())
+		m.evictions++
+	}
+}
+
+func (m *memoryTier) remove(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.items[key]; ok {
+		m.removeElement(el)
+	}
+}
+
+func (m *memoryTier) removeElement(el *list.Element) {
+	item := m.ll.Remove(el).(*memoryItem)
+	delete(m.items, item.key)
+	m.bytes -= item.size
+}
+
+func (m *memoryTier) stats() TierStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return TierStats{
+		Hits:      m.hits,
+		Misses:    m.misses,
+		Evictions: m.evictions,
+		Entries:   m.ll.Len(),
+		Bytes:     m.bytes,
+	}
+}
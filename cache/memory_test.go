@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestMemoryTierEvictsLeastRecentlyUsed(t *testing.T) {
+	now := time.Now()
+	entry := func(body string) *Entry {
+		return &Entry{Body: []byte(body), SoftExpiry: now.Add(time.Hour)}
+	}
+	// every item takes 1+10+itemOverhead bytes, so that three items fit
+	m := newMemoryTier(3*(11+itemOverhead), time.Minute)
+	for _, key := range []string{"a", "b", "c"} {
+		m.set(key, entry(strings.Repeat(key, 10)), now)
+	}
+	if _, ok := m.get("a", now); !ok {
+		t.Fatal("a is not kept")
+	}
+	m.set("d", entry(strings.Repeat("d", 10)), now)
+
+	if _, ok := m.get("b", now); ok {
+		t.Fatal("least recently used b is not evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, ok := m.get(key, now); !ok {
+			t.Fatalf("%s is evicted", key)
+		}
+	}
+	// an entry larger than the tier isn't kept
+	m.set("e", entry(strings.Repeat("e", 3*(11+itemOverhead))), now)
+	if _, ok := m.get("e", now); ok {
+		t.Fatal("oversized entry is kept")
+	}
+
+	s := m.stats()
+	if s.Entries != 3 || s.Bytes != 3*(11+itemOverhead) || s.Evictions != 1 || s.Hits != 4 || s.Misses != 2 {
+		t.Fatalf("stats are %+v", s)
+	}
+}
+
+func TestMemoryTierExpiresEntries(t *testing.T) {
+	now := time.Now()
+	m := newMemoryTier(1<<20, time.Minute)
+	m.set("fresh", &Entry{SoftExpiry: now.Add(time.Hour)}, now)
+	m.set("stale", &Entry{SoftExpiry: now.Add(10 * time.Second)}, now)
+
+	// an entry is kept for the ttl of the tier or until it's stale
+	if _, ok := m.get("stale", now.Add(10*time.Second)); ok {
+		t.Fatal("stale entry is served")
+	}
+	if _, ok := m.get("fresh", now.Add(59*time.Second)); !ok {
+		t.Fatal("entry is expired before the ttl")
+	}
+	if _, ok := m.get("fresh", now.Add(time.Minute)); ok {
+		t.Fatal("entry is served after the ttl")
+	}
+	if s := m.stats(); s.Entries != 0 || s.Bytes != 0 {
+		t.Fatalf("expired entries are kept: %+v", s)
+	}
+}
+
+func TestMemoryTierIsInvalidatedAcrossReplicas(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := MemoryOptions{MaxBytes: 1 << 20, TTL: time.Minute, KeyPrefixes: []string{"post."}}
+	replicas := make([]*Cache, 2)
+	for i := range replicas {
+		rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		replicas[i] = New(rdb)
+		if err := replicas[i].EnableMemoryTier(ctx, rdb, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b := replicas[0], replicas[1]
+
+	var loads int32
+	cacheOpts := Options{SoftTTL: time.Minute}
+	a.Fetch(ctx, "post.a", cacheOpts, countingLoader(&loads, http.StatusOK, "v1"))
+	b.Fetch(ctx, "post.a", cacheOpts, countingLoader(&loads, http.StatusOK, "v1"))
+	if _, ok := b.memory.get("post.a", time.Now()); !ok {
+		t.Fatal("entry is not kept in memory")
+	}
+	if _, ok := a.memory.get("user.a", time.Now()); ok {
+		t.Fatal("key of another prefix is kept in memory")
+	}
+
+	if err := a.Purge(ctx, "post.a"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		_, ok := b.memory.get("post.a", time.Now())
+		return !ok
+	})
+	if _, result, _ := b.Fetch(ctx, "post.a", cacheOpts, countingLoader(&loads, http.StatusOK, "v2")); result != Miss {
+		t.Fatalf("purged entry is %s", result)
+	}
+
+	// the subscriptions stop with the context
+	cancel()
+	waitFor(t, func() bool {
+		return mr.PubSubNumSub(InvalidationChannel)[InvalidationChannel] == 0
+	})
+}
@@ -6,12 +6,14 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/mirror-media/mm-apigateway/config"
+	"github.com/mirror-media/mm-apigateway/member"
 	"github.com/mirror-media/mm-apigateway/server"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -36,7 +38,9 @@ func main() {
 		log.Fatalf("unable to decode into struct, %v", err)
 	}
 
-	srv, err := server.NewServer(cfg)
+	// the background goroutines of the server and the subscriptions are stopped in shutdown
+	ctx, cancelSubscriptions := context.WithCancel(context.Background())
+	srv, err := server.NewServer(ctx, cfg)
 	if err != nil {
 		err = errors.Wrap(err, "failed to create new server")
 		log.Fatal(err)
@@ -51,6 +55,36 @@ func main() {
 		log.Fatalf("error setting up route: %v", err)
 	}
 
+	// subscriptions are waited for in shutdown, so that the messages in progress are acked or nacked
+	var subscriptions sync.WaitGroup
+	if srv.Conf.PubSubSubscribePurge != "" {
+		subscriptions.Add(1)
+		go func() {
+			defer subscriptions.Done()
+			if err := server.SubscribePurge(ctx, srv); err != nil {
+				log.Errorf("cache purge subscription stopped: %v", err)
+			}
+		}()
+	}
+	if srv.Conf.PubSubSubscribeMember != "" {
+		subscriptions.Add(1)
+		go func() {
+			defer subscriptions.Done()
+			if err := member.SubscribeMemberEvents(ctx, *srv.Conf, srv.Broker, srv.MemberEventBus); err != nil && err != context.Canceled {
+				log.Errorf("member subscription stopped: %v", err)
+			}
+		}()
+	}
+
+	// resume the member deletions left by the previous run
+	subscriptions.Add(1)
+	go func() {
+		defer subscriptions.Done()
+		if err := srv.Deletions.Run(ctx); err != nil && err != context.Canceled {
+			log.Errorf("member deletions stopped: %v", err)
+		}
+	}()
+
 	httpSRV := &http.Server{
 		Addr:    fmt.Sprintf("%s:%d", srv.Conf.Address, srv.Conf.Port),
 		Handler: srv.Engine,
@@ -62,10 +96,10 @@ func main() {
 	go func() {
 		log.Infof("server listening to %s", httpSRV.Addr)
 		if err = httpSRV.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			err = errors.Wrap(shutdown(httpSRV, nil), err.Error())
+			err = errors.Wrap(shutdown(httpSRV, cancelSubscriptions, &subscriptions), err.Error())
 			log.Fatalf("listen: %s\n", err)
 		} else if err != nil {
-			err = errors.Wrap(shutdown(nil, nil), err.Error())
+			err = errors.Wrap(shutdown(nil, cancelSubscriptions, &subscriptions), err.Error())
 			log.Fatalf("error server closed: %s\n", err)
 		}
 	}()
@@ -79,13 +113,23 @@ func main() {
 	<-quit
 	log.Println("Shutting down server...")
 
-	if err := shutdown(httpSRV, nil); err != nil {
-		log.Fatalf("Server forced to shutdown:", err)
+	if err := shutdown(httpSRV, cancelSubscriptions, &subscriptions); err != nil {
+		log.Fatalf("Server forced to shutdown: %v", err)
+	}
+	// flush the pending member and audit events
+	if err := srv.MemberEvents.Close(); err != nil {
+		log.Errorf("closing the member event publisher encountered error: %v", err)
+	}
+	if err := srv.Auditor.Close(); err != nil {
+		log.Errorf("closing the audit sinks encountered error: %v", err)
+	}
+	if err := srv.Broker.Close(); err != nil {
+		log.Errorf("closing the messaging broker encountered error: %v", err)
 	}
 	os.Exit(0)
 }
 
-func shutdown(server *http.Server, cancelMemberSubscription context.CancelFunc) error {
+func shutdown(server *http.Server, cancelSubscriptions context.CancelFunc, subscriptions *sync.WaitGroup) error {
 	if server != nil {
 		// The context is used to inform the server it has 5 seconds to finish
 		// the request it is currently handling
@@ -95,8 +139,20 @@ func shutdown(server *http.Server, cancelMemberSubscription context.CancelFunc)
 			return err
 		}
 	}
-	if cancelMemberSubscription != nil {
-		cancelMemberSubscription()
+	if cancelSubscriptions != nil {
+		cancelSubscriptions()
+	}
+	if subscriptions != nil {
+		done := make(chan struct{})
+		go func() {
+			subscriptions.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			return errors.New("subscriptions didn't stop in 10 seconds")
+		}
 	}
 	return nil
 }
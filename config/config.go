@@ -1,5 +1,142 @@
 package config
 
+// Admin describes who can use the admin api. A Firebase user is an admin if the uid is listed or the custom claim admin is true
+type Admin struct {
+	FirebaseIDs []string
+}
+
+// AuditSink is where the audit events are written
+type AuditSink struct {
+	Type  string // 1. stdout, 2. file, 3. pubsub
+	File  string // file the events are appended to, for file
+	Topic string // topic the events are published to, for pubsub
+}
+
+// Audit describes the audit events of the member-affecting actions and of the GraphQL authorization
+type Audit struct {
+	Sinks          []AuditSink // default stdout
+	RedactedFields []string    // fields whose changed values are redacted, default address, birthday, district, email, name, nickname and phone
+}
+
+// FirebaseAuth describes how the Firebase ID tokens are verified
+type FirebaseAuth struct {
+	ProjectID                string // Firebase project issuing the ID tokens, default ProjectID
+	RemoteVerification       bool   // verify every token and its revocation with Firebase instead of locally
+	RemoteRevocationFallback bool   // check the revocation with Firebase when the revoke time can't be read from the Realtime Database
+	RevocationCache          string // where the revoke times are cached, 1. memory (default), 2. redis
+	RevocationCacheTTL       int    // seconds to cache the revoke time of a user, default 60
+}
+
+// MemberDeletion describes the retries of the member deletions, which are persisted in redis
+type MemberDeletion struct {
+	RetryBase      int // seconds before the first retry of a failed step, doubled for every retry, default 5
+	RetryMax       int // seconds, default 3600
+	ConfirmTimeout int // seconds to wait for the member to be deleted in the DB before the deletion is published again, default 3600
+	PollInterval   int // seconds between the checks of the due deletions, default 10
+	Retention      int // days to keep a confirmed deletion for the status query, default 30
+}
+
+// MemberEvents describes the member lifecycle events published to PubSubTopicMember
+type MemberEvents struct {
+	RedactedFields []string // fields whose changed values are redacted, none by default because the subscribers, e.g. the CRM sync, need the personal data
+}
+
+// MemberSubscription describes how the messages of PubSubSubscribeMember are consumed
+type MemberSubscription struct {
+	Concurrency     int    // messages handled at the same time, default 10
+	MaxAttempts     int    // deliveries of a failing message before it's dead-lettered, default 5
+	DeadLetterTopic string // topic of the failed messages, which are retried forever if it's empty
+	RetryBase       int    // seconds before a nacked message is redelivered, doubled for every delivery, default 1
+	RetryMax        int    // seconds, default 60
+}
+
+// MessagingSubscription is a subscription of a topic, which is configured in Pub/Sub for pubsub
+type MessagingSubscription struct {
+	Name  string
+	Topic string
+}
+
+// Messaging describes the broker of the topics and the subscriptions shared by the server
+type Messaging struct {
+	Broker            string                  // 1. pubsub (default), 2. redis, which uses the streams of RedisService, 3. memory, which delivers the messages only within the process
+	Subscriptions     []MessagingSubscription // topics of the subscriptions, for redis and memory
+	StreamMaxLen      int                     // approximate max length of a redis stream, default 100000
+	VisibilityTimeout int                     // seconds before an unacked message is delivered again by redis, default 30
+}
+
+// OIDCProvider is a generic OpenID Connect provider whose ID tokens are accepted besides the Firebase ones
+type OIDCProvider struct {
+	Name       string // provider of the principals, which can't be firebase or apikey
+	Issuer     string // iss of the tokens, which picks the provider
+	JWKSURL    string // keys verifying the tokens
+	Audience   string // expected aud of the tokens, required
+	RolesClaim string // claim listing the roles of the principal, default roles
+	TrustRoles bool   // grant the roles in the tokens, e.g. admin, which the principals of the provider don't have by default
+}
+
+// StaticAPIKey authenticates a server to server client by the X-API-Key header
+type StaticAPIKey struct {
+	Name   string // subject of the principal
+	Key    string
+	Roles  []string
+	Scopes []string // route groups the key can call, i.e. v0 and v1, every group if it's empty
+}
+
+// APIKeys describes where the API keys managed with the admin api are stored. Only the digests of the keys are stored
+type APIKeys struct {
+	Store string // 1. redis (default), 2. file
+	File  string // JSON file of the keys of file, default ./configs/apikeys.json. It can't be shared by the replicas
+}
+
+// GraphQLRule authorizes a field of the GraphQL API. A principal is allowed if it meets any of the requirements
+type GraphQLRule struct {
+	Field        string   // Type.field, e.g. Query.member
+	Requires     []string // 1. self, the argument SelfArgument is the uid of the Firebase user, 2. role:<role>, e.g. role:staff, 3. scope:<scope> of an API key, 4. authenticated, 5. public
+	SelfArgument string   // default firebaseId
+}
+
+// GraphQLService is a backend GraphQL service stitched into /api/v1/graphql
+type GraphQLService struct {
+	Name     string
+	Endpoint string
+	Schema   string // SDL file of the schema of the service, e.g. graph/schema.graphqls of the user service
+	Auth     string // 1. gateway (default), the gateway token, 2. forward, the token of the request, 3. none. The principal and the request ID are always in the X-Forwarded-* and X-Request-ID headers
+}
+
+// GraphQLLink adds a field to a type of the stitched schema, resolved by a root query of a service, e.g. member.subscriptions by Query.subscriptions of the payment service
+type GraphQLLink struct {
+	Field     string   // Type.field, e.g. member.subscriptions
+	Service   string   // name of the service of the query
+	Query     string   // root query field of the service
+	Arguments []string // arguments of the query taken from the fields of the type, as argument=field or the name of both, e.g. firebaseId. The other arguments of the query are the arguments of the field
+}
+
+// GraphQLStitching composes the schemas of the services into the schema of /api/v1/graphql. The root fields of every service need GraphQLRules
+type GraphQLStitching struct {
+	Services []GraphQLService // the endpoint is disabled if it's empty
+	Links    []GraphQLLink
+}
+
+// GatewayToken describes how the token of the gateway to the user service is kept valid
+type GatewayToken struct {
+	RefreshBefore        int    // seconds before the expiry to refresh the token, default 300
+	RefreshWithMutation  bool   // exchange the refresh token with the user service when the latest secret version is about to expire too
+	RotationTopic        string // topic to announce a refreshed secret version, disabled if it's empty
+	RotationSubscription string // subscription of the rotation topic of this replica, disabled if it's empty
+	JWKSURL              string // verify the signature with the keys of the JWKS, the signature is not verified if neither JWKSURL nor PublicKeyFile is set
+	PublicKeyFile        string // verify the signature with the RSA or EC public key in the PEM file
+	Issuer               string // expected iss of the token, not checked if it's empty
+	Audience             string // expected aud of the token, not checked if it's empty
+}
+
+// SecretProvider picks where the secrets, e.g. the gateway token, are read from
+type SecretProvider struct {
+	Type      string            // 1. gcp (default), 2. env, 3. file, 4. memory
+	EnvPrefix string            // prefix of the environment variables of env, default MM_APIGATEWAY_SECRET_
+	Dir       string            // directory of the secret files of file, default ./configs/secrets
+	Values    map[string]string // secrets of memory
+}
+
 type ServiceEndpoints struct {
 	UserGraphQL string
 }
@@ -9,8 +146,26 @@ type RedisAddress struct {
 	Port int
 }
 
+// RedisCache holds the default ttls in seconds of the cached responses
 type RedisCache struct {
-	TTL int
+	TTL         int // how long a response is served without being refreshed
+	StaleTTL    int // how long a response is served stale after TTL while it's refreshed in the background
+	NegativeTTL int // how long an upstream error is cached, 0 disables it
+}
+
+// MemoryCache describes the in-process cache tier in front of redis
+type MemoryCache struct {
+	Enabled     bool
+	MaxBytes    int64    // default 64MiB
+	TTL         int      // seconds, default 10
+	KeyPrefixes []string // prefixes of the redis keys kept in memory, default mm-apigateway.post.
+}
+
+// RateLimit allows a client Requests requests per Window seconds. A client is the authenticated principal, e.g. a Firebase user or an API key, otherwise the client IP. An API key may have its own limit
+type RateLimit struct {
+	Requests int // 0 disables the limit
+	Window   int // seconds, default 60
+	Burst    int // requests allowed at once, default Requests
 }
 
 // RedisService represents a object of a redis service. If the type is sentinel, the first address is always treated as the master.
@@ -21,18 +176,106 @@ type RedisService struct {
 	Type      string // 1. single, 2. sentinel, 3. cluster
 }
 
+// EntitlementPredicate describes which posts trigger an entitlement rule
+type EntitlementPredicate struct {
+	Type   string   // 1. category, 2. tag, 3. section, 4. publishedDate, 5. flag
+	Field  string   // field of the category/tag/section or of the post to compare, e.g. name, slug, isMemberOnly
+	Values []string // the predicate matches if the field equals any of the values. If it's empty, the field has to be true
+	After  string   // RFC3339, only for publishedDate
+	Before string   // RFC3339, only for publishedDate
+}
+
+// EntitlementAction describes what happens to a post matched by an entitlement rule
+type EntitlementAction struct {
+	Type   string // 1. truncate, 2. teaser, 3. drop
+	Field  string // path of the field relative to the post, default content.apiData
+	Blocks int    // number of blocks kept by truncate
+	Teaser string // JSON value replacing the field for teaser
+}
+
+// EntitlementRule is applied to the posts of a response when the requester is not entitled to the full content
+type EntitlementRule struct {
+	Name   string
+	Routes []string // path patterns relative to the api version, e.g. /getposts
+	When   EntitlementPredicate
+	Action EntitlementAction
+}
+
+// UpstreamHealthCheck describes the active health probes of the targets of an upstream
+type UpstreamHealthCheck struct {
+	Path               string // path probed with GET, probes are disabled if it's empty
+	Interval           int    // seconds, default 10
+	Timeout            int    // seconds, default 2
+	HealthyThreshold   int    // consecutive successful probes to re-admit a target, default 2
+	UnhealthyThreshold int    // consecutive failed probes to eject a target, default 3
+}
+
+// Upstream is a group of targets serving the same content
+type Upstream struct {
+	Name        string
+	Targets     []string // URLs of the targets
+	Policy      string   // 1. roundRobin (default), 2. leastInFlight, 3. consistentHash (on the request URI)
+	HealthCheck UpstreamHealthCheck
+}
+
+// RouteCache describes how the responses of a route are cached in redis
+type RouteCache struct {
+	Enabled     bool
+	KeyPrefix   string // default post
+	TTL         int    // seconds, default RedisService.Cache.TTL
+	StaleTTL    int    // seconds, default RedisService.Cache.StaleTTL
+	NegativeTTL int    // seconds, default RedisService.Cache.NegativeTTL
+	// cacheability of the upstream responses, the upstream errors are left to NegativeTTL
+	Statuses     []int    // default 200
+	ContentTypes []string // media types, default application/json
+	MaxBodyBytes int64    // default 8MiB
+}
+
+// Route is an entry of the route table of a proxied api version
+type Route struct {
+	Name         string
+	Path         string   // gin path relative to the api version, e.g. /getposts or /posts/:id. A path ending with /** matches every path under it, and /** is the fallback of the requests no other route matches
+	Methods      []string // empty means any method
+	Upstream     string   // name of an upstream in Upstreams or URL of the upstream, default v0
+	Cache        RouteCache
+	Auth         string   // 1. none, 2. token (default, the token state is reported), 3. required (the token has to be valid)
+	Transformers []string // 1. entitlement, 2. stripHTML, applied in order
+}
+
 type Conf struct {
 	Address                     string
+	Admin                       Admin
+	APIKeys                     APIKeys
+	Audit                       Audit
+	Debug                       bool // reply the details of the token states, which may contain internal error messages
+	EntitlementRules            []EntitlementRule
+	FirebaseAuth                FirebaseAuth
 	FirebaseCredentialFilePath  string
 	FirebaseRealtimeDatabaseURL string
+	GatewayToken                GatewayToken
+	GraphQLRules                []GraphQLRule // the operations without a rule are denied. The default rules allow the members themselves and the staff
+	GraphQLStitching            GraphQLStitching
+	MemberDeletion              MemberDeletion
+	MemberEvents                MemberEvents
+	MemberSubscription          MemberSubscription
+	MemoryCache                 MemoryCache
+	Messaging                   Messaging
+	OIDCProviders               []OIDCProvider // identity providers other than Firebase, picked by the issuer of the token
 	Port                        int
 	ProjectID                   string
-	PubSubSubscribeMember       string
+	RateLimits                  map[string]RateLimit // keyed by route group, i.e. v0 and v1
+	PubSubSubscribeMember       string               // subscription of the member actions, disabled if it's empty
+	PubSubSubscribePurge        string               // subscription of the cache purge requests, disabled if it's empty
 	PubSubTopicMember           string
 	RedisService                RedisService
+	SecretProvider              SecretProvider
+	StaticAPIKeys               []StaticAPIKey
 	ServiceEndpoints            ServiceEndpoints
 	TokenSecretName             string
+	TrustedProxies              int        // proxies in front of the gateway appending to X-Forwarded-For, e.g. 1 for a load balancer. The client IP is the peer address if it's 0
+	Upstreams                   []Upstream // an upstream named v0 targeting V0RESTfulSrvTargetURL is added if it's not defined
 	V0RESTfulSrvTargetURL       string
+	V0Routes                    []Route // the routes are registered as gin routes, which must not conflict. The default table proxies every request to V0RESTfulSrvTargetURL and caches the posts
 }
 
 func (c *Conf) Valid() bool {
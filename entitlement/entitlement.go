@@ -0,0 +1,259 @@
+// Package entitlement decides what part of a post a requester without the entitlement is allowed to read
+package entitlement
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/mirror-media/mm-apigateway/config"
+	"github.com/mirror-media/mm-apigateway/transform"
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	PredicateCategory      = "category"
+	PredicateTag           = "tag"
+	PredicateSection       = "section"
+	PredicatePublishedDate = "publishedDate"
+	PredicateFlag          = "flag"
+)
+
+const (
+	ActionTruncate = "truncate"
+	ActionTeaser   = "teaser"
+	ActionDrop     = "drop"
+)
+
+const (
+	defaultActionField        = "content.apiData"
+	defaultPublishedDateField = "publishedDate"
+	// ItemsPath is the path of the posts in a response of the v0 RESTful service
+	ItemsPath = "_items"
+)
+
+// collections maps the collection predicates to the field of the post holding the collection
+var collections = map[string]string{
+	PredicateCategory: "categories",
+	PredicateTag:      "tags",
+	PredicateSection:  "sections",
+}
+
+// DefaultRules returns the rules used when no rule is configured. It truncates the content of a post in a member only category to 3 blocks.
+func DefaultRules() []config.EntitlementRule {
+	return []config.EntitlementRule{
+		{
+			Name:   "member-only-category",
+			Routes: []string{"/getposts", "/posts", "/post"},
+			When: config.EntitlementPredicate{
+				Type:  PredicateCategory,
+				Field: "isMemberOnly",
+			},
+			Action: config.EntitlementAction{
+				Type:   ActionTruncate,
+				Field:  defaultActionField,
+				Blocks: 3,
+			},
+		},
+	}
+}
+
+type rule struct {
+	config.EntitlementRule
+	after  *time.Time
+	before *time.Time
+}
+
+// Engine applies the entitlement rules to the responses
+type Engine struct {
+	rules []rule
+}
+
+// NewEngine validates and compiles the rules
+func NewEngine(rules []config.EntitlementRule) (*Engine, error) {
+	compiled := make([]rule, 0, len(rules))
+	for i, r := range rules {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		cr := rule{EntitlementRule: r}
+		for _, pattern := range r.Routes {
+			if _, err := path.Match(pattern, "/"); err != nil {
+				return nil, errors.Wrapf(err, "rule(%s) has an invalid route pattern(%s)", name, pattern)
+			}
+		}
+
+		switch r.When.Type {
+		case PredicateCategory, PredicateTag, PredicateSection, PredicateFlag:
+			if r.When.Field == "" {
+				return nil, fmt.Errorf("rule(%s) needs a field for predicate(%s)", name, r.When.Type)
+			}
+		case PredicatePublishedDate:
+			if cr.When.Field == "" {
+				cr.When.Field = defaultPublishedDateField
+			}
+			if r.When.After == "" && r.When.Before == "" {
+				return nil, fmt.Errorf("rule(%s) needs after or before for predicate(%s)", name, r.When.Type)
+			}
+			if r.When.After != "" {
+				t, err := time.Parse(time.RFC3339, r.When.After)
+				if err != nil {
+					return nil, errors.Wrapf(err, "rule(%s) has an invalid after", name)
+				}
+				cr.after = &t
+			}
+			if r.When.Before != "" {
+				t, err := time.Parse(time.RFC3339, r.When.Before)
+				if err != nil {
+					return nil, errors.Wrapf(err, "rule(%s) has an invalid before", name)
+				}
+				cr.before = &t
+			}
+		default:
+			return nil, fmt.Errorf("rule(%s) has an unsupported predicate(%s)", name, r.When.Type)
+		}
+
+		if cr.Action.Field == "" {
+			cr.Action.Field = defaultActionField
+		}
+		switch r.Action.Type {
+		case ActionTruncate:
+			if r.Action.Blocks < 0 {
+				return nil, fmt.Errorf("rule(%s) cannot truncate to %d blocks", name, r.Action.Blocks)
+			}
+		case ActionTeaser:
+			if !gjson.Valid(r.Action.Teaser) {
+				return nil, fmt.Errorf("rule(%s) has a teaser which is not valid JSON", name)
+			}
+		case ActionDrop:
+		default:
+			return nil, fmt.Errorf("rule(%s) has an unsupported action(%s)", name, r.Action.Type)
+		}
+		compiled = append(compiled, cr)
+	}
+	return &Engine{rules: compiled}, nil
+}
+
+// Apply modifies the posts of the body with the rules applying to the route. Route is the path relative to the api version, e.g. /getposts
+func (e *Engine) Apply(route string, body []byte) ([]byte, error) {
+	doc := transform.NewDocument(body)
+	if err := e.ApplyDocument(route, doc); err != nil {
+		return nil, err
+	}
+	return doc.Bytes()
+}
+
+// ApplyDocument records the modifications of the posts of the document with the rules applying to the route
+func (e *Engine) ApplyDocument(route string, doc *transform.Document) error {
+	rules := e.rulesFor(route)
+	if len(rules) == 0 {
+		return nil
+	}
+
+	for i, item := range doc.Items(ItemsPath) {
+		for _, r := range rules {
+			if !r.matches(item.Result) {
+				continue
+			}
+			if err := r.apply(doc, item); err != nil {
+				return errors.WithMessagef(err, "applying rule(%s) to item %d failed", r.Name, i)
+			}
+		}
+	}
+	return nil
+}
+
+func (e *Engine) rulesFor(route string) (rules []rule) {
+	for _, r := range e.rules {
+		for _, pattern := range r.Routes {
+			if ok, _ := path.Match(pattern, route); ok {
+				rules = append(rules, r)
+				break
+			}
+		}
+	}
+	return rules
+}
+
+func (r rule) matches(item gjson.Result) bool {
+	switch r.When.Type {
+	case PredicateCategory, PredicateTag, PredicateSection:
+		for _, element := range item.Get(collections[r.When.Type]).Array() {
+			if r.matchesValue(element.Get(r.When.Field)) {
+				return true
+			}
+		}
+		return false
+	case PredicateFlag:
+		return r.matchesValue(item.Get(r.When.Field))
+	case PredicatePublishedDate:
+		v := item.Get(r.When.Field)
+		if !v.Exists() {
+			return false
+		}
+		t, err := time.Parse(time.RFC3339, v.String())
+		if err != nil {
+			return false
+		}
+		if r.after != nil && !t.After(*r.after) {
+			return false
+		}
+		if r.before != nil && !t.Before(*r.before) {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+func (r rule) matchesValue(v gjson.Result) bool {
+	if !v.Exists() {
+		return false
+	}
+	if len(r.When.Values) == 0 {
+		return v.Type == gjson.True
+	}
+	for _, value := range r.When.Values {
+		if v.String() == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (r rule) apply(doc *transform.Document, item transform.Node) error {
+	switch r.Action.Type {
+	case ActionTruncate:
+		field := item.Get(r.Action.Field)
+		if !field.IsArray() {
+			return nil
+		}
+		raw := make([]byte, 0, len(field.Raw))
+		raw = append(raw, '[')
+		blocks, truncated := 0, false
+		field.ForEach(func(_, block gjson.Result) bool {
+			if blocks == r.Action.Blocks {
+				truncated = true
+				return false
+			}
+			if blocks > 0 {
+				raw = append(raw, ',')
+			}
+			raw = append(raw, block.Raw...)
+			blocks++
+			return true
+		})
+		if !truncated {
+			return nil
+		}
+		raw = append(raw, ']')
+		return doc.Replace(field, raw)
+	case ActionTeaser:
+		return doc.Set(item, r.Action.Field, []byte(r.Action.Teaser))
+	case ActionDrop:
+		return doc.Delete(item, r.Action.Field)
+	}
+	return nil
+}
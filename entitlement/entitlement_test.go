@@ -0,0 +1,125 @@
+package entitlement
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/mirror-media/mm-apigateway/config"
+	"github.com/tidwall/gjson"
+)
+
+func loadFixture(t *testing.T) []byte {
+	t.Helper()
+	body, err := ioutil.ReadFile("testdata/posts.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestEngineApply(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []config.EntitlementRule
+		route string
+		// expected raw JSON of content.apiData of each item, "" means the field is absent
+		want []string
+	}{
+		{
+			name:  "default rules truncate member only posts",
+			rules: DefaultRules(),
+			route: "/getposts",
+			want:  []string{`[{"id": 1},{"id": 2},{"id": 3}]`, `[{"id": 1}, {"id": 2}, {"id": 3}, {"id": 4}]`, `[{"id": 1}]`},
+		},
+		{
+			name:  "default rules skip other routes",
+			rules: DefaultRules(),
+			route: "/getlist",
+			want:  []string{`[{"id": 1}, {"id": 2}, {"id": 3}, {"id": 4}, {"id": 5}]`, `[{"id": 1}, {"id": 2}, {"id": 3}, {"id": 4}]`, `[{"id": 1}]`},
+		},
+		{
+			name: "tag replaced by teaser",
+			rules: []config.EntitlementRule{{
+				Routes: []string{"/posts"},
+				When:   config.EntitlementPredicate{Type: PredicateTag, Field: "name", Values: []string{"sports"}},
+				Action: config.EntitlementAction{Type: ActionTeaser, Teaser: `[{"type":"paywall"}]`},
+			}},
+			route: "/posts",
+			want:  []string{`[{"id": 1}, {"id": 2}, {"id": 3}, {"id": 4}, {"id": 5}]`, `[{"type":"paywall"}]`, `[{"id": 1}]`},
+		},
+		{
+			name: "section dropped",
+			rules: []config.EntitlementRule{{
+				Routes: []string{"/*"},
+				When:   config.EntitlementPredicate{Type: PredicateSection, Field: "name", Values: []string{"news"}},
+				Action: config.EntitlementAction{Type: ActionDrop},
+			}},
+			route: "/post",
+			want:  []string{"", `[{"id": 1}, {"id": 2}, {"id": 3}, {"id": 4}]`, `[{"id": 1}]`},
+		},
+		{
+			name: "published after truncates",
+			rules: []config.EntitlementRule{{
+				Routes: []string{"/getposts"},
+				When:   config.EntitlementPredicate{Type: PredicatePublishedDate, After: "2021-01-01T00:00:00Z"},
+				Action: config.EntitlementAction{Type: ActionTruncate, Blocks: 0},
+			}},
+			route: "/getposts",
+			want:  []string{`[]`, `[{"id": 1}, {"id": 2}, {"id": 3}, {"id": 4}]`, `[]`},
+		},
+		{
+			name: "post flag truncates",
+			rules: []config.EntitlementRule{{
+				Routes: []string{"/getposts"},
+				When:   config.EntitlementPredicate{Type: PredicateFlag, Field: "isAdvertised"},
+				Action: config.EntitlementAction{Type: ActionTruncate, Blocks: 2},
+			}},
+			route: "/getposts",
+			want:  []string{`[{"id": 1}, {"id": 2}, {"id": 3}, {"id": 4}, {"id": 5}]`, `[{"id": 1},{"id": 2}]`, `[{"id": 1}]`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine, err := NewEngine(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := engine.Apply(tt.route, loadFixture(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			items := gjson.GetBytes(body, ItemsPath).Array()
+			if len(items) != len(tt.want) {
+				t.Fatalf("got %d items, want %d", len(items), len(tt.want))
+			}
+			for i, item := range items {
+				if got := item.Get("content.apiData").Raw; got != tt.want[i] {
+					t.Errorf("item %d: got apiData %s, want %s", i, got, tt.want[i])
+				}
+				if got := item.Get("content.html").String(); got != "<p>full</p>" {
+					t.Errorf("item %d: html should be untouched, got %q", i, got)
+				}
+			}
+		})
+	}
+}
+
+func TestNewEngineInvalidRules(t *testing.T) {
+	tests := map[string]config.EntitlementRule{
+		"unknown predicate": {When: config.EntitlementPredicate{Type: "author"}, Action: config.EntitlementAction{Type: ActionDrop}},
+		"missing field":     {When: config.EntitlementPredicate{Type: PredicateCategory}, Action: config.EntitlementAction{Type: ActionDrop}},
+		"missing dates":     {When: config.EntitlementPredicate{Type: PredicatePublishedDate}, Action: config.EntitlementAction{Type: ActionDrop}},
+		"invalid date":      {When: config.EntitlementPredicate{Type: PredicatePublishedDate, After: "yesterday"}, Action: config.EntitlementAction{Type: ActionDrop}},
+		"unknown action":    {When: config.EntitlementPredicate{Type: PredicateFlag, Field: "isAdvertised"}, Action: config.EntitlementAction{Type: "blur"}},
+		"invalid teaser":    {When: config.EntitlementPredicate{Type: PredicateFlag, Field: "isAdvertised"}, Action: config.EntitlementAction{Type: ActionTeaser, Teaser: "{"}},
+		"invalid route":     {Routes: []string{"["}, When: config.EntitlementPredicate{Type: PredicateFlag, Field: "isAdvertised"}, Action: config.EntitlementAction{Type: ActionDrop}},
+	}
+	for name, r := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewEngine([]config.EntitlementRule{r}); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -7,7 +7,9 @@ require (
 	cloud.google.com/go/pubsub v1.9.1
 	firebase.google.com/go/v4 v4.1.0
 	github.com/99designs/gqlgen v0.13.0
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/dgrijalva/jwt-go/v4 v4.0.0-preview1
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/gin-gonic/gin v1.6.3
 	github.com/go-redis/redis/v8 v8.7.1
 	github.com/machinebox/graphql v0.2.2
@@ -15,10 +17,13 @@ require (
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.7.0
 	github.com/spf13/viper v1.7.1
+	github.com/tidwall/gjson v1.6.8
 	github.com/tidwall/sjson v1.1.5
 	github.com/vektah/gqlparser/v2 v2.1.0
 	golang.org/x/oauth2 v0.0.0-20210113205817-d3ed898aa8a3
+	golang.org/x/sync v0.0.0-20201207232520-09787c993a3a
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1
 	google.golang.org/api v0.36.0
 	google.golang.org/genproto v0.0.0-20210113195801-ae06605f4595
+	google.golang.org/grpc v1.34.0
 )
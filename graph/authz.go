@@ -0,0 +1,193 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	graphql99 "github.com/99designs/gqlgen/graphql"
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/mm-apigateway/audit"
+	"github.com/mirror-media/mm-apigateway/config"
+	"github.com/mirror-media/mm-apigateway/identity"
+	"github.com/mirror-media/mm-apigateway/middleware"
+)
+
+// Requirements of the GraphQL rules
+const (
+	RequireSelf          = "self"
+	RequireAuthenticated = "authenticated"
+	RequirePublic        = "public"
+	requireRolePrefix    = "role:"
+	requireScopePrefix   = "scope:"
+	defaultSelfArgument  = "firebaseId"
+)
+
+// DefaultGraphQLRules allow the members to touch themselves, the staff to look up and update the other members, and the admins to delete them
+func DefaultGraphQLRules() []config.GraphQLRule {
+	return []config.GraphQLRule{
+		{Field: "Query.member", Requires: []string{RequireSelf, requireRolePrefix + identity.RoleStaff, requireRolePrefix + identity.RoleAdmin}},
+		{Field: "Mutation.createMember", Requires: []string{RequireSelf}},
+		{Field: "Mutation.updateMember", Requires: []string{RequireSelf, requireRolePrefix + identity.RoleStaff, requireRolePrefix + identity.RoleAdmin}},
+		{Field: "Mutation.deleteMember", Requires: []string{RequireSelf, requireRolePrefix + identity.RoleAdmin}},
+		{Field: "Mutation.verifyMember", Requires: []string{RequireAuthenticated}},
+	}
+}
+
+type graphQLRule struct {
+	requires     []string
+	selfArgument string
+}
+
+// Authorizer allows or denies the fields of the GraphQL requests by the rules. The root fields, i.e. the operations, without a rule are denied, and the other fields without a rule are allowed
+type Authorizer struct {
+	rules   map[string]graphQLRule
+	auditor *audit.Auditor
+}
+
+// NewAuthorizer creates the authorizer of the rules. The decisions are recorded by the auditor
+func NewAuthorizer(rules []config.GraphQLRule, auditor *audit.Auditor) (*Authorizer, error) {
+	a := &Authorizer{
+		rules:   make(map[string]graphQLRule, len(rules)),
+		auditor: auditor,
+	}
+	for _, r := range rules {
+		if strings.Count(r.Field, ".") != 1 {
+			return nil, fmt.Errorf("GraphQL rule has an invalid field(%s), it should be Type.field", r.Field)
+		}
+		if len(r.Requires) == 0 {
+			return nil, fmt.Errorf("GraphQL rule(%s) has no requirement", r.Field)
+		}
+		for _, req := range r.Requires {
+			switch {
+			case req == RequireSelf, req == RequireAuthenticated, req == RequirePublic:
+			case strings.HasPrefix(req, requireRolePrefix) && len(req) > len(requireRolePrefix):
+			case strings.HasPrefix(req, requireScopePrefix) && len(req) > len(requireScopePrefix):
+			default:
+				return nil, fmt.Errorf("GraphQL rule(%s) has an unsupported requirement(%s)", r.Field, req)
+			}
+		}
+		selfArgument := r.SelfArgument
+		if selfArgument == "" {
+			selfArgument = defaultSelfArgument
+		}
+		a.rules[r.Field] = graphQLRule{
+			requires:     r.Requires,
+			selfArgument: selfArgument,
+		}
+	}
+	return a, nil
+}
+
+// Scopes returns the API key scopes required by the rules
+func (a *Authorizer) Scopes() []string {
+	var scopes []string
+	for _, r := range a.rules {
+		for _, req := range r.requires {
+			if strings.HasPrefix(req, requireScopePrefix) {
+				scopes = append(scopes, strings.TrimPrefix(req, requireScopePrefix))
+			}
+		}
+	}
+	return scopes
+}
+
+// Authorize is a field middleware checking the rule of every field. The decisions of the operations and of the fields with a rule are audited
+func (a *Authorizer) Authorize(ctx context.Context, next graphql99.Resolver) (interface{}, error) {
+	fc := graphql99.GetFieldContext(ctx)
+	if fc == nil {
+		return next(ctx)
+	}
+	if err := a.Allows(ctx, fc.Object, fc.Field.Name, fc.Args, fc.Parent == nil); err != nil {
+		return nil, err
+	}
+	return next(ctx)
+}
+
+// Allows checks the rule of the field of the object, which is an operation if it's a root field. It's used by the schemas resolved without gqlgen, e.g. the stitched one
+func (a *Authorizer) Allows(ctx context.Context, object string, name string, args map[string]interface{}, isOperation bool) error {
+	// introspection is always allowed
+	if strings.HasPrefix(name, "__") {
+		return nil
+	}
+	field := object + "." + name
+	rule, ok := a.rules[field]
+	if !ok && !isOperation {
+		return nil
+	}
+
+	principal := principalFromContext(ctx)
+	allowed, reason := false, "no rule"
+	if ok {
+		allowed, reason = rule.allows(principal, args)
+	}
+	a.audit(ctx, field, stringArgument(args, rule.selfArgument), allowed, reason)
+	if !allowed {
+		return fmt.Errorf("%s is not allowed to resolve %s", principal, field)
+	}
+	return nil
+}
+
+// allows returns whether the principal meets a requirement, and the requirement met
+func (r graphQLRule) allows(principal *identity.Principal, args map[string]interface{}) (bool, string) {
+	for _, req := range r.requires {
+		switch {
+		case req == RequirePublic:
+			return true, req
+		case principal == nil:
+		case req == RequireAuthenticated:
+			return true, req
+		case req == RequireSelf:
+			if principal.Provider == identity.ProviderFirebase && principal.Subject != "" && stringArgument(args, r.selfArgument) == principal.Subject {
+				return true, req
+			}
+		case strings.HasPrefix(req, requireRolePrefix):
+			if principal.HasRole(strings.TrimPrefix(req, requireRolePrefix)) {
+				return true, req
+			}
+		case strings.HasPrefix(req, requireScopePrefix):
+			// the principals without scopes are not API keys
+			if principal.Scopes != nil && principal.AllowsScope(strings.TrimPrefix(req, requireScopePrefix)) {
+				return true, req
+			}
+		}
+	}
+	return false, "requires one of " + strings.Join(r.requires, ", ")
+}
+
+func stringArgument(args map[string]interface{}, name string) string {
+	switch v := args[name].(type) {
+	case string:
+		return v
+	case *string:
+		if v != nil {
+			return *v
+		}
+	}
+	return ""
+}
+
+// principalFromContext returns the principal authenticated by the gin middlewares, nil if there's none
+func principalFromContext(ctx context.Context) *identity.Principal {
+	gc, ok := ctx.Value(middleware.CtxGinContexKey).(*gin.Context)
+	if !ok {
+		return nil
+	}
+	principal, _ := gc.Value(middleware.GCtxPrincipalKey).(*identity.Principal)
+	return principal
+}
+
+// audit records the decision of the field. The target is the member in the self argument, if any
+func (a *Authorizer) audit(ctx context.Context, field string, target string, allowed bool, reason string) {
+	outcome := audit.OutcomeDenied
+	if allowed {
+		outcome = audit.OutcomeAllowed
+	}
+	a.auditor.Record(ctx, audit.Event{
+		Operation: audit.OpGraphQLAuthorize,
+		Resource:  field,
+		Target:    target,
+		Outcome:   outcome,
+		Reason:    reason,
+	})
+}
@@ -0,0 +1,180 @@
+package graph
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	graphql99 "github.com/99designs/gqlgen/graphql"
+	"github.com/dgrijalva/jwt-go/v4"
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/mm-apigateway/audit"
+	"github.com/mirror-media/mm-apigateway/config"
+	"github.com/mirror-media/mm-apigateway/identity"
+	"github.com/mirror-media/mm-apigateway/middleware"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+func fieldContext(principal *identity.Principal, parent *graphql99.FieldContext, object, field string, args map[string]interface{}) context.Context {
+	gc, _ := gin.CreateTestContext(httptest.NewRecorder())
+	if principal != nil {
+		gc.Set(middleware.GCtxPrincipalKey, principal)
+	}
+	ctx := context.WithValue(context.Background(), middleware.CtxGinContexKey, gc)
+	if parent != nil {
+		ctx = graphql99.WithFieldContext(ctx, parent)
+	}
+	return graphql99.WithFieldContext(ctx, &graphql99.FieldContext{
+		Object: object,
+		Field:  graphql99.CollectedField{Field: &ast.Field{Name: field, Alias: field}},
+		Args:   args,
+	})
+}
+
+type eventSink struct {
+	events []audit.Event
+}
+
+func (s *eventSink) Write(ctx context.Context, e audit.Event) error {
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *eventSink) Close() error {
+	return nil
+}
+
+func TestAuthorize(t *testing.T) {
+	sink := &eventSink{}
+	authorizer, err := NewAuthorizer(append(DefaultGraphQLRules(), config.GraphQLRule{
+		Field:    "member.email",
+		Requires: []string{RequireSelf, "role:staff"},
+	}, config.GraphQLRule{
+		Field:    "Mutation.tokenVerify",
+		Requires: []string{"scope:token"},
+	}), audit.New(nil, sink))
+	if err != nil {
+		t.Fatal(err)
+	}
+	member := &identity.Principal{Subject: "u1", Provider: identity.ProviderFirebase}
+	staff := &identity.Principal{Subject: "s1", Provider: identity.ProviderFirebase, Roles: []string{identity.RoleStaff}}
+	apiKey := &identity.Principal{Subject: "k1", Provider: identity.ProviderAPIKey, Scopes: []string{"token"}}
+	self := map[string]interface{}{"firebaseId": "u1"}
+	parent := &graphql99.FieldContext{Object: "Query", Field: graphql99.CollectedField{Field: &ast.Field{Name: "member"}}}
+
+	for _, c := range []struct {
+		name      string
+		principal *identity.Principal
+		parent    *graphql99.FieldContext
+		field     string
+		args      map[string]interface{}
+		allowed   bool
+	}{
+		{"self", member, nil, "Query.member", self, true},
+		{"other member", member, nil, "Query.member", map[string]interface{}{"firebaseId": "u2"}, false},
+		{"optional self argument", member, nil, "Mutation.updateMember", map[string]interface{}{"firebaseId": stringPointer("u1")}, true},
+		{"staff", staff, nil, "Mutation.updateMember", self, true},
+		{"staff deleting", staff, nil, "Mutation.deleteMember", self, false},
+		{"anonymous", nil, nil, "Query.member", self, false},
+		{"operation without rule", staff, nil, "Mutation.archiveAccount", nil, false},
+		{"api key with the scope", apiKey, nil, "Mutation.tokenVerify", nil, true},
+		{"user without scopes", staff, nil, "Mutation.tokenVerify", nil, false},
+		{"api key is not self", &identity.Principal{Subject: "u1", Provider: identity.ProviderAPIKey}, nil, "Query.member", self, false},
+		{"field without rule", staff, parent, "member.name", nil, true},
+		{"field of the staff", staff, parent, "member.email", nil, true},
+		{"field of somebody else", member, parent, "member.email", nil, false},
+		{"introspection", nil, nil, "Query.__schema", nil, true},
+	} {
+		resolved := false
+		sink.events = nil
+		parts := strings.SplitN(c.field, ".", 2)
+		_, err := authorizer.Authorize(fieldContext(c.principal, c.parent, parts[0], parts[1], c.args), func(ctx context.Context) (interface{}, error) {
+			resolved = true
+			return nil, nil
+		})
+		if allowed := err == nil; allowed != c.allowed || resolved != c.allowed {
+			t.Errorf("%s: allowed %v, resolved %v, want %v", c.name, allowed, resolved, c.allowed)
+		}
+		// the decisions of the operations are always audited
+		if c.parent == nil && !strings.HasPrefix(parts[1], "__") {
+			if len(sink.events) != 1 || sink.events[0].Resource != c.field || (sink.events[0].Outcome == audit.OutcomeAllowed) != c.allowed {
+				t.Errorf("%s: audit events are %+v", c.name, sink.events)
+			}
+		}
+	}
+}
+
+func TestNewAuthorizerRejectsInvalidRules(t *testing.T) {
+	for _, r := range []config.GraphQLRule{
+		{Field: "member", Requires: []string{RequireSelf}},
+		{Field: "Query.member"},
+		{Field: "Query.member", Requires: []string{"staff"}},
+		{Field: "Query.member", Requires: []string{"role:"}},
+	} {
+		if _, err := NewAuthorizer([]config.GraphQLRule{r}, nil); err == nil {
+			t.Errorf("rule %+v is accepted", r)
+		}
+	}
+}
+
+func stringPointer(s string) *string {
+	return &s
+}
+
+// oidcPrincipal authenticates a token of an OIDC partner claiming the admin and staff roles
+func oidcPrincipal(t *testing.T, trustRoles bool) *identity.Principal {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": "k1",
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	defer jwks.Close()
+	oidc, err := identity.NewOIDC(config.OIDCProvider{Name: "partner", Issuer: "https://partner.example.com", JWKSURL: jwks.URL, Audience: "mm", TrustRoles: trustRoles})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"iss": "https://partner.example.com", "aud": "mm", "sub": "p1", "admin": true, "staff": true})
+	tk.Header["kid"] = "k1"
+	s, err := tk.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+s)
+	authenticated, err := oidc.NewToken(r)
+	if err != nil || authenticated.GetPrincipal() == nil {
+		t.Fatalf("token is not authenticated: %v, %s", err, authenticated.GetTokenDetail())
+	}
+	return authenticated.GetPrincipal()
+}
+
+func TestAuthorizeOIDCRoles(t *testing.T) {
+	authorizer, err := NewAuthorizer(DefaultGraphQLRules(), audit.New(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := map[string]interface{}{"firebaseId": "u2"}
+	for _, trust := range []bool{false, true} {
+		principal := oidcPrincipal(t, trust)
+		for _, field := range []string{"deleteMember", "updateMember"} {
+			err := authorizer.Allows(fieldContext(principal, nil, "Mutation", field, other), "Mutation", field, other, true)
+			if allowed := err == nil; allowed != trust {
+				t.Errorf("%s is allowed: %v when the roles of the provider are trusted: %v", field, allowed, trust)
+			}
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package graph
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	graphql99 "github.com/99designs/gqlgen/graphql"
+	"github.com/machinebox/graphql"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// Forwarder resolves the root fields by sending them as they are requested to a GraphQL service with the same types
+type Forwarder struct {
+	client *graphql.Client
+	schema *ast.Schema
+}
+
+// NewForwarder creates the forwarder to the client. The schema declares the types of the forwarded variables
+func NewForwarder(client *graphql.Client, schema *ast.Schema) *Forwarder {
+	return &Forwarder{
+		client: client,
+		schema: schema,
+	}
+}
+
+// Forward sends the root field being resolved with its arguments and its selections, and decodes the result into out. The result stays untouched if it's null
+func (f *Forwarder) Forward(ctx context.Context, out interface{}) error {
+	oc := graphql99.GetOperationContext(ctx)
+	fc := graphql99.GetFieldContext(ctx)
+	query, variables, fields, err := f.query(oc, fc.Field)
+	if err != nil {
+		return err
+	}
+
+	req := graphql.NewRequest(query)
+	for name, value := range variables {
+		req.Var(name, value)
+	}
+	var data map[string]json.RawMessage
+	if err = f.client.Run(ctx, req, &data); err != nil {
+		return err
+	}
+	result, ok := data[responseKey(fc.Field.Field)]
+	if !ok || string(result) == "null" {
+		return nil
+	}
+	// the aliased results are mapped back to the fields of the models
+	if result, err = fields.unalias(result); err != nil {
+		return err
+	}
+	return json.Unmarshal(result, out)
+}
+
+// query serializes the operation of the field with the aliases as written, and returns the fields of the result keyed by the aliases. The fragments are flattened, and every argument is passed as a variable declared with the type in the schema
+func (f *Forwarder) query(oc *graphql99.OperationContext, field graphql99.CollectedField) (string, map[string]interface{}, resultFields, error) {
+	q := &forwardedQuery{
+		oc:        oc,
+		schema:    f.schema,
+		variables: make(map[string]interface{}),
+	}
+	root := q.writeField(field.Field, field.Selections)
+	if q.err != nil {
+		return "", nil, nil, q.err
+	}
+
+	operation := string(oc.Operation.Operation)
+	if operation == "" {
+		operation = string(ast.Query)
+	}
+	if len(q.definitions) > 0 {
+		operation += "(" + strings.Join(q.definitions, ", ") + ")"
+	}
+	return operation + " { " + q.buf.String() + " }", q.variables, root.fields, nil
+}
+
+// responseKey returns the key of the field in the result, i.e. its alias if it has one
+func responseKey(field *ast.Field) string {
+	if field.Alias != "" {
+		return field.Alias
+	}
+	return field.Name
+}
+
+// resultField is a field selected in a result, with the fields of its value keyed by their response keys
+type resultField struct {
+	name   string
+	fields resultFields
+}
+
+type resultFields map[string]resultField
+
+// unalias renames the response keys of the result to the names of the fields, in the objects of the lists too
+func (fields resultFields) unalias(result json.RawMessage) (json.RawMessage, error) {
+	if len(fields) == 0 {
+		return result, nil
+	}
+	trimmed := bytes.TrimSpace(result)
+	if len(trimmed) == 0 {
+		return result, nil
+	}
+	switch trimmed[0] {
+	case '[':
+		var items []json.RawMessage
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, err
+		}
+		for i := range items {
+			item, err := fields.unalias(items[i])
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return json.Marshal(items)
+	case '{':
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(trimmed, &object); err != nil {
+			return nil, err
+		}
+		renamed := make(map[string]json.RawMessage, len(object))
+		for key, value := range object {
+			f, ok := fields[key]
+			if !ok {
+				renamed[key] = value
+				continue
+			}
+			value, err := f.fields.unalias(value)
+			if err != nil {
+				return nil, err
+			}
+			renamed[f.name] = value
+		}
+		return json.Marshal(renamed)
+	}
+	return result, nil
+}
+
+type forwardedQuery struct {
+	oc          *graphql99.OperationContext
+	schema      *ast.Schema
+	buf         strings.Builder
+	definitions []string
+	variables   map[string]interface{}
+	err         error
+}
+
+func (q *forwardedQuery) writeField(field *ast.Field, selections ast.SelectionSet) resultField {
+	if key := responseKey(field); key != field.Name {
+		q.buf.WriteString(key + ": ")
+	}
+	q.buf.WriteString(field.Name)
+	written := resultField{name: field.Name}
+	if field.Definition == nil {
+		return written
+	}
+	args := field.ArgumentMap(q.oc.Variables)
+	if len(args) > 0 {
+		arguments := make([]string, 0, len(args))
+		for _, def := range field.Definition.Arguments {
+			value, ok := args[def.Name]
+			if !ok {
+				continue
+			}
+			arguments = append(arguments, def.Name+": $"+q.declare(def.Name, def.Type, value))
+		}
+		q.buf.WriteString("(" + strings.Join(arguments, ", ") + ")")
+	}
+	if len(selections) > 0 {
+		written.fields = q.writeSelections(field.Definition.Type.Name(), selections)
+	}
+	return written
+}
+
+// declare declares the variable of the argument, whose name is suffixed if an argument of another field has the same name
+func (q *forwardedQuery) declare(name string, t *ast.Type, value interface{}) string {
+	variable := name
+	for i := 2; ; i++ {
+		if _, ok := q.variables[variable]; !ok {
+			break
+		}
+		variable = fmt.Sprintf("%s%d", name, i)
+	}
+	q.variables[variable] = value
+	q.definitions = append(q.definitions, "$"+variable+": "+t.String())
+	return variable
+}
+
+// writeSelections writes the selections of a value of the type and returns the fields of the value. The selections of an abstract type are grouped by the possible types
+func (q *forwardedQuery) writeSelections(typeName string, selections ast.SelectionSet) resultFields {
+	def := q.schema.Types[typeName]
+	if def == nil {
+		q.err = fmt.Errorf("type(%s) is not in the schema", typeName)
+		return nil
+	}
+	written := make(resultFields)
+	q.buf.WriteString(" {")
+	if !def.IsAbstractType() {
+		q.writeFields(graphql99.CollectFields(q.oc, selections, q.satisfies(def)), written)
+		q.buf.WriteString(" }")
+		return written
+	}
+	q.buf.WriteString(" __typename")
+	for _, possible := range q.schema.GetPossibleTypes(def) {
+		fields := graphql99.CollectFields(q.oc, selections, q.satisfies(possible))
+		if len(fields) == 0 {
+			continue
+		}
+		q.buf.WriteString(" ... on " + possible.Name + " {")
+		q.writeFields(fields, written)
+		q.buf.WriteString(" }")
+	}
+	q.buf.WriteString(" }")
+	return written
+}
+
+// writeFields writes the fields with their aliases and adds them to written. The fields of the same name have to be selected with the same arguments, because their results are decoded into the same field of a model
+func (q *forwardedQuery) writeFields(fields []graphql99.CollectedField, written resultFields) {
+	arguments := make(map[string]map[string]interface{}, len(fields))
+	for _, f := range fields {
+		if f.Definition == nil {
+			continue
+		}
+		args := f.ArgumentMap(q.oc.Variables)
+		if other, ok := arguments[f.Name]; ok && !reflect.DeepEqual(args, other) {
+			q.err = fmt.Errorf("field(%s) is selected with different arguments, which can't be forwarded", f.Name)
+			return
+		}
+		arguments[f.Name] = args
+	}
+	for _, f := range fields {
+		q.buf.WriteString(" ")
+		written[responseKey(f.Field)] = q.writeField(f.Field, f.Selections)
+	}
+}
+
+// satisfies returns the type conditions matching a value of the object, i.e. itself, its interfaces and the unions of it
+func (q *forwardedQuery) satisfies(def *ast.Definition) []string {
+	satisfies := append([]string{def.Name}, def.Interfaces...)
+	for _, t := range q.schema.Types {
+		if t.Kind != ast.Union {
+			continue
+		}
+		for _, member := range t.Types {
+			if member == def.Name {
+				satisfies = append(satisfies, t.Name)
+			}
+		}
+	}
+	return satisfies
+}
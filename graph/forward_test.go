@@ -0,0 +1,174 @@
+package graph
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	graphql99 "github.com/99designs/gqlgen/graphql"
+	"github.com/machinebox/graphql"
+	"github.com/mirror-media/mm-apigateway/graph/generated"
+	"github.com/mirror-media/mm-apigateway/graph/model"
+	"github.com/vektah/gqlparser/v2"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// rootField returns the operation and the first root field of the query
+func rootField(t *testing.T, schema *ast.Schema, query string, variables map[string]interface{}) (*graphql99.OperationContext, graphql99.CollectedField) {
+	doc, errs := gqlparser.LoadQuery(schema, query)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	oc := &graphql99.OperationContext{
+		Doc:       doc,
+		Operation: doc.Operations[0],
+		Variables: variables,
+	}
+	root := "Query"
+	if oc.Operation.Operation == ast.Mutation {
+		root = "Mutation"
+	}
+	return oc, graphql99.CollectFields(oc, oc.Operation.SelectionSet, []string{root})[0]
+}
+
+func TestForwardedQuery(t *testing.T) {
+	schema := generated.NewExecutableSchema(generated.Config{}).Schema()
+	f := NewForwarder(nil, schema)
+	tests := []struct {
+		name      string
+		query     string
+		variables map[string]interface{}
+		want      string
+		wantVars  map[string]interface{}
+	}{
+		{
+			name:     "nested selections",
+			query:    `mutation { createMember(firebaseId: "u1", email: "a@b.c") { success member { email } } }`,
+			want:     `mutation($email: String, $firebaseId: String!) { createMember(email: $email, firebaseId: $firebaseId) { success member { email } } }`,
+			wantVars: map[string]interface{}{"email": "a@b.c", "firebaseId": "u1"},
+		},
+		{
+			name:      "aliases and fragments",
+			query:     `query($id: String!) { m: member(firebaseId: $id) { ...names mail: email } } fragment names on member { name nickname email }`,
+			variables: map[string]interface{}{"id": "u1"},
+			want:      `query($firebaseId: String!) { m: member(firebaseId: $firebaseId) { name nickname email mail: email } }`,
+			wantVars:  map[string]interface{}{"firebaseId": "u1"},
+		},
+		{
+			name:      "skipped fields and absent arguments",
+			query:     `mutation($skip: Boolean!) { updateMember(firebaseId: "u1", name: "n") { success member @skip(if: $skip) { email } } }`,
+			variables: map[string]interface{}{"skip": true},
+			want:      `mutation($firebaseId: String!, $name: String) { updateMember(firebaseId: $firebaseId, name: $name) { success } }`,
+			wantVars:  map[string]interface{}{"firebaseId": "u1", "name": "n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oc, field := rootField(t, schema, tt.query, tt.variables)
+			query, variables, _, err := f.query(oc, field)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if query != tt.want {
+				t.Fatalf("query is\n%s\nwant\n%s", query, tt.want)
+			}
+			if len(variables) != len(tt.wantVars) {
+				t.Fatalf("variables are %v", variables)
+			}
+			for name, value := range tt.wantVars {
+				if variables[name] != value {
+					t.Fatalf("variables are %v", variables)
+				}
+			}
+		})
+	}
+}
+
+func TestForwardedQueryRejectsConflictingArguments(t *testing.T) {
+	schema := generated.NewExecutableSchema(generated.Config{}).Schema()
+	oc, field := rootField(t, schema, `mutation { createMember(firebaseId: "u1") { member { email } } }`, nil)
+	// a selection set valid for the gateway can't have conflicting fields, so the conflict is made by hand
+	conflict := *field.Field
+	conflict.Alias = "other"
+	conflict.Arguments = ast.ArgumentList{{Name: "firebaseId", Value: &ast.Value{Kind: ast.StringValue, Raw: "u2"}}}
+	root := graphql99.CollectedField{
+		Field:      &ast.Field{Name: "mutation", Definition: &ast.FieldDefinition{Type: ast.NamedType("Mutation", nil)}},
+		Selections: ast.SelectionSet{&conflict, field.Field},
+	}
+	if _, _, _, err := NewForwarder(nil, schema).query(oc, root); err == nil {
+		t.Fatal("fields with different arguments are merged")
+	}
+}
+
+func TestForward(t *testing.T) {
+	var got []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Query     string                 `json:"query"`
+			Variables map[string]interface{} `json:"variables"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		got = append(got, req.Query)
+		id := req.Variables["firebaseId"]
+		w.Header().Set("Content-Type", "application/json")
+		if id == "u1" {
+			w.Write([]byte(`{"data":{"a":{"mail":"a@b.c","email":"a@b.c","name":null}}}`))
+		} else {
+			w.Write([]byte(`{"data":{"b":{"mail":"d@e.f","name":"d"}}}`))
+		}
+	}))
+	defer upstream.Close()
+
+	schema := generated.NewExecutableSchema(generated.Config{}).Schema()
+	forwarder := NewForwarder(graphql.NewClient(upstream.URL), schema)
+	doc, errs := gqlparser.LoadQuery(schema, `{ a: member(firebaseId: "u1") { mail: email email name } b: member(firebaseId: "u2") { mail: email name } }`)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	oc := &graphql99.OperationContext{Doc: doc, Operation: doc.Operations[0]}
+	ctx := graphql99.WithOperationContext(context.Background(), oc)
+
+	// every root field is resolved by its own forward
+	members := make(map[string]*model.Member)
+	for _, field := range graphql99.CollectFields(oc, oc.Operation.SelectionSet, []string{"Query"}) {
+		var member *model.Member
+		fctx := graphql99.WithFieldContext(ctx, &graphql99.FieldContext{Object: "Query", Field: field})
+		if err := forwarder.Forward(fctx, &member); err != nil {
+			t.Fatal(err)
+		}
+		members[field.Alias] = member
+	}
+	want := []string{
+		`query($firebaseId: String!) { a: member(firebaseId: $firebaseId) { mail: email email name } }`,
+		`query($firebaseId: String!) { b: member(firebaseId: $firebaseId) { mail: email name } }`,
+	}
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("forwarded %q", got)
+	}
+	if a := members["a"]; a == nil || a.Email == nil || *a.Email != "a@b.c" || a.Name != nil {
+		t.Fatalf("member a is %+v", a)
+	}
+	if b := members["b"]; b == nil || b.Email == nil || *b.Email != "d@e.f" || b.Name == nil || *b.Name != "d" {
+		t.Fatalf("member b is %+v", b)
+	}
+}
+
+func TestUnalias(t *testing.T) {
+	fields := resultFields{
+		"m": {name: "member", fields: resultFields{
+			"mail":  {name: "email"},
+			"posts": {name: "posts", fields: resultFields{"t": {name: "title"}}},
+		}},
+	}
+	result, err := fields.unalias(json.RawMessage(`{"m":{"mail":"a@b.c","__typename":"member","posts":[{"t":"x"},null]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"member":{"__typename":"member","email":"a@b.c","posts":[{"title":"x"},null]}}`; string(result) != want {
+		t.Fatalf("result is %s, want %s", result, want)
+	}
+}
@@ -5,9 +5,10 @@ import (
 	"errors"
 	"fmt"
 
-	graphql99 "github.com/99designs/gqlgen/graphql"
-	"github.com/machinebox/graphql"
+	"github.com/mirror-media/mm-apigateway/audit"
 	"github.com/mirror-media/mm-apigateway/config"
+	"github.com/mirror-media/mm-apigateway/identity"
+	"github.com/mirror-media/mm-apigateway/member"
 	"github.com/mirror-media/mm-apigateway/middleware"
 	log "github.com/sirupsen/logrus"
 
@@ -22,22 +23,46 @@ import (
 
 type Resolver struct {
 	// Token      token.Token
-	Client     *graphql.Client
+	// Forwarder forwards the member fields to the user service
+	Forwarder  *Forwarder
 	Conf       config.Conf
 	UserSrvURL string
+	// Auditor records the member-affecting actions
+	Auditor *audit.Auditor
+	// Deletions deletes the disabled members durably
+	Deletions *member.Deletions
+	// Events publishes the lifecycle events of the members
+	Events *member.EventPublisher
 }
 
-func (r Resolver) IsRequestMatchingRequesterFirebaseID(ctx context.Context, userID string) (bool, error) {
-
-	gCTX, err := GinContextFromContext(ctx)
-	if err != nil {
-		return false, err
+// changesOf returns the values of the non-nil arguments
+func changesOf(args map[string]interface{}) map[string]interface{} {
+	changes := make(map[string]interface{}, len(args))
+	for k, v := range args {
+		switch p := v.(type) {
+		case *string:
+			if p != nil {
+				changes[k] = *p
+			}
+		case *int:
+			if p != nil {
+				changes[k] = *p
+			}
+		default:
+			if v != nil {
+				changes[k] = v
+			}
+		}
 	}
+	return changes
+}
 
-	if userID != gCTX.Value(middleware.GCtxUserIDKey).(string) {
-		return false, fmt.Errorf("member id(%s) is not allowed to perfrom action against member id(%s)", gCTX.Value(middleware.GCtxUserIDKey), userID)
+// firebaseIDFromContext returns the firebaseId of the signed-in member, empty if the principal isn't a Firebase user
+func firebaseIDFromContext(ctx context.Context) string {
+	if principal := principalFromContext(ctx); principal != nil && principal.Provider == identity.ProviderFirebase {
+		return principal.Subject
 	}
-	return true, nil
+	return ""
 }
 
 func GinContextFromContext(ctx context.Context) (*gin.Context, error) {
@@ -97,38 +122,6 @@ func FirebaseDatabaseClientFromContext(ctx context.Context) (*db.Client, error)
 	return client, nil
 }
 
-func GetPreloads(ctx context.Context) []string {
-	return GetNestedPreloads(
-		graphql99.GetOperationContext(ctx),
-		graphql99.CollectFieldsCtx(ctx, nil),
-		"",
-	)
-}
-
-func GetNestedPreloads(ctx *graphql99.OperationContext, fields []graphql99.CollectedField, prefix string) (preloads []string) {
-	for _, column := range fields {
-		prefixColumn := GetPreloadString(prefix, column.Name)
-		preloads = append(preloads, prefixColumn)
-		preloads = append(preloads, GetNestedPreloads(ctx, graphql99.CollectFields(ctx, column.Selections, nil), prefixColumn)...)
-	}
-	return
-}
-
-func GetPreloadString(prefix, name string) string {
-	if len(prefix) > 0 {
-		return prefix + "." + name
-	}
-	return name
-}
-
-func Map(vs []string, f func(string) string) []string {
-	vsm := make([]string, len(vs))
-	for i, v := range vs {
-		vsm[i] = f(v)
-	}
-	return vsm
-}
-
 func checkAndPrintGraphQLError(logger *log.Entry, err error) {
 	if err != nil {
 		logger.Infof("GraphQL request received error from:%v", err)
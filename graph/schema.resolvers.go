@@ -6,9 +6,8 @@ package graph
 import (
 	"context"
 	"fmt"
-	"strings"
 
-	"github.com/machinebox/graphql"
+	"github.com/mirror-media/mm-apigateway/audit"
 	"github.com/mirror-media/mm-apigateway/graph/generated"
 	"github.com/mirror-media/mm-apigateway/graph/model"
 	"github.com/mirror-media/mm-apigateway/member"
@@ -35,125 +34,103 @@ func (r *mutationResolver) Member(ctx context.Context) (*model.Member, error) {
 }
 
 func (r *mutationResolver) CreateMember(ctx context.Context, email *string, firebaseID string) (*model.CreateMember, error) {
-	if _, err := r.IsRequestMatchingRequesterFirebaseID(ctx, firebaseID); err != nil {
-		return nil, err
-	}
-
-	// Construct GraphQL mutation
-	preloads := GetPreloads(ctx)
-	preGQL := []string{"mutation($email: String, $firebaseId: String!) {", "createMember(email: $email, firebaseId: $firebaseId) {"}
-
-	fieldsOnly := Map(preloads, func(s string) string {
-		ns := strings.Split(s, ".")
-		return ns[len(ns)-1]
-	})
-
-	preGQL = append(preGQL, fieldsOnly...)
-	preGQL = append(preGQL, "}", "}")
-	gql := strings.Join(preGQL, "\n")
-
-	req := graphql.NewRequest(gql)
-	req.Var("firebaseId", firebaseID)
-	req.Var("email", email)
 
 	// Ask User service to create the member
-	var resp struct {
-		CreateMember *model.CreateMember `json:"createMember"`
-	}
-	err := r.Client.Run(ctx, req, &resp)
+	var createMember *model.CreateMember
+	err := r.Forwarder.Forward(ctx, &createMember)
 
 	checkAndPrintGraphQLError(logger.WithField("mutation", "CreateMember"), err)
+	changes := changesOf(map[string]interface{}{"email": email})
+	outcome, reason := audit.Outcome(err)
+	r.Auditor.Record(ctx, audit.Event{
+		Operation: audit.OpMemberCreate,
+		Target:    firebaseID,
+		Changes:   changes,
+		Outcome:   outcome,
+		Reason:    reason,
+	})
+	if err == nil {
+		r.Events.Publish(ctx, member.ActionCreated, firebaseID, changes)
+	}
 
-	return resp.CreateMember, err
+	return createMember, err
 }
 
 func (r *mutationResolver) UpdateMember(ctx context.Context, address *string, birthday *string, city *string, country *string, district *string, firebaseID string, gender *int, name *string, nickname *string, phone *string, profileImage *string) (*model.UpdateMember, error) {
-	if _, err := r.IsRequestMatchingRequesterFirebaseID(ctx, firebaseID); err != nil {
-		return nil, err
-	}
-
-	// Construct GraphQL mutation
-	preloads := GetPreloads(ctx)
-	preGQL := []string{"mutation($address: String, $birthday: Date, $city: String, $country: String, $district: String, $firebaseId: String!, $gender: Int, $name: String, $nickname: String, $phone: String, $profileImage: String) {", "updateMember(address: $address, birthday: $birthday, city: $city, country: $country, district: $district, firebaseId: $firebaseId, gender: $gender, name: $name, nickname: $nickname, phone: $phone, profileImage: $profileImage) {"}
-
-	fieldsOnly := Map(preloads, func(s string) string {
-		ns := strings.Split(s, ".")
-		return ns[len(ns)-1]
-	})
-
-	preGQL = append(preGQL, fieldsOnly...)
-	preGQL = append(preGQL, "}", "}")
-	gql := strings.Join(preGQL, "\n")
-
-	req := graphql.NewRequest(gql)
-	req.Var("firebaseId", firebaseID)
-	req.Var("address", address)
-	req.Var("birthday", birthday)
-	req.Var("city", city)
-	req.Var("country", country)
-	req.Var("district", district)
-	req.Var("firebaseId", firebaseID)
-	req.Var("gender", gender)
-	req.Var("name", name)
-	req.Var("nickname", nickname)
-	req.Var("phone", phone)
-	req.Var("profileImage", profileImage)
 
 	// Ask User service to update the member
-	var resp struct {
-		UpdateMember *model.UpdateMember `json:"updateMember"`
-	}
-	err := r.Client.Run(ctx, req, &resp)
+	var updateMember *model.UpdateMember
+	err := r.Forwarder.Forward(ctx, &updateMember)
 
 	checkAndPrintGraphQLError(logger.WithField("mutation", "UpdateMember"), err)
+	changes := changesOf(map[string]interface{}{
+		"address":      address,
+		"birthday":     birthday,
+		"city":         city,
+		"country":      country,
+		"district":     district,
+		"gender":       gender,
+		"name":         name,
+		"nickname":     nickname,
+		"phone":        phone,
+		"profileImage": profileImage,
+	})
+	outcome, reason := audit.Outcome(err)
+	r.Auditor.Record(ctx, audit.Event{
+		Operation: audit.OpMemberUpdate,
+		Target:    firebaseID,
+		Changes:   changes,
+		Outcome:   outcome,
+		Reason:    reason,
+	})
+	if err == nil {
+		r.Events.Publish(ctx, member.ActionUpdated, firebaseID, changes)
+	}
 
-	return resp.UpdateMember, err
+	return updateMember, err
 }
 
 func (r *mutationResolver) DeleteMember(ctx context.Context, firebaseID string) (*model.DeleteMember, error) {
-	if _, err := r.IsRequestMatchingRequesterFirebaseID(ctx, firebaseID); err != nil {
-		return nil, err
-	}
-	client, err := FirebaseClientFromContext(ctx)
-	if err != nil {
-		errors.WithMessage(err, "can't get FirebaseClient from context")
-		log.Error(err)
-		return nil, err
-	}
-
-	// disable firebase user before delete member to decrease response time
-	if err = member.DisableFirebaseUser(ctx, client, firebaseID); err != nil {
-		errors.WithMessage(err, fmt.Sprintf("can't disable Firebaseuser(%s)", firebaseID))
-		log.Error(err)
-		return nil, err
-	}
-
-	dbClient, err := FirebaseDatabaseClientFromContext(ctx)
+	// the deletion is persisted before any step, so that disabling the Firebase user, the token revocation, the Firebase user deletion and the request to delete the member in DB are retried until they succeed. The deletion audits its outcome when it's confirmed or fails
+	_, err := r.Deletions.Start(ctx, firebaseID)
 	if err != nil {
-		errors.WithMessage(err, "can't get FirebaseDatabaseClient from context")
+		err = errors.WithMessagef(err, "Failed to start the deletion of member(%s)", firebaseID)
 		log.Error(err)
 		return nil, err
 	}
 
-	// delete Firebase user and request to disable member in DB concurrently
-	// use context.Background() so that the "delete member" can finish without interuption
-	go func() {
-		err = member.Delete(context.Background(), r.Conf, client, dbClient, firebaseID)
-		if err != nil {
-			err = errors.WithMessagef(err, "Failed to delete Firebase User(%s) or publish to delete the member", firebaseID)
-			log.Error(err)
-		}
-	}()
-
 	Success := true
-	log.Infof("Successfully disable the Firebase user(%s)", firebaseID)
+	log.Infof("Successfully start the deletion of member(%s)", firebaseID)
 	return &model.DeleteMember{
 		Success: &Success,
 	}, err
 }
 
 func (r *mutationResolver) VerifyMember(ctx context.Context, token string) (*model.VerifyAccount, error) {
-	panic(fmt.Errorf("not implemented"))
+
+	// Ask User service to verify the email of the member
+	var verifyMember *model.VerifyAccount
+	err := r.Forwarder.Forward(ctx, &verifyMember)
+
+	checkAndPrintGraphQLError(logger.WithField("mutation", "VerifyMember"), err)
+	// the token is verified for the member who is signed in, and the success is only known if it's selected
+	firebaseID := firebaseIDFromContext(ctx)
+	verified := err == nil && verifyMember != nil && verifyMember.Success != nil && *verifyMember.Success
+	outcome, reason := audit.Outcome(err)
+	if err == nil && !verified {
+		outcome, reason = audit.OutcomeFailure, "the email is not verified"
+	}
+	r.Auditor.Record(ctx, audit.Event{
+		Operation: audit.OpMemberVerifyEmail,
+		Target:    firebaseID,
+		Outcome:   outcome,
+		Reason:    reason,
+	})
+	if verified && firebaseID != "" {
+		r.Events.Publish(ctx, member.ActionEmailVerified, firebaseID, nil)
+	}
+
+	return verifyMember, err
 }
 
 func (r *mutationResolver) ArchiveAccount(ctx context.Context, password string) (*model.ArchiveAccount, error) {
@@ -189,35 +166,14 @@ func (r *mutationResolver) RevokeToken(ctx context.Context, refreshToken string)
 }
 
 func (r *queryResolver) Member(ctx context.Context, firebaseID string) (*model.Member, error) {
-	if _, err := r.IsRequestMatchingRequesterFirebaseID(ctx, firebaseID); err != nil {
-		return nil, err
-	}
-
-	preloads := GetPreloads(ctx)
 
-	// Construct GraphQL Query
-	preGQL := []string{"query ($firebaseId: String!) {", "member(firebaseId: $firebaseId) {"}
-
-	fieldsOnly := Map(preloads, func(s string) string {
-		ns := strings.Split(s, ".")
-		return ns[len(ns)-1]
-	})
-
-	preGQL = append(preGQL, fieldsOnly...)
-	preGQL = append(preGQL, "}", "}")
-	gql := strings.Join(preGQL, "\n")
-
-	// Do the query
-	req := graphql.NewRequest(gql)
-	req.Var("firebaseId", firebaseID)
-	var member struct {
-		Member *model.Member `json:"member"`
-	}
-	err := r.Client.Run(ctx, req, &member)
+	// Ask User service for the member
+	var member *model.Member
+	err := r.Forwarder.Forward(ctx, &member)
 
 	checkAndPrintGraphQLError(logger.WithField("query", "Member"), err)
 
-	return member.Member, err
+	return member, err
 }
 
 // Mutation returns generated.MutationResolver implementation.
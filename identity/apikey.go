@@ -0,0 +1,149 @@
+package identity
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+
+	"github.com/mirror-media/mm-apigateway/apikey"
+	"github.com/mirror-media/mm-apigateway/config"
+	"github.com/mirror-media/mm-apigateway/token"
+)
+
+type staticKey struct {
+	digest [sha256.Size]byte
+	config.StaticAPIKey
+}
+
+// StaticAPIKeys authenticates the server to server clients by the configured keys in the X-API-Key header
+type StaticAPIKeys struct {
+	keys []staticKey
+}
+
+// NewStaticAPIKeys creates the authenticator of the keys
+func NewStaticAPIKeys(keys []config.StaticAPIKey) (*StaticAPIKeys, error) {
+	a := &StaticAPIKeys{}
+	for _, k := range keys {
+		if k.Name == "" || k.Key == "" {
+			return nil, errors.New("a static API key needs a name and a key")
+		}
+		a.keys = append(a.keys, staticKey{
+			digest:       sha256.Sum256([]byte(k.Key)),
+			StaticAPIKey: k,
+		})
+	}
+	return a, nil
+}
+
+// Accepts the requests with an API key
+func (a *StaticAPIKeys) Accepts(r *http.Request, issuer string) bool {
+	return r.Header.Get(APIKeyHeader) != ""
+}
+
+// NewToken looks the key up. The digests are compared in constant time
+func (a *StaticAPIKeys) NewToken(r *http.Request) (Authenticated, error) {
+	key := r.Header.Get(APIKeyHeader)
+	digest := sha256.Sum256([]byte(key))
+	t := &apiKeyToken{
+		key:   key,
+		state: token.StateInvalid,
+	}
+	for _, k := range a.keys {
+		if subtle.ConstantTimeCompare(digest[:], k.digest[:]) == 1 {
+			t.state = token.OK
+			t.principal = &Principal{
+				Subject:  k.Name,
+				Provider: ProviderAPIKey,
+				Roles:    k.Roles,
+			}
+			if len(k.Scopes) > 0 {
+				t.principal.Scopes = k.Scopes
+			}
+		}
+	}
+	if t.state != token.OK {
+		t.detail = "unknown API key"
+	}
+	return t, nil
+}
+
+// ManagedAPIKeys authenticates the API keys managed with the admin api
+type ManagedAPIKeys struct {
+	Manager *apikey.Manager
+}
+
+// Accepts the requests with an API key in the format of the managed keys
+func (a ManagedAPIKeys) Accepts(r *http.Request, issuer string) bool {
+	return apikey.IsManaged(r.Header.Get(APIKeyHeader))
+}
+
+// NewToken authenticates the key with the store. The principal is the key id, with the scopes and the rate limit of the key
+func (a ManagedAPIKeys) NewToken(r *http.Request) (Authenticated, error) {
+	key := r.Header.Get(APIKeyHeader)
+	t := &apiKeyToken{
+		key: key,
+	}
+	k, err := a.Manager.Authenticate(r.Context(), key)
+	if err != nil {
+		t.state, t.detail = apiKeyStateOf(err), err.Error()
+		return t, nil
+	}
+	t.state = token.OK
+	t.principal = &Principal{
+		Subject:  k.ID,
+		Provider: ProviderAPIKey,
+		Claims: map[string]interface{}{
+			"name": k.Name,
+		},
+		Scopes: k.Scopes,
+	}
+	if k.RateLimit != nil {
+		t.principal.RateLimit = &config.RateLimit{
+			Requests: k.RateLimit.Requests,
+			Window:   k.RateLimit.Window,
+			Burst:    k.RateLimit.Burst,
+		}
+	}
+	return t, nil
+}
+
+// apiKeyStateOf maps the error of the authentication of a managed key to the token state. The key is unverifiable if the store fails
+func apiKeyStateOf(err error) token.State {
+	switch err {
+	case apikey.ErrInvalid:
+		return token.StateInvalid
+	case apikey.ErrRevoked:
+		return token.StateRevoked
+	default:
+		return token.StateUnverifiable
+	}
+}
+
+// apiKeyToken is an API key taken as a token
+type apiKeyToken struct {
+	key       string
+	state     token.State
+	detail    string
+	principal *Principal
+}
+
+func (t *apiKeyToken) ExecuteTokenStateUpdate() error {
+	return nil
+}
+
+func (t *apiKeyToken) GetTokenString() (string, error) {
+	return t.key, nil
+}
+
+func (t *apiKeyToken) GetTokenState() token.State {
+	return t.state
+}
+
+func (t *apiKeyToken) GetTokenDetail() string {
+	return t.detail
+}
+
+func (t *apiKeyToken) GetPrincipal() *Principal {
+	return t.principal
+}
@@ -0,0 +1,47 @@
+package identity
+
+import (
+	"net/http"
+
+	"github.com/mirror-media/mm-apigateway/token"
+)
+
+const firebaseIssuerPrefix = "https://securetoken.google.com/"
+
+// Firebase authenticates the Firebase ID tokens of the project
+type Firebase struct {
+	ProjectID string
+	Verifier  token.IDTokenVerifier
+}
+
+// Accepts the tokens issued by the Firebase project
+func (f Firebase) Accepts(r *http.Request, issuer string) bool {
+	return issuer == firebaseIssuerPrefix+f.ProjectID
+}
+
+// NewToken verifies the bearer token of the request with Firebase. A request without one gets a token in the state StateNotProvided
+func (f Firebase) NewToken(r *http.Request) (Authenticated, error) {
+	t, err := token.NewFirebaseToken(r.Header.Get("Authorization"), f.Verifier)
+	if err != nil {
+		return nil, err
+	}
+	return firebaseToken{t}, nil
+}
+
+type firebaseToken struct {
+	*token.FirebaseToken
+}
+
+// GetPrincipal returns the Firebase user. The roles are in the roles custom claim
+func (t firebaseToken) GetPrincipal() *Principal {
+	idToken := t.GetIDToken()
+	if idToken == nil {
+		return nil
+	}
+	return &Principal{
+		Subject:  idToken.UID,
+		Provider: ProviderFirebase,
+		Roles:    rolesOf(idToken.Claims, DefaultRolesClaim),
+		Claims:   idToken.Claims,
+	}
+}
@@ -0,0 +1,146 @@
+// Package identity picks the authenticator of a request among the identity providers and describes the authenticated principal uniformly
+package identity
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go/v4"
+	"github.com/mirror-media/mm-apigateway/config"
+	"github.com/mirror-media/mm-apigateway/token"
+)
+
+const (
+	ProviderFirebase = "firebase"
+	ProviderAPIKey   = "apikey"
+)
+
+const (
+	// RoleAdmin is granted by the admin custom claim of Firebase as well
+	RoleAdmin = "admin"
+	// RoleStaff is granted by the staff custom claim of Firebase as well, e.g. to the customer support
+	RoleStaff = "staff"
+	// DefaultRolesClaim is the claim listing the roles of a principal
+	DefaultRolesClaim = "roles"
+	// APIKeyHeader is the header of the API key of a server to server client
+	APIKeyHeader = "X-API-Key"
+	bearerSchema = "Bearer "
+)
+
+// Principal is the authenticated requester, independent of the identity provider
+type Principal struct {
+	Subject  string                 `json:"subject"`
+	Provider string                 `json:"provider"`
+	Roles    []string               `json:"roles,omitempty"`
+	Claims   map[string]interface{} `json:"-"`
+	// Scopes are the route groups an API key can call. nil allows every group
+	Scopes []string `json:"scopes,omitempty"`
+	// RateLimit replaces the rate limit of the route groups if it's not nil
+	RateLimit *config.RateLimit `json:"-"`
+}
+
+// String returns the provider and the subject of the principal
+func (p *Principal) String() string {
+	if p == nil {
+		return "anonymous"
+	}
+	return p.Provider + ":" + p.Subject
+}
+
+// HasRole reports whether the principal is granted the role
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsScope reports whether the principal can call the route group
+func (p *Principal) AllowsScope(scope string) bool {
+	if p.Scopes == nil {
+		return true
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticated is a token which knows the principal once it's verified
+type Authenticated interface {
+	token.Token
+	// GetPrincipal returns the principal, nil unless the state is OK
+	GetPrincipal() *Principal
+}
+
+// Authenticator creates the tokens of the requests whose credentials it recognizes
+type Authenticator interface {
+	// Accepts reports whether the credentials of the request are for the authenticator. issuer is the unverified iss of the bearer token, empty if there's none
+	Accepts(r *http.Request, issuer string) bool
+	NewToken(r *http.Request) (Authenticated, error)
+}
+
+// Registry picks the authenticator of a request. The first accepting authenticator is used, or the fallback if none accepts
+type Registry struct {
+	authenticators []Authenticator
+	fallback       Authenticator
+	parser         jwt.Parser
+}
+
+// NewRegistry creates the registry of the authenticators
+func NewRegistry(fallback Authenticator, authenticators ...Authenticator) *Registry {
+	return &Registry{
+		authenticators: authenticators,
+		fallback:       fallback,
+	}
+}
+
+// NewToken creates the token of the request with the authenticator recognizing it
+func (r *Registry) NewToken(req *http.Request) (Authenticated, error) {
+	issuer := ""
+	if s, ok := bearer(req); ok {
+		claims := &jwt.StandardClaims{}
+		if _, _, err := r.parser.ParseUnverified(s, claims); err == nil {
+			issuer = claims.Issuer
+		}
+	}
+	for _, a := range r.authenticators {
+		if a.Accepts(req, issuer) {
+			return a.NewToken(req)
+		}
+	}
+	return r.fallback.NewToken(req)
+}
+
+// bearer returns the bearer token of the request
+func bearer(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, bearerSchema) {
+		return "", false
+	}
+	return h[len(bearerSchema):], true
+}
+
+// rolesOf returns the roles listed in the claim. The admin and staff claims grant RoleAdmin and RoleStaff. Only the claims of the trusted providers are read
+func rolesOf(claims map[string]interface{}, rolesClaim string) (roles []string) {
+	switch v := claims[rolesClaim].(type) {
+	case []interface{}:
+		for _, r := range v {
+			if s, ok := r.(string); ok && s != "" {
+				roles = append(roles, s)
+			}
+		}
+	case string:
+		roles = strings.Fields(v)
+	}
+	for _, role := range []string{RoleAdmin, RoleStaff} {
+		if granted, _ := claims[role].(bool); granted {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
@@ -0,0 +1,176 @@
+package identity
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go/v4"
+	"github.com/mirror-media/mm-apigateway/config"
+	"github.com/mirror-media/mm-apigateway/token"
+)
+
+type fakeAuthenticator struct {
+	issuer string
+	used   int
+}
+
+func (f *fakeAuthenticator) Accepts(r *http.Request, issuer string) bool {
+	return issuer == f.issuer
+}
+
+func (f *fakeAuthenticator) NewToken(r *http.Request) (Authenticated, error) {
+	f.used++
+	return &apiKeyToken{state: token.OK}, nil
+}
+
+func bearerRequest(t *testing.T, issuer string) *http.Request {
+	s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{Issuer: issuer}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+s)
+	return r
+}
+
+func TestRegistryPicksTheIssuer(t *testing.T) {
+	fallback := &fakeAuthenticator{}
+	oidc := &fakeAuthenticator{issuer: "https://accounts.example.com"}
+	registry := NewRegistry(fallback, oidc)
+
+	if _, err := registry.NewToken(bearerRequest(t, "https://accounts.example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if oidc.used != 1 || fallback.used != 0 {
+		t.Fatalf("the token of the issuer is not created by its authenticator, oidc: %d, fallback: %d", oidc.used, fallback.used)
+	}
+
+	if _, err := registry.NewToken(bearerRequest(t, "https://unknown.example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.NewToken(httptest.NewRequest(http.MethodGet, "/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if oidc.used != 1 || fallback.used != 2 {
+		t.Fatalf("the other tokens are not created by the fallback, oidc: %d, fallback: %d", oidc.used, fallback.used)
+	}
+}
+
+func TestStaticAPIKeys(t *testing.T) {
+	keys, err := NewStaticAPIKeys([]config.StaticAPIKey{{Name: "rss", Key: "k1", Roles: []string{"feed"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := NewRegistry(&fakeAuthenticator{}, keys)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(APIKeyHeader, "k1")
+	tt, err := registry.NewToken(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tt.GetTokenState() != token.OK {
+		t.Fatalf("state of a known key is %s", tt.GetTokenState())
+	}
+	want := &Principal{Subject: "rss", Provider: ProviderAPIKey, Roles: []string{"feed"}}
+	if got := tt.GetPrincipal(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("principal is %+v, want %+v", got, want)
+	}
+
+	r.Header.Set(APIKeyHeader, "k2")
+	if tt, _ = registry.NewToken(r); tt.GetTokenState() != token.StateInvalid || tt.GetPrincipal() != nil {
+		t.Fatalf("an unknown key is in the state %s", tt.GetTokenState())
+	}
+
+	if _, err := NewStaticAPIKeys([]config.StaticAPIKey{{Name: "rss"}}); err == nil {
+		t.Fatal("a key without the key is accepted")
+	}
+}
+
+func TestRolesOf(t *testing.T) {
+	claims := map[string]interface{}{
+		"roles": []interface{}{"editor", "", 1},
+		"admin": true,
+		"scope": "read write",
+	}
+	if got, want := rolesOf(claims, DefaultRolesClaim), []string{"editor", RoleAdmin}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("roles are %v, want %v", got, want)
+	}
+	if got, want := rolesOf(claims, "scope"), []string{"read", "write", RoleAdmin}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("roles are %v, want %v", got, want)
+	}
+}
+
+// newTestIssuer serves the JWKS of a RSA key and returns the function signing the tokens with it
+func newTestIssuer(t *testing.T) (string, func(claims jwt.MapClaims) string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": "k1",
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	t.Cleanup(jwks.Close)
+	return jwks.URL, func(claims jwt.MapClaims) string {
+		tk := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		tk.Header["kid"] = "k1"
+		s, err := tk.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+}
+
+func TestOIDCTrustsRolesOnlyIfConfigured(t *testing.T) {
+	jwksURL, sign := newTestIssuer(t)
+	provider := config.OIDCProvider{Name: "partner", Issuer: "https://partner.example.com", JWKSURL: jwksURL, Audience: "mm"}
+	s := sign(jwt.MapClaims{"iss": provider.Issuer, "aud": "mm", "sub": "p1", "admin": true, "roles": []string{"staff"}})
+
+	for _, trust := range []bool{false, true} {
+		provider.TrustRoles = trust
+		oidc, err := NewOIDC(provider)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+s)
+		tk, err := oidc.NewToken(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tk.GetTokenState() != token.OK {
+			t.Fatalf("state is %s: %s", tk.GetTokenState(), tk.GetTokenDetail())
+		}
+		principal := tk.GetPrincipal()
+		if principal.HasRole(RoleAdmin) != trust || principal.HasRole(RoleStaff) != trust {
+			t.Fatalf("roles are %v when the roles are trusted: %v", principal.Roles, trust)
+		}
+	}
+}
+
+func TestOIDCRequiresAnAudience(t *testing.T) {
+	if _, err := NewOIDC(config.OIDCProvider{Name: "partner", Issuer: "https://partner.example.com", JWKSURL: "https://partner.example.com/jwks"}); err == nil {
+		t.Fatal("a provider without an audience is accepted")
+	}
+}
+
+func TestOIDCRejectsReservedNames(t *testing.T) {
+	for _, name := range []string{ProviderFirebase, ProviderAPIKey} {
+		if _, err := NewOIDC(config.OIDCProvider{Name: name, Issuer: "https://partner.example.com", JWKSURL: "https://partner.example.com/jwks", Audience: "mm-apigateway"}); err == nil {
+			t.Errorf("a provider named %s is accepted", name)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/dgrijalva/jwt-go/v4"
+	"github.com/mirror-media/mm-apigateway/config"
+	"github.com/mirror-media/mm-apigateway/token"
+)
+
+// OIDC authenticates the ID tokens of a generic OpenID Connect provider against the keys of its JWKS
+type OIDC struct {
+	name       string
+	issuer     string
+	rolesClaim string
+	trustRoles bool
+	verifier   *token.Verifier
+}
+
+// NewOIDC creates the authenticator of the provider. The audience is required, otherwise the tokens the issuer made for any client would be accepted. The names of the built-in providers are reserved, otherwise its principals would be taken as Firebase users or API keys
+func NewOIDC(c config.OIDCProvider) (*OIDC, error) {
+	if c.Name == "" || c.Issuer == "" || c.JWKSURL == "" || c.Audience == "" {
+		return nil, errors.New("an OIDC provider needs a name, an issuer, a JWKS URL and an audience")
+	}
+	if c.Name == ProviderFirebase || c.Name == ProviderAPIKey {
+		return nil, fmt.Errorf("the name %s is reserved for the built-in provider", c.Name)
+	}
+	rolesClaim := c.RolesClaim
+	if rolesClaim == "" {
+		rolesClaim = DefaultRolesClaim
+	}
+	return &OIDC{
+		name:       c.Name,
+		issuer:     c.Issuer,
+		rolesClaim: rolesClaim,
+		trustRoles: c.TrustRoles,
+		verifier: token.NewVerifier(token.NewJWKS(c.JWKSURL).Keyfunc, token.VerifyOptions{
+			Issuer:   c.Issuer,
+			Audience: c.Audience,
+		}),
+	}, nil
+}
+
+// Accepts the tokens issued by the provider
+func (o *OIDC) Accepts(r *http.Request, issuer string) bool {
+	return issuer == o.issuer
+}
+
+// NewToken verifies the bearer token of the request
+func (o *OIDC) NewToken(r *http.Request) (Authenticated, error) {
+	t := &oidcToken{}
+	s, ok := bearer(r)
+	if !ok {
+		t.state = token.StateNotBearer
+		return t, nil
+	}
+	t.tokenString = s
+	claims := jwt.MapClaims{}
+	err := o.verifier.Verify(s, claims)
+	t.state = token.StateOf(err)
+	if err != nil {
+		t.detail = err.Error()
+		return t, nil
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		t.state, t.detail = token.StateInvalid, "token has an empty sub"
+		return t, nil
+	}
+	t.principal = &Principal{
+		Subject:  subject,
+		Provider: o.name,
+		Claims:   claims,
+	}
+	// the roles of a third party provider would grant the gateway roles, e.g. admin
+	if o.trustRoles {
+		t.principal.Roles = rolesOf(claims, o.rolesClaim)
+	}
+	return t, nil
+}
+
+// oidcToken is verified when it's created
+type oidcToken struct {
+	tokenString string
+	state       token.State
+	detail      string
+	principal   *Principal
+}
+
+func (t *oidcToken) ExecuteTokenStateUpdate() error {
+	return nil
+}
+
+func (t *oidcToken) GetTokenString() (string, error) {
+	if t.tokenString == "" {
+		return "", errors.New("token is nil")
+	}
+	return t.tokenString, nil
+}
+
+func (t *oidcToken) GetTokenState() token.State {
+	return t.state
+}
+
+func (t *oidcToken) GetTokenDetail() string {
+	return t.detail
+}
+
+func (t *oidcToken) GetPrincipal() *Principal {
+	return t.principal
+}
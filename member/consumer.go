@@ -0,0 +1,246 @@
+package member
+
+import (
+	"context"
+	"expvar"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mirror-media/mm-apigateway/messaging"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Attributes added to the dead-lettered messages
+const (
+	MsgAttrKeyDeliveryAttempts = "deliveryAttempts"
+	MsgAttrKeyLastError        = "lastError"
+)
+
+// consumerMetrics are published by expvar as memberConsumer
+var (
+	consumerMetrics = expvar.NewMap("memberConsumer")
+	lagMillis       = new(expvar.Int)
+	maxLagMillis    = new(expvar.Int)
+)
+
+func init() {
+	consumerMetrics.Set(metricLagMillis, lagMillis)
+	consumerMetrics.Set(metricMaxLagMillis, maxLagMillis)
+}
+
+// Keys of the consumer metrics
+const (
+	metricReceived     = "received"
+	metricSucceeded    = "succeeded"
+	metricFailed       = "failed"
+	metricDeadLettered = "deadLettered"
+	metricInFlight     = "inFlight"
+	metricRestarts     = "restarts"
+	metricLagMillis    = "lagMillis"
+	metricMaxLagMillis = "maxLagMillis"
+)
+
+// ConsumerOptions tunes the concurrency, the retries and the dead-lettering of a Consumer
+type ConsumerOptions struct {
+	Concurrency     int           // messages handled at the same time, default 10
+	MaxAttempts     int           // deliveries of a failing message before it's dead-lettered, default 5
+	DeadLetterTopic string        // failed messages are nacked forever if it's empty
+	RetryBase       time.Duration // delay of the redelivery of a nacked message, doubled for every delivery, default 1s
+	RetryMax        time.Duration // default 1m
+}
+
+// localAttemptsTTL is how long the deliveries of a message counted locally are kept without another delivery, e.g. because the message is redelivered to another replica
+const localAttemptsTTL = time.Hour
+
+// permanentError is an error which won't go away by retrying the message
+type permanentError struct {
+	error
+}
+
+// Permanent marks the error of a message which should be dead-lettered without retrying
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+// Consumer receives the messages of a subscription for the life of the context. A failed message is nacked with a backoff delay, and it's dead-lettered once it has been delivered MaxAttempts times
+type Consumer struct {
+	broker       messaging.Broker
+	subscription string
+	handle       func(ctx context.Context, msg *messaging.Message) error
+	opts         ConsumerOptions
+	now          func() time.Time
+
+	// attempts counts the deliveries when the broker doesn't count them
+	mu        sync.Mutex
+	attempts  map[string]localAttempts
+	lastPrune time.Time
+}
+
+type localAttempts struct {
+	count     int
+	delivered time.Time
+}
+
+// NewConsumer creates the consumer of the subscription. The dead-letter topic, if any, is published with the same broker
+func NewConsumer(broker messaging.Broker, subscription string, handle func(ctx context.Context, msg *messaging.Message) error, opts ConsumerOptions) *Consumer {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 10
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 5
+	}
+	if opts.RetryBase <= 0 {
+		opts.RetryBase = time.Second
+	}
+	if opts.RetryMax <= 0 {
+		opts.RetryMax = time.Minute
+	}
+	return &Consumer{
+		broker:       broker,
+		subscription: subscription,
+		handle:       handle,
+		opts:         opts,
+		now:          time.Now,
+		attempts:     make(map[string]localAttempts),
+	}
+}
+
+// Run receives the messages until the context is done. Receive is restarted with a backoff when it stops with an error
+func (c *Consumer) Run(ctx context.Context) error {
+	for restarts := 0; ; restarts++ {
+		log.Infof("Pulling subscription: %s", c.subscription)
+		err := c.broker.Receive(ctx, c.subscription, c.opts.Concurrency, c.process)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		consumerMetrics.Add(metricRestarts, 1)
+		delay := backoff(c.opts.RetryBase, c.opts.RetryMax, restarts+1)
+		log.Errorf("receiving subscription(%s) stopped, restart in %s: %v", c.subscription, delay, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// process handles the message and returns whether to ack it. A failed message is nacked with the backoff of its delivery as the delay of the redelivery, so that it doesn't hold a slot of the concurrency meanwhile. It's acked once it's dead-lettered
+func (c *Consumer) process(ctx context.Context, msg *messaging.Message) bool {
+	consumerMetrics.Add(metricReceived, 1)
+	consumerMetrics.Add(metricInFlight, 1)
+	defer consumerMetrics.Add(metricInFlight, -1)
+	if !msg.PublishTime.IsZero() {
+		// lag is how long the message waited for the consumer
+		lag := c.now().Sub(msg.PublishTime).Milliseconds()
+		lagMillis.Set(lag)
+		c.mu.Lock()
+		if maxLagMillis.Value() < lag {
+			maxLagMillis.Set(lag)
+		}
+		c.mu.Unlock()
+	}
+
+	err := c.handle(ctx, msg)
+	attempts := c.deliveryAttempt(msg, err == nil)
+	if err == nil {
+		consumerMetrics.Add(metricSucceeded, 1)
+		return true
+	}
+	consumerMetrics.Add(metricFailed, 1)
+	logger := log.WithFields(log.Fields{
+		"subscription": c.subscription,
+		"messageId":    msg.ID,
+		"attempts":     attempts,
+	})
+
+	var permanentErr permanentError
+	permanent := errors.As(err, &permanentErr)
+	if permanent || attempts >= c.opts.MaxAttempts {
+		if c.opts.DeadLetterTopic == "" {
+			if permanent {
+				logger.Errorf("message is dropped because it can't be handled: %v", err)
+				return true
+			}
+			logger.Errorf("message failed and there is no dead-letter topic: %v", err)
+		} else if dlErr := c.deadLetter(ctx, msg, attempts, err); dlErr != nil {
+			logger.Errorf("fail to dead-letter the message which failed with %v: %v", err, dlErr)
+		} else {
+			logger.Errorf("message is dead-lettered to %s: %v", c.opts.DeadLetterTopic, err)
+			consumerMetrics.Add(metricDeadLettered, 1)
+			c.forget(msg)
+			return true
+		}
+	} else {
+		logger.Warnf("message failed: %v", err)
+	}
+
+	msg.NackDelay = backoff(c.opts.RetryBase, c.opts.RetryMax, attempts)
+	return false
+}
+
+// deliveryAttempt returns the delivery attempt of the message, counted by the broker or locally if the broker doesn't count it. The local counts not updated for localAttemptsTTL are forgotten
+func (c *Consumer) deliveryAttempt(msg *messaging.Message, done bool) int {
+	if msg.DeliveryAttempt > 0 {
+		return msg.DeliveryAttempt
+	}
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastPrune) > localAttemptsTTL/10 {
+		c.lastPrune = now
+		for id, a := range c.attempts {
+			if now.Sub(a.delivered) > localAttemptsTTL {
+				delete(c.attempts, id)
+			}
+		}
+	}
+	a := c.attempts[msg.ID]
+	a.count++
+	if done {
+		delete(c.attempts, msg.ID)
+		return a.count
+	}
+	a.delivered = now
+	c.attempts[msg.ID] = a
+	return a.count
+}
+
+func (c *Consumer) forget(msg *messaging.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.attempts, msg.ID)
+}
+
+// deadLetter publishes the message with the attempts and the last error to the dead-letter topic
+func (c *Consumer) deadLetter(ctx context.Context, msg *messaging.Message, attempts int, cause error) error {
+	attributes := make(map[string]string, len(msg.Attributes)+2)
+	for k, v := range msg.Attributes {
+		attributes[k] = v
+	}
+	attributes[MsgAttrKeyDeliveryAttempts] = strconv.Itoa(attempts)
+	attributes[MsgAttrKeyLastError] = cause.Error()
+	publishCTX, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	_, err := c.broker.Publish(publishCTX, c.opts.DeadLetterTopic, &messaging.Message{
+		Data:       msg.Data,
+		Attributes: attributes,
+	})
+	return errors.WithMessagef(err, "fail to dead-letter message(%s)", msg.ID)
+}
+
+// backoff returns the exponential delay of the attempt with a jitter, capped by max
+func backoff(base time.Duration, max time.Duration, attempts int) time.Duration {
+	delay := max
+	if attempts < 32 {
+		if exp := base << uint(attempts-1); exp > 0 && exp < delay {
+			delay = exp
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,153 @@
+package member
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mirror-media/mm-apigateway/messaging"
+)
+
+// newTestConsumer returns the consumer and the subscription of its dead-letter topic
+func newTestConsumer(t *testing.T, handle func(ctx context.Context, msg *messaging.Message) error) (*Consumer, func() []*messaging.Message) {
+	broker := messaging.NewMemory()
+	if err := broker.Subscribe("member-dead-letter", "dead-letter"); err != nil {
+		t.Fatal(err)
+	}
+	c := NewConsumer(broker, "member", handle, ConsumerOptions{
+		MaxAttempts:     3,
+		DeadLetterTopic: "member-dead-letter",
+		RetryBase:       time.Millisecond,
+		RetryMax:        time.Millisecond,
+	})
+	deadLettered := func() []*messaging.Message {
+		var msgs []*messaging.Message
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		broker.Receive(ctx, "dead-letter", 1, func(ctx context.Context, msg *messaging.Message) bool {
+			msgs = append(msgs, msg)
+			return true
+		})
+		return msgs
+	}
+	return c, deadLettered
+}
+
+func TestConsumerDeadLettersAfterMaxAttempts(t *testing.T) {
+	c, deadLettered := newTestConsumer(t, func(ctx context.Context, msg *messaging.Message) error {
+		return errors.New("user service is down")
+	})
+	msg := &messaging.Message{ID: "1", Attributes: map[string]string{MsgAttrKeyAction: MsgAttrValueDelete}}
+
+	for attempt := 1; attempt < 3; attempt++ {
+		if c.process(context.Background(), msg) {
+			t.Fatalf("failed message is acked at attempt %d", attempt)
+		}
+	}
+	if !c.process(context.Background(), msg) {
+		t.Fatal("dead-lettered message is not acked")
+	}
+	dl := deadLettered()
+	if len(dl) != 1 {
+		t.Fatalf("%d messages are dead-lettered", len(dl))
+	}
+	attributes := dl[0].Attributes
+	if attributes[MsgAttrKeyAction] != MsgAttrValueDelete || attributes[MsgAttrKeyDeliveryAttempts] != "3" || attributes[MsgAttrKeyLastError] != "user service is down" {
+		t.Fatalf("dead-lettered attributes are %v", attributes)
+	}
+	if len(c.attempts) != 0 {
+		t.Fatalf("attempts are not forgotten: %v", c.attempts)
+	}
+}
+
+func TestConsumerUsesReportedDeliveryAttempt(t *testing.T) {
+	c, deadLettered := newTestConsumer(t, func(ctx context.Context, msg *messaging.Message) error {
+		return errors.New("user service is down")
+	})
+	if !c.process(context.Background(), &messaging.Message{ID: "1", DeliveryAttempt: 3}) || len(deadLettered()) != 1 {
+		t.Fatal("message delivered for the last time is not dead-lettered")
+	}
+}
+
+func TestConsumerDeadLettersPermanentFailures(t *testing.T) {
+	c, deadLettered := newTestConsumer(t, func(ctx context.Context, msg *messaging.Message) error {
+		return Permanent(errors.New("action(update) is not supported"))
+	})
+	if !c.process(context.Background(), &messaging.Message{ID: "1"}) || len(deadLettered()) != 1 {
+		t.Fatal("permanent failure is retried")
+	}
+
+	wrapped, _ := newTestConsumer(t, func(ctx context.Context, msg *messaging.Message) error {
+		return fmt.Errorf("fail to handle message(%s): %w", msg.ID, Permanent(errors.New("invalid payload")))
+	})
+	if !wrapped.process(context.Background(), &messaging.Message{ID: "1"}) {
+		t.Fatal("wrapped permanent failure is retried")
+	}
+
+	c.opts.DeadLetterTopic = ""
+	if !c.process(context.Background(), &messaging.Message{ID: "2"}) {
+		t.Fatal("permanent failure is retried without a dead-letter topic")
+	}
+}
+
+func TestConsumerSucceeds(t *testing.T) {
+	failures := 1
+	c, deadLettered := newTestConsumer(t, func(ctx context.Context, msg *messaging.Message) error {
+		if failures > 0 {
+			failures--
+			return errors.New("timeout")
+		}
+		return nil
+	})
+	msg := &messaging.Message{ID: "1", PublishTime: time.Now().Add(-time.Second)}
+	if c.process(context.Background(), msg) {
+		t.Fatal("failed message is acked")
+	}
+	if !c.process(context.Background(), msg) {
+		t.Fatal("message is not acked")
+	}
+	if len(deadLettered()) != 0 || len(c.attempts) != 0 {
+		t.Fatalf("succeeded message is dead-lettered or remembered: %v", c.attempts)
+	}
+	if lagMillis.Value() < 1000 {
+		t.Fatalf("lag is %dms", lagMillis.Value())
+	}
+}
+
+func TestConsumerNacksWithTheBackoffAsDelay(t *testing.T) {
+	c, _ := newTestConsumer(t, func(ctx context.Context, msg *messaging.Message) error {
+		return errors.New("user service is down")
+	})
+	c.opts.RetryBase = time.Hour
+	c.opts.RetryMax = time.Hour
+	msg := &messaging.Message{ID: "1"}
+	start := time.Now()
+	if c.process(context.Background(), msg) {
+		t.Fatal("failed message is acked")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("failed message is held for %v", elapsed)
+	}
+	if msg.NackDelay < 30*time.Minute || msg.NackDelay > time.Hour {
+		t.Fatalf("nack delay is %v", msg.NackDelay)
+	}
+}
+
+func TestConsumerForgetsStaleAttempts(t *testing.T) {
+	c, _ := newTestConsumer(t, func(ctx context.Context, msg *messaging.Message) error {
+		return errors.New("user service is down")
+	})
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	// the message is redelivered to another replica after its first delivery here
+	c.process(context.Background(), &messaging.Message{ID: "1"})
+	now = now.Add(localAttemptsTTL / 2)
+	c.process(context.Background(), &messaging.Message{ID: "2"})
+	now = now.Add(localAttemptsTTL/2 + time.Minute)
+	c.process(context.Background(), &messaging.Message{ID: "3"})
+	if _, ok := c.attempts["1"]; ok || len(c.attempts) != 2 {
+		t.Fatalf("attempts are %v", c.attempts)
+	}
+}
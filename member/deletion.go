@@ -0,0 +1,433 @@
+package member
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+	"firebase.google.com/go/v4/db"
+	"github.com/mirror-media/mm-apigateway/audit"
+	"github.com/mirror-media/mm-apigateway/config"
+	"github.com/mirror-media/mm-apigateway/messaging"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DeletionState is the step a member deletion has reached
+type DeletionState string
+
+// States of a member deletion, in order
+const (
+	DeletionRequested       DeletionState = "requested"
+	DeletionDisabled        DeletionState = "disabled"
+	DeletionTokensRevoked   DeletionState = "tokensRevoked"
+	DeletionFirebaseDeleted DeletionState = "firebaseDeleted"
+	DeletionPublished       DeletionState = "deletePublished"
+	DeletionConfirmed       DeletionState = "confirmed"
+	// DeletionRestored ends a deletion cancelled before the Firebase user is deleted
+	DeletionRestored DeletionState = "restored"
+)
+
+// Done reports whether the deletion has ended, i.e. it's neither processed nor scheduled anymore
+func (s DeletionState) Done() bool {
+	return s == DeletionConfirmed || s == DeletionRestored
+}
+
+// restorable reports whether the Firebase user still exists, so that the deletion can be cancelled
+func (s DeletionState) restorable() bool {
+	return s == DeletionRequested || s == DeletionDisabled || s == DeletionTokensRevoked
+}
+
+// ErrDeletionNotFound is returned when the member has no deletion
+var ErrDeletionNotFound = errors.New("member deletion not found")
+
+// ErrDeletionNotRestorable is returned when the member can't be restored because its Firebase user is deleted or the deletion is being processed
+var ErrDeletionNotRestorable = errors.New("member deletion can't be restored")
+
+// Deletion is the persisted state of the deletion of a member. Attempts and LastError are of the current state
+type Deletion struct {
+	FirebaseID    string        `json:"firebaseId"`
+	State         DeletionState `json:"state"`
+	Attempts      int           `json:"attempts"`
+	LastError     string        `json:"lastError,omitempty"`
+	NextAttempt   time.Time     `json:"nextAttempt"`
+	RequestID     string        `json:"requestId,omitempty"`
+	Actor         string        `json:"actor,omitempty"`
+	ActorProvider string        `json:"actorProvider,omitempty"`
+	CreatedAt     time.Time     `json:"createdAt"`
+	UpdatedAt     time.Time     `json:"updatedAt"`
+}
+
+// auditRequest returns the requester of the deletion, so that the resumed steps are audited as the request
+func (d *Deletion) auditRequest() audit.Request {
+	return audit.Request{
+		ID:            d.RequestID,
+		Actor:         d.Actor,
+		ActorProvider: d.ActorProvider,
+	}
+}
+
+// DeletionStore persists the deletions and schedules their next attempts
+type DeletionStore interface {
+	Get(ctx context.Context, firebaseID string) (*Deletion, error)
+	// Save saves the deletion and schedules it at NextAttempt. A done deletion is not scheduled
+	Save(ctx context.Context, d *Deletion) error
+	// Due returns the members whose next attempts are due
+	Due(ctx context.Context, now time.Time, limit int) ([]string, error)
+	// Lock prevents the other replicas from processing the deletion. The owner identifies the holder of the lock
+	Lock(ctx context.Context, firebaseID string, owner string, ttl time.Duration) (bool, error)
+	// Unlock removes the lock if it's still held by the owner
+	Unlock(ctx context.Context, firebaseID string, owner string) error
+}
+
+// DeletionActions are the side effects of the steps of a deletion. They have to be idempotent because a step is retried if its state isn't saved
+type DeletionActions interface {
+	DisableUser(ctx context.Context, firebaseID string) error
+	EnableUser(ctx context.Context, firebaseID string) error
+	RevokeTokens(ctx context.Context, firebaseID string) error
+	DeleteFirebaseUser(ctx context.Context, firebaseID string) error
+	PublishDelete(ctx context.Context, firebaseID string) error
+}
+
+// FirebaseDeletionActions disable the user, revoke the tokens and delete the user in Firebase, and publish the deletion of the member in the DB
+type FirebaseDeletionActions struct {
+	Conf      config.Conf
+	Client    *auth.Client
+	DBClient  *db.Client
+	Publisher messaging.Publisher
+	Events    *EventPublisher // nil if PubSubTopicMember is empty
+}
+
+// DisableUser disables the user, so that it can't sign in before it's deleted, and publishes the disabled event
+func (a FirebaseDeletionActions) DisableUser(ctx context.Context, firebaseID string) error {
+	if err := DisableFirebaseUser(ctx, a.Client, firebaseID); err != nil {
+		return err
+	}
+	a.Events.Publish(ctx, ActionDisabled, firebaseID, nil)
+	return nil
+}
+
+// EnableUser enables the user of a cancelled deletion and publishes the restored event
+func (a FirebaseDeletionActions) EnableUser(ctx context.Context, firebaseID string) error {
+	if err := EnableFirebaseUser(ctx, a.Client, firebaseID); err != nil {
+		return err
+	}
+	a.Events.Publish(ctx, ActionRestored, firebaseID, nil)
+	return nil
+}
+
+// RevokeTokens revokes the refresh tokens and saves the revoke time to the Realtime Database
+func (a FirebaseDeletionActions) RevokeTokens(ctx context.Context, firebaseID string) error {
+	return revokeFirebaseToken(ctx, a.Client, a.DBClient, firebaseID)
+}
+
+// DeleteFirebaseUser deletes the user. A user which is already deleted is fine
+func (a FirebaseDeletionActions) DeleteFirebaseUser(ctx context.Context, firebaseID string) error {
+	err := deleteFirebaseUser(ctx, a.Client, firebaseID)
+	if auth.IsUserNotFound(errors.Cause(err)) {
+		return nil
+	}
+	return err
+}
+
+// PublishDelete publishes the message asking to delete the member in the DB
+func (a FirebaseDeletionActions) PublishDelete(ctx context.Context, firebaseID string) error {
+	return publishDeleteMemberMessage(ctx, a.Publisher, a.Conf.PubSubTopicMember, firebaseID)
+}
+
+// DeletionOptions tunes the retries of the deletions
+type DeletionOptions struct {
+	RetryBase      time.Duration // default 5s
+	RetryMax       time.Duration // default 1h
+	ConfirmTimeout time.Duration // the deletion is published again if it's not confirmed in time, default 1h
+	PollInterval   time.Duration // default 10s
+}
+
+type deletionStep struct {
+	next      DeletionState
+	operation string
+	action    func(DeletionActions, context.Context, string) error
+}
+
+// deletionSteps are the transitions of the states. A published deletion is published again when the confirmation times out
+var deletionSteps = map[DeletionState]deletionStep{
+	DeletionRequested:       {DeletionDisabled, audit.OpMemberDisable, DeletionActions.DisableUser},
+	DeletionDisabled:        {DeletionTokensRevoked, audit.OpMemberRevokeTokens, DeletionActions.RevokeTokens},
+	DeletionTokensRevoked:   {DeletionFirebaseDeleted, audit.OpMemberDeleteFirebase, DeletionActions.DeleteFirebaseUser},
+	DeletionFirebaseDeleted: {DeletionPublished, audit.OpMemberPublishDelete, DeletionActions.PublishDelete},
+	DeletionPublished:       {DeletionPublished, audit.OpMemberPublishDelete, DeletionActions.PublishDelete},
+}
+
+const (
+	deletionStepTimeout = 30 * time.Second
+	// deletionLockTTL outlives the steps run in a row by process, i.e. from requested to published
+	deletionLockTTL  = 5 * deletionStepTimeout
+	deletionDueLimit = 100
+)
+
+// Deletions runs the member deletions as a state machine persisted in the store. Every failed step is retried with an exponential backoff, and the unfinished deletions are resumed by Run after a restart
+type Deletions struct {
+	store   DeletionStore
+	actions DeletionActions
+	auditor *audit.Auditor
+	opts    DeletionOptions
+	wake    chan struct{}
+	now     func() time.Time
+}
+
+// NewDeletions creates the workflow of the deletions
+func NewDeletions(store DeletionStore, actions DeletionActions, auditor *audit.Auditor, opts DeletionOptions) *Deletions {
+	if opts.RetryBase <= 0 {
+		opts.RetryBase = 5 * time.Second
+	}
+	if opts.RetryMax <= 0 {
+		opts.RetryMax = time.Hour
+	}
+	if opts.ConfirmTimeout <= 0 {
+		opts.ConfirmTimeout = time.Hour
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 10 * time.Second
+	}
+	return &Deletions{
+		store:   store,
+		actions: actions,
+		auditor: auditor,
+		opts:    opts,
+		wake:    make(chan struct{}, 1),
+		now:     time.Now,
+	}
+}
+
+// Start persists the deletion of the member and wakes Run up to process it, starting with disabling the Firebase user. The existing deletion is returned if the member is being deleted or is deleted, and a restored member is deleted again
+func (d *Deletions) Start(ctx context.Context, firebaseID string) (*Deletion, error) {
+	existing, err := d.store.Get(ctx, firebaseID)
+	if err == nil && existing.State != DeletionRestored {
+		return existing, nil
+	} else if err != nil && err != ErrDeletionNotFound {
+		return nil, err
+	}
+	now := d.now().UTC()
+	r := audit.RequestFrom(ctx)
+	deletion := &Deletion{
+		FirebaseID:    firebaseID,
+		State:         DeletionRequested,
+		NextAttempt:   now,
+		RequestID:     r.ID,
+		Actor:         r.Actor,
+		ActorProvider: r.ActorProvider,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if err = d.store.Save(ctx, deletion); err != nil {
+		err = errors.WithMessagef(err, "fail to save the deletion of member(%s)", firebaseID)
+		d.recordDeletion(ctx, firebaseID, err)
+		return nil, err
+	}
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return deletion, nil
+}
+
+// Get returns the deletion of the member
+func (d *Deletions) Get(ctx context.Context, firebaseID string) (*Deletion, error) {
+	return d.store.Get(ctx, firebaseID)
+}
+
+// Confirm marks the deletion as confirmed once the member is deleted in the DB
+func (d *Deletions) Confirm(ctx context.Context, firebaseID string) error {
+	deletion, err := d.store.Get(ctx, firebaseID)
+	if err != nil {
+		return err
+	}
+	if deletion.State == DeletionConfirmed {
+		return nil
+	}
+	deletion.State = DeletionConfirmed
+	deletion.Attempts, deletion.LastError = 0, ""
+	deletion.UpdatedAt = d.now().UTC()
+	err = d.store.Save(ctx, deletion)
+	outcome, reason := audit.Outcome(err)
+	d.auditor.Record(audit.WithRequest(ctx, deletion.auditRequest()), audit.Event{
+		Operation: audit.OpMemberDeleteConfirmed,
+		Target:    firebaseID,
+		Outcome:   outcome,
+		Reason:    reason,
+	})
+	if err != nil {
+		return errors.WithMessagef(err, "fail to confirm the deletion of member(%s)", firebaseID)
+	}
+	d.recordDeletion(audit.WithRequest(ctx, deletion.auditRequest()), firebaseID, nil)
+	return nil
+}
+
+// Restore cancels the deletion of the member and enables its Firebase user, which is only possible until the Firebase user is deleted. It fails with ErrDeletionNotRestorable if it's too late or the deletion is being processed
+func (d *Deletions) Restore(ctx context.Context, firebaseID string) (err error) {
+	defer func() {
+		outcome, reason := audit.Outcome(err)
+		d.auditor.Record(ctx, audit.Event{
+			Operation: audit.OpMemberRestore,
+			Target:    firebaseID,
+			Outcome:   outcome,
+			Reason:    reason,
+		})
+	}()
+	owner, err := lockOwner()
+	if err != nil {
+		return err
+	}
+	locked, err := d.store.Lock(ctx, firebaseID, owner, deletionLockTTL)
+	if err != nil {
+		return err
+	} else if !locked {
+		return errors.WithMessagef(ErrDeletionNotRestorable, "deletion of member(%s) is being processed", firebaseID)
+	}
+	defer func() {
+		if err := d.store.Unlock(ctx, firebaseID, owner); err != nil {
+			log.Warn(err)
+		}
+	}()
+
+	deletion, err := d.store.Get(ctx, firebaseID)
+	if err != nil {
+		return err
+	}
+	if deletion.State == DeletionRestored {
+		return nil
+	}
+	if !deletion.State.restorable() {
+		return errors.WithMessagef(ErrDeletionNotRestorable, "deletion of member(%s) is %s", firebaseID, deletion.State)
+	}
+	stepCTX, cancel := context.WithTimeout(ctx, deletionStepTimeout)
+	defer cancel()
+	if err = d.actions.EnableUser(stepCTX, firebaseID); err != nil {
+		return err
+	}
+	deletion.State = DeletionRestored
+	deletion.Attempts, deletion.LastError = 0, ""
+	deletion.UpdatedAt = d.now().UTC()
+	return errors.WithMessagef(d.store.Save(ctx, deletion), "fail to restore the deletion of member(%s)", firebaseID)
+}
+
+// recordDeletion audits the outcome of the whole deletion, which fails if it can't be started or resumed, and succeeds once it's confirmed
+func (d *Deletions) recordDeletion(ctx context.Context, firebaseID string, err error) {
+	outcome, reason := audit.Outcome(err)
+	d.auditor.Record(ctx, audit.Event{
+		Operation: audit.OpMemberDelete,
+		Target:    firebaseID,
+		Outcome:   outcome,
+		Reason:    reason,
+	})
+}
+
+// Run processes the due deletions until the context is done, starting with the ones left by the previous run
+func (d *Deletions) Run(ctx context.Context) error {
+	ticker := time.NewTicker(d.opts.PollInterval)
+	defer ticker.Stop()
+	for {
+		d.processDue(ctx)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+func (d *Deletions) processDue(ctx context.Context) {
+	ids, err := d.store.Due(ctx, d.now(), deletionDueLimit)
+	if err != nil {
+		log.Errorf("fail to read the due member deletions: %v", err)
+		return
+	}
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := d.process(ctx, id); err != nil {
+			log.Errorf("processing the deletion of member(%s) encountered error: %v", id, err)
+		}
+	}
+}
+
+// process advances the deletion until it's published or a step fails, which is scheduled to be retried
+func (d *Deletions) process(ctx context.Context, firebaseID string) error {
+	owner, err := lockOwner()
+	if err != nil {
+		return err
+	}
+	locked, err := d.store.Lock(ctx, firebaseID, owner, deletionLockTTL)
+	if err != nil || !locked {
+		return err
+	}
+	defer func() {
+		if err := d.store.Unlock(ctx, firebaseID, owner); err != nil {
+			log.Warn(err)
+		}
+	}()
+
+	deletion, err := d.store.Get(ctx, firebaseID)
+	if err != nil {
+		return err
+	}
+	if deletion.State.Done() || deletion.NextAttempt.After(d.now()) {
+		return nil
+	}
+	actx := audit.WithRequest(ctx, deletion.auditRequest())
+	for {
+		step, ok := deletionSteps[deletion.State]
+		if !ok {
+			err = errors.Errorf("deletion of member(%s) has an unknown state(%s)", firebaseID, deletion.State)
+			d.recordDeletion(actx, firebaseID, err)
+			return err
+		}
+		stepCTX, cancel := context.WithTimeout(actx, deletionStepTimeout)
+		err = step.action(d.actions, stepCTX, firebaseID)
+		cancel()
+		outcome, reason := audit.Outcome(err)
+		d.auditor.Record(actx, audit.Event{
+			Operation: step.operation,
+			Target:    firebaseID,
+			Outcome:   outcome,
+			Reason:    reason,
+		})
+
+		now := d.now().UTC()
+		deletion.UpdatedAt = now
+		if err != nil {
+			deletion.Attempts++
+			deletion.LastError = err.Error()
+			deletion.NextAttempt = now.Add(d.backoff(deletion.Attempts))
+			log.WithField("firebaseId", firebaseID).Warnf("deletion step of %s failed %d times, retry at %s: %v", deletion.State, deletion.Attempts, deletion.NextAttempt, err)
+			return d.store.Save(ctx, deletion)
+		}
+		deletion.State = step.next
+		deletion.Attempts, deletion.LastError = 0, ""
+		if deletion.State == DeletionPublished {
+			deletion.NextAttempt = now.Add(d.opts.ConfirmTimeout)
+			return d.store.Save(ctx, deletion)
+		}
+		if err = d.store.Save(ctx, deletion); err != nil {
+			return err
+		}
+	}
+}
+
+// lockOwner returns a random owner of a lock
+func lockOwner() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "fail to generate the owner of a lock")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// backoff returns the exponential delay of the attempt with a jitter, capped by RetryMax
+func (d *Deletions) backoff(attempts int) time.Duration {
+	return backoff(d.opts.RetryBase, d.opts.RetryMax, attempts)
+}
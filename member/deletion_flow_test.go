@@ -0,0 +1,131 @@
+package member
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/machinebox/graphql"
+	"github.com/mirror-media/mm-apigateway/audit"
+	"github.com/mirror-media/mm-apigateway/config"
+	"github.com/mirror-media/mm-apigateway/messaging"
+)
+
+// localDeletionActions publishes with the broker of FirebaseDeletionActions, but doesn't call Firebase
+type localDeletionActions struct {
+	FirebaseDeletionActions
+}
+
+func (a localDeletionActions) DisableUser(ctx context.Context, firebaseID string) error {
+	a.Events.Publish(ctx, ActionDisabled, firebaseID, nil)
+	return nil
+}
+
+func (a localDeletionActions) RevokeTokens(ctx context.Context, firebaseID string) error {
+	return nil
+}
+
+func (a localDeletionActions) DeleteFirebaseUser(ctx context.Context, firebaseID string) error {
+	return nil
+}
+
+// TestDeleteFlow deletes a member from the start of the deletion to its confirmation through the in-memory broker. The user service fails once
+func TestDeleteFlow(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	userService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, string(body))
+		failed := len(requests) == 1
+		mu.Unlock()
+		if failed {
+			w.Write([]byte(`{"errors":[{"message":"db is down"}]}`))
+			return
+		}
+		w.Write([]byte(`{"data":{"deleteMember":{"success":true}}}`))
+	}))
+	defer userService.Close()
+
+	broker := messaging.NewMemory()
+	for _, subscription := range []string{"member-gateway", "member-crm"} {
+		if err := broker.Subscribe("member", subscription); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf := config.Conf{
+		PubSubTopicMember:     "member",
+		PubSubSubscribeMember: "member-gateway",
+	}
+	store := newMemoryDeletionStore()
+	events := NewEventPublisher(broker, conf.PubSubTopicMember, nil)
+	deletions := NewDeletions(store, localDeletionActions{FirebaseDeletionActions{Conf: conf, Publisher: broker, Events: events}}, nil, DeletionOptions{
+		PollInterval: 10 * time.Millisecond,
+	})
+	bus := NewEventBus()
+	bus.Handle(MsgAttrValueDelete, DeleteMemberHandler(graphql.NewClient(userService.URL), deletions, events))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go deletions.Run(ctx)
+	go SubscribeMemberEvents(ctx, conf, broker, bus)
+
+	requestCTX := audit.WithRequest(context.Background(), audit.Request{ID: "req-1", Actor: "admin-uid"})
+	if _, err := deletions.Start(requestCTX, "uid"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deletion, err := deletions.Get(ctx, "uid")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deletion.State == DeletionConfirmed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("deletion is not confirmed: %+v", deletion)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	events.Close()
+
+	mu.Lock()
+	if len(requests) != 2 || !strings.Contains(requests[1], "deleteMember") || !strings.Contains(requests[1], `"firebaseId":"uid"`) {
+		t.Fatalf("user service received %v", requests)
+	}
+	mu.Unlock()
+
+	// the other subscribers receive the disabled event, the request of the deletion and the deleted event
+	var received []Event
+	receiveCTX, cancelReceive := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelReceive()
+	broker.Receive(receiveCTX, "member-crm", 1, func(ctx context.Context, msg *messaging.Message) bool {
+		e, err := EventFromMessage(msg)
+		if err != nil {
+			t.Error(err)
+		}
+		received = append(received, e)
+		return true
+	})
+	// the events are published asynchronously
+	actions := make([]string, 0, len(received))
+	for _, e := range received {
+		actions = append(actions, e.Action)
+	}
+	sort.Strings(actions)
+	if strings.Join(actions, " ") != strings.Join([]string{MsgAttrValueDelete, ActionDeleted, ActionDisabled}, " ") {
+		t.Fatalf("received events are %+v", received)
+	}
+	for _, e := range received {
+		if e.FirebaseID != "uid" || e.RequestID != "req-1" || e.Actor != "admin-uid" {
+			t.Fatalf("event is not of the request: %+v", e)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package member
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+const deletionNamespace = "mm-apigateway.deletion"
+
+// unlockScript deletes the lock of KEYS[1] if its owner is ARGV[1], so that an expired lock taken by another replica isn't removed
+const unlockScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`
+
+// Rediser is the part of a redis client used by RedisDeletionStore
+type Rediser interface {
+	Get(ctx context.Context, key string) *redis.StringCmd
+	Set(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.StatusCmd
+	SetNX(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.BoolCmd
+	Del(ctx context.Context, keys ...string) *redis.IntCmd
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd
+	ZAdd(ctx context.Context, key string, members ...*redis.Z) *redis.IntCmd
+	ZRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd
+	ZRangeByScore(ctx context.Context, key string, opt *redis.ZRangeBy) *redis.StringSliceCmd
+}
+
+// RedisDeletionStore keeps every deletion in a redis string and schedules the unconfirmed ones in a sorted set by the next attempt
+type RedisDeletionStore struct {
+	Rdb Rediser
+	// Retention is how long a confirmed deletion is kept for the status query, default 30 days
+	Retention time.Duration
+}
+
+func deletionKey(firebaseID string) string {
+	return fmt.Sprintf("%s.%s", deletionNamespace, firebaseID)
+}
+
+func deletionLockKey(firebaseID string) string {
+	return fmt.Sprintf("%s.lock.%s", deletionNamespace, firebaseID)
+}
+
+func deletionScheduleKey() string {
+	return fmt.Sprintf("%s.schedule", deletionNamespace)
+}
+
+// Get reads the deletion from redis
+func (s RedisDeletionStore) Get(ctx context.Context, firebaseID string) (*Deletion, error) {
+	data, err := s.Rdb.Get(ctx, deletionKey(firebaseID)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrDeletionNotFound
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "fail to read the deletion of member(%s)", firebaseID)
+	}
+	d := &Deletion{}
+	if err = json.Unmarshal(data, d); err != nil {
+		return nil, errors.Wrapf(err, "the deletion of member(%s) is malformed", firebaseID)
+	}
+	return d, nil
+}
+
+// Save writes the deletion and schedules it. A confirmed or restored deletion expires after the retention
+func (s RedisDeletionStore) Save(ctx context.Context, d *Deletion) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return errors.Wrapf(err, "fail to marshal the deletion of member(%s)", d.FirebaseID)
+	}
+	var ttl time.Duration
+	if d.State.Done() {
+		ttl = s.Retention
+		if ttl <= 0 {
+			ttl = 30 * 24 * time.Hour
+		}
+	}
+	if err = s.Rdb.Set(ctx, deletionKey(d.FirebaseID), data, ttl).Err(); err != nil {
+		return errors.Wrapf(err, "fail to write the deletion of member(%s)", d.FirebaseID)
+	}
+	if d.State.Done() {
+		err = s.Rdb.ZRem(ctx, deletionScheduleKey(), d.FirebaseID).Err()
+	} else {
+		err = s.Rdb.ZAdd(ctx, deletionScheduleKey(), &redis.Z{
+			Score:  float64(d.NextAttempt.UnixNano() / int64(time.Millisecond)),
+			Member: d.FirebaseID,
+		}).Err()
+	}
+	return errors.Wrapf(err, "fail to schedule the deletion of member(%s)", d.FirebaseID)
+}
+
+// Due returns the members scheduled before now
+func (s RedisDeletionStore) Due(ctx context.Context, now time.Time, limit int) ([]string, error) {
+	ids, err := s.Rdb.ZRangeByScore(ctx, deletionScheduleKey(), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10),
+		Count: int64(limit),
+	}).Result()
+	return ids, errors.Wrap(err, "fail to read the deletion schedule")
+}
+
+// Lock sets the lock of the deletion to the owner if it's not set
+func (s RedisDeletionStore) Lock(ctx context.Context, firebaseID string, owner string, ttl time.Duration) (bool, error) {
+	ok, err := s.Rdb.SetNX(ctx, deletionLockKey(firebaseID), owner, ttl).Result()
+	return ok, errors.Wrapf(err, "fail to lock the deletion of member(%s)", firebaseID)
+}
+
+// Unlock removes the lock of the deletion if it's held by the owner
+func (s RedisDeletionStore) Unlock(ctx context.Context, firebaseID string, owner string) error {
+	err := s.Rdb.Eval(ctx, unlockScript, []string{deletionLockKey(firebaseID)}, owner).Err()
+	return errors.Wrapf(err, "fail to unlock the deletion of member(%s)", firebaseID)
+}
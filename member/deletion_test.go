@@ -0,0 +1,291 @@
+package member
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/mirror-media/mm-apigateway/audit"
+)
+
+type memoryDeletionStore struct {
+	mu        sync.Mutex
+	deletions map[string]Deletion
+	locks     map[string]string
+}
+
+func newMemoryDeletionStore() *memoryDeletionStore {
+	return &memoryDeletionStore{
+		deletions: make(map[string]Deletion),
+		locks:     make(map[string]string),
+	}
+}
+
+func (s *memoryDeletionStore) Get(ctx context.Context, firebaseID string) (*Deletion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.deletions[firebaseID]
+	if !ok {
+		return nil, ErrDeletionNotFound
+	}
+	return &d, nil
+}
+
+func (s *memoryDeletionStore) Save(ctx context.Context, d *Deletion) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deletions[d.FirebaseID] = *d
+	return nil
+}
+
+func (s *memoryDeletionStore) Due(ctx context.Context, now time.Time, limit int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id, d := range s.deletions {
+		if !d.State.Done() && !d.NextAttempt.After(now) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *memoryDeletionStore) Lock(ctx context.Context, firebaseID string, owner string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.locks[firebaseID]; ok {
+		return false, nil
+	}
+	s.locks[firebaseID] = owner
+	return true, nil
+}
+
+func (s *memoryDeletionStore) Unlock(ctx context.Context, firebaseID string, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locks[firebaseID] == owner {
+		delete(s.locks, firebaseID)
+	}
+	return nil
+}
+
+type fakeDeletionActions struct {
+	calls    []string
+	failures map[string]int
+}
+
+func (f *fakeDeletionActions) do(action string) error {
+	f.calls = append(f.calls, action)
+	if f.failures[action] > 0 {
+		f.failures[action]--
+		return errors.New(action + " failed")
+	}
+	return nil
+}
+
+func (f *fakeDeletionActions) DisableUser(ctx context.Context, firebaseID string) error {
+	return f.do("disable")
+}
+
+func (f *fakeDeletionActions) EnableUser(ctx context.Context, firebaseID string) error {
+	return f.do("enable")
+}
+
+func (f *fakeDeletionActions) RevokeTokens(ctx context.Context, firebaseID string) error {
+	return f.do("revoke")
+}
+
+func (f *fakeDeletionActions) DeleteFirebaseUser(ctx context.Context, firebaseID string) error {
+	return f.do("delete")
+}
+
+func (f *fakeDeletionActions) PublishDelete(ctx context.Context, firebaseID string) error {
+	return f.do("publish")
+}
+
+type eventSink struct {
+	events []audit.Event
+}
+
+func (s *eventSink) Write(ctx context.Context, e audit.Event) error {
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *eventSink) Close() error {
+	return nil
+}
+
+func TestDeletionIsRetriedAndResumed(t *testing.T) {
+	ctx := audit.WithRequest(context.Background(), audit.Request{ID: "req-1", Actor: "admin-uid"})
+	store := newMemoryDeletionStore()
+	actions := &fakeDeletionActions{failures: map[string]int{"delete": 2}}
+	sink := &eventSink{}
+	now := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	d := NewDeletions(store, actions, audit.New(nil, sink), DeletionOptions{
+		RetryBase:      time.Minute,
+		RetryMax:       time.Hour,
+		ConfirmTimeout: 2 * time.Hour,
+	})
+	d.now = func() time.Time { return now }
+
+	if _, err := d.Start(ctx, "uid"); err != nil {
+		t.Fatal(err)
+	}
+	d.processDue(context.Background())
+	deletion, _ := store.Get(ctx, "uid")
+	if deletion.State != DeletionTokensRevoked || deletion.Attempts != 1 || deletion.LastError == "" {
+		t.Fatalf("a failed step is not scheduled to be retried: %+v", deletion)
+	}
+	if delay := deletion.NextAttempt.Sub(now); delay < 30*time.Second || delay > time.Minute {
+		t.Fatalf("first retry is in %s", delay)
+	}
+
+	// nothing is due before the retry
+	d.processDue(context.Background())
+	if len(actions.calls) != 3 {
+		t.Fatalf("actions are called before the retry: %v", actions.calls)
+	}
+
+	// a new instance resumes the deletion from the store
+	resumed := NewDeletions(store, actions, audit.New(nil, sink), d.opts)
+	now = now.Add(time.Minute)
+	resumed.now = func() time.Time { return now }
+	resumed.processDue(context.Background())
+	deletion, _ = store.Get(ctx, "uid")
+	if deletion.Attempts != 2 {
+		t.Fatalf("second failure is not counted: %+v", deletion)
+	}
+	if delay := deletion.NextAttempt.Sub(now); delay < time.Minute || delay > 2*time.Minute {
+		t.Fatalf("second retry is in %s", delay)
+	}
+
+	now = now.Add(2 * time.Minute)
+	resumed.processDue(context.Background())
+	deletion, _ = store.Get(ctx, "uid")
+	if deletion.State != DeletionPublished || deletion.Attempts != 0 || !deletion.NextAttempt.Equal(now.Add(2*time.Hour)) {
+		t.Fatalf("deletion is not published: %+v", deletion)
+	}
+
+	// the deletion is published again if it's not confirmed in time
+	now = now.Add(2 * time.Hour)
+	resumed.processDue(context.Background())
+	if err := resumed.Confirm(context.Background(), "uid"); err != nil {
+		t.Fatal(err)
+	}
+	deletion, _ = store.Get(ctx, "uid")
+	if deletion.State != DeletionConfirmed {
+		t.Fatalf("deletion is not confirmed: %+v", deletion)
+	}
+
+	want := []string{"disable", "revoke", "delete", "delete", "delete", "publish", "publish"}
+	if len(actions.calls) != len(want) {
+		t.Fatalf("actions are %v, want %v", actions.calls, want)
+	}
+	for i := range want {
+		if actions.calls[i] != want[i] {
+			t.Fatalf("actions are %v, want %v", actions.calls, want)
+		}
+	}
+	for _, e := range sink.events {
+		if e.RequestID != "req-1" || e.Actor != "admin-uid" || e.Target != "uid" {
+			t.Fatalf("event is not audited as the request: %+v", e)
+		}
+	}
+	// the whole deletion is audited once it's confirmed
+	for i, e := range sink.events {
+		if e.Operation == audit.OpMemberDelete && i != len(sink.events)-1 {
+			t.Fatalf("deletion is audited before it's confirmed: %+v", e)
+		}
+	}
+	confirmed, last := sink.events[len(sink.events)-2], sink.events[len(sink.events)-1]
+	if confirmed.Operation != audit.OpMemberDeleteConfirmed || last.Operation != audit.OpMemberDelete || last.Outcome != audit.OutcomeSuccess {
+		t.Fatalf("last events are %+v and %+v", confirmed, last)
+	}
+}
+
+func TestDeletionIsRestoredUntilTheFirebaseUserIsDeleted(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryDeletionStore()
+	actions := &fakeDeletionActions{failures: map[string]int{"delete": 1}}
+	sink := &eventSink{}
+	d := NewDeletions(store, actions, audit.New(nil, sink), DeletionOptions{})
+
+	if err := d.Restore(ctx, "uid"); !errors.Is(err, ErrDeletionNotFound) {
+		t.Fatalf("member without a deletion is restored: %v", err)
+	}
+	if _, err := d.Start(ctx, "uid"); err != nil {
+		t.Fatal(err)
+	}
+	d.processDue(ctx)
+	if err := d.Restore(ctx, "uid"); err != nil {
+		t.Fatal(err)
+	}
+	deletion, _ := store.Get(ctx, "uid")
+	if deletion.State != DeletionRestored || actions.calls[len(actions.calls)-1] != "enable" {
+		t.Fatalf("deletion is %+v after %v", deletion, actions.calls)
+	}
+	// the restored deletion isn't resumed, and the member can be deleted again
+	calls := len(actions.calls)
+	d.processDue(ctx)
+	if len(actions.calls) != calls {
+		t.Fatalf("restored deletion is resumed: %v", actions.calls)
+	}
+	if deletion, _ = d.Start(ctx, "uid"); deletion.State != DeletionRequested {
+		t.Fatalf("deletion of the restored member is %+v", deletion)
+	}
+
+	d.processDue(ctx)
+	if err := d.Restore(ctx, "uid"); !errors.Is(err, ErrDeletionNotRestorable) {
+		t.Fatalf("member whose Firebase user is deleted is restored: %v", err)
+	}
+	if last := sink.events[len(sink.events)-1]; last.Operation != audit.OpMemberRestore || last.Outcome != audit.OutcomeFailure {
+		t.Fatalf("last event is %+v", last)
+	}
+}
+
+func TestBackoffIsCapped(t *testing.T) {
+	d := NewDeletions(newMemoryDeletionStore(), &fakeDeletionActions{}, nil, DeletionOptions{
+		RetryBase: time.Second,
+		RetryMax:  time.Minute,
+	})
+	for _, attempts := range []int{1, 10, 40, 100} {
+		if delay := d.backoff(attempts); delay <= 0 || delay > time.Minute {
+			t.Errorf("delay of attempt %d is %s", attempts, delay)
+		}
+	}
+}
+
+func TestRedisDeletionStoreUnlocksOnlyItsOwnLock(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store := RedisDeletionStore{Rdb: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+	ctx := context.Background()
+
+	if ok, err := store.Lock(ctx, "uid", "a", time.Minute); err != nil || !ok {
+		t.Fatalf("lock is not taken: %v", err)
+	}
+	if ok, _ := store.Lock(ctx, "uid", "b", time.Minute); ok {
+		t.Fatal("lock is taken twice")
+	}
+	// the lock expired and taken by b is kept when a finishes
+	mr.FastForward(time.Minute)
+	if ok, _ := store.Lock(ctx, "uid", "b", time.Minute); !ok {
+		t.Fatal("expired lock is not taken")
+	}
+	if err := store.Unlock(ctx, "uid", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := mr.Get(deletionLockKey("uid")); owner != "b" {
+		t.Fatalf("lock is owned by %q", owner)
+	}
+	if err := store.Unlock(ctx, "uid", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(deletionLockKey("uid")) {
+		t.Fatal("lock is not removed by its owner")
+	}
+}
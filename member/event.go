@@ -0,0 +1,180 @@
+package member
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/mirror-media/mm-apigateway/audit"
+	"github.com/mirror-media/mm-apigateway/messaging"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Actions of the member lifecycle events. MsgAttrValueDelete is the request to delete the member in the DB rather than an event
+const (
+	ActionCreated       = "created"
+	ActionUpdated       = "updated"
+	ActionEmailVerified = "emailVerified"
+	ActionDisabled      = "disabled"
+	ActionDeleted       = "deleted"
+	ActionRestored      = "restored"
+)
+
+// MsgAttrKeySchemaVersion is the attribute of the version of the Event in the data
+const (
+	MsgAttrKeySchemaVersion = "schemaVersion"
+	EventSchemaVersion      = "1"
+)
+
+// Event is a member lifecycle event published to PubSubTopicMember. The action and the firebaseID are in the attributes as well to filter the subscriptions
+type Event struct {
+	Action        string                 `json:"action"`
+	FirebaseID    string                 `json:"firebaseId"`
+	Time          time.Time              `json:"time"`
+	RequestID     string                 `json:"requestId,omitempty"`
+	Actor         string                 `json:"actor,omitempty"`
+	ActorProvider string                 `json:"actorProvider,omitempty"`
+	Changes       map[string]interface{} `json:"changes,omitempty"` // fields set by created and updated, except the values of the redacted fields
+}
+
+// newEvent returns the event of the member done by the request in the context
+func newEvent(ctx context.Context, action string, firebaseID string, changes map[string]interface{}) Event {
+	r := audit.RequestFrom(ctx)
+	return Event{
+		Action:        action,
+		FirebaseID:    firebaseID,
+		Time:          time.Now().UTC(),
+		RequestID:     r.ID,
+		Actor:         r.Actor,
+		ActorProvider: r.ActorProvider,
+		Changes:       changes,
+	}
+}
+
+// message encodes the event in the data and the attributes of a message
+func (e Event) message() (*messaging.Message, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to marshal the %s event of member(%s)", e.Action, e.FirebaseID)
+	}
+	return &messaging.Message{
+		Data: data,
+		Attributes: map[string]string{
+			MsgAttrKeyAction:        e.Action,
+			MsgAttrKeyFirebaseID:    e.FirebaseID,
+			MsgAttrKeySchemaVersion: EventSchemaVersion,
+		},
+	}, nil
+}
+
+// EventFromMessage decodes the event of the message. A message without data, which is published by an older version, has only the action and the firebaseID attributes
+func EventFromMessage(msg *messaging.Message) (Event, error) {
+	e := Event{
+		Action:     msg.Attributes[MsgAttrKeyAction],
+		FirebaseID: msg.Attributes[MsgAttrKeyFirebaseID],
+		Time:       msg.PublishTime,
+	}
+	if len(msg.Data) > 0 {
+		if err := json.Unmarshal(msg.Data, &e); err != nil {
+			return e, errors.Wrapf(err, "message(%s) has a malformed event", msg.ID)
+		}
+	}
+	if e.Action == "" {
+		return e, errors.Errorf("message(%s) has no action", msg.ID)
+	}
+	return e, nil
+}
+
+// EventPublisher publishes the member events to a topic. A nil EventPublisher publishes nothing
+type EventPublisher struct {
+	publisher messaging.Publisher
+	topic     string
+	redactor  audit.Redactor
+	pending   sync.WaitGroup
+}
+
+// NewEventPublisher creates the publisher of the topic. The values of the redacted fields in the changes are never published
+func NewEventPublisher(publisher messaging.Publisher, topic string, redactedFields []string) *EventPublisher {
+	return &EventPublisher{
+		publisher: publisher,
+		topic:     topic,
+		redactor:  audit.NewRedactor(redactedFields),
+	}
+}
+
+// Publish publishes the event of the member done by the request in the context. It's published in the background and logged if it fails, so the action isn't blocked by the broker
+func (p *EventPublisher) Publish(ctx context.Context, action string, firebaseID string, changes map[string]interface{}) {
+	if p == nil {
+		return
+	}
+	e := newEvent(ctx, action, firebaseID, p.redactor.Redact(changes))
+	msg, err := e.message()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	p.pending.Add(1)
+	go func() {
+		defer p.pending.Done()
+		// the event may be published after the request is done
+		publishCTX, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if _, err := p.publisher.Publish(publishCTX, p.topic, msg); err != nil {
+			log.WithFields(log.Fields{
+				"action":    action,
+				"requestId": e.RequestID,
+			}).Errorf("event of member(%s) is not published: %v", firebaseID, err)
+		}
+	}()
+}
+
+// Close waits for the pending events. The broker is closed by its owner
+func (p *EventPublisher) Close() error {
+	if p == nil {
+		return nil
+	}
+	p.pending.Wait()
+	return nil
+}
+
+// EventHandler handles the member events of an action. It has to be idempotent because a failed message is delivered again to every handler of the action
+type EventHandler func(ctx context.Context, e Event) error
+
+// EventBus dispatches the messages of the member subscription to the handlers registered for their actions
+type EventBus struct {
+	handlers map[string][]EventHandler
+}
+
+// NewEventBus creates a bus without handlers
+func NewEventBus() *EventBus {
+	return &EventBus{
+		handlers: make(map[string][]EventHandler),
+	}
+}
+
+// Handle registers the handler of the action. It's not safe to register handlers while the bus is dispatching
+func (b *EventBus) Handle(action string, handler EventHandler) {
+	b.handlers[action] = append(b.handlers[action], handler)
+}
+
+// Dispatch calls the handlers of the event in the message in order, and stops at the first failure. The messages of the actions without a handler are for the other subscribers and are done
+func (b *EventBus) Dispatch(ctx context.Context, msg *messaging.Message) error {
+	e, err := EventFromMessage(msg)
+	if err != nil {
+		return Permanent(err)
+	}
+	handlers := b.handlers[e.Action]
+	if len(handlers) == 0 {
+		log.Debugf("no handler of the %s event of member(%s)", e.Action, e.FirebaseID)
+		return nil
+	}
+	log.Infof("Got message to %s member: %s", e.Action, e.FirebaseID)
+	for _, handle := range handlers {
+		if err = handle(ctx, e); err != nil {
+			return errors.WithMessagef(err, "fail to handle the %s event of member(%s)", e.Action, e.FirebaseID)
+		}
+	}
+	return nil
+}
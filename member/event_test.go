@@ -0,0 +1,86 @@
+package member
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mirror-media/mm-apigateway/audit"
+	"github.com/mirror-media/mm-apigateway/messaging"
+	pkgerrors "github.com/pkg/errors"
+)
+
+func TestEventBusDispatch(t *testing.T) {
+	ctx := audit.WithRequest(context.Background(), audit.Request{ID: "req-1", Actor: "uid"})
+	updated, err := newEvent(ctx, ActionUpdated, "uid", map[string]interface{}{"city": "Taipei"}).message()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var handled []Event
+	bus := NewEventBus()
+	bus.Handle(ActionUpdated, func(ctx context.Context, e Event) error {
+		handled = append(handled, e)
+		return nil
+	})
+	bus.Handle(MsgAttrValueDelete, func(ctx context.Context, e Event) error {
+		handled = append(handled, e)
+		return errors.New("user service is down")
+	})
+
+	if err = bus.Dispatch(context.Background(), updated); err != nil {
+		t.Fatal(err)
+	}
+	if len(handled) != 1 || handled[0].FirebaseID != "uid" || handled[0].RequestID != "req-1" || handled[0].Changes["city"] != "Taipei" {
+		t.Fatalf("handled events are %+v", handled)
+	}
+	if updated.Attributes[MsgAttrKeyAction] != ActionUpdated || updated.Attributes[MsgAttrKeySchemaVersion] != EventSchemaVersion {
+		t.Fatalf("attributes are %v", updated.Attributes)
+	}
+
+	// the messages of the older versions have no data
+	legacy := &messaging.Message{Attributes: map[string]string{MsgAttrKeyAction: MsgAttrValueDelete, MsgAttrKeyFirebaseID: "uid"}}
+	if err = bus.Dispatch(context.Background(), legacy); err == nil {
+		t.Fatal("failure of the handler is not returned")
+	}
+	if len(handled) != 2 || handled[1].Action != MsgAttrValueDelete || handled[1].FirebaseID != "uid" {
+		t.Fatalf("handled events are %+v", handled)
+	}
+
+	// the events without a handler are for the other subscribers
+	if err = bus.Dispatch(context.Background(), &messaging.Message{Attributes: map[string]string{MsgAttrKeyAction: ActionCreated}}); err != nil {
+		t.Fatal(err)
+	}
+
+	err = bus.Dispatch(context.Background(), &messaging.Message{Data: []byte("{")})
+	if _, ok := pkgerrors.Cause(err).(permanentError); !ok {
+		t.Fatalf("malformed message is not a permanent failure: %v", err)
+	}
+}
+
+func TestEventPublisherRedactsTheChanges(t *testing.T) {
+	broker := messaging.NewMemory()
+	if err := broker.Subscribe("member", "member-crm"); err != nil {
+		t.Fatal(err)
+	}
+	p := NewEventPublisher(broker, "member", []string{"phone"})
+	p.Publish(context.Background(), ActionUpdated, "uid", map[string]interface{}{"phone": "0912345678", "city": "Taipei"})
+	p.Close()
+
+	var events []Event
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	broker.Receive(ctx, "member-crm", 1, func(ctx context.Context, msg *messaging.Message) bool {
+		e, err := EventFromMessage(msg)
+		if err != nil {
+			t.Error(err)
+		}
+		events = append(events, e)
+		cancel()
+		return true
+	})
+	if len(events) != 1 || events[0].Changes["phone"] != "[REDACTED]" || events[0].Changes["city"] != "Taipei" {
+		t.Fatalf("published events are %+v", events)
+	}
+}
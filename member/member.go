@@ -3,7 +3,6 @@ package member
 
 import (
 	"context"
-	"fmt"
 	"strings"
 	"sync"
 	"time"
@@ -13,11 +12,11 @@ import (
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
 
-	"cloud.google.com/go/pubsub"
 	"firebase.google.com/go/v4/auth"
 	"firebase.google.com/go/v4/db"
+	"github.com/mirror-media/mm-apigateway/audit"
 	"github.com/mirror-media/mm-apigateway/config"
-	"github.com/mirror-media/mm-apigateway/token"
+	"github.com/mirror-media/mm-apigateway/messaging"
 	"github.com/pkg/errors"
 )
 
@@ -35,15 +34,9 @@ type Clients struct {
 	graphqlClient *graphql.Client
 }
 
-func (c *Clients) getGraphQLClient(userSrvToken string, serverConf config.Conf) (graphqlClient *graphql.Client, err error) {
+func (c *Clients) getGraphQLClient(userSrvToken oauth2.TokenSource, serverConf config.Conf) (graphqlClient *graphql.Client, err error) {
 	c.Do(func() {
-		src := oauth2.StaticTokenSource(
-			&oauth2.Token{
-				AccessToken: userSrvToken,
-				TokenType:   token.TypeJWT,
-			},
-		)
-		httpClient := oauth2.NewClient(context.Background(), src)
+		httpClient := oauth2.NewClient(context.Background(), userSrvToken)
 		c.graphqlClient = graphql.NewClient(serverConf.ServiceEndpoints.UserGraphQL, graphql.WithHTTPClient(httpClient))
 	})
 	if c.graphqlClient == nil {
@@ -69,19 +62,12 @@ func DisableFirebaseUser(parent context.Context, client *auth.Client, firebaseID
 	return nil
 }
 
-// Delete performs a series of actions to revoke token, remove firebase user and request to disable the member in the DB
-func Delete(parent context.Context, serverConf config.Conf, client *auth.Client, dbClient *db.Client, firebaseID string) (err error) {
-
-	if err = revokeFirebaseToken(parent, client, dbClient, firebaseID); err != nil {
-		return err
-	} else if err = deleteFirebaseUser(parent, client, firebaseID); err != nil {
-		return err
-	}
-
-	if err = publishDeleteMemberMessage(parent, serverConf.ProjectID, serverConf.PubSubTopicMember, firebaseID); err != nil {
-		return err
+// EnableFirebaseUser enables the user disabled in Firebase
+func EnableFirebaseUser(ctx context.Context, client *auth.Client, firebaseID string) error {
+	params := (&auth.UserToUpdate{}).Disabled(false)
+	if _, err := client.UpdateUser(ctx, firebaseID, params); err != nil {
+		return errors.WithMessagef(err, "fail to enable member(%s)", firebaseID)
 	}
-
 	return nil
 }
 
@@ -127,102 +113,51 @@ func deleteFirebaseUser(parent context.Context, client *auth.Client, firebaseID
 	return nil
 }
 
-func publishDeleteMemberMessage(parent context.Context, projectID string, topic string, firebaseID string) error {
-
-	clientCTX, cancel := context.WithCancel(parent)
-	defer cancel()
-	client, err := pubsub.NewClient(clientCTX, projectID)
+func publishDeleteMemberMessage(ctx context.Context, publisher messaging.Publisher, topic string, firebaseID string) error {
+	msg, err := newEvent(ctx, MsgAttrValueDelete, firebaseID, nil).message()
 	if err != nil {
-		err = errors.WithMessage(err, "error creating client for pubsub")
 		return err
 	}
-
-	ctx, cancelPublish := context.WithCancel(clientCTX)
-	defer cancelPublish()
-	t := client.Topic(topic)
-	result := t.Publish(ctx, &pubsub.Message{
-		Attributes: map[string]string{
-			MsgAttrKeyFirebaseID: firebaseID,
-			MsgAttrKeyAction:     MsgAttrValueDelete,
-		},
-	})
-	// Block until the result is returned and a server-generated
-	// ID is returned for the published message.
-	ctx, cancelGet := context.WithCancel(clientCTX)
-	defer cancelGet()
-	id, err := result.Get(ctx)
+	id, err := publisher.Publish(ctx, topic, msg)
 	if err != nil {
-		errors.WithMessage(err, "get published message result has error")
-		return err
+		return errors.WithMessagef(err, "fail to publish the deletion of member(%s)", firebaseID)
 	}
 	log.Printf("Published member deletion message with custom attributes(firebaseID: %s); msg ID: %v", firebaseID, id)
 	return nil
 }
 
-func SubscribeDeleteMember(parent context.Context, c config.Conf, userSrvToken token.Token) error {
-	clientCTX, cancel := context.WithCancel(parent)
-	defer cancel()
-	client, err := pubsub.NewClient(clientCTX, c.ProjectID)
-	if err != nil {
-		return fmt.Errorf("pubsub.NewClient: %v", err)
-	}
-	defer client.Close()
-
-	sub := client.Subscription(c.PubSubSubscribeMember)
-
-	// Create a channel to handle messages to as they come in.
-	cm := make(chan *pubsub.Message)
-	defer close(cm)
+// SubscribeMemberEvents dispatches the messages of the member subscription to the bus until the context is done
+func SubscribeMemberEvents(ctx context.Context, c config.Conf, broker messaging.Broker, bus *EventBus) error {
+	s := c.MemberSubscription
+	consumer := NewConsumer(broker, c.PubSubSubscribeMember, bus.Dispatch, ConsumerOptions{
+		Concurrency:     s.Concurrency,
+		MaxAttempts:     s.MaxAttempts,
+		DeadLetterTopic: s.DeadLetterTopic,
+		RetryBase:       time.Duration(s.RetryBase) * time.Second,
+		RetryMax:        time.Duration(s.RetryMax) * time.Second,
+	})
+	return consumer.Run(ctx)
+}
 
-	tokenString, err := userSrvToken.GetTokenString()
-	if err != nil {
-		panic(err)
-	}
-	src := oauth2.StaticTokenSource(
-		&oauth2.Token{
-			AccessToken: tokenString,
-			TokenType:   token.TypeJWT,
-		},
-	)
-	httpClient := oauth2.NewClient(context.Background(), src)
-	graphqlClient := graphql.NewClient(c.ServiceEndpoints.UserGraphQL, graphql.WithHTTPClient(httpClient))
-
-	// Handle individual messages in a goroutine.
-	go func() {
-		for msg := range cm {
-			firebaseID := msg.Attributes[MsgAttrKeyFirebaseID]
-			log.Infof("Got message to %s member: %s", msg.Attributes[MsgAttrKeyAction], firebaseID)
-
-			switch msg.Attributes[MsgAttrKeyAction] {
-			case MsgAttrValueDelete:
-				if err := requestToDeleteMember(userSrvToken, graphqlClient, firebaseID); err == nil {
-					msg.Ack()
-				}
-			default:
-				log.Errorf("action(%s) is not supported", msg.Attributes[MsgAttrKeyAction])
-			}
+// DeleteMemberHandler deletes the member in the DB as requested by the delete message, confirms the deletion and publishes the deleted event
+func DeleteMemberHandler(graphqlClient *graphql.Client, deletions *Deletions, events *EventPublisher) EventHandler {
+	return func(ctx context.Context, e Event) error {
+		if e.FirebaseID == "" {
+			return Permanent(errors.Errorf("%s message has no %s", e.Action, MsgAttrKeyFirebaseID))
 		}
-	}()
-
-	// Receive messages for 10 seconds.
-	ctx, cancelReceive := context.WithTimeout(clientCTX, 10*time.Second)
-	defer cancelReceive()
-	// Receive blocks until the context is cancelled or an error occurs.
-	log.Infof("Pulling subscription: %s", c.PubSubSubscribeMember)
-	err = sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
-		cm <- msg
-	})
-	if err != nil {
-		err = errors.Wrap(err, "receive failed")
-		log.Error(err)
-		return err
+		if err := requestToDeleteMember(ctx, graphqlClient, e.FirebaseID); err != nil {
+			return err
+		}
+		// an unconfirmed deletion is published again, so the message is done anyway
+		if err := deletions.Confirm(ctx, e.FirebaseID); err != nil && err != ErrDeletionNotFound {
+			log.Errorf("fail to confirm the deletion of member(%s): %v", e.FirebaseID, err)
+		}
+		events.Publish(audit.WithRequest(ctx, audit.Request{ID: e.RequestID, Actor: e.Actor, ActorProvider: e.ActorProvider}), ActionDeleted, e.FirebaseID, nil)
+		return nil
 	}
-
-	return nil
-
 }
 
-func requestToDeleteMember(userSrvToken token.Token, graphqlClient *graphql.Client, firebaseID string) (err error) {
+func requestToDeleteMember(parent context.Context, graphqlClient *graphql.Client, firebaseID string) (err error) {
 	log.Infof("Request Saleor-mirror to delete member: %s", firebaseID)
 
 	preGQL := []string{"mutation($firebaseId: String!) {", "deleteMember(firebaseId: $firebaseId) {"}
@@ -238,7 +173,7 @@ func requestToDeleteMember(userSrvToken token.Token, graphqlClient *graphql.Clie
 	var resp struct {
 		DeleteMember *model.DeleteMember `json:"deleteMember"`
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(parent, 5*time.Second)
 	defer cancel()
 	if err = graphqlClient.Run(ctx, req, &resp); err == nil {
 		log.Infof("Successfully delete member(%s)", firebaseID)
@@ -0,0 +1,156 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Memory is a broker within the process, e.g. for the tests or for a single instance without Pub/Sub. A message published to a topic is queued for every subscription of the topic, and it's lost if the process stops
+type Memory struct {
+	mu            sync.Mutex
+	lastID        int64
+	topics        map[string][]*memorySubscription
+	subscriptions map[string]*memorySubscription
+}
+
+type memorySubscription struct {
+	mu      sync.Mutex
+	pending []*Message
+	// ready is signaled when a message is queued
+	ready chan struct{}
+}
+
+// NewMemory creates a broker without subscriptions
+func NewMemory() *Memory {
+	return &Memory{
+		topics:        make(map[string][]*memorySubscription),
+		subscriptions: make(map[string]*memorySubscription),
+	}
+}
+
+// Subscribe creates the subscription of the topic. The messages published before are not received by it
+func (m *Memory) Subscribe(topic string, subscription string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.subscriptions[subscription]; ok {
+		return fmt.Errorf("subscription(%s) exists", subscription)
+	}
+	s := &memorySubscription{ready: make(chan struct{}, 1)}
+	m.subscriptions[subscription] = s
+	m.topics[topic] = append(m.topics[topic], s)
+	return nil
+}
+
+// Publish queues the message for every subscription of the topic
+func (m *Memory) Publish(ctx context.Context, topic string, msg *Message) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	m.lastID++
+	id := fmt.Sprint(m.lastID)
+	subscriptions := m.topics[topic]
+	m.mu.Unlock()
+
+	now := time.Now()
+	for _, s := range subscriptions {
+		s.push(&Message{
+			ID:          id,
+			Data:        msg.Data,
+			Attributes:  copyAttributes(msg.Attributes),
+			PublishTime: now,
+		})
+	}
+	return id, nil
+}
+
+// Receive delivers the queued messages to the handler. A message which isn't acked is queued again after its NackDelay
+func (m *Memory) Receive(ctx context.Context, subscription string, concurrency int, handle Handler) error {
+	m.mu.Lock()
+	s, ok := m.subscriptions[subscription]
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("subscription(%s) not found", subscription)
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var workers sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				msg := s.pop(ctx)
+				if msg == nil {
+					return
+				}
+				msg.DeliveryAttempt++
+				if !handle(ctx, msg) {
+					s.requeue(msg)
+				}
+			}
+		}()
+	}
+	workers.Wait()
+	return nil
+}
+
+// Close does nothing because the messages live in the memory
+func (m *Memory) Close() error {
+	return nil
+}
+
+func (s *memorySubscription) push(msg *Message) {
+	s.mu.Lock()
+	s.pending = append(s.pending, msg)
+	s.mu.Unlock()
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// requeue queues the nacked message again once its NackDelay has passed
+func (s *memorySubscription) requeue(msg *Message) {
+	delay := msg.NackDelay
+	msg.NackDelay = 0
+	if delay <= 0 {
+		s.push(msg)
+		return
+	}
+	time.AfterFunc(delay, func() { s.push(msg) })
+}
+
+// pop waits for a message and returns nil once the context is done
+func (s *memorySubscription) pop(ctx context.Context) *Message {
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+		s.mu.Lock()
+		if len(s.pending) > 0 {
+			msg := s.pending[0]
+			s.pending = s.pending[1:]
+			more := len(s.pending) > 0
+			s.mu.Unlock()
+			// wake another worker up for the rest
+			if more {
+				select {
+				case s.ready <- struct{}{}:
+				default:
+				}
+			}
+			return msg
+		}
+		s.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.ready:
+		}
+	}
+}
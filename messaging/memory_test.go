@@ -0,0 +1,84 @@
+package messaging
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryRedeliversTheNackedMessages(t *testing.T) {
+	broker := NewMemory()
+	for _, subscription := range []string{"a", "b"} {
+		if err := broker.Subscribe("topic", subscription); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := broker.Subscribe("topic", "a"); err == nil {
+		t.Fatal("subscription is created twice")
+	}
+	if err := broker.Receive(context.Background(), "c", 1, nil); err == nil {
+		t.Fatal("unknown subscription is received")
+	}
+	for _, data := range []string{"1", "2", "3"} {
+		if _, err := broker.Publish(context.Background(), "topic", &Message{Data: []byte(data), Attributes: map[string]string{"k": data}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	deliveries := make(map[string][]int)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- broker.Receive(ctx, "a", 2, func(ctx context.Context, msg *Message) bool {
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			deliveries[string(msg.Data)] = append(deliveries[string(msg.Data)], msg.DeliveryAttempt)
+			acked := string(msg.Data) != "2" || len(deliveries["2"]) == 3
+			if len(deliveries["1"])+len(deliveries["2"])+len(deliveries["3"]) == 5 {
+				cancel()
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return acked
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("receive doesn't stop")
+	}
+
+	if maxRunning > 2 {
+		t.Fatalf("%d messages are handled at the same time", maxRunning)
+	}
+	if len(deliveries["1"]) != 1 || len(deliveries["3"]) != 1 {
+		t.Fatalf("deliveries are %v", deliveries)
+	}
+	if d := deliveries["2"]; len(d) != 3 || d[0] != 1 || d[1] != 2 || d[2] != 3 {
+		t.Fatalf("deliveries of the nacked message are %v", d)
+	}
+
+	// the other subscription receives every message once
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var received []string
+	broker.Receive(ctx, "b", 1, func(ctx context.Context, msg *Message) bool {
+		received = append(received, string(msg.Data)+msg.Attributes["k"])
+		return true
+	})
+	if len(received) != 3 || received[0] != "11" || received[2] != "33" {
+		t.Fatalf("received %v", received)
+	}
+}
@@ -0,0 +1,53 @@
+// Package messaging publishes and receives the messages of the topics and the subscriptions, whatever the transport is
+package messaging
+
+import (
+	"context"
+	"time"
+)
+
+// Message is a message of a topic
+type Message struct {
+	ID          string
+	Data        []byte
+	Attributes  map[string]string
+	PublishTime time.Time
+	// DeliveryAttempt counts the deliveries of the message to the subscription from 1. It's 0 if the transport doesn't count them
+	DeliveryAttempt int
+	// NackDelay may be set by a handler not acking the message to delay its redelivery. The message doesn't count towards the concurrency meanwhile
+	NackDelay time.Duration
+}
+
+// Handler handles a received message and returns whether to ack it. A message which isn't acked is delivered again, after its NackDelay if the transport supports it
+type Handler func(ctx context.Context, msg *Message) bool
+
+// Publisher publishes the messages to the topics
+type Publisher interface {
+	// Publish returns the ID of the message once the transport has accepted it
+	Publish(ctx context.Context, topic string, msg *Message) (string, error)
+}
+
+// Subscriber receives the messages of the subscriptions
+type Subscriber interface {
+	// Receive calls the handler with at most concurrency messages at the same time until the context is done, when it returns nil, or an error stops the receiving
+	Receive(ctx context.Context, subscription string, concurrency int, handle Handler) error
+}
+
+// Broker is the transport shared by the publishers and the subscribers of a server
+type Broker interface {
+	Publisher
+	Subscriber
+	Close() error
+}
+
+// copyAttributes copies the attributes, so that a published message can't be changed by the publisher
+func copyAttributes(attributes map[string]string) map[string]string {
+	if attributes == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(attributes))
+	for k, v := range attributes {
+		copied[k] = v
+	}
+	return copied
+}
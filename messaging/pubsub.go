@@ -0,0 +1,87 @@
+package messaging
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/pkg/errors"
+	"google.golang.org/api/option"
+)
+
+// PubSub is the broker of Google Cloud Pub/Sub. The topics of a subscription are configured in Pub/Sub
+type PubSub struct {
+	client *pubsub.Client
+
+	mu     sync.Mutex
+	topics map[string]*pubsub.Topic
+}
+
+// NewPubSub creates the client of the project, which is shared by every topic and subscription. The options configure the client, e.g. to connect to an emulator
+func NewPubSub(ctx context.Context, projectID string, opts ...option.ClientOption) (*PubSub, error) {
+	client, err := pubsub.NewClient(ctx, projectID, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to create the pubsub client")
+	}
+	return &PubSub{
+		client: client,
+		topics: make(map[string]*pubsub.Topic),
+	}, nil
+}
+
+// topic returns the topic, which is kept to batch its messages
+func (p *PubSub) topic(id string) *pubsub.Topic {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t, ok := p.topics[id]
+	if !ok {
+		t = p.client.Topic(id)
+		p.topics[id] = t
+	}
+	return t
+}
+
+// Publish publishes the message and waits for its server-generated ID
+func (p *PubSub) Publish(ctx context.Context, topic string, msg *Message) (string, error) {
+	result := p.topic(topic).Publish(ctx, &pubsub.Message{
+		Data:       msg.Data,
+		Attributes: copyAttributes(msg.Attributes),
+	})
+	id, err := result.Get(ctx)
+	return id, errors.Wrapf(err, "fail to publish to %s", topic)
+}
+
+// Receive receives the messages of the subscription. The delivery attempts are only counted by a subscription with a dead-letter policy. A message is nacked at once, whatever its NackDelay, because its redelivery is delayed by the retry policy of the subscription
+func (p *PubSub) Receive(ctx context.Context, subscription string, concurrency int, handle Handler) error {
+	sub := p.client.Subscription(subscription)
+	if concurrency > 0 {
+		sub.ReceiveSettings.MaxOutstandingMessages = concurrency
+	}
+	err := sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+		msg := &Message{
+			ID:          m.ID,
+			Data:        m.Data,
+			Attributes:  m.Attributes,
+			PublishTime: m.PublishTime,
+		}
+		if m.DeliveryAttempt != nil {
+			msg.DeliveryAttempt = *m.DeliveryAttempt
+		}
+		if handle(ctx, msg) {
+			m.Ack()
+		} else {
+			m.Nack()
+		}
+	})
+	return errors.Wrapf(err, "fail to receive %s", subscription)
+}
+
+// Close flushes the pending messages and closes the client
+func (p *PubSub) Close() error {
+	p.mu.Lock()
+	for _, t := range p.topics {
+		t.Stop()
+	}
+	p.mu.Unlock()
+	return p.client.Close()
+}
@@ -0,0 +1,78 @@
+package messaging
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// newTestPubSub connects to a fake Pub/Sub server with the topic and its subscription
+func newTestPubSub(t *testing.T) *PubSub {
+	srv := pstest.NewServer()
+	t.Cleanup(func() { srv.Close() })
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	p, err := NewPubSub(ctx, "project", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	topic, err := p.client.CreateTopic(ctx, "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = p.client.CreateSubscription(ctx, "a", pubsub.SubscriptionConfig{Topic: topic, AckDeadline: 10 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPubSubRedeliversTheNackedMessages(t *testing.T) {
+	p := newTestPubSub(t)
+	ctx := context.Background()
+	ids := make(map[string]string)
+	for _, data := range []string{"1", "2"} {
+		id, err := p.Publish(ctx, "topic", &Message{Data: []byte(data), Attributes: map[string]string{"k": data}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[data] = id
+	}
+
+	var mu sync.Mutex
+	deliveries := make(map[string]int)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	err := p.Receive(ctx, "a", 1, func(ctx context.Context, msg *Message) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		data := string(msg.Data)
+		if msg.ID != ids[data] || msg.Attributes["k"] != data || msg.PublishTime.IsZero() {
+			t.Errorf("received %+v", msg)
+		}
+		deliveries[data]++
+		// the second message is nacked once
+		acked := data != "2" || deliveries[data] > 1
+		if deliveries["1"] == 1 && deliveries["2"] == 2 {
+			cancel()
+		}
+		return acked
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if deliveries["1"] != 1 || deliveries["2"] != 2 {
+		t.Fatalf("deliveries are %v", deliveries)
+	}
+}
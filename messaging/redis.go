@@ -0,0 +1,323 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const streamNamespace = "mm-apigateway.messaging"
+
+// Fields of the stream entries
+const (
+	fieldData        = "data"
+	fieldAttributes  = "attributes"
+	fieldPublishTime = "publishTime"
+)
+
+// Streamer is the part of a redis client used by RedisStreams
+type Streamer interface {
+	XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd
+	XGroupCreateMkStream(ctx context.Context, stream, group, start string) *redis.StatusCmd
+	XReadGroup(ctx context.Context, a *redis.XReadGroupArgs) *redis.XStreamSliceCmd
+	XAck(ctx context.Context, stream, group string, ids ...string) *redis.IntCmd
+	XPendingExt(ctx context.Context, a *redis.XPendingExtArgs) *redis.XPendingExtCmd
+	XClaim(ctx context.Context, a *redis.XClaimArgs) *redis.XMessageSliceCmd
+	Do(ctx context.Context, args ...interface{}) *redis.Cmd
+}
+
+// RedisStreams is the broker of redis streams. A topic is a stream and a subscription is a consumer group of the stream. A message which isn't acked is delivered again once it has been pending for the visibility timeout, or for its NackDelay if it's shorter
+type RedisStreams struct {
+	rdb Streamer
+	// subscriptions are the topics keyed by the subscriptions
+	subscriptions map[string]string
+	opts          RedisStreamsOptions
+}
+
+// RedisStreamsOptions tunes the streams
+type RedisStreamsOptions struct {
+	MaxLen            int64         // approximate max length of a stream, default 100000
+	VisibilityTimeout time.Duration // default 30s
+	Consumer          string        // name of the consumer in the groups, default the hostname
+}
+
+// NewRedisStreams creates the broker of the subscriptions, which are the topics keyed by the subscriptions
+func NewRedisStreams(rdb Streamer, subscriptions map[string]string, opts RedisStreamsOptions) *RedisStreams {
+	if opts.MaxLen <= 0 {
+		opts.MaxLen = 100000
+	}
+	if opts.VisibilityTimeout <= 0 {
+		opts.VisibilityTimeout = 30 * time.Second
+	}
+	if opts.Consumer == "" {
+		opts.Consumer, _ = os.Hostname()
+	}
+	return &RedisStreams{
+		rdb:           rdb,
+		subscriptions: subscriptions,
+		opts:          opts,
+	}
+}
+
+func streamKey(topic string) string {
+	return fmt.Sprintf("%s.%s", streamNamespace, topic)
+}
+
+// Publish adds the message to the stream of the topic
+func (r *RedisStreams) Publish(ctx context.Context, topic string, msg *Message) (string, error) {
+	attributes, err := json.Marshal(msg.Attributes)
+	if err != nil {
+		return "", errors.Wrap(err, "fail to marshal the attributes")
+	}
+	id, err := r.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream:       streamKey(topic),
+		MaxLenApprox: r.opts.MaxLen,
+		Values: map[string]interface{}{
+			fieldData:        msg.Data,
+			fieldAttributes:  attributes,
+			fieldPublishTime: time.Now().UnixNano() / int64(time.Millisecond),
+		},
+	}).Result()
+	return id, errors.Wrapf(err, "fail to publish to %s", topic)
+}
+
+// Receive reads the new messages of the consumer group and reclaims the messages pending for the visibility timeout
+func (r *RedisStreams) Receive(ctx context.Context, subscription string, concurrency int, handle Handler) error {
+	topic, ok := r.subscriptions[subscription]
+	if !ok {
+		return fmt.Errorf("subscription(%s) has no topic", subscription)
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	stream := streamKey(topic)
+	if err := r.rdb.XGroupCreateMkStream(ctx, stream, subscription, "$").Err(); err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return errors.Wrapf(err, "fail to create the group of %s", subscription)
+	}
+
+	// the pending messages are reclaimed every half of the visibility timeout, or earlier once a nacked message is due
+	var reclaimMu sync.Mutex
+	var nextReclaim time.Time
+	reclaimBy := func(at time.Time) {
+		reclaimMu.Lock()
+		defer reclaimMu.Unlock()
+		if at.Before(nextReclaim) {
+			nextReclaim = at
+		}
+	}
+
+	slots := make(chan struct{}, concurrency)
+	var inFlight sync.WaitGroup
+	defer inFlight.Wait()
+	deliver := func(msg *Message) {
+		inFlight.Add(1)
+		go func() {
+			defer inFlight.Done()
+			defer func() { <-slots }()
+			acked := handle(ctx, msg)
+			// the handled message is acked or delayed even if the context is done meanwhile
+			ackCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if !acked {
+				if delayed, err := r.delay(ackCTX, stream, subscription, msg); err != nil {
+					log.Errorf("fail to delay message(%s) of %s: %v", msg.ID, subscription, err)
+				} else if delayed {
+					reclaimBy(time.Now().Add(msg.NackDelay))
+				}
+				return
+			}
+			if err := r.rdb.XAck(ackCTX, stream, subscription, msg.ID).Err(); err != nil {
+				log.Errorf("fail to ack message(%s) of %s: %v", msg.ID, subscription, err)
+			}
+		}()
+	}
+
+	for {
+		// wait for a free slot and take the others which are free
+		select {
+		case <-ctx.Done():
+			return nil
+		case slots <- struct{}{}:
+		}
+		free := 1
+		for more := true; more && free < concurrency; {
+			select {
+			case slots <- struct{}{}:
+				free++
+			default:
+				more = false
+			}
+		}
+
+		var msgs []*Message
+		var err error
+		reclaimMu.Lock()
+		due := !time.Now().Before(nextReclaim)
+		if due {
+			nextReclaim = time.Now().Add(r.opts.VisibilityTimeout / 2)
+		}
+		reclaimMu.Unlock()
+		if due {
+			msgs, err = r.reclaim(ctx, stream, subscription, free)
+		}
+		if err == nil && len(msgs) == 0 {
+			msgs, err = r.read(ctx, stream, subscription, free)
+		}
+		for i := len(msgs); i < free; i++ {
+			<-slots
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			deliver(msg)
+		}
+	}
+}
+
+// delay sets the idle time of the nacked message, so that it's reclaimed once its NackDelay has passed instead of the visibility timeout, and returns whether it did. The deliveries are kept
+func (r *RedisStreams) delay(ctx context.Context, stream string, group string, msg *Message) (bool, error) {
+	idle := r.opts.VisibilityTimeout - msg.NackDelay
+	if msg.NackDelay <= 0 || idle <= 0 {
+		return false, nil
+	}
+	err := r.rdb.Do(ctx, "XCLAIM", stream, group, r.opts.Consumer, 0, msg.ID,
+		"IDLE", idle.Milliseconds(), "RETRYCOUNT", msg.DeliveryAttempt, "JUSTID").Err()
+	return err == nil, errors.Wrapf(err, "fail to set the idle time of message(%s) of the group %s", msg.ID, group)
+}
+
+// read reads the new messages of the group, waiting for a second at most
+func (r *RedisStreams) read(ctx context.Context, stream string, group string, count int) ([]*Message, error) {
+	streams, err := r.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    group,
+		Consumer: r.opts.Consumer,
+		Streams:  []string{stream, ">"},
+		Count:    int64(count),
+		Block:    time.Second,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "fail to read the group %s of %s", group, stream)
+	}
+	var msgs []*Message
+	for _, s := range streams {
+		for _, m := range s.Messages {
+			msgs = append(msgs, decodeMessage(m, 1))
+		}
+	}
+	return msgs, nil
+}
+
+// reclaim claims the messages of the group which have been pending for the visibility timeout, i.e. they are not acked or their consumers are gone
+func (r *RedisStreams) reclaim(ctx context.Context, stream string, group string, count int) ([]*Message, error) {
+	ids := make([]string, 0, count)
+	deliveries := make(map[string]int, count)
+	// the pending list is paged through, since the idle messages may be after many messages still in progress
+	pageSize := int64(count) * 10
+	for start := "-"; start != "" && len(ids) < count; {
+		pending, err := r.rdb.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: stream,
+			Group:  group,
+			Start:  start,
+			End:    "+",
+			Count:  pageSize,
+		}).Result()
+		if err == redis.Nil {
+			break
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "fail to read the pending messages of the group %s of %s", group, stream)
+		}
+		for _, p := range pending {
+			if p.Idle < r.opts.VisibilityTimeout {
+				continue
+			}
+			ids = append(ids, p.ID)
+			deliveries[p.ID] = int(p.RetryCount) + 1
+			if len(ids) == count {
+				break
+			}
+		}
+		if int64(len(pending)) < pageSize {
+			break
+		}
+		start = nextStreamID(pending[len(pending)-1].ID)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	claimed, err := r.rdb.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   stream,
+		Group:    group,
+		Consumer: r.opts.Consumer,
+		MinIdle:  r.opts.VisibilityTimeout,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to claim the pending messages of the group %s of %s", group, stream)
+	}
+	msgs := make([]*Message, 0, len(claimed))
+	for _, m := range claimed {
+		msgs = append(msgs, decodeMessage(m, deliveries[m.ID]))
+	}
+	return msgs, nil
+}
+
+// nextStreamID returns the smallest ID after the ID of a stream entry, or "" if the ID is malformed
+func nextStreamID(id string) string {
+	i := strings.IndexByte(id, '-')
+	if i < 0 {
+		return ""
+	}
+	ms, err := strconv.ParseUint(id[:i], 10, 64)
+	if err != nil {
+		return ""
+	}
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
+	if err != nil {
+		return ""
+	}
+	if seq == math.MaxUint64 {
+		return strconv.FormatUint(ms+1, 10) + "-0"
+	}
+	return strconv.FormatUint(ms, 10) + "-" + strconv.FormatUint(seq+1, 10)
+}
+
+func decodeMessage(m redis.XMessage, deliveryAttempt int) *Message {
+	msg := &Message{
+		ID:              m.ID,
+		DeliveryAttempt: deliveryAttempt,
+	}
+	if data, ok := m.Values[fieldData].(string); ok {
+		msg.Data = []byte(data)
+	}
+	if attributes, ok := m.Values[fieldAttributes].(string); ok {
+		if err := json.Unmarshal([]byte(attributes), &msg.Attributes); err != nil {
+			log.Errorf("message(%s) has malformed attributes: %v", m.ID, err)
+		}
+	}
+	if publishTime, ok := m.Values[fieldPublishTime].(string); ok {
+		if ms, err := strconv.ParseInt(publishTime, 10, 64); err == nil {
+			msg.PublishTime = time.Unix(0, ms*int64(time.Millisecond))
+		}
+	}
+	return msg
+}
+
+// Close does nothing because the redis client is owned by the server
+func (r *RedisStreams) Close() error {
+	return nil
+}
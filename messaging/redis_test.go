@@ -0,0 +1,252 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func newTestRedis(t *testing.T) *redis.Client {
+	mr := miniredis.RunT(t)
+	return redis.NewClient(&redis.Options{Addr: mr.Addr()})
+}
+
+// receiveUntil receives the subscription until the handler has returned true n times or the time is out. It returns the received messages in order
+func receiveUntil(t *testing.T, broker *RedisStreams, subscription string, n int, handle Handler) []*Message {
+	t.Helper()
+	var mu sync.Mutex
+	var received []*Message
+	acked := 0
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := broker.Receive(ctx, subscription, 2, func(ctx context.Context, msg *Message) bool {
+		ok := handle == nil || handle(ctx, msg)
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, msg)
+		if ok {
+			if acked++; acked == n {
+				cancel()
+			}
+		}
+		return ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if acked < n {
+		t.Fatalf("%d messages are acked, want %d", acked, n)
+	}
+	return received
+}
+
+func pendingCount(t *testing.T, rdb *redis.Client, topic, group string) int64 {
+	t.Helper()
+	pending, err := rdb.XPending(context.Background(), streamKey(topic), group).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pending.Count
+}
+
+func TestRedisStreamsDeliversToEveryGroup(t *testing.T) {
+	rdb := newTestRedis(t)
+	ctx := context.Background()
+	broker := NewRedisStreams(rdb, map[string]string{"a": "topic", "b": "topic"}, RedisStreamsOptions{Consumer: "gateway-1"})
+	if err := broker.Receive(ctx, "c", 1, nil); err == nil {
+		t.Fatal("subscription without a topic is received")
+	}
+	// the groups start with the new messages, so they are created before the messages are published
+	for _, group := range []string{"a", "b"} {
+		if err := rdb.XGroupCreateMkStream(ctx, streamKey("topic"), group, "$").Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := make(map[string]string)
+	for _, data := range []string{"1", "2", "3"} {
+		id, err := broker.Publish(ctx, "topic", &Message{Data: []byte(data), Attributes: map[string]string{"k": data}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[data] = id
+	}
+
+	for _, group := range []string{"a", "b"} {
+		received := receiveUntil(t, broker, group, 3, nil)
+		if len(received) != 3 {
+			t.Fatalf("group %s received %d messages", group, len(received))
+		}
+		for _, msg := range received {
+			data := string(msg.Data)
+			if msg.ID != ids[data] || msg.Attributes["k"] != data || msg.DeliveryAttempt != 1 || msg.PublishTime.IsZero() {
+				t.Fatalf("group %s received %+v", group, msg)
+			}
+		}
+		if n := pendingCount(t, rdb, "topic", group); n != 0 {
+			t.Fatalf("%d messages of group %s are not acked", n, group)
+		}
+	}
+}
+
+func TestRedisStreamsShareAGroupAcrossConsumers(t *testing.T) {
+	rdb := newTestRedis(t)
+	ctx := context.Background()
+	subscriptions := map[string]string{"a": "topic"}
+	if err := rdb.XGroupCreateMkStream(ctx, streamKey("topic"), "a", "$").Err(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := NewRedisStreams(rdb, subscriptions, RedisStreamsOptions{}).Publish(ctx, "topic", &Message{Data: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	handled := make(map[string]int)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, consumer := range []string{"gateway-1", "gateway-2"} {
+		broker := NewRedisStreams(rdb, subscriptions, RedisStreamsOptions{Consumer: consumer})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := broker.Receive(ctx, "a", 1, func(ctx context.Context, msg *Message) bool {
+				mu.Lock()
+				defer mu.Unlock()
+				if handled[string(msg.Data)]++; len(handled) == 10 {
+					cancel()
+				}
+				return true
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(handled) != 10 {
+		t.Fatalf("handled %v", handled)
+	}
+	for data, n := range handled {
+		if n != 1 {
+			t.Fatalf("message %s is handled %d times by the group", data, n)
+		}
+	}
+}
+
+func TestRedisStreamsRedeliverTheUnackedMessages(t *testing.T) {
+	rdb := newTestRedis(t)
+	ctx := context.Background()
+	subscriptions := map[string]string{"a": "topic"}
+	opts := RedisStreamsOptions{VisibilityTimeout: 100 * time.Millisecond, Consumer: "gateway-1"}
+	broker := NewRedisStreams(rdb, subscriptions, opts)
+	if err := rdb.XGroupCreateMkStream(ctx, streamKey("topic"), "a", "$").Err(); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"1", "2"} {
+		if _, err := broker.Publish(ctx, "topic", &Message{Data: []byte(data)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a consumer reads the first message and is gone before acking it
+	if err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    "a",
+		Consumer: "gone",
+		Streams:  []string{streamKey("topic"), ">"},
+		Count:    1,
+	}).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second message is nacked once
+	received := receiveUntil(t, broker, "a", 2, func(ctx context.Context, msg *Message) bool {
+		return string(msg.Data) != "2" || msg.DeliveryAttempt > 1
+	})
+	deliveries := make(map[string][]int)
+	for _, msg := range received {
+		deliveries[string(msg.Data)] = append(deliveries[string(msg.Data)], msg.DeliveryAttempt)
+	}
+	if d := deliveries["1"]; len(d) != 1 || d[0] != 2 {
+		t.Fatalf("deliveries of the message of the gone consumer are %v", d)
+	}
+	if d := deliveries["2"]; len(d) != 2 || d[0] != 1 || d[1] != 2 {
+		t.Fatalf("deliveries of the nacked message are %v", d)
+	}
+	if n := pendingCount(t, rdb, "topic", "a"); n != 0 {
+		t.Fatalf("%d messages are not acked", n)
+	}
+}
+
+func TestRedisStreamsRedeliverAfterTheNackDelay(t *testing.T) {
+	rdb := newTestRedis(t)
+	ctx := context.Background()
+	opts := RedisStreamsOptions{VisibilityTimeout: time.Hour, Consumer: "gateway-1"}
+	broker := NewRedisStreams(rdb, map[string]string{"a": "topic"}, opts)
+	if err := rdb.XGroupCreateMkStream(ctx, streamKey("topic"), "a", "$").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := broker.Publish(ctx, "topic", &Message{Data: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the message would wait for the visibility timeout without the delay
+	received := receiveUntil(t, broker, "a", 1, func(ctx context.Context, msg *Message) bool {
+		if msg.DeliveryAttempt == 1 {
+			msg.NackDelay = 100 * time.Millisecond
+			return false
+		}
+		return true
+	})
+	if len(received) != 2 || received[1].DeliveryAttempt != 2 {
+		t.Fatalf("received %+v", received)
+	}
+}
+
+func TestRedisStreamsReclaimPagesThroughThePendingMessages(t *testing.T) {
+	rdb := newTestRedis(t)
+	ctx := context.Background()
+	opts := RedisStreamsOptions{VisibilityTimeout: time.Hour, Consumer: "gateway-1"}
+	broker := NewRedisStreams(rdb, map[string]string{"a": "topic"}, opts)
+	stream := streamKey("topic")
+	if err := rdb.XGroupCreateMkStream(ctx, stream, "a", "$").Err(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 25; i++ {
+		if _, err := broker.Publish(ctx, "topic", &Message{Data: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    "a",
+		Consumer: "busy",
+		Streams:  []string{stream, ">"},
+		Count:    25,
+	}).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the messages after the first page of the pending list are idle
+	entries := read[0].Messages
+	for _, m := range entries[22:] {
+		if err := rdb.Do(ctx, "XCLAIM", stream, "a", "gone", 0, m.ID, "IDLE", (2 * time.Hour).Milliseconds(), "JUSTID").Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msgs, err := broker.reclaim(ctx, stream, "a", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || string(msgs[0].Data) != "22" || string(msgs[1].Data) != "23" {
+		t.Fatalf("reclaimed %+v", msgs)
+	}
+}
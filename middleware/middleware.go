@@ -11,8 +11,14 @@ const (
 	CtxFirebaseDatabaseClientKey CtxKey = "CtxFirebaseDBClient"
 )
 const (
+	// GCtxRequestIDKey is the key of a string of the ID of the request in *gin.Context
+	GCtxRequestIDKey string = "GCtxRequestID"
 	// GCtxTokenKey is the key of a token.Token in *gin.Context
 	GCtxTokenKey string = "GCtxToken"
-	// GCtxUserIDKey is the key of a string of a User ID in *gin.Context
+	// GCtxPrincipalKey is the key of the *identity.Principal of the authenticated requester in *gin.Context
+	GCtxPrincipalKey string = "GCtxPrincipal"
+	// GCtxUserIDKey is the key of a string of a User ID in *gin.Context. It's only set for a Firebase user
 	GCtxUserIDKey string = "GCtxUserID"
+	// GCtxUserClaimsKey is the key of a map[string]interface{} of the claims of the ID token in *gin.Context
+	GCtxUserClaimsKey string = "GCtxUserClaims"
 )
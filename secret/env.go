@@ -0,0 +1,53 @@
+package secret
+
+import (
+	"context"
+	"os"
+	"strings"
+)
+
+// DefaultEnvPrefix is the prefix of the environment variables of the secrets
+const DefaultEnvPrefix = "MM_APIGATEWAY_SECRET_"
+
+// Env reads the secrets from environment variables. The variable of a secret is the prefix followed by the upper cased name, in which every character other than a letter or a digit is replaced by _
+type Env struct {
+	prefix string
+}
+
+// NewEnv reads the variables with the prefix, default DefaultEnvPrefix
+func NewEnv(prefix string) *Env {
+	if prefix == "" {
+		prefix = DefaultEnvPrefix
+	}
+	return &Env{prefix: prefix}
+}
+
+// Variable returns the environment variable of the secret
+func (e *Env) Variable(name string) string {
+	return e.prefix + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Latest returns the value of the variable. The version is the digest of the value
+func (e *Env) Latest(ctx context.Context, name string) (Secret, error) {
+	v, ok := os.LookupEnv(e.Variable(name))
+	if !ok {
+		return Secret{}, ErrNotFound
+	}
+	return Secret{
+		Version: contentVersion([]byte(v)),
+		Data:    []byte(v),
+	}, nil
+}
+
+// Add is not supported because the environment can't be changed for the other processes
+func (e *Env) Add(ctx context.Context, name string, data []byte) (Secret, error) {
+	return Secret{}, ErrReadOnly
+}
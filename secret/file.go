@@ -0,0 +1,105 @@
+package secret
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// DefaultDir is the directory of the secret files
+const DefaultDir = "./configs/secrets"
+
+// File reads every secret from the file of its name in a directory. The version is the digest of the content
+type File struct {
+	dir string
+}
+
+// NewFile reads the secrets in the directory, default DefaultDir
+func NewFile(dir string) *File {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return &File{dir: dir}
+}
+
+func (f *File) path(name string) string {
+	return filepath.Join(f.dir, filepath.Base(name))
+}
+
+// Latest reads the file of the secret
+func (f *File) Latest(ctx context.Context, name string) (Secret, error) {
+	data, err := ioutil.ReadFile(f.path(name))
+	if os.IsNotExist(err) {
+		return Secret{}, ErrNotFound
+	} else if err != nil {
+		return Secret{}, errors.Wrapf(err, "failed to read secret %s", name)
+	}
+	return Secret{
+		Version: contentVersion(data),
+		Data:    data,
+	}, nil
+}
+
+// Add replaces the file of the secret atomically
+func (f *File) Add(ctx context.Context, name string, data []byte) (Secret, error) {
+	tmp, err := ioutil.TempFile(f.dir, "."+filepath.Base(name)+".*")
+	if err != nil {
+		return Secret{}, errors.Wrapf(err, "failed to add a version to secret %s", name)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path(name))
+	}
+	if err != nil {
+		return Secret{}, errors.Wrapf(err, "failed to add a version to secret %s", name)
+	}
+	return Secret{
+		Version: contentVersion(data),
+		Data:    data,
+	}, nil
+}
+
+// Watch calls changed whenever the file of the secret is written, created or replaced. The directory is watched because editors and secret mounts replace the files
+func (f *File) Watch(ctx context.Context, name string, changed func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "failed to create the file watcher")
+	}
+	defer watcher.Close()
+	if err = watcher.Add(f.dir); err != nil {
+		return errors.Wrapf(err, "failed to watch %s", f.dir)
+	}
+
+	target := filepath.Clean(f.path(name))
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			// a mounted secret is replaced by swapping the ..data symlink of the directory
+			if filepath.Clean(event.Name) == target || filepath.Base(event.Name) == "..data" {
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					changed()
+				}
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			return errors.Wrap(err, "file watcher failed")
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package secret
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"github.com/pkg/errors"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+)
+
+// GCP reads the secrets from Google Cloud Secret Manager
+type GCP struct {
+	projectID string
+	client    *secretmanager.Client
+}
+
+// NewGCP creates the Secret Manager client of the project
+func NewGCP(ctx context.Context, projectID string) (*GCP, error) {
+	c, err := secretmanager.NewClient(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to setup client")
+	}
+	return &GCP{
+		projectID: projectID,
+		client:    c,
+	}, nil
+}
+
+// Latest returns the latest version of the secret
+func (g *GCP) Latest(ctx context.Context, name string) (Secret, error) {
+	req := &secretmanagerpb.AccessSecretVersionRequest{
+		Name: fmt.Sprintf("projects/%s/secrets/%s/versions/latest", g.projectID, name),
+	}
+	// the response names the resolved version, so that the data and the version always agree
+	resp, err := g.client.AccessSecretVersion(ctx, req)
+	if err != nil {
+		return Secret{}, errors.Wrapf(err, "failed to get latest version of secret data of %s", name)
+	}
+	return Secret{
+		Version: lastFragment(resp.GetName()),
+		Data:    resp.GetPayload().GetData(),
+	}, nil
+}
+
+// Add adds a version to the secret
+func (g *GCP) Add(ctx context.Context, name string, data []byte) (Secret, error) {
+	v, err := g.client.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+		Parent: fmt.Sprintf("projects/%s/secrets/%s", g.projectID, name),
+		Payload: &secretmanagerpb.SecretPayload{
+			Data: data,
+		},
+	})
+	if err != nil {
+		return Secret{}, errors.Wrapf(err, "failed to add a version to secret %s", name)
+	}
+	return Secret{
+		Version: lastFragment(v.GetName()),
+		Data:    data,
+	}, nil
+}
+
+func lastFragment(name string) string {
+	fragments := strings.Split(name, "/")
+	return fragments[len(fragments)-1]
+}
@@ -0,0 +1,68 @@
+package secret
+
+import (
+	"context"
+	"strconv"
+	"sync"
+)
+
+// Memory keeps the versions of the secrets in memory. It's meant for tests and local development
+type Memory struct {
+	mu       sync.Mutex
+	versions map[string][]Secret
+	watchers map[string][]func()
+}
+
+// NewMemory creates the provider with the initial data of the secrets
+func NewMemory(secrets map[string]string) *Memory {
+	m := &Memory{
+		versions: make(map[string][]Secret),
+		watchers: make(map[string][]func()),
+	}
+	for name, data := range secrets {
+		m.Add(context.Background(), name, []byte(data))
+	}
+	return m
+}
+
+// Latest returns the latest version of the secret
+func (m *Memory) Latest(ctx context.Context, name string) (Secret, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	versions := m.versions[name]
+	if len(versions) == 0 {
+		return Secret{}, ErrNotFound
+	}
+	return versions[len(versions)-1], nil
+}
+
+// Add adds a version numbered from 1 and notifies the watchers
+func (m *Memory) Add(ctx context.Context, name string, data []byte) (Secret, error) {
+	m.mu.Lock()
+	s := Secret{
+		Version: strconv.Itoa(len(m.versions[name]) + 1),
+		Data:    append([]byte(nil), data...),
+	}
+	m.versions[name] = append(m.versions[name], s)
+	watchers := m.watchers[name]
+	m.mu.Unlock()
+
+	for _, changed := range watchers {
+		changed()
+	}
+	return s, nil
+}
+
+// Watch calls changed whenever a version is added to the secret until the context is done
+func (m *Memory) Watch(ctx context.Context, name string, changed func()) error {
+	m.mu.Lock()
+	m.watchers[name] = append(m.watchers[name], changed)
+	i := len(m.watchers[name]) - 1
+	m.mu.Unlock()
+
+	<-ctx.Done()
+	m.mu.Lock()
+	m.watchers[name][i] = func() {}
+	m.mu.Unlock()
+	return nil
+}
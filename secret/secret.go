@@ -0,0 +1,66 @@
+// Package secret reads and rotates the secrets of the gateway from a pluggable provider
+package secret
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/mirror-media/mm-apigateway/config"
+)
+
+const (
+	ProviderGCP    = "gcp"
+	ProviderEnv    = "env"
+	ProviderFile   = "file"
+	ProviderMemory = "memory"
+)
+
+// ErrReadOnly is returned by the providers which can't add a version
+var ErrReadOnly = errors.New("secret provider is read only")
+
+// ErrNotFound is returned when the secret doesn't exist
+var ErrNotFound = errors.New("secret is not found")
+
+// Secret is a version of a secret
+type Secret struct {
+	Version string
+	Data    []byte
+}
+
+// Provider reads and adds the versions of the secrets
+type Provider interface {
+	// Latest returns the latest version of the secret
+	Latest(ctx context.Context, name string) (Secret, error)
+	// Add adds the data as the latest version of the secret
+	Add(ctx context.Context, name string, data []byte) (Secret, error)
+}
+
+// Watcher is a Provider which can notify the changes of a secret made outside of the gateway
+type Watcher interface {
+	// Watch calls changed whenever the secret changes until the context is done
+	Watch(ctx context.Context, name string, changed func()) error
+}
+
+// contentVersion names a version by the digest of the data for the providers without versions
+func contentVersion(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// New creates the provider picked by the config. Only gcp needs the project and the credentials
+func New(ctx context.Context, c config.SecretProvider, projectID string) (Provider, error) {
+	switch c.Type {
+	case "", ProviderGCP:
+		return NewGCP(ctx, projectID)
+	case ProviderEnv:
+		return NewEnv(c.EnvPrefix), nil
+	case ProviderFile:
+		return NewFile(c.Dir), nil
+	case ProviderMemory:
+		return NewMemory(c.Values), nil
+	}
+	return nil, fmt.Errorf("unsupported secret provider(%s)", c.Type)
+}
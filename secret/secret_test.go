@@ -0,0 +1,96 @@
+package secret
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileAddAndLatest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := NewFile(dir)
+	ctx := context.Background()
+	if _, err := f.Latest(ctx, "token"); err != ErrNotFound {
+		t.Fatalf("got error %v, want ErrNotFound", err)
+	}
+	added, err := f.Add(ctx, "token", []byte(`{"token":"a"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest, err := f.Latest(ctx, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.Version != added.Version || string(latest.Data) != `{"token":"a"}` {
+		t.Errorf("got %s(%s), want %s(%s)", latest.Data, latest.Version, `{"token":"a"}`, added.Version)
+	}
+}
+
+func TestFileWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := NewFile(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan struct{}, 10)
+	watching := make(chan error, 1)
+	go func() {
+		watching <- f.Watch(ctx, "token", func() { changed <- struct{}{} })
+	}()
+	// give the watcher the time to start
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := f.Add(ctx, "token", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case err := <-watching:
+		t.Fatalf("watch stopped: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the change of the secret is not notified")
+	}
+}
+
+func TestEnvLatest(t *testing.T) {
+	os.Setenv(DefaultEnvPrefix+"GATEWAY_TOKEN", "c")
+	defer os.Unsetenv(DefaultEnvPrefix + "GATEWAY_TOKEN")
+
+	e := NewEnv("")
+	latest, err := e.Latest(context.Background(), "gateway-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(latest.Data) != "c" {
+		t.Errorf("got %s, want c", latest.Data)
+	}
+	if _, err := e.Add(context.Background(), "gateway-token", nil); err != ErrReadOnly {
+		t.Errorf("got error %v, want ErrReadOnly", err)
+	}
+}
+
+func TestMemoryVersions(t *testing.T) {
+	m := NewMemory(map[string]string{"token": "a"})
+	ctx := context.Background()
+	if _, err := m.Add(ctx, "token", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	latest, err := m.Latest(ctx, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.Version != "2" || string(latest.Data) != "b" {
+		t.Errorf("got %s(%s), want b(2)", latest.Data, latest.Version)
+	}
+}
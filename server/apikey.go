@@ -0,0 +1,190 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/mm-apigateway/apikey"
+	log "github.com/sirupsen/logrus"
+)
+
+// Scopes of the API keys are the route groups built by SetRoute
+const (
+	ScopeV0 = "v0"
+	ScopeV1 = "v1"
+)
+
+// apiKeyScopes returns the known scopes, which are the route groups and the extra scopes, e.g. the ones of the GraphQL rules
+func apiKeyScopes(extra []string) map[string]bool {
+	scopes := map[string]bool{
+		ScopeV0: true,
+		ScopeV1: true,
+	}
+	for _, s := range extra {
+		scopes[s] = true
+	}
+	return scopes
+}
+
+// APIKeyRequest creates an API key or replaces its scopes and rate limit
+type APIKeyRequest struct {
+	Name      string            `json:"name,omitempty"`
+	Scopes    []string          `json:"scopes"`
+	RateLimit *apikey.RateLimit `json:"rateLimit,omitempty"`
+}
+
+// APIKeyReply is the key without its digest. Key is only replied when it's created
+type APIKeyReply struct {
+	Key    string     `json:"key,omitempty"`
+	APIKey apikey.Key `json:"apiKey"`
+}
+
+// APIKeysReply lists the keys without their digests
+type APIKeysReply struct {
+	APIKeys []apikey.Key `json:"apiKeys"`
+}
+
+// RequireScope is a middleware to allow only the principals granted the scope. The principals without scopes, e.g. the Firebase users, are allowed every scope
+func RequireScope(server *Server, scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := principalOf(c)
+		if principal == nil || principal.AllowsScope(scope) {
+			c.Next()
+			return
+		}
+		log.WithFields(log.Fields{
+			"path":      c.FullPath(),
+			"principal": principal,
+		}).Infof("principal is not granted the scope(%s)", scope)
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorReply{
+			Errors: []Error{{Message: fmt.Sprintf("scope %s is required", scope)}},
+		})
+	}
+}
+
+// bindAPIKeyRequest binds the body and validates the scopes and the rate limit
+func bindAPIKeyRequest(c *gin.Context, scopes map[string]bool) (APIKeyRequest, bool) {
+	var req APIKeyRequest
+	err := c.ShouldBindJSON(&req)
+	if err == nil {
+		for _, s := range req.Scopes {
+			if !scopes[s] {
+				err = fmt.Errorf("unknown scope(%s)", s)
+			}
+		}
+	}
+	// a key of no requests would be unlimited instead of blocked
+	if err == nil && req.RateLimit != nil && req.RateLimit.Requests <= 0 {
+		err = fmt.Errorf("rate limit needs a positive number of requests")
+	}
+	if err == nil && req.RateLimit != nil && (req.RateLimit.Window < 0 || req.RateLimit.Burst < 0) {
+		err = fmt.Errorf("rate limit can't be negative")
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorReply{
+			Errors: []Error{{Message: err.Error()}},
+		})
+		return req, false
+	}
+	return req, true
+}
+
+// abortWithAPIKeyError replies the error of the manager
+func abortWithAPIKeyError(c *gin.Context, logger *log.Entry, err error) {
+	status := http.StatusInternalServerError
+	switch err {
+	case apikey.ErrNotFound:
+		status = http.StatusNotFound
+	case apikey.ErrRevoked:
+		status = http.StatusConflict
+	default:
+		logger.Error(err)
+	}
+	c.AbortWithStatusJSON(status, ErrorReply{
+		Errors: []Error{{Message: err.Error()}},
+	})
+}
+
+// ListAPIKeysHandler lists every API key, including the revoked ones
+func ListAPIKeysHandler(server *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := log.WithFields(log.Fields{
+			"path": c.FullPath(),
+		})
+		keys, err := server.APIKeys.List(c.Request.Context())
+		if err != nil {
+			abortWithAPIKeyError(c, logger, err)
+			return
+		}
+		reply := APIKeysReply{APIKeys: make([]apikey.Key, 0, len(keys))}
+		for _, k := range keys {
+			reply.APIKeys = append(reply.APIKeys, k.Public())
+		}
+		c.JSON(http.StatusOK, reply)
+	}
+}
+
+// CreateAPIKeyHandler creates an API key. The key is only replied once. The scopes are the route groups and the extra scopes
+func CreateAPIKeyHandler(server *Server, extraScopes []string) gin.HandlerFunc {
+	scopes := apiKeyScopes(extraScopes)
+	return func(c *gin.Context) {
+		logger := log.WithFields(log.Fields{
+			"path": c.FullPath(),
+		})
+		req, ok := bindAPIKeyRequest(c, scopes)
+		if !ok {
+			return
+		}
+		if req.Name == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, ErrorReply{
+				Errors: []Error{{Message: "name is required"}},
+			})
+			return
+		}
+		key, k, err := server.APIKeys.Create(c.Request.Context(), req.Name, req.Scopes, req.RateLimit)
+		if err != nil {
+			abortWithAPIKeyError(c, logger, err)
+			return
+		}
+		logger.Infof("api key(%s) of %s is created by %v", k.ID, k.Name, principalOf(c))
+		c.JSON(http.StatusCreated, APIKeyReply{Key: key, APIKey: k.Public()})
+	}
+}
+
+// SetAPIKeyScopesHandler replaces the scopes of the API key, and the rate limit if it's in the body. The scopes are the route groups and the extra scopes
+func SetAPIKeyScopesHandler(server *Server, extraScopes []string) gin.HandlerFunc {
+	scopes := apiKeyScopes(extraScopes)
+	return func(c *gin.Context) {
+		logger := log.WithFields(log.Fields{
+			"path": c.FullPath(),
+		})
+		req, ok := bindAPIKeyRequest(c, scopes)
+		if !ok {
+			return
+		}
+		k, err := server.APIKeys.SetScopes(c.Request.Context(), c.Param("id"), req.Scopes, req.RateLimit)
+		if err != nil {
+			abortWithAPIKeyError(c, logger, err)
+			return
+		}
+		logger.Infof("scopes of api key(%s) are set to %v by %v", k.ID, k.Scopes, principalOf(c))
+		c.JSON(http.StatusOK, APIKeyReply{APIKey: k.Public()})
+	}
+}
+
+// RevokeAPIKeyHandler revokes the API key
+func RevokeAPIKeyHandler(server *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := log.WithFields(log.Fields{
+			"path": c.FullPath(),
+		})
+		k, err := server.APIKeys.Revoke(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			abortWithAPIKeyError(c, logger, err)
+			return
+		}
+		logger.Infof("api key(%s) is revoked by %v", k.ID, principalOf(c))
+		c.JSON(http.StatusOK, APIKeyReply{APIKey: k.Public()})
+	}
+}
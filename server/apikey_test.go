@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/mm-apigateway/apikey"
+	"github.com/mirror-media/mm-apigateway/identity"
+	"github.com/mirror-media/mm-apigateway/middleware"
+)
+
+func newAPIKeyEngine(t *testing.T) *gin.Engine {
+	store, err := apikey.NewFileStore(filepath.Join(t.TempDir(), "apikeys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{APIKeys: apikey.NewManager(store)}
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.GET("/apikeys", ListAPIKeysHandler(server))
+	engine.POST("/apikeys", CreateAPIKeyHandler(server, []string{"feed"}))
+	engine.PUT("/apikeys/:id/scopes", SetAPIKeyScopesHandler(server, []string{"feed"}))
+	engine.DELETE("/apikeys/:id", RevokeAPIKeyHandler(server))
+	return engine
+}
+
+// serveJSON serves the request of the body and decodes the reply into reply if it's not nil
+func serveJSON(t *testing.T, engine *gin.Engine, method string, path string, body string, reply interface{}) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	if reply != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), reply); err != nil {
+			t.Fatalf("reply(%s) is malformed: %v", w.Body, err)
+		}
+	}
+	return w.Code
+}
+
+func TestAPIKeyHandlers(t *testing.T) {
+	engine := newAPIKeyEngine(t)
+
+	var created APIKeyReply
+	if status := serveJSON(t, engine, http.MethodPost, "/apikeys", `{"name":"rss","scopes":["v0","feed"],"rateLimit":{"requests":10}}`, &created); status != http.StatusCreated {
+		t.Fatalf("create got %d", status)
+	}
+	k := created.APIKey
+	if !apikey.IsManaged(created.Key) || k.Digest != "" || k.Name != "rss" || len(k.Scopes) != 2 || k.RateLimit.Requests != 10 {
+		t.Fatalf("created key is %+v", created)
+	}
+
+	var set APIKeyReply
+	if status := serveJSON(t, engine, http.MethodPut, "/apikeys/"+k.ID+"/scopes", `{"scopes":["v1"]}`, &set); status != http.StatusOK {
+		t.Fatalf("set scopes got %d", status)
+	}
+	if len(set.APIKey.Scopes) != 1 || set.APIKey.Scopes[0] != "v1" || set.APIKey.RateLimit.Requests != 10 || set.Key != "" {
+		t.Fatalf("key of the set scopes is %+v", set)
+	}
+
+	var revoked APIKeyReply
+	if status := serveJSON(t, engine, http.MethodDelete, "/apikeys/"+k.ID, "", &revoked); status != http.StatusOK || revoked.APIKey.RevokedAt == nil {
+		t.Fatalf("revoke got %d: %+v", status, revoked)
+	}
+	if status := serveJSON(t, engine, http.MethodPut, "/apikeys/"+k.ID+"/scopes", `{"scopes":["v1"]}`, nil); status != http.StatusConflict {
+		t.Fatalf("set scopes of a revoked key got %d", status)
+	}
+
+	var list APIKeysReply
+	if status := serveJSON(t, engine, http.MethodGet, "/apikeys", "", &list); status != http.StatusOK {
+		t.Fatalf("list got %d", status)
+	}
+	if len(list.APIKeys) != 1 || list.APIKeys[0].ID != k.ID || list.APIKeys[0].Digest != "" {
+		t.Fatalf("listed keys are %+v", list)
+	}
+}
+
+func TestAPIKeyHandlersRejectInvalidRequests(t *testing.T) {
+	engine := newAPIKeyEngine(t)
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{name: "no name", method: http.MethodPost, path: "/apikeys", body: `{"scopes":["v0"]}`, status: http.StatusBadRequest},
+		{name: "unknown scope", method: http.MethodPost, path: "/apikeys", body: `{"name":"rss","scopes":["admin"]}`, status: http.StatusBadRequest},
+		{name: "no requests", method: http.MethodPost, path: "/apikeys", body: `{"name":"rss","scopes":["v0"],"rateLimit":{"requests":0}}`, status: http.StatusBadRequest},
+		{name: "negative burst", method: http.MethodPost, path: "/apikeys", body: `{"name":"rss","scopes":["v0"],"rateLimit":{"requests":1,"burst":-1}}`, status: http.StatusBadRequest},
+		{name: "malformed body", method: http.MethodPost, path: "/apikeys", body: `{`, status: http.StatusBadRequest},
+		{name: "unknown key", method: http.MethodPut, path: "/apikeys/unknown/scopes", body: `{"scopes":["v0"]}`, status: http.StatusNotFound},
+		{name: "revoke an unknown key", method: http.MethodDelete, path: "/apikeys/unknown", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reply ErrorReply
+			if status := serveJSON(t, engine, tt.method, tt.path, tt.body, &reply); status != tt.status || len(reply.Errors) != 1 {
+				t.Fatalf("got %d: %+v", status, reply)
+			}
+		})
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal *identity.Principal
+		status    int
+	}{
+		{name: "anonymous", status: http.StatusOK},
+		{name: "firebase user", principal: &identity.Principal{Subject: "u1", Provider: identity.ProviderFirebase}, status: http.StatusOK},
+		{name: "granted key", principal: &identity.Principal{Subject: "k1", Provider: identity.ProviderAPIKey, Scopes: []string{"v0", "v1"}}, status: http.StatusOK},
+		{name: "key of another scope", principal: &identity.Principal{Subject: "k1", Provider: identity.ProviderAPIKey, Scopes: []string{"v0"}}, status: http.StatusForbidden},
+		{name: "key of no scope", principal: &identity.Principal{Subject: "k1", Provider: identity.ProviderAPIKey, Scopes: []string{}}, status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			engine := gin.New()
+			engine.GET("/v1/ping", func(c *gin.Context) {
+				if tt.principal != nil {
+					c.Set(middleware.GCtxPrincipalKey, tt.principal)
+				}
+			}, RequireScope(&Server{}, ScopeV1), func(c *gin.Context) {
+				c.String(http.StatusOK, "pong")
+			})
+			w := httptest.NewRecorder()
+			engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/ping", nil))
+			if w.Code != tt.status {
+				t.Fatalf("got %d", w.Code)
+			}
+		})
+	}
+}
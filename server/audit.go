@@ -0,0 +1,62 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/mm-apigateway/audit"
+	"github.com/mirror-media/mm-apigateway/middleware"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// RequestIDHeader carries the ID of a request from the client or a load balancer, and back in the response
+	RequestIDHeader    = "X-Request-ID"
+	maxRequestIDLength = 128
+)
+
+// validRequestID accepts the printable ASCII IDs of a reasonable length, so that an ID can't forge the logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestID is a middleware to identify every request by the X-Request-ID header, or by a random ID if there's no valid one. The ID is replied in the header too
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID(id) {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err != nil {
+				log.Warnf("fail to generate a request id: %v", err)
+			}
+			id = hex.EncodeToString(b)
+		}
+		c.Set(middleware.GCtxRequestIDKey, id)
+		c.Header(RequestIDHeader, id)
+		c.Next()
+	}
+}
+
+// AuditContextMiddleware saves the requester of the audit events to *context. It has to be used after AuthenticateIDToken
+func AuditContextMiddleware(server *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		r := audit.Request{
+			ID:       c.GetString(middleware.GCtxRequestIDKey),
+			ClientIP: clientIP(server, c),
+		}
+		if principal := principalOf(c); principal != nil {
+			r.Actor, r.ActorProvider = principal.Subject, principal.Provider
+		}
+		c.Request = c.Request.WithContext(audit.WithRequest(c.Request.Context(), r))
+		c.Next()
+	}
+}
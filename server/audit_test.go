@@ -0,0 +1,33 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/mm-apigateway/audit"
+	"github.com/mirror-media/mm-apigateway/config"
+)
+
+func TestAuditContextUsesTheTrustedClientIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := &Server{Conf: &config.Conf{TrustedProxies: 1}}
+	var r audit.Request
+	engine := gin.New()
+	engine.Use(RequestID(), AuditContextMiddleware(server))
+	engine.GET("/v1/ping", func(c *gin.Context) {
+		r = audit.RequestFrom(c.Request.Context())
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/ping", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	// the client can prepend any address to the header but not the one appended by the load balancer
+	req.Header.Set("X-Forwarded-For", "6.6.6.6, 1.2.3.4")
+	req.Header.Set(RequestIDHeader, "req-1")
+	engine.ServeHTTP(httptest.NewRecorder(), req)
+
+	if r.ClientIP != "1.2.3.4" || r.ID != "req-1" {
+		t.Fatalf("audit request is %+v", r)
+	}
+}
@@ -0,0 +1,519 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/mm-apigateway/cache"
+	"github.com/mirror-media/mm-apigateway/config"
+	"github.com/mirror-media/mm-apigateway/identity"
+	"github.com/mirror-media/mm-apigateway/middleware"
+	"github.com/mirror-media/mm-apigateway/token"
+	"github.com/mirror-media/mm-apigateway/transform"
+	"github.com/mirror-media/mm-apigateway/upstream"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	cacheKeyNamespace   = "mm-apigateway"
+	jsonContentType     = "application/json; charset=utf-8"
+	defaultMaxBodyBytes = 8 << 20
+)
+
+func singleJoiningSlash(a, b string) string {
+
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+func joinURLPath(a, b *url.URL) (path, rawpath string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return singleJoiningSlash(a.Path, b.Path), ""
+	}
+
+	// Same as singleJoiningSlash, but uses EscapedPath to determine
+	// whether a slash should be added
+	apath := a.EscapedPath()
+	bpath := b.EscapedPath()
+	aslash := strings.HasSuffix(apath, "/")
+	bslash := strings.HasPrefix(bpath, "/")
+	switch {
+	case aslash && bslash:
+		return a.Path + b.Path[1:], apath + bpath[1:]
+	case !aslash && !bslash:
+		return a.Path + "/" + b.Path, apath + "/" + bpath
+	}
+
+	return a.Path + b.Path, apath + bpath
+
+}
+
+// getTokenStatus returns the status of the token saved by GetIDTokenOnly. The detail is logged and only kept in debug mode
+func getTokenStatus(c *gin.Context, debug bool) token.Status {
+	tokenSaved, exist := c.Get(middleware.GCtxTokenKey)
+	if !exist {
+		return token.Status{State: token.StateNotProvided}
+	}
+	status := token.StatusOf(tokenSaved.(token.Token))
+	if status.Detail != "" {
+		log.WithFields(log.Fields{
+			"path":       c.FullPath(),
+			"tokenState": status.State,
+		}).Info(status.Detail)
+	}
+	if !debug {
+		status.Detail = ""
+	}
+	return status
+}
+
+// cacheKey returns the redis key of the response for the requester
+func cacheKey(route *proxyRoute, c *gin.Context, tokenState token.State) string {
+	variant := "notmember"
+	if tokenState == token.OK {
+		variant = "member"
+	}
+	return fmt.Sprintf("%s.%s.%s.%s", cacheKeyNamespace, route.Cache.KeyPrefix, variant, c.Request.RequestURI)
+}
+
+// transformBody applies the transformers of the route to the body in a single pass
+func transformBody(route *proxyRoute, tc TransformContext, body []byte) ([]byte, error) {
+	if len(route.transformers) == 0 {
+		return body, nil
+	}
+	doc := transform.NewDocument(body)
+	for i, t := range route.transformers {
+		if err := t(tc, doc); err != nil {
+			return nil, errors.WithMessagef(err, "transformer(%s) failed", route.Transformers[i])
+		}
+	}
+	return doc.Bytes()
+}
+
+// readBody reads the whole body into a buffer sized by the content length
+func readBody(r *http.Response) ([]byte, error) {
+	defer r.Body.Close()
+	if r.ContentLength <= 0 {
+		return io.ReadAll(r.Body)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, r.ContentLength+bytes.MinRead))
+	_, err := buf.ReadFrom(r.Body)
+	return buf.Bytes(), err
+}
+
+// ModifyReverseProxyResponse modifies the JSON body of a successful response by the transformers of the route, and wraps it in a Reply if wrap is true. An unsuccessful response is wrapped in an ErrorReply instead. routePath is the path relative to the api version. A wrapped response is tagged with the ETag of the Reply and answers the conditional headers of reqHeader with 304. It's private if the requester is authenticated
+func ModifyReverseProxyResponse(route *proxyRoute, routePath string, tokenStatus token.Status, wrap bool, private bool, reqHeader http.Header) func(*http.Response) error {
+	logger := log.WithFields(log.Fields{
+		"path":  routePath,
+		"route": route.Name,
+	})
+	return func(r *http.Response) error {
+		body, err := readBody(r)
+		if err != nil {
+			logger.Errorf("encounter error when reading proxy response: %v", err)
+			return err
+		}
+
+		switch {
+		case !successful(r.StatusCode):
+			if wrap {
+				body, err = json.Marshal(upstreamErrorReply(r.StatusCode, r.Header, body))
+				if err != nil {
+					logger.Errorf("Marshalling error reply encountered error: %v", err)
+					return err
+				}
+				r.Header.Set("Content-Type", jsonContentType)
+				r.Header.Del("ETag")
+			}
+		case !isJSON(r.Header, body):
+			if len(route.transformers) > 0 {
+				err = fmt.Errorf("body of content type(%s) can't be transformed", r.Header.Get("Content-Type"))
+				logger.Error(err)
+				return err
+			}
+			// a body which isn't JSON is passed through without being wrapped
+		default:
+			body, err = transformBody(route, TransformContext{
+				Route:  routePath,
+				Member: tokenStatus.State == token.OK,
+			}, body)
+			if err != nil {
+				logger.Error(err)
+				return err
+			}
+			if !wrap {
+				break
+			}
+
+			body, err = wrapReply(tokenStatus, body)
+			if err != nil {
+				logger.Errorf("Marshalling reply encountered error: %v", err)
+				return err
+			}
+			r.Header.Set("Content-Type", jsonContentType)
+
+			etag := cache.ETag(body)
+			r.Header.Set("ETag", etag)
+			if cc := responseCacheControl(private, r.Header.Get("Cache-Control")); cc != "" {
+				r.Header.Set("Cache-Control", cc)
+			}
+			r.Header.Add("Vary", credentialHeaders)
+			if r.StatusCode == http.StatusOK && cache.NotModified(reqHeader, etag, r.Header.Get("Last-Modified")) {
+				r.StatusCode = http.StatusNotModified
+				body = nil
+			}
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		return nil
+	}
+}
+
+// newDirector returns a director rewriting the request to the target and stripping the path base
+func newDirector(target *url.URL, pathBaseToStrip string) func(req *http.Request) {
+	targetQuery := target.RawQuery
+	return func(req *http.Request) {
+		if strings.HasSuffix(pathBaseToStrip, "/") {
+			pathBaseToStrip = pathBaseToStrip + "/"
+		}
+		req.URL.Path = strings.TrimPrefix(req.URL.Path, pathBaseToStrip)
+		req.URL.RawPath = strings.TrimPrefix(req.URL.RawPath, pathBaseToStrip)
+
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+		req.URL.Path, req.URL.RawPath = joinURLPath(target, req.URL)
+
+		if targetQuery == "" || req.URL.RawQuery == "" {
+			req.URL.RawQuery = targetQuery + req.URL.RawQuery
+		} else {
+			req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
+		}
+
+		// the gateway validates the conditional requests against its own ETag of the modified body, and the body has to be readable by the transformers
+		req.Header.Del("If-None-Match")
+		req.Header.Del("If-Modified-Since")
+		req.Header.Del("Accept-Encoding")
+
+		if _, ok := req.Header["User-Agent"]; !ok {
+			// explicitly disable User-Agent so it's not set to default value
+			req.Header.Set("User-Agent", "")
+		}
+	}
+}
+
+// NewReverseProxy returns a handler proxying the request to a healthy target of the upstream of the route. The responses are served from the cache if the route enables it
+func NewReverseProxy(pool *upstream.Pool, pathBaseToStrip string, responseCache *cache.Cache, index *CacheIndex, route *proxyRoute) func(c *gin.Context) {
+	// serve proxies the request and writes the response to w. It must not refer to the gin.Context, which is recycled before a background refresh runs. A failure of the proxy is written to w as an ErrorReply only if wrap is true
+	serve := func(w http.ResponseWriter, r *http.Request, routePath string, tokenStatus token.Status, wrap bool, private bool) error {
+		logger := log.WithFields(log.Fields{
+			"path":     routePath,
+			"upstream": pool.Name(),
+		})
+		target, err := pool.Pick(r.RequestURI)
+		if err != nil {
+			logger.Error(err)
+			if wrap {
+				writeErrorReply(w, http.StatusServiceUnavailable, fmt.Sprintf("upstream(%s) is unavailable", pool.Name()))
+			}
+			return err
+		}
+		release := target.Acquire()
+		defer release()
+
+		var proxyErr error
+		reverseProxy := httputil.ReverseProxy{Director: newDirector(target.URL, pathBaseToStrip)}
+		reverseProxy.ModifyResponse = ModifyReverseProxyResponse(route, routePath, tokenStatus, wrap, private, r.Header)
+		reverseProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			proxyErr = err
+			logger.Errorf("proxying encountered error: %v", err)
+			if wrap {
+				writeErrorReply(w, http.StatusBadGateway, fmt.Sprintf("upstream(%s) failed", pool.Name()))
+			}
+		}
+		reverseProxy.ServeHTTP(w, r)
+		return proxyErr
+	}
+
+	return func(c *gin.Context) {
+		tokenStatus := getTokenStatus(c, route.debug)
+		routePath := strings.TrimPrefix(c.Request.URL.Path, pathBaseToStrip)
+
+		if !route.Cache.Enabled {
+			_ = serve(c.Writer, c.Request, routePath, tokenStatus, true, isPrivate(c))
+			return
+		}
+
+		key := cacheKey(route, c, tokenStatus.State)
+		req := c.Request
+		opts := route.cacheOptions
+		opts.RequestHeader = req.Header
+		entry, result, err := responseCache.Fetch(req.Context(), key, opts, func(ctx context.Context) (*cache.Entry, error) {
+			// the request is detached from the requester so that the load can finish for the other requests sharing it
+			w := newBufferedResponseWriter()
+			if err := serve(w, req.Clone(ctx), routePath, tokenStatus, false, false); err != nil {
+				return nil, err
+			}
+			entry := &cache.Entry{
+				Status: w.status,
+				Header: cache.FilterHeader(w.header),
+				Body:   w.body.Bytes(),
+			}
+			if reason := route.uncacheable(entry.Status, w.header, len(entry.Body)); reason != "" {
+				log.WithField("path", routePath).Debugf("response of %s is not cached: %s", req.RequestURI, reason)
+				entry.Uncacheable = true
+			} else if entry.Status == http.StatusOK {
+				index.Add(ctx, route.Cache.KeyPrefix, req.RequestURI, entry.Body, route.cacheOptions.HardTTL)
+			}
+			return entry, nil
+		})
+		c.Header("X-Cache", string(result))
+		if err != nil {
+			log.WithField("path", c.FullPath()).Errorf("fetching %s encountered error: %v", key, err)
+			c.AbortWithStatusJSON(http.StatusBadGateway, ErrorReply{
+				Errors: []Error{{Message: "upstream failed"}},
+			})
+			return
+		}
+		if entry.Negative && len(entry.Body) == 0 {
+			c.AbortWithStatusJSON(entry.Status, ErrorReply{
+				Errors: []Error{{Message: "upstream failed"}},
+			})
+			return
+		}
+
+		contentType := jsonContentType
+		var body []byte
+		switch {
+		case !successful(entry.Status):
+			body, err = json.Marshal(upstreamErrorReply(entry.Status, entry.Header, entry.Body))
+		case !isJSON(entry.Header, entry.Body):
+			contentType, body = entry.Header.Get("Content-Type"), entry.Body
+		default:
+			body, err = wrapReply(tokenStatus, entry.Body)
+		}
+		if err != nil {
+			log.WithField("path", c.FullPath()).Errorf("Marshalling reply encountered error: %v", err)
+			c.AbortWithStatusJSON(http.StatusBadGateway, ErrorReply{
+				Errors: []Error{{Message: "upstream failed"}},
+			})
+			return
+		}
+		writeEntry(c, entry, body, contentType)
+	}
+}
+
+// writeEntry writes the wrapped body of the cached entry with its status and headers, or 304 if the conditional headers of the request match
+func writeEntry(c *gin.Context, entry *cache.Entry, body []byte, contentType string) {
+	now := time.Now()
+	header := c.Writer.Header()
+	for _, name := range []string{"Expires", "Last-Modified"} {
+		if v := entry.Header.Get(name); v != "" {
+			header.Set(name, v)
+		}
+	}
+	etag := cache.ETag(body)
+	header.Set("ETag", etag)
+	header.Set("Age", strconv.Itoa(int(entry.Age(now)/time.Second)))
+	header.Set("Vary", strings.Join(append([]string{credentialHeaders}, entry.Vary...), ", "))
+	private := isPrivate(c)
+
+	switch {
+	case entry.Negative:
+		header.Set("Cache-Control", "no-store")
+	case entry.Uncacheable:
+		if cc := responseCacheControl(private, entry.Header.Get("Cache-Control")); cc != "" {
+			header.Set("Cache-Control", cc)
+		}
+	case private:
+		header.Set("Cache-Control", "private, no-cache")
+	default:
+		maxAge := entry.SoftExpiry.Sub(now)
+		if maxAge < 0 {
+			maxAge = 0
+		}
+		header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d, stale-while-revalidate=%d", maxAge/time.Second, entry.HardExpiry.Sub(entry.SoftExpiry)/time.Second))
+	}
+
+	if entry.Status == http.StatusOK && cache.NotModified(c.Request.Header, etag, entry.Header.Get("Last-Modified")) {
+		c.AbortWithStatus(http.StatusNotModified)
+		return
+	}
+	c.Abort()
+	c.Data(entry.Status, contentType, body)
+}
+
+// credentialHeaders are the request headers carrying the credentials, which the responses vary by
+const credentialHeaders = "Authorization, " + identity.APIKeyHeader
+
+// isPrivate reports whether the requester is authenticated or has sent credentials, whose responses must not be shared
+func isPrivate(c *gin.Context) bool {
+	return principalOf(c) != nil || c.Request.Header.Get("Authorization") != "" || c.Request.Header.Get(identity.APIKeyHeader) != ""
+}
+
+// responseCacheControl returns the Cache-Control of a response that isn't served from the cache. The responses to the authenticated requests are private because the Reply depends on the requester
+func responseCacheControl(private bool, upstreamCacheControl string) string {
+	if !private {
+		return upstreamCacheControl
+	}
+	if cc := cache.ParseCacheControl(http.Header{"Cache-Control": {upstreamCacheControl}}); cc.NoStore {
+		return "no-store"
+	}
+	return "private, no-cache"
+}
+
+// successful reports whether the status is 2xx
+func successful(status int) bool {
+	return status >= 200 && status < 300
+}
+
+// isJSON reports whether the body is valid JSON of a JSON media type. A body without a content type is sniffed
+func isJSON(header http.Header, body []byte) bool {
+	if ct := header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+			return false
+		}
+	}
+	return json.Valid(body)
+}
+
+// wrapReply wraps the JSON body in a Reply. The body is copied once instead of being compacted by json.Marshal
+func wrapReply(tokenStatus token.Status, body []byte) ([]byte, error) {
+	head, err := json.Marshal(Reply{
+		TokenState:       tokenStatus.State,
+		TokenStateDetail: tokenStatus.Detail,
+	})
+	if err != nil || len(body) == 0 {
+		return head, err
+	}
+	const data = `,"data":`
+	// the head is the reply without data, its closing brace is replaced by the data
+	b := make([]byte, 0, len(head)+len(data)+len(body))
+	b = append(b, head[:len(head)-1]...)
+	b = append(b, data...)
+	b = append(b, body...)
+	return append(b, '}'), nil
+}
+
+// upstreamErrorReply wraps the unsuccessful response of the upstream
+func upstreamErrorReply(status int, header http.Header, body []byte) ErrorReply {
+	return ErrorReply{
+		Errors: []Error{{Message: fmt.Sprintf("upstream responded with status %d", status)}},
+		Upstream: &UpstreamError{
+			Status:      status,
+			ContentType: header.Get("Content-Type"),
+			Body:        string(body),
+		},
+	}
+}
+
+func writeErrorReply(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(ErrorReply{
+		Errors: []Error{{Message: message}},
+	})
+}
+
+// uncacheable returns why the response may not be stored by the rules of the route, or an empty string if it may. Upstream errors are left to the negative cache
+func (r *proxyRoute) uncacheable(status int, header http.Header, size int) string {
+	if status >= http.StatusInternalServerError {
+		return ""
+	}
+	statuses := r.Cache.Statuses
+	if len(statuses) == 0 {
+		statuses = []int{http.StatusOK}
+	}
+	allowed := false
+	for _, s := range statuses {
+		allowed = allowed || s == status
+	}
+	if !allowed {
+		return fmt.Sprintf("status %d is not allowed", status)
+	}
+
+	contentTypes := r.Cache.ContentTypes
+	if len(contentTypes) == 0 {
+		contentTypes = []string{"application/json"}
+	}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	allowed = false
+	for _, ct := range contentTypes {
+		allowed = allowed || strings.EqualFold(ct, mediaType)
+	}
+	if !allowed {
+		return fmt.Sprintf("content type(%s) is not allowed", header.Get("Content-Type"))
+	}
+
+	maxBodyBytes := r.Cache.MaxBodyBytes
+	if maxBodyBytes <= 0 {
+		maxBodyBytes = defaultMaxBodyBytes
+	}
+	if int64(size) > maxBodyBytes {
+		return fmt.Sprintf("body of %d bytes exceeds %d bytes", size, maxBodyBytes)
+	}
+	return ""
+}
+
+// bufferedResponseWriter keeps the response of a load in memory
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponseWriter() *bufferedResponseWriter {
+	return &bufferedResponseWriter{
+		header: make(http.Header),
+		status: http.StatusOK,
+	}
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+// cacheOptions returns the cache options of the route. The ttls in seconds fall back to the defaults if they are not positive
+func cacheOptions(rc config.RouteCache, defaults config.RedisCache) cache.Options {
+	seconds := func(ttl int, defaultTTL int) time.Duration {
+		if ttl <= 0 {
+			ttl = defaultTTL
+		}
+		return time.Duration(ttl) * time.Second
+	}
+	soft := seconds(rc.TTL, defaults.TTL)
+	return cache.Options{
+		SoftTTL:     soft,
+		HardTTL:     soft + seconds(rc.StaleTTL, defaults.StaleTTL),
+		NegativeTTL: seconds(rc.NegativeTTL, defaults.NegativeTTL),
+	}
+}
@@ -0,0 +1,512 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/mirror-media/mm-apigateway/cache"
+	"github.com/mirror-media/mm-apigateway/config"
+	"github.com/mirror-media/mm-apigateway/entitlement"
+	"github.com/mirror-media/mm-apigateway/identity"
+	"github.com/mirror-media/mm-apigateway/middleware"
+	"github.com/mirror-media/mm-apigateway/token"
+	"github.com/mirror-media/mm-apigateway/transform"
+	"github.com/mirror-media/mm-apigateway/upstream"
+)
+
+// fakeRedis keeps the strings and sets of the Rediser in memory. It ignores the ttls
+type fakeRedis struct {
+	mu      sync.Mutex
+	strings map[string]string
+	sets    map[string]map[string]bool
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{
+		strings: make(map[string]string),
+		sets:    make(map[string]map[string]bool),
+	}
+}
+
+func (f *fakeRedis) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.StatusCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch v := value.(type) {
+	case []byte:
+		f.strings[key] = string(v)
+	case string:
+		f.strings[key] = v
+	}
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (f *fakeRedis) SetXX(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.BoolCmd {
+	f.mu.Lock()
+	_, ok := f.strings[key]
+	f.mu.Unlock()
+	if ok {
+		f.Set(ctx, key, value, ttl)
+	}
+	return redis.NewBoolResult(ok, nil)
+}
+
+func (f *fakeRedis) SetNX(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.BoolCmd {
+	f.mu.Lock()
+	_, ok := f.strings[key]
+	f.mu.Unlock()
+	if !ok {
+		f.Set(ctx, key, value, ttl)
+	}
+	return redis.NewBoolResult(!ok, nil)
+}
+
+func (f *fakeRedis) Get(ctx context.Context, key string) *redis.StringCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.strings[key]
+	if !ok {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult(v, nil)
+}
+
+func (f *fakeRedis) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var n int64
+	for _, key := range keys {
+		if _, ok := f.strings[key]; ok {
+			delete(f.strings, key)
+			n++
+		}
+		if _, ok := f.sets[key]; ok {
+			delete(f.sets, key)
+			n++
+		}
+	}
+	return redis.NewIntResult(n, nil)
+}
+
+func (f *fakeRedis) Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd {
+	return redis.NewBoolResult(true, nil)
+}
+
+func (f *fakeRedis) SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.sets[key] == nil {
+		f.sets[key] = make(map[string]bool)
+	}
+	for _, m := range members {
+		f.sets[key][m.(string)] = true
+	}
+	return redis.NewIntResult(int64(len(members)), nil)
+}
+
+func (f *fakeRedis) SMembers(ctx context.Context, key string) *redis.StringSliceCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	members := make([]string, 0, len(f.sets[key]))
+	for m := range f.sets[key] {
+		members = append(members, m)
+	}
+	return redis.NewStringSliceResult(members, nil)
+}
+
+func (f *fakeRedis) SRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, m := range members {
+		delete(f.sets[key], m.(string))
+	}
+	return redis.NewIntResult(int64(len(members)), nil)
+}
+
+func (f *fakeRedis) ZAdd(ctx context.Context, key string, members ...*redis.Z) *redis.IntCmd {
+	return redis.NewIntResult(0, errors.New("zadd is not supported"))
+}
+
+func (f *fakeRedis) ZRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	return redis.NewIntResult(0, errors.New("zrem is not supported"))
+}
+
+func (f *fakeRedis) ZRangeByScore(ctx context.Context, key string, opt *redis.ZRangeBy) *redis.StringSliceCmd {
+	return redis.NewStringSliceResult(nil, errors.New("zrangebyscore is not supported"))
+}
+
+func (f *fakeRedis) Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd {
+	return redis.NewCmdResult(nil, errors.New("eval is not supported"))
+}
+
+func (f *fakeRedis) Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd {
+	return redis.NewIntResult(0, nil)
+}
+
+func (f *fakeRedis) Subscribe(ctx context.Context, channels ...string) *redis.PubSub {
+	return nil
+}
+
+type upstreamResponse struct {
+	status      int
+	contentType string
+	body        string
+}
+
+// newTestGateway serves the route table of v0 in front of an upstream answering every request with the response. It returns the url of the gateway and the number of requests received by the upstream
+func newTestGateway(t *testing.T, routes []config.Route, resp upstreamResponse) (string, *int64) {
+	t.Helper()
+	hits := new(int64)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(hits, 1)
+		if resp.contentType != "" {
+			w.Header().Set("Content-Type", resp.contentType)
+		}
+		w.WriteHeader(resp.status)
+		_, _ = io.WriteString(w, resp.body)
+	}))
+	t.Cleanup(up.Close)
+	return newTestGatewayTo(t, up.URL, routes), hits
+}
+
+func newTestGatewayTo(t *testing.T, upstreamURL string, routes []config.Route, middlewares ...gin.HandlerFunc) string {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	rdb := newFakeRedis()
+	server := &Server{
+		Conf: &config.Conf{
+			RedisService: config.RedisService{
+				Cache: config.RedisCache{TTL: 60, StaleTTL: 60},
+			},
+		},
+		Rdb:   rdb,
+		Cache: cache.New(rdb),
+	}
+	server.CacheIndex = NewCacheIndex(rdb, server.Cache)
+	registry, err := upstream.NewRegistry([]config.Upstream{{Name: DefaultUpstream, Targets: []string{upstreamURL}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Upstreams = registry
+
+	transformers := map[string]Transformer{
+		"identity": func(tc TransformContext, doc *transform.Document) error {
+			return nil
+		},
+	}
+	engine := gin.New()
+	v0Router := engine.Group("/api/v0")
+	table, err := NewRouteTable(server, v0Router.BasePath(), routes, transformers, middlewares...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = table.Register(engine, v0Router); err != nil {
+		t.Fatal(err)
+	}
+
+	gateway := httptest.NewServer(engine)
+	t.Cleanup(gateway.Close)
+	return gateway.URL
+}
+
+func cachedRoute(rc config.RouteCache) []config.Route {
+	rc.Enabled = true
+	return []config.Route{{
+		Name:  "posts",
+		Path:  "/posts",
+		Auth:  RouteAuthNone,
+		Cache: rc,
+	}}
+}
+
+func get(t *testing.T, url string) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestCachedRouteStoresSuccessfulJSON(t *testing.T) {
+	gateway, hits := newTestGateway(t, cachedRoute(config.RouteCache{}), upstreamResponse{
+		status:      http.StatusOK,
+		contentType: "application/json",
+		body:        `{"_items":[]}`,
+	})
+
+	for i, want := range []string{"MISS", "HIT"} {
+		resp, body := get(t, gateway+"/api/v0/posts")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want 200", i, resp.StatusCode)
+		}
+		if got := resp.Header.Get("X-Cache"); got != want {
+			t.Errorf("request %d: X-Cache = %s, want %s", i, got, want)
+		}
+		var reply Reply
+		if err := json.Unmarshal(body, &reply); err != nil {
+			t.Fatalf("request %d: reply is not JSON: %v", i, err)
+		}
+	}
+	if *hits != 1 {
+		t.Errorf("upstream hits = %d, want 1", *hits)
+	}
+}
+
+func TestCachedRouteSkipsUncacheableResponses(t *testing.T) {
+	cases := []struct {
+		name string
+		rc   config.RouteCache
+		resp upstreamResponse
+	}{
+		{
+			name: "status not allowed",
+			resp: upstreamResponse{status: http.StatusNotFound, contentType: "application/json", body: `{"error":"not found"}`},
+		},
+		{
+			name: "content type not allowed",
+			resp: upstreamResponse{status: http.StatusOK, contentType: "text/html", body: "<html></html>"},
+		},
+		{
+			name: "body too large",
+			rc:   config.RouteCache{MaxBodyBytes: 8},
+			resp: upstreamResponse{status: http.StatusOK, contentType: "application/json", body: `{"_items":[1,2,3]}`},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			gateway, hits := newTestGateway(t, cachedRoute(tc.rc), tc.resp)
+			for i := 0; i < 2; i++ {
+				resp, _ := get(t, gateway+"/api/v0/posts")
+				if resp.StatusCode != tc.resp.status {
+					t.Fatalf("status = %d, want %d", resp.StatusCode, tc.resp.status)
+				}
+			}
+			if *hits != 2 {
+				t.Errorf("upstream hits = %d, want 2", *hits)
+			}
+		})
+	}
+}
+
+func TestCredentialedResponsesArePrivate(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"_items":[]}`)
+	}))
+	t.Cleanup(up.Close)
+	// the principal is set without any credential header, as an authenticator not reading the headers would do
+	principal := func(c *gin.Context) {
+		if c.Query("principal") != "" {
+			c.Set(middleware.GCtxPrincipalKey, &identity.Principal{Subject: "k1", Provider: identity.ProviderAPIKey})
+		}
+	}
+	uncached := []config.Route{{Name: "posts", Path: "/posts", Auth: RouteAuthNone}}
+
+	for name, routes := range map[string][]config.Route{"cached": cachedRoute(config.RouteCache{}), "uncached": uncached} {
+		gateway := newTestGatewayTo(t, up.URL, routes, principal)
+		tests := []struct {
+			name    string
+			query   string
+			apiKey  string
+			private bool
+		}{
+			{name: "anonymous"},
+			{name: "api key", apiKey: "k1", private: true},
+			{name: "principal", query: "?principal=1", private: true},
+		}
+		for _, tc := range tests {
+			t.Run(name+" "+tc.name, func(t *testing.T) {
+				req, _ := http.NewRequest(http.MethodGet, gateway+"/api/v0/posts"+tc.query, nil)
+				if tc.apiKey != "" {
+					req.Header.Set(identity.APIKeyHeader, tc.apiKey)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if vary := resp.Header.Get("Vary"); !strings.Contains(vary, identity.APIKeyHeader) {
+					t.Errorf("Vary = %q, want %s", vary, identity.APIKeyHeader)
+				}
+				if cc := resp.Header.Get("Cache-Control"); (cc == "private, no-cache") != tc.private {
+					t.Errorf("Cache-Control = %q", cc)
+				}
+			})
+		}
+	}
+}
+
+func TestUpstreamErrorIsPassedThroughInEnvelope(t *testing.T) {
+	const page = "<html><body>internal error</body></html>"
+	for _, routes := range [][]config.Route{
+		{{Name: "posts", Path: "/posts", Auth: RouteAuthNone}},
+		cachedRoute(config.RouteCache{}),
+	} {
+		gateway, _ := newTestGateway(t, routes, upstreamResponse{
+			status:      http.StatusInternalServerError,
+			contentType: "text/html",
+			body:        page,
+		})
+		resp, body := get(t, gateway+"/api/v0/posts")
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Fatalf("cache(%t): status = %d, want 500", routes[0].Cache.Enabled, resp.StatusCode)
+		}
+		var reply ErrorReply
+		if err := json.Unmarshal(body, &reply); err != nil {
+			t.Fatalf("cache(%t): reply is not JSON: %v", routes[0].Cache.Enabled, err)
+		}
+		if reply.Upstream == nil || reply.Upstream.Status != http.StatusInternalServerError || reply.Upstream.Body != page {
+			t.Errorf("cache(%t): upstream error = %+v, want the unchanged page", routes[0].Cache.Enabled, reply.Upstream)
+		}
+	}
+}
+
+func TestMalformedJSONIsNotCached(t *testing.T) {
+	routes := cachedRoute(config.RouteCache{})
+	routes[0].Transformers = []string{"identity"}
+	gateway, hits := newTestGateway(t, routes, upstreamResponse{
+		status:      http.StatusOK,
+		contentType: "application/json",
+		body:        `{"_items":[`,
+	})
+	for i := 0; i < 2; i++ {
+		resp, body := get(t, gateway+"/api/v0/posts")
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("status = %d, want 502", resp.StatusCode)
+		}
+		if !strings.Contains(resp.Header.Get("Content-Type"), "application/json") || !json.Valid(body) {
+			t.Errorf("reply is not JSON: %s", body)
+		}
+	}
+	if *hits != 2 {
+		t.Errorf("upstream hits = %d, want 2", *hits)
+	}
+}
+
+func TestUnreachableUpstreamRepliesJSON(t *testing.T) {
+	up := httptest.NewServer(http.NotFoundHandler())
+	up.Close()
+	gateway := newTestGatewayTo(t, up.URL, []config.Route{{Name: "posts", Path: "/posts", Auth: RouteAuthNone}})
+
+	resp, body := get(t, gateway+"/api/v0/posts")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", resp.StatusCode)
+	}
+	var reply ErrorReply
+	if err := json.Unmarshal(body, &reply); err != nil || len(reply.Errors) == 0 {
+		t.Errorf("reply = %s, want an ErrorReply", body)
+	}
+}
+
+func TestWrapReply(t *testing.T) {
+	tests := []struct {
+		name   string
+		status token.Status
+		body   string
+		want   string
+	}{
+		{
+			name:   "data",
+			status: token.Status{State: token.OK},
+			body:   `{"_items":[]}`,
+			want:   `{"tokenState":"OK","data":{"_items":[]}}`,
+		},
+		{
+			name:   "detail in debug mode",
+			status: token.Status{State: token.StateExpired, Detail: "token expired"},
+			body:   `[]`,
+			want:   `{"tokenState":"EXPIRED","tokenStateDetail":"token expired","data":[]}`,
+		},
+		{
+			name:   "no data",
+			status: token.Status{State: token.StateNotProvided},
+			want:   `{"tokenState":"NOT_PROVIDED"}`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := wrapReply(tc.status, []byte(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+// postsBody generates a listing of posts resembling a response of /getposts. Every other post is in a member only category
+func postsBody(items int) []byte {
+	var b strings.Builder
+	b.WriteString(`{"_items":[`)
+	for i := 0; i < items; i++ {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `{"_id":"%024d","slug":"post-%d","publishedDate":"2021-03-01T00:00:00Z",`, i, i)
+		fmt.Fprintf(&b, `"categories":[{"name":"c%d","isMemberOnly":%t}],"content":{"html":"%s","apiData":[`, i, i%2 == 0, strings.Repeat("<p>paragraph</p>", 200))
+		for j := 0; j < 20; j++ {
+			if j > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, `{"id":"%d","type":"unstyled","content":["%s"]}`, j, strings.Repeat("text ", 40))
+		}
+		b.WriteString(`]}}`)
+	}
+	b.WriteString(`],"_meta":{"page":1}}`)
+	return []byte(b.String())
+}
+
+func BenchmarkModifyReverseProxyResponse(b *testing.B) {
+	engine, err := entitlement.NewEngine(entitlement.DefaultRules())
+	if err != nil {
+		b.Fatal(err)
+	}
+	transformers := NewTransformers(engine)
+	route := &proxyRoute{
+		Route: config.Route{
+			Name:         "getposts",
+			Transformers: []string{TransformerEntitlement, TransformerStripHTML},
+		},
+		transformers: []Transformer{transformers[TransformerEntitlement], transformers[TransformerStripHTML]},
+	}
+	modify := ModifyReverseProxyResponse(route, "/getposts", token.Status{State: token.StateNotProvided}, true, false, http.Header{})
+
+	for _, items := range []int{10, 50, 200} {
+		body := postsBody(items)
+		b.Run(fmt.Sprintf("items=%d", items), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				resp := &http.Response{
+					StatusCode:    http.StatusOK,
+					Header:        http.Header{"Content-Type": {"application/json"}},
+					Body:          io.NopCloser(bytes.NewReader(body)),
+					ContentLength: int64(len(body)),
+				}
+				if err := modify(resp); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
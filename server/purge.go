@@ -0,0 +1,265 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/mirror-media/mm-apigateway/cache"
+	"github.com/mirror-media/mm-apigateway/messaging"
+	"github.com/mirror-media/mm-apigateway/middleware"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	indexNamespace = "expiryindex"
+	indexURIs      = "uris"
+	indexSlug      = "slug"
+	indexID        = "id"
+	// defaultMaxIndexSize caps an index, whose URIs expiring first are dropped
+	defaultMaxIndexSize = 10000
+)
+
+// indexScript adds ARGV[1] expiring at ARGV[2] to the sorted set of KEYS[1], which is scored by the expiries in milliseconds. The expired URIs are removed, the URIs expiring first are dropped over ARGV[4] URIs, and the set expires with its last URI. ARGV[3] is the current time in milliseconds
+const indexScript = `
+local max = tonumber(ARGV[4])
+redis.call("ZADD", KEYS[1], ARGV[2], ARGV[1])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[3])
+local size = redis.call("ZCARD", KEYS[1])
+if size > max then
+	redis.call("ZREMRANGEBYRANK", KEYS[1], 0, size - max - 1)
+end
+local last = redis.call("ZRANGE", KEYS[1], -1, -1, "WITHSCORES")
+if last[2] then
+	redis.call("PEXPIREAT", KEYS[1], last[2])
+end
+return size
+`
+
+// cacheVariants are the requester variants of every cached URI
+var cacheVariants = []string{"member", "notmember"}
+
+// PurgeRequest selects the cached responses to purge. Every selected URI is purged for both members and non-members
+type PurgeRequest struct {
+	// KeyPrefix is the cache key prefix of the route, default post
+	KeyPrefix string `json:"keyPrefix,omitempty"`
+	// URIs are the exact request URIs, e.g. /api/v0/getposts?max_results=10
+	URIs []string `json:"uris,omitempty"`
+	// Prefixes select every cached URI starting with one of them
+	Prefixes []string `json:"prefixes,omitempty"`
+	// Globs select every cached URI matching one of them in the syntax of path.Match
+	Globs []string `json:"globs,omitempty"`
+	// Slugs select every cached URI whose response contains a post with one of the slugs
+	Slugs []string `json:"slugs,omitempty"`
+	// IDs select every cached URI whose response contains a post with one of the ids
+	IDs []string `json:"ids,omitempty"`
+}
+
+// PurgeReply reports the purged URIs
+type PurgeReply struct {
+	URIs []string `json:"uris"`
+}
+
+// CacheIndex keeps secondary indexes from the post slugs and ids to the cached URIs, so that they can be purged
+type CacheIndex struct {
+	rdb     Rediser
+	cache   *cache.Cache
+	maxSize int64
+}
+
+// NewCacheIndex creates the index of the cached responses
+func NewCacheIndex(rdb Rediser, responseCache *cache.Cache) *CacheIndex {
+	return &CacheIndex{
+		rdb:     rdb,
+		cache:   responseCache,
+		maxSize: defaultMaxIndexSize,
+	}
+}
+
+func indexKey(keyPrefix string, fragments ...string) string {
+	return strings.Join(append([]string{cacheKeyNamespace, indexNamespace, keyPrefix}, fragments...), ".")
+}
+
+// Add indexes the uri by the slugs and ids of the posts in the body. The uri is kept in the indexes as long as its cached response
+func (i *CacheIndex) Add(ctx context.Context, keyPrefix string, uri string, body []byte, ttl time.Duration) {
+	keys := []string{indexKey(keyPrefix, indexURIs)}
+	for _, item := range gjson.GetBytes(body, "_items").Array() {
+		if slug := item.Get("slug").String(); slug != "" {
+			keys = append(keys, indexKey(keyPrefix, indexSlug, slug))
+		}
+		if id := item.Get("_id").String(); id != "" {
+			keys = append(keys, indexKey(keyPrefix, indexID, id))
+		}
+	}
+	now := time.Now()
+	expiry := now.Add(ttl)
+	for _, key := range keys {
+		size, err := i.rdb.Eval(ctx, indexScript, []string{key}, uri, toMilliseconds(expiry), toMilliseconds(now), i.maxSize).Int64()
+		if err != nil {
+			log.WithField("key", key).Warnf("indexing %s encountered error: %v", uri, err)
+			continue
+		}
+		if size > i.maxSize {
+			log.WithField("key", key).Warnf("index is full, %d uris expiring first are dropped", size-i.maxSize)
+		}
+	}
+}
+
+// indexedURIs returns the unexpired uris of the index
+func (i *CacheIndex) indexedURIs(ctx context.Context, index string) ([]string, error) {
+	return i.rdb.ZRangeByScore(ctx, index, &redis.ZRangeBy{
+		Min: strconv.FormatInt(toMilliseconds(time.Now()), 10),
+		Max: "+inf",
+	}).Result()
+}
+
+func toMilliseconds(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Purge removes the selected responses of both variants from the cache, together with the variants of their Vary headers
+func (i *CacheIndex) Purge(ctx context.Context, req PurgeRequest) ([]string, error) {
+	keyPrefix := req.KeyPrefix
+	if keyPrefix == "" {
+		keyPrefix = defaultCacheKeyPrefix
+	}
+
+	selected := make(map[string]bool)
+	for _, uri := range req.URIs {
+		selected[uri] = true
+	}
+
+	if len(req.Prefixes) > 0 || len(req.Globs) > 0 {
+		for _, g := range req.Globs {
+			if _, err := path.Match(g, ""); err != nil {
+				return nil, errors.Wrapf(err, "invalid glob(%s)", g)
+			}
+		}
+		uris, err := i.indexedURIs(ctx, indexKey(keyPrefix, indexURIs))
+		if err != nil {
+			return nil, errors.Wrap(err, "fail to read the uri index")
+		}
+		for _, uri := range uris {
+			if matchesAny(uri, req.Prefixes, req.Globs) {
+				selected[uri] = true
+			}
+		}
+	}
+
+	indexes := make([]string, 0, len(req.Slugs)+len(req.IDs))
+	for _, slug := range req.Slugs {
+		indexes = append(indexes, indexKey(keyPrefix, indexSlug, slug))
+	}
+	for _, id := range req.IDs {
+		indexes = append(indexes, indexKey(keyPrefix, indexID, id))
+	}
+	for _, index := range indexes {
+		uris, err := i.indexedURIs(ctx, index)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fail to read the index(%s)", index)
+		}
+		for _, uri := range uris {
+			selected[uri] = true
+		}
+	}
+
+	uris := make([]string, 0, len(selected))
+	keys := make([]string, 0, len(selected)*len(cacheVariants))
+	for uri := range selected {
+		uris = append(uris, uri)
+		for _, variant := range cacheVariants {
+			keys = append(keys, fmt.Sprintf("%s.%s.%s.%s", cacheKeyNamespace, keyPrefix, variant, uri))
+		}
+	}
+	// delete the keys one by one because they may live in different slots of a redis cluster
+	for _, key := range keys {
+		if err := i.cache.Purge(ctx, key); err != nil {
+			return nil, errors.Wrapf(err, "fail to purge %s", key)
+		}
+	}
+	// the responses are purged, and a uri left in an index is only purged again
+	for _, index := range indexes {
+		if err := i.rdb.Del(ctx, index).Err(); err != nil {
+			log.WithField("key", index).Warnf("deleting the purged index encountered error: %v", err)
+		}
+	}
+	if len(uris) > 0 {
+		members := make([]interface{}, 0, len(uris))
+		for _, uri := range uris {
+			members = append(members, uri)
+		}
+		if err := i.rdb.ZRem(ctx, indexKey(keyPrefix, indexURIs), members...).Err(); err != nil {
+			log.WithField("key", indexKey(keyPrefix, indexURIs)).Warnf("removing the purged uris encountered error: %v", err)
+		}
+	}
+	return uris, nil
+}
+
+func matchesAny(uri string, prefixes []string, globs []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(uri, prefix) {
+			return true
+		}
+	}
+	for _, g := range globs {
+		if ok, _ := path.Match(g, uri); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// PurgeCacheHandler purges the cached responses selected by the PurgeRequest in the body
+func PurgeCacheHandler(server *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := log.WithFields(log.Fields{
+			"path": c.FullPath(),
+		})
+		var req PurgeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, ErrorReply{
+				Errors: []Error{{Message: err.Error()}},
+			})
+			return
+		}
+		uris, err := server.CacheIndex.Purge(c.Request.Context(), req)
+		if err != nil {
+			logger.Error(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorReply{
+				Errors: []Error{{Message: err.Error()}},
+			})
+			return
+		}
+		logger.Infof("purged %d uris requested by %s", len(uris), c.GetString(middleware.GCtxUserIDKey))
+		c.JSON(http.StatusOK, PurgeReply{URIs: uris})
+	}
+}
+
+// SubscribePurge purges the cached responses requested by the messages of the subscription until the context is done. The data of a message is a PurgeRequest in JSON
+func SubscribePurge(ctx context.Context, server *Server) error {
+	log.Infof("Pulling subscription: %s", server.Conf.PubSubSubscribePurge)
+	return server.Broker.Receive(ctx, server.Conf.PubSubSubscribePurge, 10, func(ctx context.Context, msg *messaging.Message) bool {
+		var req PurgeRequest
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			log.Errorf("purge message(%s) is malformed: %v", msg.ID, err)
+			// a malformed message will never succeed
+			return true
+		}
+		uris, err := server.CacheIndex.Purge(ctx, req)
+		if err != nil {
+			log.Errorf("purge message(%s) failed: %v", msg.ID, err)
+			return false
+		}
+		log.Infof("purged %d uris requested by message(%s)", len(uris), msg.ID)
+		return true
+	})
+}
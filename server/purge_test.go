@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/mirror-media/mm-apigateway/cache"
+)
+
+func newTestCacheIndex(t *testing.T) (*CacheIndex, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	return NewCacheIndex(rdb, cache.New(rdb)), mr
+}
+
+func cachedURIs(t *testing.T, mr *miniredis.Miniredis, index string) []string {
+	t.Helper()
+	if !mr.Exists(index) {
+		return nil
+	}
+	uris, err := mr.ZMembers(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(uris)
+	return uris
+}
+
+func TestCacheIndexAdd(t *testing.T) {
+	i, mr := newTestCacheIndex(t)
+	ctx := context.Background()
+	uris := indexKey("post", indexURIs)
+	slug := indexKey("post", indexSlug, "a")
+
+	i.Add(ctx, "post", "/api/v0/posts?page=1", []byte(`{"_items":[{"slug":"a","_id":"1"}]}`), time.Minute)
+	i.Add(ctx, "post", "/api/v0/posts?page=2", []byte(`{"_items":[{"slug":"a"},{"_id":"2"}]}`), 50*time.Millisecond)
+	if got := strings.Join(cachedURIs(t, mr, slug), " "); got != "/api/v0/posts?page=1 /api/v0/posts?page=2" {
+		t.Fatalf("uris of the slug are %s", got)
+	}
+	if got := strings.Join(cachedURIs(t, mr, indexKey("post", indexID, "2")), " "); got != "/api/v0/posts?page=2" {
+		t.Fatalf("uris of the id are %s", got)
+	}
+	// the index expires with its last uri instead of the last added one
+	if ttl := mr.TTL(slug); ttl < 59*time.Second || ttl > time.Minute {
+		t.Fatalf("ttl of the index is %v", ttl)
+	}
+
+	// the expired uris are removed by the next add
+	time.Sleep(100 * time.Millisecond)
+	i.Add(ctx, "post", "/api/v0/posts?page=3", []byte(`{}`), -time.Second)
+	if got := strings.Join(cachedURIs(t, mr, uris), " "); got != "/api/v0/posts?page=1" {
+		t.Fatalf("uris are %s", got)
+	}
+
+	i.maxSize = 2
+	i.Add(ctx, "post", "/api/v0/posts?page=4", []byte(`{}`), 2*time.Minute)
+	i.Add(ctx, "post", "/api/v0/posts?page=5", []byte(`{}`), 3*time.Minute)
+	if got := strings.Join(cachedURIs(t, mr, uris), " "); got != "/api/v0/posts?page=4 /api/v0/posts?page=5" {
+		t.Fatalf("uris of the full index are %s", got)
+	}
+	if ttl := mr.TTL(uris); ttl < 179*time.Second || ttl > 3*time.Minute {
+		t.Fatalf("ttl of the full index is %v", ttl)
+	}
+}
+
+func TestCacheIndexPurge(t *testing.T) {
+	ctx := context.Background()
+	pages := map[string]string{
+		"/api/v0/posts?page=1":   `{"_items":[{"slug":"a","_id":"1"}]}`,
+		"/api/v0/posts?page=2":   `{"_items":[{"slug":"b","_id":"2"}]}`,
+		"/api/v0/sections/news":  `{"_items":[{"slug":"c","_id":"3"}]}`,
+		"/api/v0/posts/b/detail": `{"_items":[{"slug":"b","_id":"2"}]}`,
+	}
+	tests := []struct {
+		name string
+		req  PurgeRequest
+		want []string
+	}{
+		{name: "uri", req: PurgeRequest{URIs: []string{"/api/v0/posts?page=1"}}, want: []string{"/api/v0/posts?page=1"}},
+		{name: "prefix", req: PurgeRequest{Prefixes: []string{"/api/v0/posts?"}}, want: []string{"/api/v0/posts?page=1", "/api/v0/posts?page=2"}},
+		{name: "glob", req: PurgeRequest{Globs: []string{"/api/v0/sections/*"}}, want: []string{"/api/v0/sections/news"}},
+		{name: "slug", req: PurgeRequest{Slugs: []string{"b"}}, want: []string{"/api/v0/posts/b/detail", "/api/v0/posts?page=2"}},
+		{name: "id", req: PurgeRequest{IDs: []string{"3", "4"}}, want: []string{"/api/v0/sections/news"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, mr := newTestCacheIndex(t)
+			for uri, body := range pages {
+				i.Add(ctx, "post", uri, []byte(body), time.Minute)
+				for _, variant := range cacheVariants {
+					mr.Set(cacheKeyNamespace+".post."+variant+"."+uri, body)
+				}
+			}
+
+			uris, err := i.Purge(ctx, tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(uris)
+			if strings.Join(uris, " ") != strings.Join(tt.want, " ") {
+				t.Fatalf("purged uris are %v, want %v", uris, tt.want)
+			}
+			purged := make(map[string]bool)
+			for _, uri := range uris {
+				purged[uri] = true
+			}
+			for uri := range pages {
+				for _, variant := range cacheVariants {
+					if key := cacheKeyNamespace + ".post." + variant + "." + uri; mr.Exists(key) == purged[uri] {
+						t.Fatalf("%s exists(%v) after the purge", key, !purged[uri])
+					}
+				}
+				indexed := false
+				for _, u := range cachedURIs(t, mr, indexKey("post", indexURIs)) {
+					indexed = indexed || u == uri
+				}
+				if indexed == purged[uri] {
+					t.Fatalf("%s is indexed(%v) after the purge", uri, indexed)
+				}
+			}
+		})
+	}
+}
+
+func TestCacheIndexPurgesTheVariants(t *testing.T) {
+	i, mr := newTestCacheIndex(t)
+	ctx := context.Background()
+	uri := "/api/v0/posts?page=1"
+	key := cacheKeyNamespace + ".post.member." + uri
+	for _, token := range []string{"Bearer a", "Bearer b"} {
+		opts := cache.Options{SoftTTL: time.Minute, RequestHeader: http.Header{"Authorization": {token}}}
+		_, _, err := i.cache.Fetch(ctx, key, opts, func(ctx context.Context) (*cache.Entry, error) {
+			return &cache.Entry{Status: http.StatusOK, Header: http.Header{"Vary": {"Authorization"}}, Body: []byte(`{}`)}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(mr.Keys()); n != 4 {
+		t.Fatalf("%d keys are cached: %v", n, mr.Keys())
+	}
+	if _, err := i.Purge(ctx, PurgeRequest{URIs: []string{uri}}); err != nil {
+		t.Fatal(err)
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Fatalf("keys left by the purge are %v", keys)
+	}
+}
+
+func TestCacheIndexPurgeRejectsInvalidGlobs(t *testing.T) {
+	i, _ := newTestCacheIndex(t)
+	if _, err := i.Purge(context.Background(), PurgeRequest{Globs: []string{"["}}); err == nil {
+		t.Fatal("invalid glob is accepted")
+	}
+}
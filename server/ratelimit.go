@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/mm-apigateway/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	rateLimitNamespace     = "ratelimit"
+	defaultRateLimitWindow = 60
+)
+
+// tokenBucketScript takes a token from the bucket of KEYS[1] after refilling it for the time passed. ARGV are the capacity, the milliseconds to refill a token and the current time in milliseconds. It returns whether the token is taken, the tokens left, the milliseconds until a token is available and the milliseconds until the bucket is full
+const tokenBucketScript = `
+local capacity = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1]) or capacity
+local ts = tonumber(bucket[2]) or now
+if now > ts then
+	tokens = math.min(capacity, tokens + (now - ts) / interval)
+else
+	now = ts
+end
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) * interval)
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(capacity * interval))
+return {allowed, math.floor(tokens), retry, math.ceil((capacity - tokens) * interval)}
+`
+
+// clientIP returns the IP of the client. Only the X-Forwarded-For hops appended by the trusted proxies are read, since the client can send any hops before them
+func clientIP(server *Server, c *gin.Context) string {
+	peer, _, err := net.SplitHostPort(strings.TrimSpace(c.Request.RemoteAddr))
+	if err != nil {
+		peer = strings.TrimSpace(c.Request.RemoteAddr)
+	}
+	proxies := server.Conf.TrustedProxies
+	if proxies <= 0 {
+		return peer
+	}
+	var hops []string
+	for _, header := range c.Request.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	if len(hops) == 0 {
+		return peer
+	}
+	// the first trusted proxy appends the address of the client
+	i := len(hops) - proxies
+	if i < 0 {
+		i = 0
+	}
+	if net.ParseIP(hops[i]) == nil {
+		return peer
+	}
+	return hops[i]
+}
+
+// rateLimitKey returns the redis key of the bucket of the client. The client is the authenticated principal or the client IP
+func rateLimitKey(server *Server, group string, c *gin.Context) string {
+	client := "ip:" + clientIP(server, c)
+	if principal := principalOf(c); principal != nil {
+		client = principal.Provider + ":" + principal.Subject
+	}
+	return fmt.Sprintf("%s.%s.%s.%s", cacheKeyNamespace, rateLimitNamespace, group, client)
+}
+
+// tokenBucket is the capacity and the milliseconds to refill a token of a rate limit
+type tokenBucket struct {
+	limit    config.RateLimit
+	capacity int
+	interval float64
+}
+
+// newTokenBucket returns the bucket of the limit, false if the limit is disabled
+func newTokenBucket(limit config.RateLimit) (tokenBucket, bool) {
+	if limit.Requests <= 0 {
+		return tokenBucket{}, false
+	}
+	if limit.Window <= 0 {
+		limit.Window = defaultRateLimitWindow
+	}
+	capacity := limit.Burst
+	if capacity <= 0 {
+		capacity = limit.Requests
+	}
+	return tokenBucket{
+		limit:    limit,
+		capacity: capacity,
+		interval: float64(limit.Window) * 1000 / float64(limit.Requests),
+	}, true
+}
+
+// RateLimit limits the requests of every client to the route group with a token bucket in redis. It has to run after AuthenticateIDToken to key on the principal. A principal with its own rate limit, e.g. an API key, is limited by it instead, unless it's disabled. The requests are let through if redis fails
+func RateLimit(server *Server, group string) gin.HandlerFunc {
+	groupBucket, groupLimited := newTokenBucket(server.Conf.RateLimits[group])
+
+	return func(c *gin.Context) {
+		bucket, limited := groupBucket, groupLimited
+		if principal := principalOf(c); principal != nil && principal.RateLimit != nil {
+			// a disabled limit of the principal leaves it to the limit of the group
+			if b, ok := newTokenBucket(*principal.RateLimit); ok {
+				bucket, limited = b, ok
+			}
+		}
+		if !limited {
+			c.Next()
+			return
+		}
+		key := rateLimitKey(server, group, c)
+		logger := log.WithFields(log.Fields{
+			"path": c.FullPath(),
+			"key":  key,
+		})
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		result, err := server.Rdb.Eval(c.Request.Context(), tokenBucketScript, []string{key}, bucket.capacity, bucket.interval, now).Result()
+		if err != nil {
+			logger.Warnf("rate limiting encountered error, the request is let through: %v", err)
+			c.Next()
+			return
+		}
+		values, ok := result.([]interface{})
+		if !ok || len(values) != 4 {
+			logger.Warnf("rate limiting got an unexpected result(%v), the request is let through", result)
+			c.Next()
+			return
+		}
+		allowed, _ := values[0].(int64)
+		remaining, _ := values[1].(int64)
+		retry, _ := values[2].(int64)
+		reset, _ := values[3].(int64)
+
+		c.Header("RateLimit-Limit", strconv.Itoa(bucket.limit.Requests))
+		c.Header("RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+		c.Header("RateLimit-Reset", strconv.FormatInt(millisecondsToSeconds(reset), 10))
+		if allowed != 1 {
+			logger.Info("rate limit exceeded")
+			c.Header("Retry-After", strconv.FormatInt(millisecondsToSeconds(retry), 10))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, ErrorReply{
+				Errors: []Error{{Message: "too many requests"}},
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+func millisecondsToSeconds(ms int64) int64 {
+	return int64(math.Ceil(float64(ms) / 1000))
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/mirror-media/mm-apigateway/config"
+	"github.com/mirror-media/mm-apigateway/identity"
+	"github.com/mirror-media/mm-apigateway/middleware"
+)
+
+// newRateLimitedEngine serves /v1/ping behind RateLimit of the group v1. The principal of the request is read from the X-Test-Subject header
+func newRateLimitedEngine(server *Server) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(func(c *gin.Context) {
+		if subject := c.GetHeader("X-Test-Subject"); subject != "" {
+			principal := &identity.Principal{Subject: subject, Provider: identity.ProviderAPIKey}
+			switch subject {
+			case "unlimited":
+				principal.RateLimit = &config.RateLimit{Requests: 100}
+			case "disabled":
+				principal.RateLimit = &config.RateLimit{Requests: 0}
+			}
+			c.Set(middleware.GCtxPrincipalKey, principal)
+		}
+	})
+	engine.GET("/v1/ping", RateLimit(server, "v1"), func(c *gin.Context) {
+		c.String(http.StatusOK, "pong")
+	})
+	return engine
+}
+
+func newRateLimitServer(rdb Rediser) *Server {
+	return &Server{
+		Conf: &config.Conf{
+			RateLimits:     map[string]config.RateLimit{"v1": {Requests: 2, Window: 60}},
+			TrustedProxies: 1,
+		},
+		Rdb: rdb,
+	}
+}
+
+func ping(engine *gin.Engine, remoteAddr string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/v1/ping", nil)
+	req.RemoteAddr = remoteAddr
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	return w
+}
+
+func TestRateLimit(t *testing.T) {
+	mr := miniredis.RunT(t)
+	engine := newRateLimitedEngine(newRateLimitServer(redis.NewClient(&redis.Options{Addr: mr.Addr()})))
+	lb := "10.0.0.1:1234"
+	client := http.Header{"X-Forwarded-For": []string{"1.2.3.4"}}
+
+	for i, remaining := range []string{"1", "0"} {
+		w := ping(engine, lb, client)
+		if w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "2" || w.Header().Get("RateLimit-Remaining") != remaining {
+			t.Fatalf("request %d got %d with headers %v", i, w.Code, w.Header())
+		}
+	}
+	w := ping(engine, lb, client)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "30" {
+		t.Fatalf("exhausted bucket got %d with headers %v", w.Code, w.Header())
+	}
+
+	// the hops before the load balancer are sent by the client
+	if w := ping(engine, lb, http.Header{"X-Forwarded-For": []string{"5.6.7.8, 1.2.3.4"}}); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("spoofed hop got %d", w.Code)
+	}
+	if w := ping(engine, lb, http.Header{"X-Forwarded-For": []string{"5.6.7.8"}}); w.Code != http.StatusOK {
+		t.Fatalf("another client got %d", w.Code)
+	}
+}
+
+func TestRateLimitKeysOnThePrincipal(t *testing.T) {
+	mr := miniredis.RunT(t)
+	engine := newRateLimitedEngine(newRateLimitServer(redis.NewClient(&redis.Options{Addr: mr.Addr()})))
+	lb := "10.0.0.1:1234"
+	client := http.Header{"X-Forwarded-For": []string{"1.2.3.4"}}
+
+	for i := 0; i < 2; i++ {
+		ping(engine, lb, client)
+	}
+	if w := ping(engine, lb, client); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("anonymous client got %d", w.Code)
+	}
+	principal := http.Header{"X-Forwarded-For": []string{"1.2.3.4"}, "X-Test-Subject": []string{"k1"}}
+	for i := 0; i < 2; i++ {
+		if w := ping(engine, lb, principal); w.Code != http.StatusOK {
+			t.Fatalf("request %d of the principal got %d", i, w.Code)
+		}
+	}
+	if w := ping(engine, lb, principal); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("exhausted principal got %d", w.Code)
+	}
+	unlimited := http.Header{"X-Forwarded-For": []string{"1.2.3.4"}, "X-Test-Subject": []string{"unlimited"}}
+	if w := ping(engine, lb, unlimited); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "100" {
+		t.Fatalf("principal of its own limit got %d with headers %v", w.Code, w.Header())
+	}
+	disabled := http.Header{"X-Forwarded-For": []string{"1.2.3.4"}, "X-Test-Subject": []string{"disabled"}}
+	for i := 0; i < 2; i++ {
+		ping(engine, lb, disabled)
+	}
+	if w := ping(engine, lb, disabled); w.Code != http.StatusTooManyRequests || w.Header().Get("RateLimit-Limit") != "2" {
+		t.Fatalf("principal of a disabled limit got %d with headers %v", w.Code, w.Header())
+	}
+}
+
+func TestRateLimitFailsOpen(t *testing.T) {
+	engine := newRateLimitedEngine(newRateLimitServer(newFakeRedis()))
+	for i := 0; i < 3; i++ {
+		if w := ping(engine, "10.0.0.1:1234", nil); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "" {
+			t.Fatalf("request %d got %d with headers %v", i, w.Code, w.Header())
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies int
+		xff     []string
+		want    string
+	}{
+		{name: "no proxy", xff: []string{"1.2.3.4"}, want: "10.0.0.1"},
+		{name: "load balancer", proxies: 1, xff: []string{"5.6.7.8, 1.2.3.4"}, want: "1.2.3.4"},
+		{name: "two proxies", proxies: 2, xff: []string{"5.6.7.8, 1.2.3.4", "10.0.0.2"}, want: "1.2.3.4"},
+		{name: "fewer hops than proxies", proxies: 2, xff: []string{"1.2.3.4"}, want: "1.2.3.4"},
+		{name: "no hop", proxies: 1, want: "10.0.0.1"},
+		{name: "invalid hop", proxies: 1, xff: []string{"localhost"}, want: "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+			c.Request.RemoteAddr = "10.0.0.1:1234"
+			c.Request.Header["X-Forwarded-For"] = tt.xff
+			server := &Server{Conf: &config.Conf{TrustedProxies: tt.proxies}}
+			if got := clientIP(server, c); got != tt.want {
+				t.Fatalf("client IP is %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,23 +1,20 @@
 package server
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
-	"io"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
-	"strconv"
-	"strings"
-	"time"
 
 	"github.com/machinebox/graphql"
+	"github.com/mirror-media/mm-apigateway/cache"
+	"github.com/mirror-media/mm-apigateway/entitlement"
+	"github.com/mirror-media/mm-apigateway/identity"
+	"github.com/mirror-media/mm-apigateway/member"
 	"github.com/mirror-media/mm-apigateway/middleware"
 	"github.com/mirror-media/mm-apigateway/token"
-	"github.com/tidwall/sjson"
+	"github.com/mirror-media/mm-apigateway/upstream"
 	"golang.org/x/oauth2"
 
 	log "github.com/sirupsen/logrus"
@@ -29,16 +26,14 @@ import (
 	"github.com/mirror-media/mm-apigateway/graph/generated"
 )
 
-// GetIDTokenOnly is a middleware to construct the token.Token interface
+// GetIDTokenOnly is a middleware to construct the token.Token interface with the authenticator of the identity provider of the request
 func GetIDTokenOnly(server *Server) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		logger := log.WithFields(log.Fields{
 			"path": c.FullPath(),
 		})
 		// Create a Token Instance
-		authHeader := c.GetHeader("Authorization")
-		firebaseClient := server.FirebaseClient
-		token, err := token.NewFirebaseToken(authHeader, firebaseClient)
+		token, err := server.Authenticators.NewToken(c.Request)
 		if err != nil {
 			logger.Info(err)
 			c.Next()
@@ -67,276 +62,163 @@ func AuthenticateIDToken(server *Server) gin.HandlerFunc {
 		}
 		tt := t.(token.Token)
 
-		if tt.GetTokenState() != token.OK {
-			logger.Info(tt.GetTokenState())
+		if status := token.StatusOf(tt); status.State != token.OK {
+			logger.WithField("tokenState", status.State).Info(status.Detail)
 			c.AbortWithStatusJSON(http.StatusForbidden, ErrorReply{
-				Errors: []Error{{Message: tt.GetTokenState()}},
+				Errors: []Error{{Message: tokenStatusMessage(server, status)}},
 			})
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		// Because GetTokenState() already fetch the public key and cache it. Here VerifyIDToken() would only verify the signature.
-		firebaseClient := server.FirebaseClient
-		tokenString, _ := tt.GetTokenString()
-		idToken, err := firebaseClient.VerifyIDToken(ctx, tokenString)
-		if err != nil {
-			logger.Info(err.Error())
+		// the token has been verified with the state, it's not verified again
+		var principal *identity.Principal
+		if at, ok := tt.(identity.Authenticated); ok {
+			principal = at.GetPrincipal()
+		}
+		if principal == nil {
+			logger.Info("token has no principal")
 			c.AbortWithStatusJSON(http.StatusForbidden, ErrorReply{
-				Errors: []Error{{Message: err.Error()}},
+				Errors: []Error{{Message: string(token.StateInvalid)}},
 			})
 			return
 		}
-		c.Set(middleware.GCtxUserIDKey, idToken.Subject)
-		c.Next()
-	}
-}
-
-func GinContextToContextMiddleware(server *Server) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		ctx := context.WithValue(c.Request.Context(), middleware.CtxGinContexKey, c)
-		c.Request = c.Request.WithContext(ctx)
-		c.Next()
-	}
-}
-
-func FirebaseClientToContextMiddleware(server *Server) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		ctx := context.WithValue(c.Request.Context(), middleware.CtxFirebaseClientKey, server.FirebaseClient)
-		c.Request = c.Request.WithContext(ctx)
+		c.Set(middleware.GCtxPrincipalKey, principal)
+		c.Set(middleware.GCtxUserClaimsKey, principal.Claims)
+		// the members are Firebase users
+		if principal.Provider == identity.ProviderFirebase {
+			c.Set(middleware.GCtxUserIDKey, principal.Subject)
+		}
 		c.Next()
 	}
 }
 
-func FirebaseDBClientToContextMiddleware(server *Server) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		ctx := context.WithValue(c.Request.Context(), middleware.CtxFirebaseDatabaseClientKey, server.FirebaseDatabaseClient)
-		c.Request = c.Request.WithContext(ctx)
-		c.Next()
+// tokenStatusMessage returns the state as the message of an error reply, followed by the detail in debug mode
+func tokenStatusMessage(server *Server, status token.Status) string {
+	if server.Conf.Debug && status.Detail != "" {
+		return fmt.Sprintf("%s: %s", status.State, status.Detail)
 	}
+	return string(status.State)
 }
 
-func singleJoiningSlash(a, b string) string {
-
-	aslash := strings.HasSuffix(a, "/")
-	bslash := strings.HasPrefix(b, "/")
-
-	switch {
-	case aslash && bslash:
-		return a + b[1:]
-	case !aslash && !bslash:
-		return a + "/" + b
+// principalOf returns the principal saved by AuthenticateIDToken, or the principal of the valid token of a route which doesn't require one. It returns nil if the request is not authenticated
+func principalOf(c *gin.Context) *identity.Principal {
+	if principal, ok := c.Value(middleware.GCtxPrincipalKey).(*identity.Principal); ok {
+		return principal
 	}
-	return a + b
-}
-func joinURLPath(a, b *url.URL) (path, rawpath string) {
-	if a.RawPath == "" && b.RawPath == "" {
-		return singleJoiningSlash(a.Path, b.Path), ""
+	if t, ok := c.Value(middleware.GCtxTokenKey).(identity.Authenticated); ok && t.GetTokenState() == token.OK {
+		return t.GetPrincipal()
 	}
-
-	// Same as singleJoiningSlash, but uses EscapedPath to determine
-	// whether a slash should be added
-	apath := a.EscapedPath()
-	bpath := b.EscapedPath()
-	aslash := strings.HasSuffix(apath, "/")
-	bslash := strings.HasPrefix(bpath, "/")
-	switch {
-	case aslash && bslash:
-		return a.Path + b.Path[1:], apath + bpath[1:]
-	case !aslash && !bslash:
-		return a.Path + "/" + b.Path, apath + "/" + bpath
-	}
-
-	return a.Path + b.Path, apath + bpath
-
+	return nil
 }
 
-func ModifyReverseProxyResponse(c *gin.Context, rdb Rediser, cacheTTL int) func(*http.Response) error {
-	logger := log.WithFields(log.Fields{
-		"path": c.FullPath(),
-	})
-	return func(r *http.Response) error {
-		body, err := io.ReadAll(r.Body)
-		_ = r.Body.Close()
-		if err != nil {
-			logger.Errorf("encounter error when reading proxy response:", err)
-			return err
+// RequireAdmin is a middleware to allow only the admins, who are the listed Firebase users or the principals with the admin role. It has to be used after AuthenticateIDToken
+func RequireAdmin(server *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if isListedAdmin(server, c.GetString(middleware.GCtxUserIDKey)) {
+			c.Next()
+			return
 		}
-
-		var tokenState string
-
-		tokenSaved, exist := c.Get(middleware.GCtxTokenKey)
-		if !exist {
-			tokenState = "No Bearer token available"
-		} else {
-			tokenState = tokenSaved.(token.Token).GetTokenState()
+		principal := principalOf(c)
+		if principal != nil && principal.HasRole(identity.RoleAdmin) {
+			c.Next()
+			return
 		}
+		log.WithFields(log.Fields{
+			"path":      c.FullPath(),
+			"principal": principal,
+		}).Info("principal is not an admin")
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorReply{
+			Errors: []Error{{Message: "admin only"}},
+		})
+	}
+}
 
-		var redisKey string
-		switch path := r.Request.URL.Path; {
-		// TODO refactor condition
-		case strings.HasSuffix(path, "/getposts") || strings.HasSuffix(path, "/posts") || strings.HasSuffix(path, "/post"):
-
-			type Category struct {
-				IsMemberOnly *bool `json:"isMemberOnly,omitempty"`
-			}
-
-			type ItemContent struct {
-				APIData []interface{} `json:"apiData"`
-			}
-			type Item struct {
-				Content    ItemContent `json:"content"`
-				Categories []Category  `json:"categories"`
-			}
-			type Resp struct {
-				Items []Item `json:"_items"`
-			}
-
-			var items Resp
-			err = json.Unmarshal(body, &items)
-			if err != nil {
-				logger.Errorf("Unmarshal post encountered error: %v", err)
-				return err
-			}
-
-			// truncate the content if the user is not a member and the post falls into a member only category
-			if tokenState == token.OK {
-				// TODO refactor redis cache code
-				redisKey = fmt.Sprintf("%s.%s.%s.%s", "mm-apigateway", "post", "member", c.Request.RequestURI)
-			} else {
-				// TODO refactor redis cache code
-				redisKey = fmt.Sprintf("%s.%s.%s.%s", "mm-apigateway", "post", "notmember", c.Request.RequestURI)
-
-				// modify body if the item falls into a "member only" category
-				for i, item := range items.Items {
-					for _, category := range item.Categories {
-						if category.IsMemberOnly != nil && *category.IsMemberOnly {
-							truncatedAPIData := item.Content.APIData[0:3]
-							body, err = sjson.SetBytes(body, fmt.Sprintf("_items.%d.content.apiData", i), truncatedAPIData)
-							if err != nil {
-								logger.Errorf("encounter error when truncating apiData:", err)
-								return err
-							}
-							break
-						}
-					}
-				}
-			}
-
-			// remove html because only apidata is useful and html contains full content
-			for i, _ := range items.Items {
-				body, err = sjson.DeleteBytes(body, fmt.Sprintf("_items.%d.content.html", i))
-				if err != nil {
-					logger.Errorf("encounter error when deleting html:", err)
-					return err
-				}
+// RequireRole is a middleware to allow only the principals with any of the roles. The Firebase users listed as admins have the admin role. It has to be used after AuthenticateIDToken
+func RequireRole(server *Server, roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := principalOf(c)
+		for _, role := range roles {
+			if role == identity.RoleAdmin && isListedAdmin(server, c.GetString(middleware.GCtxUserIDKey)) {
+				c.Next()
+				return
 			}
-			// TODO refactor redis cache code
-			err = rdb.Set(context.TODO(), redisKey, body, time.Duration(cacheTTL)*time.Second).Err()
-			if err != nil {
-				logger.Warnf("setting redis cache(%s) encountered error: %v", redisKey, err)
+			if principal != nil && principal.HasRole(role) {
+				c.Next()
+				return
 			}
-		default:
 		}
-
-		b, err := json.Marshal(Reply{
-			TokenState: tokenState,
-			Data:       json.RawMessage(body),
+		log.WithFields(log.Fields{
+			"path":      c.FullPath(),
+			"principal": principal,
+		}).Infof("principal has none of the roles %v", roles)
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorReply{
+			Errors: []Error{{Message: fmt.Sprintf("one of the roles %v is required", roles)}},
 		})
-
-		if err != nil {
-			logger.Errorf("Marshalling reply encountered error: %v", err)
-			return err
-		}
-
-		r.Body = io.NopCloser(bytes.NewReader(b))
-		r.ContentLength = int64(len(b))
-		r.Header.Set("Content-Length", strconv.Itoa(len(b)))
-		return nil
 	}
 }
 
-func NewSingleHostReverseProxy(target *url.URL, pathBaseToStrip string, rdb Rediser, cacheTTL int) func(c *gin.Context) {
-	targetQuery := target.RawQuery
-	director := func(req *http.Request) {
-		if strings.HasSuffix(pathBaseToStrip, "/") {
-			pathBaseToStrip = pathBaseToStrip + "/"
-		}
-		req.URL.Path = strings.TrimPrefix(req.URL.Path, pathBaseToStrip)
-		req.URL.RawPath = strings.TrimPrefix(req.URL.RawPath, pathBaseToStrip)
-
-		req.URL.Scheme = target.Scheme
-		req.URL.Host = target.Host
-		req.URL.Path, req.URL.RawPath = joinURLPath(target, req.URL)
-
-		if targetQuery == "" || req.URL.RawQuery == "" {
-			req.URL.RawQuery = targetQuery + req.URL.RawQuery
-		} else {
-			req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
-		}
-
-		if _, ok := req.Header["User-Agent"]; !ok {
-			// explicitly disable User-Agent so it's not set to default value
-			req.Header.Set("User-Agent", "")
+func isListedAdmin(server *Server, uid string) bool {
+	for _, id := range server.Conf.Admin.FirebaseIDs {
+		if id != "" && id == uid {
+			return true
 		}
 	}
-	return func(c *gin.Context) {
-		// TODO refactor modification and cache code
-		var tokenState string
-
-		tokenSaved, exist := c.Get(middleware.GCtxTokenKey)
-		if !exist {
-			tokenState = "No Bearer token available"
-		} else {
-			tokenState = tokenSaved.(token.Token).GetTokenState()
-		}
-
-		switch path := c.Request.URL.Path; {
-		case strings.HasSuffix(path, "/getposts") || strings.HasSuffix(path, "/posts") || strings.HasSuffix(path, "/post"):
-			// Try to read cache first
-			var key string
-			if tokenState != token.OK {
-				key = fmt.Sprintf("%s.%s.%s.%s", "mm-apigateway", "post", "notmember", c.Request.RequestURI)
-			} else {
-				key = fmt.Sprintf("%s.%s.%s.%s", "mm-apigateway", "post", "member", c.Request.RequestURI)
-			}
+	return false
+}
 
-			cmd := rdb.Get(context.TODO(), key)
-			// cache doesn't exist, do fetch reverse proxy
-			if cmd == nil {
-				break
-			}
-			body, err := cmd.Bytes()
-			// cache can't be understood, do fetch reverse proxy
-			if err != nil {
-				break
-			}
+func GinContextToContextMiddleware(server *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.WithValue(c.Request.Context(), middleware.CtxGinContexKey, c)
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
 
-			c.AbortWithStatusJSON(http.StatusOK, Reply{
-				TokenState: tokenState,
-				Data:       json.RawMessage(body),
-			})
-			return
-		}
+func FirebaseClientToContextMiddleware(server *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.WithValue(c.Request.Context(), middleware.CtxFirebaseClientKey, server.FirebaseClient)
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
 
-		reverseProxy := httputil.ReverseProxy{Director: director}
-		reverseProxy.ModifyResponse = ModifyReverseProxyResponse(c, rdb, cacheTTL)
-		reverseProxy.ServeHTTP(c.Writer, c.Request)
+func FirebaseDBClientToContextMiddleware(server *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.WithValue(c.Request.Context(), middleware.CtxFirebaseDatabaseClientKey, server.FirebaseDatabaseClient)
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
 	}
 }
 
+// Reply wraps the data with the state of the token of the request. TokenStateDetail is only replied in debug mode
 type Reply struct {
-	TokenState interface{} `json:"tokenState"`
-	Data       interface{} `json:"data,omitempty"`
+	TokenState       interface{} `json:"tokenState"`
+	TokenStateDetail string      `json:"tokenStateDetail,omitempty"`
+	Data             interface{} `json:"data,omitempty"`
 }
 
 type Error struct {
 	Message string `json:"message,omitempty"`
 }
 type ErrorReply struct {
-	Errors []Error     `json:"errors,omitempty"`
-	Data   interface{} `json:"data,omitempty"`
+	Errors   []Error        `json:"errors,omitempty"`
+	Data     interface{}    `json:"data,omitempty"`
+	Upstream *UpstreamError `json:"upstream,omitempty"`
+}
+
+// UpstreamError is the unsuccessful response of an upstream passed through the gateway. Body is the unchanged body of the upstream
+type UpstreamError struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"contentType,omitempty"`
+	Body        string `json:"body,omitempty"`
+}
+
+// Health is the reply of /health. The status is degraded when an upstream has no healthy target or the gateway token is not OK
+type Health struct {
+	Status       string                `json:"status"`
+	GatewayToken token.State           `json:"gatewayToken,omitempty"`
+	Upstreams    []upstream.PoolStatus `json:"upstreams,omitempty"`
+	Cache        *cache.Stats          `json:"cache,omitempty"`
 }
 
 func SetHealthRoute(server *Server) error {
@@ -347,7 +229,26 @@ func SetHealthRoute(server *Server) error {
 
 	router := server.Engine
 	router.GET("/health", func(c *gin.Context) {
-		c.AbortWithStatus(http.StatusOK)
+		status := "ok"
+		upstreams := server.Upstreams.Status()
+		for _, u := range upstreams {
+			if !u.Healthy {
+				status = "degraded"
+			}
+		}
+		var gatewayTokenState token.State
+		if server.UserSrvToken != nil {
+			if gatewayTokenState = server.UserSrvToken.GetTokenState(); gatewayTokenState != token.OK {
+				status = "degraded"
+			}
+		}
+		stats := server.Cache.Stats()
+		c.AbortWithStatusJSON(http.StatusOK, Health{
+			Status:       status,
+			GatewayToken: gatewayTokenState,
+			Upstreams:    upstreams,
+			Cache:        &stats,
+		})
 	})
 
 	return nil
@@ -362,53 +263,145 @@ func SetRoute(server *Server) error {
 	v1Router := apiRouter.Group("/v1")
 	v1tokenStateRouter := v1Router.Use(GetIDTokenOnly(server))
 	v1tokenStateRouter.GET("/tokenState", func(c *gin.Context) {
-		t := c.Value(middleware.GCtxTokenKey).(token.Token)
+		t, _ := c.Value(middleware.GCtxTokenKey).(token.Token)
 		if t == nil {
 			c.JSON(http.StatusBadRequest, Reply{
 				TokenState: nil,
 			})
 			return
 		}
+		status := getTokenStatus(c, server.Conf.Debug)
 		c.JSON(http.StatusOK, Reply{
-			TokenState: t.GetTokenState(),
+			TokenState:       status.State,
+			TokenStateDetail: status.Detail,
 		})
 	})
 
 	// Private API
 	// v1 User
 	// It will save FirebaseClient and FirebaseDBClient to *gin.context, and *gin.context to *context
-	v1TokenAuthenticatedWithFirebaseRouter := v1Router.Use(AuthenticateIDToken(server), GinContextToContextMiddleware(server), FirebaseClientToContextMiddleware(server), FirebaseDBClientToContextMiddleware(server))
+	v1TokenAuthenticatedWithFirebaseRouter := v1Router.Use(AuthenticateIDToken(server), AuditContextMiddleware(server), GinContextToContextMiddleware(server), FirebaseClientToContextMiddleware(server), FirebaseDBClientToContextMiddleware(server))
+	graphQLRules := server.Conf.GraphQLRules
+	if len(graphQLRules) == 0 {
+		graphQLRules = graph.DefaultGraphQLRules()
+	}
+	authorizer, err := graph.NewAuthorizer(graphQLRules, server.Auditor)
+	if err != nil {
+		return err
+	}
+	// the token source refreshes the gateway token before it expires
+	userClient := graphql.NewClient(server.Services.UserGraphQL, graphql.WithHTTPClient(oauth2.NewClient(context.Background(), server.UserSrvToken)))
+	// the user service has the same member types as the gateway schema
+	userSchema := generated.NewExecutableSchema(generated.Config{}).Schema()
 	srv := handler.NewDefaultServer(generated.NewExecutableSchema(generated.Config{Resolvers: &graph.Resolver{
 		Conf:       *server.Conf,
 		UserSrvURL: server.Conf.ServiceEndpoints.UserGraphQL,
-		// Token:      server.UserSrvToken,
-		// TODO Temp workaround
-		Client: func() *graphql.Client {
-			tokenString, err := server.UserSrvToken.GetTokenString()
-			if err != nil {
-				panic(err)
-			}
-			src := oauth2.StaticTokenSource(
-				&oauth2.Token{
-					AccessToken: tokenString,
-					TokenType:   token.TypeJWT,
-				},
-			)
-			httpClient := oauth2.NewClient(context.Background(), src)
-			return graphql.NewClient(server.Services.UserGraphQL, graphql.WithHTTPClient(httpClient))
-		}(),
+		Auditor:    server.Auditor,
+		Deletions:  server.Deletions,
+		Events:     server.MemberEvents,
+		Forwarder:  graph.NewForwarder(userClient, userSchema),
 	}}))
-	v1TokenAuthenticatedWithFirebaseRouter.POST("/graphql/user", gin.WrapH(srv))
+	// the operations are authorized by the rules and the decisions are audited
+	srv.AroundFields(authorizer.Authorize)
+	v1TokenAuthenticatedWithFirebaseRouter.POST("/graphql/user", RequireScope(server, ScopeV1), RateLimit(server, ScopeV1), gin.WrapH(srv))
+	// the single endpoint of the stitched services
+	gateway, err := newGraphQLGateway(server, authorizer)
+	if err != nil {
+		return err
+	}
+	if gateway != nil {
+		v1TokenAuthenticatedWithFirebaseRouter.POST("/graphql", RequireScope(server, ScopeV1), RateLimit(server, ScopeV1), StitchedGraphQLHandler(gateway))
+		v1TokenAuthenticatedWithFirebaseRouter.GET("/graphql/schema", RequireScope(server, ScopeV1), StitchedSchemaHandler(gateway))
+	}
 
-	// v0 api proxy every request to the restful serverce
+	// v0 api proxy every request to the restful serverce according to the route table
 	v0Router := apiRouter.Group("/v0")
-	v0tokenStateRouter := v0Router.Use(GetIDTokenOnly(server))
-	proxyURL, err := url.Parse(server.Conf.V0RESTfulSrvTargetURL)
+
+	rules := server.Conf.EntitlementRules
+	if len(rules) == 0 {
+		rules = entitlement.DefaultRules()
+	}
+	engine, err := entitlement.NewEngine(rules)
 	if err != nil {
 		return err
 	}
 
-	v0tokenStateRouter.Any("/*wildcard", NewSingleHostReverseProxy(proxyURL, v0Router.BasePath(), server.Rdb, server.Conf.RedisService.Cache.TTL))
+	routes := server.Conf.V0Routes
+	if len(routes) == 0 {
+		routes = DefaultV0Routes()
+	}
+	v0RouteTable, err := NewRouteTable(server, v0Router.BasePath(), routes, NewTransformers(engine), RequireScope(server, ScopeV0), RateLimit(server, ScopeV0))
+	if err != nil {
+		return err
+	}
+	if err = v0RouteTable.Register(server.Engine, v0Router); err != nil {
+		return err
+	}
+
+	// Admin API
+	adminRouter := apiRouter.Group("/admin", GetIDTokenOnly(server), AuthenticateIDToken(server), RequireAdmin(server))
+	adminRouter.POST("/cache/purge", PurgeCacheHandler(server))
+	adminRouter.GET("/apikeys", ListAPIKeysHandler(server))
+	adminRouter.POST("/apikeys", CreateAPIKeyHandler(server, authorizer.Scopes()))
+	adminRouter.PUT("/apikeys/:id/scopes", SetAPIKeyScopesHandler(server, authorizer.Scopes()))
+	adminRouter.DELETE("/apikeys/:id", RevokeAPIKeyHandler(server))
+	adminRouter.POST("/members/:firebaseId/restore", RestoreMemberHandler(server))
+	// expvar metrics, e.g. memberConsumer
+	adminRouter.GET("/metrics", gin.WrapH(expvar.Handler()))
+
+	// Support API
+	supportRouter := apiRouter.Group("/support", GetIDTokenOnly(server), AuthenticateIDToken(server), RequireRole(server, identity.RoleStaff, identity.RoleAdmin))
+	supportRouter.GET("/members/:firebaseId/deletion", MemberDeletionHandler(server))
 
 	return nil
 }
+
+// MemberDeletionHandler replies the state of the deletion of the member
+func MemberDeletionHandler(server *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deletion, err := server.Deletions.Get(c.Request.Context(), c.Param("firebaseId"))
+		if err == member.ErrDeletionNotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, ErrorReply{
+				Errors: []Error{{Message: err.Error()}},
+			})
+			return
+		} else if err != nil {
+			log.WithField("path", c.FullPath()).Error(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorReply{
+				Errors: []Error{{Message: err.Error()}},
+			})
+			return
+		}
+		c.JSON(http.StatusOK, deletion)
+	}
+}
+
+// RestoreMemberHandler cancels the deletion of the member, which is replied with its restored state
+func RestoreMemberHandler(server *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		firebaseID := c.Param("firebaseId")
+		err := server.Deletions.Restore(c.Request.Context(), firebaseID)
+		if err == nil {
+			var deletion *member.Deletion
+			if deletion, err = server.Deletions.Get(c.Request.Context(), firebaseID); err == nil {
+				c.JSON(http.StatusOK, deletion)
+				return
+			}
+		}
+		switch {
+		case errors.Is(err, member.ErrDeletionNotFound):
+			c.AbortWithStatusJSON(http.StatusNotFound, ErrorReply{
+				Errors: []Error{{Message: err.Error()}},
+			})
+		case errors.Is(err, member.ErrDeletionNotRestorable):
+			c.AbortWithStatusJSON(http.StatusConflict, ErrorReply{
+				Errors: []Error{{Message: err.Error()}},
+			})
+		default:
+			log.WithField("path", c.FullPath()).Error(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorReply{
+				Errors: []Error{{Message: err.Error()}},
+			})
+		}
+	}
+}
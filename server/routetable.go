@@ -0,0 +1,263 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/mm-apigateway/cache"
+	"github.com/mirror-media/mm-apigateway/config"
+	"github.com/mirror-media/mm-apigateway/entitlement"
+	"github.com/mirror-media/mm-apigateway/transform"
+	"github.com/mirror-media/mm-apigateway/upstream"
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	RouteAuthNone     = "none"
+	RouteAuthToken    = "token"
+	RouteAuthRequired = "required"
+)
+
+const (
+	TransformerEntitlement = "entitlement"
+	TransformerStripHTML   = "stripHTML"
+)
+
+const (
+	defaultCacheKeyPrefix = "post"
+	// catchAllParam is the parameter of the gin routes of the paths ending with /**
+	catchAllParam = "rest"
+)
+
+// TransformContext carries the information of the request a Transformer may need
+type TransformContext struct {
+	// Route is the path relative to the api version, e.g. /getposts
+	Route  string
+	Member bool
+}
+
+// Transformer records the modifications of the body of an upstream response in the document. The modifications of all transformers are applied together in a single pass
+type Transformer func(tc TransformContext, doc *transform.Document) error
+
+// NewTransformers returns the transformers which can be referred by name in the route table
+func NewTransformers(engine *entitlement.Engine) map[string]Transformer {
+	return map[string]Transformer{
+		TransformerEntitlement: func(tc TransformContext, doc *transform.Document) error {
+			if err := validatePosts(doc); err != nil {
+				return err
+			}
+			if tc.Member {
+				return nil
+			}
+			return engine.ApplyDocument(tc.Route, doc)
+		},
+		// remove html because only apidata is useful and html contains full content
+		TransformerStripHTML: func(tc TransformContext, doc *transform.Document) error {
+			if err := validatePosts(doc); err != nil {
+				return err
+			}
+			for _, item := range doc.Items(entitlement.ItemsPath) {
+				if err := doc.Delete(item, "content.html"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// validatePosts checks the body is a response of the posts, i.e. an object whose items are an array if there are any
+func validatePosts(doc *transform.Document) error {
+	root := doc.Root()
+	if !root.IsObject() {
+		return errors.New("posts are not a JSON object")
+	}
+	if items := root.Get(entitlement.ItemsPath); items.Exists() && !items.IsArray() && items.Type != gjson.Null {
+		return fmt.Errorf("%s of the posts is not an array", entitlement.ItemsPath)
+	}
+	return nil
+}
+
+// DefaultV0Routes returns the route table used when V0Routes is not configured
+func DefaultV0Routes() []config.Route {
+	routes := make([]config.Route, 0, 4)
+	for _, p := range []string{"/getposts", "/posts", "/post"} {
+		routes = append(routes, config.Route{
+			Name:         strings.TrimPrefix(p, "/"),
+			Path:         p,
+			Cache:        config.RouteCache{Enabled: true},
+			Auth:         RouteAuthToken,
+			Transformers: []string{TransformerEntitlement, TransformerStripHTML},
+		})
+	}
+	return append(routes, config.Route{
+		Name: "default",
+		Path: "/**",
+		Auth: RouteAuthToken,
+	})
+}
+
+type proxyRoute struct {
+	config.Route
+	ginPath      string // path of the gin routes, empty for the fallback route
+	transformers []Transformer
+	cacheOptions cache.Options
+	handlers     []gin.HandlerFunc
+	debug        bool // reply the details of the token states
+}
+
+// ginPath converts the path of a route to the path of its gin routes. A path ending with /** is a catch-all, which is the fallback route of the api version if it's /**
+func ginPath(p string) (string, error) {
+	if !strings.HasPrefix(p, "/") {
+		return "", errors.New("path doesn't start with /")
+	}
+	if p == "/**" {
+		return "", nil
+	}
+	if strings.HasSuffix(p, "/**") {
+		p = strings.TrimSuffix(p, "**") + "*" + catchAllParam
+	}
+	if strings.Contains(strings.TrimSuffix(p, "*"+catchAllParam), "*") {
+		return "", errors.New("only the last segment of a path can be **")
+	}
+	return p, nil
+}
+
+// anyMethods are the methods of a route without methods, as registered by gin's Any
+var anyMethods = []string{
+	http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodHead,
+	http.MethodOptions, http.MethodDelete, http.MethodConnect, http.MethodTrace,
+}
+
+// RouteTable registers the routes of an api version as gin routes, each with the handlers of its auth, the middlewares and the proxy
+type RouteTable struct {
+	pathBase string
+	routes   []*proxyRoute
+	fallback *proxyRoute
+}
+
+// NewRouteTable builds the handlers of the routes. pathBase is the base path of the api version, which is stripped before proxying. The middlewares run after the authentication of a route and before the proxy
+func NewRouteTable(server *Server, pathBase string, routes []config.Route, transformers map[string]Transformer, middlewares ...gin.HandlerFunc) (*RouteTable, error) {
+	table := &RouteTable{
+		pathBase: pathBase,
+		routes:   make([]*proxyRoute, 0, len(routes)),
+	}
+	for i, r := range routes {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("#%d", i)
+		}
+		p, err := ginPath(r.Path)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "route(%s) has an invalid path(%s)", r.Name, r.Path)
+		}
+
+		pr := &proxyRoute{
+			Route:   r,
+			ginPath: p,
+			debug:   server.Conf.Debug,
+		}
+		for _, name := range r.Transformers {
+			t, ok := transformers[name]
+			if !ok {
+				return nil, fmt.Errorf("route(%s) refers to an unknown transformer(%s)", r.Name, name)
+			}
+			pr.transformers = append(pr.transformers, t)
+		}
+		if pr.Cache.KeyPrefix == "" {
+			pr.Cache.KeyPrefix = defaultCacheKeyPrefix
+		}
+		pr.cacheOptions = cacheOptions(r.Cache, server.Conf.RedisService.Cache)
+
+		pool, err := routeUpstream(server.Upstreams, r)
+		if err != nil {
+			return nil, err
+		}
+
+		switch r.Auth {
+		case RouteAuthNone:
+		case "", RouteAuthToken:
+			pr.handlers = append(pr.handlers, GetIDTokenOnly(server))
+		case RouteAuthRequired:
+			pr.handlers = append(pr.handlers, GetIDTokenOnly(server), AuthenticateIDToken(server))
+		default:
+			return nil, fmt.Errorf("route(%s) has an unsupported auth(%s)", r.Name, r.Auth)
+		}
+		pr.handlers = append(pr.handlers, middlewares...)
+		pr.handlers = append(pr.handlers, NewReverseProxy(pool, pathBase, server.Cache, server.CacheIndex, pr))
+
+		if p != "" {
+			table.routes = append(table.routes, pr)
+			continue
+		}
+		if table.fallback != nil {
+			return nil, fmt.Errorf("route(%s) is a second fallback after route(%s)", r.Name, table.fallback.Name)
+		}
+		if len(r.Methods) > 0 {
+			return nil, fmt.Errorf("fallback route(%s) can't be limited to methods", r.Name)
+		}
+		table.fallback = pr
+	}
+	return table, nil
+}
+
+// routeUpstream returns the pool of the upstream of the route. An upstream which is not in the registry is treated as the URL of a single target without health checks
+func routeUpstream(registry *upstream.Registry, r config.Route) (*upstream.Pool, error) {
+	name := r.Upstream
+	if name == "" {
+		name = DefaultUpstream
+	}
+	if pool, ok := registry.Get(name); ok {
+		return pool, nil
+	}
+	u, err := url.Parse(name)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("route(%s) refers to an unknown upstream(%s)", r.Name, name)
+	}
+	return upstream.NewPool(config.Upstream{
+		Name:    name,
+		Targets: []string{name},
+	})
+}
+
+// Register adds the gin routes of the table to the router of the api version. The fallback route serves the requests of the api version which no other route matches, and is registered as the NoRoute handlers of the engine because a gin catch-all can't be a sibling of the other routes
+func (t *RouteTable) Register(engine *gin.Engine, router gin.IRoutes) (err error) {
+	defer func() {
+		// gin panics on conflicting routes
+		if r := recover(); r != nil {
+			err = fmt.Errorf("routes conflict: %v", r)
+		}
+	}()
+	for _, route := range t.routes {
+		methods := route.Methods
+		if len(methods) == 0 {
+			methods = anyMethods
+		}
+		for _, m := range methods {
+			router.Handle(strings.ToUpper(m), route.ginPath, route.handlers...)
+		}
+	}
+
+	handlers := []gin.HandlerFunc{t.notFound}
+	if t.fallback != nil {
+		handlers = append(handlers, t.fallback.handlers...)
+	}
+	engine.NoRoute(handlers...)
+	return nil
+}
+
+// notFound leaves the requests outside of the api version to the default 404 of gin, and replies 404 to the requests of the api version if there's no fallback route
+func (t *RouteTable) notFound(c *gin.Context) {
+	if !strings.HasPrefix(c.Request.URL.Path, t.pathBase+"/") {
+		c.Abort()
+		return
+	}
+	if t.fallback == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, ErrorReply{
+			Errors: []Error{{Message: "no route matches the request"}},
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/mm-apigateway/config"
+	"github.com/mirror-media/mm-apigateway/entitlement"
+	"github.com/mirror-media/mm-apigateway/transform"
+	"github.com/mirror-media/mm-apigateway/upstream"
+)
+
+func TestRouteTableRunsTheMiddlewaresInOrder(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"path":"` + r.URL.Path + `"}`))
+	}))
+	t.Cleanup(up.Close)
+
+	var mu sync.Mutex
+	var calls []string
+	// the middleware records the gin route before the proxy, and whether the proxy has replied after it
+	recorder := func(c *gin.Context) {
+		mu.Lock()
+		calls = append(calls, "before "+c.FullPath())
+		mu.Unlock()
+		c.Next()
+		mu.Lock()
+		calls = append(calls, "after "+c.FullPath()+" "+http.StatusText(c.Writer.Status()))
+		mu.Unlock()
+	}
+	gateway := newTestGatewayTo(t, up.URL, []config.Route{
+		{Name: "posts", Path: "/posts", Methods: []string{"get"}, Auth: RouteAuthNone},
+		{Name: "sections", Path: "/sections/**", Auth: RouteAuthNone},
+		{Name: "default", Path: "/**", Auth: RouteAuthNone},
+	}, recorder)
+
+	tests := []struct {
+		method string
+		path   string
+		route  string
+	}{
+		{method: http.MethodGet, path: "/posts", route: "/api/v0/posts"},
+		{method: http.MethodGet, path: "/sections/news/1", route: "/api/v0/sections/*rest"},
+		// the methods of a route are left to the fallback
+		{method: http.MethodPost, path: "/posts", route: ""},
+		{method: http.MethodGet, path: "/getlist", route: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			mu.Lock()
+			calls = nil
+			mu.Unlock()
+			req, _ := http.NewRequest(tt.method, gateway+"/api/v0"+tt.path, nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", resp.StatusCode)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			want := []string{"before " + tt.route, "after " + tt.route + " OK"}
+			if len(calls) != 2 || calls[0] != want[0] || calls[1] != want[1] {
+				t.Fatalf("middleware calls are %q, want %q", calls, want)
+			}
+		})
+	}
+}
+
+func TestRouteTableRepliesNotFoundWithoutFallback(t *testing.T) {
+	gateway := newTestGatewayTo(t, "http://127.0.0.1:1", []config.Route{
+		{Name: "posts", Path: "/posts", Auth: RouteAuthNone},
+	})
+	resp, body := get(t, gateway+"/api/v0/getlist")
+	if resp.StatusCode != http.StatusNotFound || !strings.Contains(string(body), "no route matches the request") {
+		t.Fatalf("request of v0 got %d: %s", resp.StatusCode, body)
+	}
+	resp, body = get(t, gateway+"/api/v1/unknown")
+	if resp.StatusCode != http.StatusNotFound || strings.Contains(string(body), "no route matches the request") {
+		t.Fatalf("request outside of v0 got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestRouteTableRejectsInvalidRoutes(t *testing.T) {
+	registry, err := upstream.NewRegistry(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{Conf: &config.Conf{}, Upstreams: registry}
+	tests := []struct {
+		name   string
+		routes []config.Route
+	}{
+		{name: "relative path", routes: []config.Route{{Path: "posts", Upstream: "http://a"}}},
+		{name: "glob", routes: []config.Route{{Path: "/post*", Upstream: "http://a"}}},
+		{name: "catch-all in the middle", routes: []config.Route{{Path: "/**/posts", Upstream: "http://a"}}},
+		{name: "second fallback", routes: []config.Route{{Path: "/**", Upstream: "http://a"}, {Path: "/**", Upstream: "http://b"}}},
+		{name: "fallback of methods", routes: []config.Route{{Path: "/**", Methods: []string{"GET"}, Upstream: "http://a"}}},
+		{name: "conflict", routes: []config.Route{{Path: "/posts", Upstream: "http://a"}, {Path: "/posts", Upstream: "http://b"}}},
+		{name: "conflicting catch-all", routes: []config.Route{{Path: "/sections/news", Upstream: "http://a"}, {Path: "/sections/**", Upstream: "http://b"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table, err := NewRouteTable(server, "/api/v0", tt.routes, nil)
+			if err == nil {
+				engine := gin.New()
+				err = table.Register(engine, engine.Group("/api/v0"))
+			}
+			if err == nil {
+				t.Fatal("invalid routes are accepted")
+			}
+		})
+	}
+}
+
+func TestPostTransformersValidateTheBody(t *testing.T) {
+	engine, err := entitlement.NewEngine(entitlement.DefaultRules())
+	if err != nil {
+		t.Fatal(err)
+	}
+	transformers := NewTransformers(engine)
+	tests := []struct {
+		body  string
+		valid bool
+	}{
+		{body: `{"_items":[{"content":{"html":"<p></p>"}}]}`, valid: true},
+		{body: `{"_items":null}`, valid: true},
+		{body: `{"_meta":{}}`, valid: true},
+		{body: `[]`},
+		{body: `"posts"`},
+		{body: `{"_items":{}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.body, func(t *testing.T) {
+			for _, name := range []string{TransformerEntitlement, TransformerStripHTML} {
+				err := transformers[name](TransformContext{Route: "/posts"}, transform.NewDocument([]byte(tt.body)))
+				if valid := err == nil; valid != tt.valid {
+					t.Fatalf("%s accepts the body(%v): %v", name, valid, err)
+				}
+			}
+		})
+	}
+}
@@ -4,17 +4,29 @@ package server
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"time"
 
 	firebase "firebase.google.com/go/v4"
 	"firebase.google.com/go/v4/auth"
 	"firebase.google.com/go/v4/db"
+	"github.com/dgrijalva/jwt-go/v4"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
+	"github.com/machinebox/graphql"
+	"github.com/mirror-media/mm-apigateway/apikey"
+	"github.com/mirror-media/mm-apigateway/audit"
+	"github.com/mirror-media/mm-apigateway/cache"
 	"github.com/mirror-media/mm-apigateway/config"
+	"github.com/mirror-media/mm-apigateway/identity"
+	"github.com/mirror-media/mm-apigateway/member"
+	"github.com/mirror-media/mm-apigateway/messaging"
+	"github.com/mirror-media/mm-apigateway/secret"
 	"github.com/mirror-media/mm-apigateway/token"
+	"github.com/mirror-media/mm-apigateway/upstream"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
 	"google.golang.org/api/option"
 )
 
@@ -28,11 +40,25 @@ type Server struct {
 	FirebaseApp            *firebase.App
 	FirebaseClient         *auth.Client
 	FirebaseDatabaseClient *db.Client
+	IDTokenVerifier        token.IDTokenVerifier
+	Authenticators         *identity.Registry
+	APIKeys                *apikey.Manager
 	Services               *ServiceEndpoints
-	UserSrvToken           token.Token
+	UserSrvToken           token.ServiceToken
 	Rdb                    Rediser
+	Broker                 messaging.Broker // shared by the publishers and the subscribers
+	Cache                  *cache.Cache
+	CacheIndex             *CacheIndex
+	Upstreams              *upstream.Registry
+	Auditor                *audit.Auditor
+	Deletions              *member.Deletions
+	MemberEvents           *member.EventPublisher // nil if PubSubTopicMember is empty
+	MemberEventBus         *member.EventBus
 }
 
+// DefaultUpstream is the name of the upstream used by the routes without one
+const DefaultUpstream = "v0"
+
 func init() {
 	log.SetFormatter(&log.JSONFormatter{})
 	log.SetReportCaller(true)
@@ -49,11 +75,34 @@ type Rediser interface {
 
 	Get(ctx context.Context, key string) *redis.StringCmd
 	Del(ctx context.Context, keys ...string) *redis.IntCmd
+
+	Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd
+
+	SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd
+	SMembers(ctx context.Context, key string) *redis.StringSliceCmd
+	SRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd
+
+	ZAdd(ctx context.Context, key string, members ...*redis.Z) *redis.IntCmd
+	ZRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd
+	ZRangeByScore(ctx context.Context, key string, opt *redis.ZRangeBy) *redis.StringSliceCmd
+
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd
+
+	Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd
+	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
 }
 
-func NewServer(c config.Conf) (*Server, error) {
+// NewServer creates the server, whose background goroutines run until the context is done. They are stopped if the server fails to be created
+func NewServer(ctx context.Context, c config.Conf) (s *Server, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		if err != nil {
+			cancel()
+		}
+	}()
 
 	engine := gin.Default()
+	engine.Use(RequestID())
 
 	opt := option.WithCredentialsFile(c.FirebaseCredentialFilePath)
 
@@ -125,22 +174,318 @@ func NewServer(c config.Conf) (*Server, error) {
 		return nil, errors.New(fmt.Sprintf("unsupported redis type(%s)", c.RedisService.Type))
 	}
 
-	gatewayToken, err := token.NewGatewayToken(c.TokenSecretName, c.ProjectID)
+	responseCache := cache.New(rdb)
+	if c.MemoryCache.Enabled {
+		err = responseCache.EnableMemoryTier(ctx, rdb, memoryCacheOptions(c.MemoryCache))
+		if err != nil {
+			return nil, errors.Wrap(err, "fail to enable the memory cache")
+		}
+	}
+
+	broker, err := newBroker(context.Background(), c, rdb)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to initialize the messaging broker")
+	}
+
+	upstreams, err := upstream.NewRegistry(withDefaultUpstream(c))
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to initialize the upstreams")
+	}
+	upstreams.Start(ctx)
+
+	gatewayTokenOptions := token.GatewayOptions{
+		RefreshBefore: time.Duration(c.GatewayToken.RefreshBefore) * time.Second,
+		RotationTopic: c.GatewayToken.RotationTopic,
+		Broker:        broker,
+	}
+	if c.GatewayToken.RefreshWithMutation {
+		gatewayTokenOptions.Refresher = token.NewGraphQLRefresher(c.ServiceEndpoints.UserGraphQL)
+	}
+	gatewayTokenOptions.Verifier, err = gatewayTokenVerifier(c.GatewayToken)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to initialize the gateway token verifier")
+	}
+	secretProvider, err := secret.New(context.Background(), c.SecretProvider, c.ProjectID)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to initialize the secret provider")
+	}
+	gatewayToken, err := token.NewGatewayToken(ctx, secretProvider, c.TokenSecretName, gatewayTokenOptions)
 	if err != nil {
 		return nil, errors.Wrapf(err, "fail to retrieve the latest token(%s)", c.TokenSecretName)
 	}
+	go gatewayToken.Run(ctx)
+	if c.GatewayToken.RotationSubscription != "" {
+		go func() {
+			if err := gatewayToken.SubscribeRotation(ctx, c.GatewayToken.RotationSubscription); err != nil {
+				log.Errorf("gateway token rotation subscription stopped: %v", err)
+			}
+		}()
+	}
+	go func() {
+		if err := gatewayToken.WatchSecret(ctx); err != nil {
+			log.Errorf("watching the gateway token secret stopped: %v", err)
+		}
+	}()
 
-	s := &Server{
+	idTokenVerifier, err := newIDTokenVerifier(c, firebaseClient, dbClient, rdb)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to initialize the ID token verifier")
+	}
+
+	apiKeyStore, err := newAPIKeyStore(c.APIKeys, rdb)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to initialize the api key store")
+	}
+	apiKeys := apikey.NewManager(apiKeyStore)
+
+	authenticators, err := newAuthenticators(c, idTokenVerifier, apiKeys)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to initialize the authenticators")
+	}
+
+	auditor, err := newAuditor(c, broker)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to initialize the auditor")
+	}
+
+	var memberEvents *member.EventPublisher
+	if c.PubSubTopicMember != "" {
+		memberEvents = member.NewEventPublisher(broker, c.PubSubTopicMember, c.MemberEvents.RedactedFields)
+	}
+
+	deletions := member.NewDeletions(member.RedisDeletionStore{
+		Rdb:       rdb,
+		Retention: time.Duration(c.MemberDeletion.Retention) * 24 * time.Hour,
+	}, member.FirebaseDeletionActions{
+		Conf:      c,
+		Client:    firebaseClient,
+		DBClient:  dbClient,
+		Publisher: broker,
+		Events:    memberEvents,
+	}, auditor, member.DeletionOptions{
+		RetryBase:      time.Duration(c.MemberDeletion.RetryBase) * time.Second,
+		RetryMax:       time.Duration(c.MemberDeletion.RetryMax) * time.Second,
+		ConfirmTimeout: time.Duration(c.MemberDeletion.ConfirmTimeout) * time.Second,
+		PollInterval:   time.Duration(c.MemberDeletion.PollInterval) * time.Second,
+	})
+
+	// the token source refreshes the gateway token before it expires
+	userGraphQL := graphql.NewClient(c.ServiceEndpoints.UserGraphQL, graphql.WithHTTPClient(oauth2.NewClient(context.Background(), gatewayToken)))
+	// more handlers of the member events can be registered before the subscription starts
+	memberEventBus := member.NewEventBus()
+	memberEventBus.Handle(member.MsgAttrValueDelete, member.DeleteMemberHandler(userGraphQL, deletions, memberEvents))
+
+	s = &Server{
 		Conf:                   &c,
 		Engine:                 engine,
 		FirebaseApp:            app,
 		FirebaseClient:         firebaseClient,
 		FirebaseDatabaseClient: dbClient,
+		IDTokenVerifier:        idTokenVerifier,
+		Authenticators:         authenticators,
+		APIKeys:                apiKeys,
 		Rdb:                    rdb,
+		Broker:                 broker,
+		Cache:                  responseCache,
+		CacheIndex:             NewCacheIndex(rdb, responseCache),
 		Services: &ServiceEndpoints{
 			UserGraphQL: c.ServiceEndpoints.UserGraphQL,
 		},
-		UserSrvToken: gatewayToken,
+		UserSrvToken:   gatewayToken,
+		Upstreams:      upstreams,
+		Auditor:        auditor,
+		Deletions:      deletions,
+		MemberEvents:   memberEvents,
+		MemberEventBus: memberEventBus,
 	}
 	return s, nil
 }
+
+// newBroker creates the broker of the configured transport
+func newBroker(ctx context.Context, c config.Conf, rdb Rediser) (messaging.Broker, error) {
+	switch c.Messaging.Broker {
+	case "", "pubsub":
+		return messaging.NewPubSub(ctx, c.ProjectID)
+	case "redis":
+		streamer, ok := rdb.(messaging.Streamer)
+		if !ok {
+			return nil, errors.New("the redis client doesn't support the streams")
+		}
+		return messaging.NewRedisStreams(streamer, subscriptionTopics(c.Messaging), messaging.RedisStreamsOptions{
+			MaxLen:            int64(c.Messaging.StreamMaxLen),
+			VisibilityTimeout: time.Duration(c.Messaging.VisibilityTimeout) * time.Second,
+		}), nil
+	case "memory":
+		broker := messaging.NewMemory()
+		for subscription, topic := range subscriptionTopics(c.Messaging) {
+			if err := broker.Subscribe(topic, subscription); err != nil {
+				return nil, err
+			}
+		}
+		return broker, nil
+	default:
+		return nil, fmt.Errorf("unsupported messaging broker(%s)", c.Messaging.Broker)
+	}
+}
+
+func subscriptionTopics(c config.Messaging) map[string]string {
+	topics := make(map[string]string, len(c.Subscriptions))
+	for _, s := range c.Subscriptions {
+		topics[s.Name] = s.Topic
+	}
+	return topics
+}
+
+// newAuditor creates the auditor writing to the configured sinks, stdout by default
+func newAuditor(c config.Conf, broker messaging.Broker) (*audit.Auditor, error) {
+	sinks := c.Audit.Sinks
+	if len(sinks) == 0 {
+		sinks = []config.AuditSink{{Type: "stdout"}}
+	}
+	auditSinks := make([]audit.Sink, 0, len(sinks))
+	for _, s := range sinks {
+		var sink audit.Sink
+		var err error
+		switch s.Type {
+		case "stdout":
+			sink = audit.NewStdout()
+		case "file":
+			sink, err = audit.NewFile(s.File)
+		case "pubsub":
+			sink = audit.NewPubSub(broker, s.Topic)
+		default:
+			err = fmt.Errorf("unsupported audit sink(%s)", s.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+		auditSinks = append(auditSinks, sink)
+	}
+	redactedFields := c.Audit.RedactedFields
+	if len(redactedFields) == 0 {
+		redactedFields = audit.DefaultRedactedFields
+	}
+	return audit.New(redactedFields, auditSinks...), nil
+}
+
+// firebaseProjectID returns the Firebase project issuing the ID tokens
+func firebaseProjectID(c config.Conf) string {
+	if c.FirebaseAuth.ProjectID != "" {
+		return c.FirebaseAuth.ProjectID
+	}
+	return c.ProjectID
+}
+
+// newAPIKeyStore creates the store of the managed API keys
+func newAPIKeyStore(c config.APIKeys, rdb Rediser) (apikey.Store, error) {
+	switch c.Store {
+	case "", "redis":
+		return apikey.RedisStore{Rdb: rdb}, nil
+	case "file":
+		return apikey.NewFileStore(c.File)
+	default:
+		return nil, fmt.Errorf("unsupported api key store(%s)", c.Store)
+	}
+}
+
+// newAuthenticators creates the registry of the identity providers. API keys are picked by the header, the managed ones by their format, and the OIDC providers by the issuer of the token. The other requests are authenticated by Firebase
+func newAuthenticators(c config.Conf, verifier token.IDTokenVerifier, apiKeys *apikey.Manager) (*identity.Registry, error) {
+	firebase := identity.Firebase{
+		ProjectID: firebaseProjectID(c),
+		Verifier:  verifier,
+	}
+	authenticators := []identity.Authenticator{identity.ManagedAPIKeys{Manager: apiKeys}}
+	if len(c.StaticAPIKeys) > 0 {
+		apiKeys, err := identity.NewStaticAPIKeys(c.StaticAPIKeys)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, apiKeys)
+	}
+	authenticators = append(authenticators, firebase)
+	for _, p := range c.OIDCProviders {
+		oidc, err := identity.NewOIDC(p)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "OIDC provider(%s)", p.Name)
+		}
+		authenticators = append(authenticators, oidc)
+	}
+	return identity.NewRegistry(firebase, authenticators...), nil
+}
+
+// newIDTokenVerifier creates the verifier of the Firebase ID tokens. The tokens are verified locally unless RemoteVerification is set
+func newIDTokenVerifier(c config.Conf, firebaseClient *auth.Client, dbClient *db.Client, rdb Rediser) (token.IDTokenVerifier, error) {
+	if c.FirebaseAuth.RemoteVerification {
+		return firebaseClient, nil
+	}
+	opts := token.FirebaseVerifierOptions{
+		CacheTTL: time.Duration(c.FirebaseAuth.RevocationCacheTTL) * time.Second,
+	}
+	switch c.FirebaseAuth.RevocationCache {
+	case "", "memory":
+		opts.Cache = token.NewMemoryRevocationCache()
+	case "redis":
+		opts.Cache = token.RedisRevocationCache{Rdb: rdb}
+	default:
+		return nil, fmt.Errorf("unsupported revocation cache(%s)", c.FirebaseAuth.RevocationCache)
+	}
+	if c.FirebaseAuth.RemoteRevocationFallback {
+		opts.Fallback = firebaseClient
+	}
+	return token.NewFirebaseVerifier(firebaseProjectID(c), token.NewJWKS(token.GoogleJWKSURL).Keyfunc, token.DatabaseRevokeTimes{Client: dbClient}, opts), nil
+}
+
+// gatewayTokenVerifier creates the verifier of the gateway token with the JWKS or the public key of the config. It returns nil if neither is configured
+func gatewayTokenVerifier(c config.GatewayToken) (*token.Verifier, error) {
+	var keyfunc jwt.Keyfunc
+	switch {
+	case c.JWKSURL != "":
+		keyfunc = token.NewJWKS(c.JWKSURL).Keyfunc
+	case c.PublicKeyFile != "":
+		pem, err := ioutil.ReadFile(c.PublicKeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fail to read the public key(%s)", c.PublicKeyFile)
+		}
+		if keyfunc, err = token.NewPEMKeyfunc(pem); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+	return token.NewVerifier(keyfunc, token.VerifyOptions{
+		Issuer:   c.Issuer,
+		Audience: c.Audience,
+	}), nil
+}
+
+// withDefaultUpstream returns the configured upstreams with the default one targeting V0RESTfulSrvTargetURL if it's not configured
+func withDefaultUpstream(c config.Conf) []config.Upstream {
+	for _, u := range c.Upstreams {
+		if u.Name == DefaultUpstream {
+			return c.Upstreams
+		}
+	}
+	return append(append([]config.Upstream{}, c.Upstreams...), config.Upstream{
+		Name:    DefaultUpstream,
+		Targets: []string{c.V0RESTfulSrvTargetURL},
+	})
+}
+
+// memoryCacheOptions returns the options of the memory cache with the defaults
+func memoryCacheOptions(c config.MemoryCache) cache.MemoryOptions {
+	opts := cache.MemoryOptions{
+		MaxBytes:    c.MaxBytes,
+		TTL:         time.Duration(c.TTL) * time.Second,
+		KeyPrefixes: c.KeyPrefixes,
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = 64 << 20
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 10 * time.Second
+	}
+	if len(opts.KeyPrefixes) == 0 {
+		opts.KeyPrefixes = []string{fmt.Sprintf("%s.%s.", cacheKeyNamespace, defaultCacheKeyPrefix)}
+	}
+	return opts
+}
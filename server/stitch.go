@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mirror-media/mm-apigateway/audit"
+	"github.com/mirror-media/mm-apigateway/graph"
+	"github.com/mirror-media/mm-apigateway/identity"
+	"github.com/mirror-media/mm-apigateway/middleware"
+	"github.com/mirror-media/mm-apigateway/stitch"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// Headers propagating the principal of a request to the stitched GraphQL services. The services should only trust them from the gateway
+const (
+	ForwardedSubjectHeader  = "X-Forwarded-Subject"
+	ForwardedProviderHeader = "X-Forwarded-Provider"
+	ForwardedRolesHeader    = "X-Forwarded-Roles"
+)
+
+// Auth of the stitched GraphQL services
+const (
+	stitchAuthGateway = "gateway"
+	stitchAuthForward = "forward"
+	stitchAuthNone    = "none"
+)
+
+// newGraphQLGateway creates the gateway of the stitched services, whose fields are authorized by the GraphQL rules. It returns nil if there's no service
+func newGraphQLGateway(server *Server, authorizer *graph.Authorizer) (*stitch.Gateway, error) {
+	c := server.Conf.GraphQLStitching
+	if len(c.Services) == 0 {
+		return nil, nil
+	}
+	services := make([]*stitch.Service, 0, len(c.Services))
+	auths := make(map[string]string, len(c.Services))
+	for _, s := range c.Services {
+		schema, err := stitch.LoadSchema(s.Schema)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "fail to load the schema of service(%s)", s.Name)
+		}
+		service := &stitch.Service{
+			Name:     s.Name,
+			Endpoint: s.Endpoint,
+			Schema:   schema,
+		}
+		switch s.Auth {
+		case "", stitchAuthGateway:
+			// the token source refreshes the gateway token before it expires
+			service.Client = oauth2.NewClient(context.Background(), server.UserSrvToken)
+		case stitchAuthForward, stitchAuthNone:
+		default:
+			return nil, fmt.Errorf("service(%s) has an unsupported auth(%s)", s.Name, s.Auth)
+		}
+		services = append(services, service)
+		auths[s.Name] = s.Auth
+	}
+	return stitch.NewGateway(services, c.Links, stitch.Options{
+		Header:    stitchHeaders(auths),
+		Authorize: authorizer.Allows,
+	})
+}
+
+// stitchHeaders propagates the request ID and the principal of the request to the services, and the token of the request to the services of the forward auth
+func stitchHeaders(auths map[string]string) stitch.HeaderFunc {
+	return func(ctx context.Context, service string) http.Header {
+		header := make(http.Header)
+		if id := audit.RequestFrom(ctx).ID; id != "" {
+			header.Set(RequestIDHeader, id)
+		}
+		gc, ok := ctx.Value(middleware.CtxGinContexKey).(*gin.Context)
+		if !ok {
+			return header
+		}
+		if principal := principalOf(gc); principal != nil {
+			header.Set(ForwardedSubjectHeader, principal.Subject)
+			header.Set(ForwardedProviderHeader, principal.Provider)
+			if len(principal.Roles) > 0 {
+				header.Set(ForwardedRolesHeader, strings.Join(principal.Roles, ","))
+			}
+		}
+		if auths[service] == stitchAuthForward {
+			for _, name := range []string{"Authorization", identity.APIKeyHeader} {
+				if value := gc.GetHeader(name); value != "" {
+					header.Set(name, value)
+				}
+			}
+		}
+		return header
+	}
+}
+
+// StitchedGraphQLHandler executes the GraphQL requests of the stitched schema
+func StitchedGraphQLHandler(gateway *stitch.Gateway) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req stitch.Request
+		dec := json.NewDecoder(c.Request.Body)
+		// the variables are validated as in gqlgen
+		dec.UseNumber()
+		if err := dec.Decode(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, ErrorReply{
+				Errors: []Error{{Message: "json body could not be decoded: " + err.Error()}},
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gateway.Execute(c.Request.Context(), req))
+	}
+}
+
+// StitchedSchemaHandler replies the SDL of the stitched schema
+func StitchedSchemaHandler(gateway *stitch.Gateway) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.String(http.StatusOK, gateway.Schema())
+	}
+}
@@ -0,0 +1,563 @@
+package stitch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	graphql99 "github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/introspection"
+	"github.com/mirror-media/mm-apigateway/config"
+	"github.com/pkg/errors"
+	"github.com/vektah/gqlparser/v2"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"github.com/vektah/gqlparser/v2/validator"
+)
+
+// HeaderFunc returns the headers of the requests to the service on behalf of the request in the context, e.g. the principal
+type HeaderFunc func(ctx context.Context, service string) http.Header
+
+// AuthorizeFunc allows or denies the field of the object in the request of the context. A root field is an operation
+type AuthorizeFunc func(ctx context.Context, object string, field string, args map[string]interface{}, isOperation bool) error
+
+// Options are the hooks of the gateway into the requests
+type Options struct {
+	Header    HeaderFunc    // nothing is propagated if it's nil
+	Authorize AuthorizeFunc // every field is allowed if it's nil
+}
+
+// Gateway executes the operations of the public schema composed of the schemas of the services. The root fields are sent to the services defining them, and the links are resolved by the queries of their services
+type Gateway struct {
+	*composition
+	schema *ast.Schema
+	sdl    string
+	opts   Options
+}
+
+// NewGateway composes the schemas of the services and the links
+func NewGateway(services []*Service, links []config.GraphQLLink, opts Options) (*Gateway, error) {
+	sdl, c, err := compose(services, links)
+	if err != nil {
+		return nil, err
+	}
+	schema, gerr := gqlparser.LoadSchema(&ast.Source{Name: "stitched", Input: sdl})
+	if gerr != nil {
+		return nil, errors.Wrap(gerr, "stitched schema is invalid")
+	}
+	return &Gateway{
+		composition: c,
+		schema:      schema,
+		sdl:         sdl,
+		opts:        opts,
+	}, nil
+}
+
+// Schema returns the SDL of the public schema
+func (g *Gateway) Schema() string {
+	return g.sdl
+}
+
+// Request is a GraphQL request
+type Request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// Response is a GraphQL response. Data is omitted if the request is invalid
+type Response struct {
+	Data   json.RawMessage `json:"data,omitempty"`
+	Errors gqlerror.List   `json:"errors,omitempty"`
+}
+
+// Execute executes the operation of the request. The root fields of a query are sent to their services concurrently, and those of a mutation one by one
+func (g *Gateway) Execute(ctx context.Context, req Request) *Response {
+	doc, errs := gqlparser.LoadQuery(g.schema, req.Query)
+	if errs != nil {
+		return &Response{Errors: errs}
+	}
+	op := doc.Operations.ForName(req.OperationName)
+	if op == nil {
+		return &Response{Errors: gqlerror.List{gqlerror.Errorf("operation(%s) is not found", req.OperationName)}}
+	}
+	var root *ast.Definition
+	switch op.Operation {
+	case ast.Query:
+		root = g.schema.Query
+	case ast.Mutation:
+		root = g.schema.Mutation
+	default:
+		return &Response{Errors: gqlerror.List{gqlerror.Errorf("%s is not supported", op.Operation)}}
+	}
+	variables, gerr := validator.VariableValues(g.schema, op, req.Variables)
+	if gerr != nil {
+		return &Response{Errors: gqlerror.List{gerr}}
+	}
+
+	e := &execution{
+		ctx:       ctx,
+		gateway:   g,
+		decisions: make(map[*ast.Field]bool),
+		denied:    make(map[*ast.Field]error),
+		oc: &graphql99.OperationContext{
+			RawQuery:      req.Query,
+			Variables:     variables,
+			OperationName: req.OperationName,
+			Doc:           doc,
+			Operation:     op,
+		},
+	}
+	fields := graphql99.CollectFields(e.oc, op.SelectionSet, []string{root.Name})
+	data := e.resolveRoots(ctx, root, fields)
+	var sites []linkSite
+	e.collect(root.Name, op.SelectionSet, data, nil, &sites)
+	e.resolveLinks(ctx, sites)
+
+	var buf bytes.Buffer
+	e.writeObject(&buf, nil, root, op.SelectionSet, data)
+	return &Response{
+		Data:   buf.Bytes(),
+		Errors: e.errors,
+	}
+}
+
+// execution is the state of an operation
+type execution struct {
+	ctx     context.Context
+	gateway *Gateway
+	oc      *graphql99.OperationContext
+	mu      sync.Mutex
+	// decisions are the authorization of the selected fields, which is the same for every object
+	decisions map[*ast.Field]bool
+	denied    map[*ast.Field]error
+	errors    gqlerror.List
+}
+
+// allows authorizes the field once per operation. A denied field is written as null with the error
+func (e *execution) allows(object string, f graphql99.CollectedField, isOperation bool) bool {
+	authorize := e.gateway.opts.Authorize
+	if authorize == nil {
+		return true
+	}
+	e.mu.Lock()
+	allowed, ok := e.decisions[f.Field]
+	e.mu.Unlock()
+	if ok {
+		return allowed
+	}
+	err := authorize(e.ctx, object, f.Name, f.ArgumentMap(e.oc.Variables), isOperation)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.decisions[f.Field] = err == nil
+	if err != nil {
+		e.denied[f.Field] = err
+	}
+	return err == nil
+}
+
+// batch is the fields sent to a service in a request
+type batch struct {
+	service *Service
+	fields  []graphql99.CollectedField
+	data    map[string]interface{}
+}
+
+// resolveRoots resolves the root fields by their services, and the introspection by the gateway
+func (e *execution) resolveRoots(ctx context.Context, root *ast.Definition, fields []graphql99.CollectedField) map[string]interface{} {
+	data := make(map[string]interface{}, len(fields))
+	var batches []*batch
+	byService := make(map[*Service]*batch)
+	for _, f := range fields {
+		switch f.Name {
+		case "__typename":
+			continue
+		case "__schema":
+			data[f.Alias] = introspection.WrapSchema(e.gateway.schema)
+			continue
+		case "__type":
+			name, _ := f.ArgumentMap(e.oc.Variables)["name"].(string)
+			if def := e.gateway.schema.Types[name]; def != nil {
+				data[f.Alias] = introspection.WrapTypeFromDef(e.gateway.schema, def)
+			}
+			continue
+		}
+		if !e.allows(root.Name, f, true) {
+			continue
+		}
+		s := e.gateway.roots[root.Name+"."+f.Name]
+		b := byService[s]
+		// the fields of a mutation are sent one by one in order
+		if b == nil || e.oc.Operation.Operation == ast.Mutation {
+			b = &batch{service: s}
+			byService[s] = b
+			batches = append(batches, b)
+		}
+		b.fields = append(b.fields, f)
+	}
+
+	if e.oc.Operation.Operation == ast.Mutation {
+		for _, b := range batches {
+			e.resolveBatch(ctx, b)
+		}
+	} else {
+		var wg sync.WaitGroup
+		for _, b := range batches {
+			wg.Add(1)
+			go func(b *batch) {
+				defer wg.Done()
+				e.resolveBatch(ctx, b)
+			}(b)
+		}
+		wg.Wait()
+	}
+	for _, b := range batches {
+		for _, f := range b.fields {
+			data[f.Alias] = b.data[f.Alias]
+		}
+	}
+	return data
+}
+
+// resolveBatch sends the root fields of the batch to its service
+func (e *execution) resolveBatch(ctx context.Context, b *batch) {
+	operation := e.oc.Operation.Operation
+	root := b.service.Schema.Query
+	if operation == ast.Mutation {
+		root = b.service.Schema.Mutation
+	}
+	q := newUpstreamQuery(e, b.service)
+	for _, f := range b.fields {
+		if err := q.field(f.Alias, root.Fields.ForName(f.Name), f.ArgumentMap(e.oc.Variables), f.Selections); err != nil {
+			e.fail(b.service, ast.Path{ast.PathName(f.Alias)}, err)
+			return
+		}
+	}
+	data, errs, err := e.gateway.send(ctx, b.service, q.String(operation), q.variables)
+	if err != nil {
+		for _, f := range b.fields {
+			e.fail(b.service, ast.Path{ast.PathName(f.Alias)}, err)
+		}
+		return
+	}
+	// the aliases of the root fields are kept, so the paths of the errors are the same
+	e.upstreamErrors(b.service, errs, func(path ast.Path) ast.Path { return path })
+	b.data = data
+}
+
+// linkSite is a link selected in an object of the results
+type linkSite struct {
+	link   *link
+	field  graphql99.CollectedField
+	parent map[string]interface{}
+	path   ast.Path
+}
+
+// collect appends the links selected in the value of the type
+func (e *execution) collect(typeName string, selections ast.SelectionSet, value interface{}, path ast.Path, sites *[]linkSite) {
+	switch v := value.(type) {
+	case []interface{}:
+		for i, item := range v {
+			e.collect(typeName, selections, item, appendPath(path, ast.PathIndex(i)), sites)
+		}
+	case map[string]interface{}:
+		def := e.concreteType(e.gateway.schema.Types[typeName], v)
+		if def == nil {
+			return
+		}
+		for _, f := range graphql99.CollectFields(e.oc, selections, satisfies(e.gateway.schema, def)) {
+			if e.denied[f.Field] != nil {
+				continue
+			}
+			fieldPath := appendPath(path, ast.PathName(f.Alias))
+			if l := e.gateway.links[def.Name+"."+f.Name]; l != nil {
+				*sites = append(*sites, linkSite{
+					link:   l,
+					field:  f,
+					parent: v,
+					path:   fieldPath,
+				})
+				continue
+			}
+			if f.Definition != nil && len(f.Selections) > 0 {
+				e.collect(f.Definition.Type.Name(), f.Selections, v[f.Alias], fieldPath, sites)
+			}
+		}
+	}
+}
+
+// resolveLinks resolves the links by the queries of their services. The links of a service at the same depth are sent in a request, and the links in their results are resolved next
+func (e *execution) resolveLinks(ctx context.Context, sites []linkSite) {
+	for len(sites) > 0 {
+		var batches []*linkBatch
+		byService := make(map[*Service]*linkBatch)
+		for _, site := range sites {
+			b := byService[site.link.service]
+			if b == nil {
+				b = &linkBatch{query: newUpstreamQuery(e, site.link.service)}
+				byService[site.link.service] = b
+				batches = append(batches, b)
+			}
+			b.add(e, site)
+		}
+
+		var wg sync.WaitGroup
+		for _, b := range batches {
+			if len(b.sites) == 0 {
+				continue
+			}
+			wg.Add(1)
+			go func(b *linkBatch) {
+				defer wg.Done()
+				b.data, b.errs, b.err = e.gateway.send(ctx, b.query.service, b.query.String(ast.Query), b.query.variables)
+			}(b)
+		}
+		wg.Wait()
+
+		// the results are written to the parents after the requests, since the links of different services may share a parent
+		var next []linkSite
+		for _, b := range batches {
+			b.resolve(e, &next)
+		}
+		sites = next
+	}
+}
+
+// linkBatch is the links sent to a service in a request. The query of the i-th link is aliased as stitch__i
+type linkBatch struct {
+	query *upstreamQuery
+	sites []linkSite
+	data  map[string]interface{}
+	errs  gqlerror.List
+	err   error
+}
+
+// add adds the query of the link. The link is null if a key is null
+func (b *linkBatch) add(e *execution, site linkSite) {
+	args := site.field.ArgumentMap(e.oc.Variables)
+	for arg, key := range site.link.keys {
+		value := site.parent[reservedPrefix+key]
+		if value == nil {
+			site.parent[site.field.Alias] = nil
+			return
+		}
+		args[arg] = value
+	}
+	alias := fmt.Sprintf("%s%d", reservedPrefix, len(b.sites))
+	if err := b.query.field(alias, site.link.query, args, site.field.Selections); err != nil {
+		e.fail(site.link.service, site.path, err)
+		site.parent[site.field.Alias] = nil
+		return
+	}
+	b.sites = append(b.sites, site)
+}
+
+// resolve writes the results to the parents of the links and collects the links in them
+func (b *linkBatch) resolve(e *execution, next *[]linkSite) {
+	service := b.query.service
+	for i, site := range b.sites {
+		if b.err != nil {
+			e.fail(service, site.path, b.err)
+			site.parent[site.field.Alias] = nil
+			continue
+		}
+		value := b.data[fmt.Sprintf("%s%d", reservedPrefix, i)]
+		site.parent[site.field.Alias] = value
+		e.collect(site.field.Definition.Type.Name(), site.field.Selections, value, site.path, next)
+	}
+	e.upstreamErrors(service, b.errs, func(path ast.Path) ast.Path {
+		if len(path) == 0 {
+			return path
+		}
+		var i int
+		if name, ok := path[0].(ast.PathName); !ok || !strings.HasPrefix(string(name), reservedPrefix) {
+			return path
+		} else if _, err := fmt.Sscanf(string(name)[len(reservedPrefix):], "%d", &i); err != nil || i >= len(b.sites) {
+			return path
+		}
+		return append(appendPath(b.sites[i].path), path[1:]...)
+	})
+}
+
+// concreteType returns the object type of the value of the type. The type of a value of an abstract type is selected by the gateway
+func (e *execution) concreteType(def *ast.Definition, value map[string]interface{}) *ast.Definition {
+	if def == nil || !def.IsAbstractType() {
+		return def
+	}
+	name, _ := value[typenameAlias].(string)
+	return e.gateway.schema.Types[name]
+}
+
+// fail records the error of the field at the path
+func (e *execution) fail(s *Service, path ast.Path, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.errors = append(e.errors, &gqlerror.Error{
+		Message:    err.Error(),
+		Path:       path,
+		Extensions: map[string]interface{}{"service": s.Name},
+	})
+}
+
+// upstreamErrors records the errors replied by the service. The locations are dropped since they are of the query sent to the service
+func (e *execution) upstreamErrors(s *Service, errs gqlerror.List, path func(ast.Path) ast.Path) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, err := range errs {
+		if err.Extensions == nil {
+			err.Extensions = make(map[string]interface{})
+		}
+		err.Extensions["service"] = s.Name
+		err.Path = path(err.Path)
+		err.Locations = nil
+		e.errors = append(e.errors, err)
+	}
+}
+
+// writeValue writes the value of the type as JSON in the order of the selections. The fields selected by the gateway for itself are left out
+func (e *execution) writeValue(buf *bytes.Buffer, path ast.Path, typ *ast.Type, selections ast.SelectionSet, value interface{}) {
+	rv := reflect.ValueOf(value)
+	if value == nil || (rv.Kind() == reflect.Ptr && rv.IsNil()) {
+		buf.WriteString("null")
+		return
+	}
+	if typ.Elem != nil {
+		if rv.Kind() != reflect.Slice {
+			buf.WriteString("null")
+			return
+		}
+		buf.WriteByte('[')
+		for i := 0; i < rv.Len(); i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			item := rv.Index(i)
+			// the methods of the introspection types have pointer receivers
+			if item.Kind() == reflect.Struct {
+				item = item.Addr()
+			}
+			e.writeValue(buf, appendPath(path, ast.PathIndex(i)), typ.Elem, selections, item.Interface())
+		}
+		buf.WriteByte(']')
+		return
+	}
+	def := e.gateway.schema.Types[typ.Name()]
+	if def == nil || def.Kind == ast.Scalar || def.Kind == ast.Enum {
+		b, err := json.Marshal(value)
+		if err != nil {
+			b = []byte("null")
+		}
+		buf.Write(b)
+		return
+	}
+	e.writeObject(buf, path, def, selections, value)
+}
+
+// writeObject writes the selections of an object, which is decoded from a service or is an introspection type
+func (e *execution) writeObject(buf *bytes.Buffer, path ast.Path, def *ast.Definition, selections ast.SelectionSet, value interface{}) {
+	object, decoded := value.(map[string]interface{})
+	if decoded {
+		def = e.concreteType(def, object)
+	}
+	if def == nil {
+		buf.WriteString("null")
+		return
+	}
+	buf.WriteByte('{')
+	for i, f := range graphql99.CollectFields(e.oc, selections, satisfies(e.gateway.schema, def)) {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		alias, _ := json.Marshal(f.Alias)
+		buf.Write(alias)
+		buf.WriteByte(':')
+		fieldPath := appendPath(path, ast.PathName(f.Alias))
+		if err := e.denied[f.Field]; err != nil {
+			e.errors = append(e.errors, &gqlerror.Error{Message: err.Error(), Path: fieldPath})
+			buf.WriteString("null")
+			continue
+		}
+		var v interface{}
+		switch {
+		case f.Name == "__typename":
+			v = def.Name
+		case decoded:
+			v = object[f.Alias]
+		default:
+			v = introspect(value, f, e.oc.Variables)
+		}
+		e.writeValue(buf, fieldPath, f.Definition.Type, f.Selections, v)
+	}
+	buf.WriteByte('}')
+}
+
+// introspect resolves the field of an introspection object by the method or the struct field of the same name
+func introspect(object interface{}, f graphql99.CollectedField, variables map[string]interface{}) interface{} {
+	rv := reflect.ValueOf(object)
+	name := strings.ToUpper(f.Name[:1]) + f.Name[1:]
+	if m := rv.MethodByName(name); m.IsValid() {
+		var in []reflect.Value
+		// fields and enumValues take includeDeprecated
+		if m.Type().NumIn() == 1 {
+			include, _ := f.ArgumentMap(variables)["includeDeprecated"].(bool)
+			in = append(in, reflect.ValueOf(include))
+		}
+		return m.Call(in)[0].Interface()
+	}
+	if field := reflect.Indirect(rv).FieldByName(name); field.IsValid() {
+		return field.Interface()
+	}
+	return nil
+}
+
+func appendPath(path ast.Path, elements ...ast.PathElement) ast.Path {
+	return append(append(ast.Path{}, path...), elements...)
+}
+
+// send posts the query to the service with the headers of the request in the context, and decodes the response
+func (g *Gateway) send(ctx context.Context, s *Service, query string, variables map[string]interface{}) (map[string]interface{}, gqlerror.List, error) {
+	body, err := json.Marshal(Request{Query: query, Variables: variables})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "fail to marshal the request to service(%s)", s.Name)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "fail to create the request to service(%s)", s.Name)
+	}
+	if g.opts.Header != nil {
+		for name, values := range g.opts.Header(ctx, s.Name) {
+			req.Header[name] = values
+		}
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Accept", "application/json; charset=utf-8")
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "fail to request service(%s)", s.Name)
+	}
+	defer resp.Body.Close()
+	var r struct {
+		Data   map[string]interface{} `json:"data"`
+		Errors gqlerror.List          `json:"errors"`
+	}
+	dec := json.NewDecoder(resp.Body)
+	// the numbers are passed through as they are
+	dec.UseNumber()
+	if err = dec.Decode(&r); err != nil {
+		return nil, nil, errors.Wrapf(err, "service(%s) replied %s", s.Name, resp.Status)
+	}
+	if r.Data == nil && len(r.Errors) == 0 {
+		return nil, nil, fmt.Errorf("service(%s) replied %s without data", s.Name, resp.Status)
+	}
+	return r.Data, r.Errors, nil
+}
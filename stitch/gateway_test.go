@@ -0,0 +1,227 @@
+package stitch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mirror-media/mm-apigateway/config"
+	"github.com/vektah/gqlparser/v2"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+const userSDL = `
+type member {
+  id: ID!
+  firebaseId: String
+  email: String
+  name: String
+}
+type Query {
+  member(firebaseId: String!): member
+}
+type Mutation {
+  updateMember(firebaseId: String!, name: String): member
+}
+`
+
+const paymentSDL = `
+type subscription {
+  id: ID!
+  plan: String!
+}
+type Query {
+  subscriptions(firebaseId: String!, active: Boolean): [subscription!]!
+}
+`
+
+// fakeService replies the canned response of the queries and records the requests
+type fakeService struct {
+	*httptest.Server
+	replies  map[string]string
+	requests []Request
+	headers  []http.Header
+}
+
+func newFakeService(t *testing.T, replies map[string]string) *fakeService {
+	s := &fakeService{replies: replies}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		s.requests = append(s.requests, req)
+		s.headers = append(s.headers, r.Header)
+		reply, ok := s.replies[req.Query]
+		if !ok {
+			t.Errorf("unexpected query: %s", req.Query)
+			reply = `{"errors":[{"message":"unexpected query"}]}`
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(reply))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newTestGateway(t *testing.T, user *fakeService, payment *fakeService, opts Options) *Gateway {
+	services := []*Service{
+		{Name: "user", Endpoint: user.URL, Schema: gqlparser.MustLoadSchema(&ast.Source{Name: "user", Input: userSDL})},
+		{Name: "payment", Endpoint: payment.URL, Schema: gqlparser.MustLoadSchema(&ast.Source{Name: "payment", Input: paymentSDL})},
+	}
+	g, err := NewGateway(services, []config.GraphQLLink{{
+		Field:     "member.subscriptions",
+		Service:   "payment",
+		Query:     "subscriptions",
+		Arguments: []string{"firebaseId"},
+	}}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+const (
+	memberQuery = `query($firebaseId: String!) { me: member(firebaseId: $firebaseId) { email stitch__firebaseId: firebaseId } }`
+	linkQuery   = `query($firebaseId: String!, $active: Boolean) { stitch__0: subscriptions(firebaseId: $firebaseId, active: $active) { plan } }`
+	stitchedOp  = `query($id: String!) { me: member(firebaseId: $id) { email ...subscriptions } } fragment subscriptions on member { subscriptions(active: true) { plan } }`
+)
+
+func TestExecuteResolvesLinks(t *testing.T) {
+	user := newFakeService(t, map[string]string{
+		memberQuery: `{"data":{"me":{"email":"a@b.c","stitch__firebaseId":"u1"}}}`,
+	})
+	payment := newFakeService(t, map[string]string{
+		linkQuery: `{"data":{"stitch__0":[{"plan":"monthly"},{"plan":"yearly"}]}}`,
+	})
+	g := newTestGateway(t, user, payment, Options{
+		Header: func(ctx context.Context, service string) http.Header {
+			return http.Header{"X-Forwarded-Subject": []string{"u1"}}
+		},
+	})
+
+	resp := g.Execute(context.Background(), Request{Query: stitchedOp, Variables: map[string]interface{}{"id": "u1"}})
+	if len(resp.Errors) > 0 {
+		t.Fatal(resp.Errors)
+	}
+	if want := `{"me":{"email":"a@b.c","subscriptions":[{"plan":"monthly"},{"plan":"yearly"}]}}`; string(resp.Data) != want {
+		t.Fatalf("data is %s, want %s", resp.Data, want)
+	}
+	if len(payment.requests) != 1 || payment.requests[0].Variables["firebaseId"] != "u1" || payment.requests[0].Variables["active"] != true {
+		t.Fatalf("payment service got %+v", payment.requests)
+	}
+	for _, h := range append(user.headers, payment.headers...) {
+		if h.Get("X-Forwarded-Subject") != "u1" {
+			t.Fatalf("headers are not propagated: %v", h)
+		}
+	}
+}
+
+func TestExecuteReportsLinkErrorsAtTheirPaths(t *testing.T) {
+	user := newFakeService(t, map[string]string{
+		memberQuery: `{"data":{"me":{"email":"a@b.c","stitch__firebaseId":"u1"}}}`,
+	})
+	payment := newFakeService(t, map[string]string{
+		linkQuery: `{"data":{"stitch__0":null},"errors":[{"message":"payment is down","path":["stitch__0"],"locations":[{"line":1,"column":60}]}]}`,
+	})
+	g := newTestGateway(t, user, payment, Options{})
+
+	resp := g.Execute(context.Background(), Request{Query: stitchedOp, Variables: map[string]interface{}{"id": "u1"}})
+	if want := `{"me":{"email":"a@b.c","subscriptions":null}}`; string(resp.Data) != want {
+		t.Fatalf("data is %s, want %s", resp.Data, want)
+	}
+	if len(resp.Errors) != 1 {
+		t.Fatalf("errors are %v", resp.Errors)
+	}
+	err := resp.Errors[0]
+	if err.Path.String() != "me.subscriptions" || err.Extensions["service"] != "payment" || err.Locations != nil {
+		t.Fatalf("error is %+v", err)
+	}
+}
+
+func TestExecuteWritesDeniedFieldsAsNull(t *testing.T) {
+	user := newFakeService(t, map[string]string{
+		`query($firebaseId: String!) { member(firebaseId: $firebaseId) { name } }`: `{"data":{"member":{"name":"n"}}}`,
+	})
+	payment := newFakeService(t, nil)
+	var decisions []string
+	g := newTestGateway(t, user, payment, Options{
+		Authorize: func(ctx context.Context, object string, field string, args map[string]interface{}, isOperation bool) error {
+			decisions = append(decisions, object+"."+field)
+			if field == "email" || field == "updateMember" {
+				return errors.New("not allowed")
+			}
+			return nil
+		},
+	})
+
+	resp := g.Execute(context.Background(), Request{Query: `{ member(firebaseId: "u1") { name email } }`})
+	if want := `{"member":{"name":"n","email":null}}`; string(resp.Data) != want {
+		t.Fatalf("data is %s, want %s", resp.Data, want)
+	}
+	if len(resp.Errors) != 1 || resp.Errors[0].Path.String() != "member.email" {
+		t.Fatalf("errors are %v", resp.Errors)
+	}
+	if strings.Join(decisions, " ") != "Query.member member.name member.email" {
+		t.Fatalf("decisions are %v", decisions)
+	}
+
+	resp = g.Execute(context.Background(), Request{Query: `mutation { updateMember(firebaseId: "u1") { name } }`})
+	if string(resp.Data) != `{"updateMember":null}` || len(user.requests) != 1 {
+		t.Fatalf("denied mutation is sent: %s", resp.Data)
+	}
+}
+
+func TestExecuteIntrospection(t *testing.T) {
+	g := newTestGateway(t, newFakeService(t, nil), newFakeService(t, nil), Options{})
+	resp := g.Execute(context.Background(), Request{Query: `{ __typename __schema { queryType { name } } __type(name: "member") { fields { name } } }`})
+	if len(resp.Errors) > 0 {
+		t.Fatal(resp.Errors)
+	}
+	want := `{"__typename":"Query","__schema":{"queryType":{"name":"Query"}},"__type":{"fields":[{"name":"id"},{"name":"firebaseId"},{"name":"email"},{"name":"name"},{"name":"subscriptions"}]}}`
+	if string(resp.Data) != want {
+		t.Fatalf("data is %s, want %s", resp.Data, want)
+	}
+}
+
+func TestNewGatewayRejectsConflicts(t *testing.T) {
+	user := gqlparser.MustLoadSchema(&ast.Source{Name: "user", Input: userSDL})
+	tests := []struct {
+		name     string
+		services []*Service
+		links    []config.GraphQLLink
+	}{
+		{
+			name:     "root field of two services",
+			services: []*Service{{Name: "user", Schema: user}, {Name: "legacy", Schema: user}},
+		},
+		{
+			name: "field of different types",
+			services: []*Service{{Name: "user", Schema: user}, {Name: "payment", Schema: gqlparser.MustLoadSchema(&ast.Source{
+				Name:  "payment",
+				Input: `type member { email: Int } type Query { subscriptions: [member] }`,
+			})}},
+		},
+		{
+			name:     "link to an unknown query",
+			services: []*Service{{Name: "user", Schema: user}},
+			links:    []config.GraphQLLink{{Field: "member.subscriptions", Service: "user", Query: "subscriptions"}},
+		},
+		{
+			name:     "link of an unknown key",
+			services: []*Service{{Name: "user", Schema: user}},
+			links:    []config.GraphQLLink{{Field: "member.self", Service: "user", Query: "member", Arguments: []string{"firebaseId=uid"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewGateway(tt.services, tt.links, Options{}); err == nil {
+				t.Fatal("conflict is composed")
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package stitch
+
+import (
+	"fmt"
+	"strings"
+
+	graphql99 "github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+const (
+	// reservedPrefix prefixes the aliases of the fields selected by the gateway for itself
+	reservedPrefix = "stitch__"
+	typenameAlias  = reservedPrefix + "typename"
+)
+
+// upstreamQuery builds the query of the fields sent to a service. The fragments are flattened, the arguments are passed as variables declared with the types in the schema of the service, and the links are replaced by their keys
+type upstreamQuery struct {
+	e           *execution
+	service     *Service
+	buf         strings.Builder
+	definitions []string
+	variables   map[string]interface{}
+}
+
+func newUpstreamQuery(e *execution, s *Service) *upstreamQuery {
+	return &upstreamQuery{
+		e:         e,
+		service:   s,
+		variables: make(map[string]interface{}),
+	}
+}
+
+// String returns the operation of the fields written
+func (q *upstreamQuery) String(operation ast.Operation) string {
+	op := string(operation)
+	if len(q.definitions) > 0 {
+		op += "(" + strings.Join(q.definitions, ", ") + ")"
+	}
+	return op + " {" + q.buf.String() + " }"
+}
+
+// field writes the field of the service under the alias
+func (q *upstreamQuery) field(alias string, def *ast.FieldDefinition, args map[string]interface{}, selections ast.SelectionSet) error {
+	q.buf.WriteString(" ")
+	if alias != def.Name {
+		q.buf.WriteString(alias + ": ")
+	}
+	q.buf.WriteString(def.Name)
+	for name := range args {
+		if def.Arguments.ForName(name) == nil {
+			return fmt.Errorf("argument(%s) of %s is not defined by service(%s)", name, def.Name, q.service.Name)
+		}
+	}
+	if len(args) > 0 {
+		written := make([]string, 0, len(args))
+		for _, a := range def.Arguments {
+			if value, ok := args[a.Name]; ok {
+				written = append(written, a.Name+": $"+q.declare(a.Name, a.Type, value))
+			}
+		}
+		q.buf.WriteString("(" + strings.Join(written, ", ") + ")")
+	}
+	if len(selections) == 0 {
+		return nil
+	}
+	return q.selections(def.Type.Name(), selections)
+}
+
+// declare declares the variable of the argument, whose name is suffixed if an argument of another field has the same name
+func (q *upstreamQuery) declare(name string, t *ast.Type, value interface{}) string {
+	variable := name
+	for i := 2; ; i++ {
+		if _, ok := q.variables[variable]; !ok {
+			break
+		}
+		variable = fmt.Sprintf("%s%d", name, i)
+	}
+	q.variables[variable] = value
+	q.definitions = append(q.definitions, "$"+variable+": "+t.String())
+	return variable
+}
+
+// selections writes the selections of a value of the type. The selections of an abstract type are grouped by the possible types, and the type of the value is selected to write it
+func (q *upstreamQuery) selections(typeName string, selections ast.SelectionSet) error {
+	def := q.e.gateway.schema.Types[typeName]
+	sdef := q.service.Schema.Types[typeName]
+	if def == nil || sdef == nil {
+		return fmt.Errorf("type(%s) is not defined by service(%s)", typeName, q.service.Name)
+	}
+	q.buf.WriteString(" {")
+	if !def.IsAbstractType() {
+		if err := q.fields(def, sdef, graphql99.CollectFields(q.e.oc, selections, satisfies(q.e.gateway.schema, def))); err != nil {
+			return err
+		}
+		q.buf.WriteString(" }")
+		return nil
+	}
+	q.buf.WriteString(" " + typenameAlias + ": __typename")
+	for _, possible := range q.service.Schema.GetPossibleTypes(sdef) {
+		pdef := q.e.gateway.schema.Types[possible.Name]
+		fields := graphql99.CollectFields(q.e.oc, selections, satisfies(q.e.gateway.schema, pdef))
+		if len(fields) == 0 {
+			continue
+		}
+		q.buf.WriteString(" ... on " + possible.Name + " {")
+		if err := q.fields(pdef, possible, fields); err != nil {
+			return err
+		}
+		q.buf.WriteString(" }")
+	}
+	q.buf.WriteString(" }")
+	return nil
+}
+
+// fields writes the fields of the object of the public type def, which is sdef in the service
+func (q *upstreamQuery) fields(def *ast.Definition, sdef *ast.Definition, fields []graphql99.CollectedField) error {
+	written := q.buf.Len()
+	keys := make(map[string]bool)
+	for _, f := range fields {
+		// the type is written by the gateway, and the denied fields are written as null
+		if f.Name == "__typename" || !q.e.allows(def.Name, f, false) {
+			continue
+		}
+		if l := q.e.gateway.links[def.Name+"."+f.Name]; l != nil {
+			for _, key := range l.keys {
+				if keys[key] {
+					continue
+				}
+				keys[key] = true
+				if sdef.Fields.ForName(key) == nil {
+					return fmt.Errorf("%s.%s is not resolved by service(%s)", def.Name, key, q.service.Name)
+				}
+				q.buf.WriteString(" " + reservedPrefix + key + ": " + key)
+			}
+			continue
+		}
+		fdef := sdef.Fields.ForName(f.Name)
+		if fdef == nil {
+			return fmt.Errorf("%s.%s is not resolved by service(%s)", def.Name, f.Name, q.service.Name)
+		}
+		if err := q.field(f.Alias, fdef, f.ArgumentMap(q.e.oc.Variables), f.Selections); err != nil {
+			return err
+		}
+	}
+	// the selections may be all skipped or denied
+	if q.buf.Len() == written {
+		q.buf.WriteString(" " + typenameAlias + ": __typename")
+	}
+	return nil
+}
+
+// satisfies returns the type conditions matching a value of the object, i.e. itself, its interfaces and the unions of it
+func satisfies(schema *ast.Schema, def *ast.Definition) []string {
+	satisfies := append([]string{def.Name}, def.Interfaces...)
+	for _, t := range schema.Types {
+		if t.Kind != ast.Union {
+			continue
+		}
+		for _, member := range t.Types {
+			if member == def.Name {
+				satisfies = append(satisfies, t.Name)
+			}
+		}
+	}
+	return satisfies
+}
@@ -0,0 +1,236 @@
+package stitch
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/mirror-media/mm-apigateway/config"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vektah/gqlparser/v2"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/formatter"
+)
+
+// Service is a backend GraphQL service stitched into the public schema
+type Service struct {
+	Name     string
+	Endpoint string
+	Schema   *ast.Schema
+	Client   *http.Client // default http.DefaultClient
+}
+
+// LoadSchema loads the schema of a service from the SDL file
+func LoadSchema(path string) (*ast.Schema, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to read the schema %s", path)
+	}
+	schema, gerr := gqlparser.LoadSchema(&ast.Source{Name: path, Input: string(b)})
+	if gerr != nil {
+		return nil, errors.Wrapf(gerr, "schema %s is invalid", path)
+	}
+	return schema, nil
+}
+
+// link is a field of a type resolved by a root query of another service
+type link struct {
+	service *Service
+	query   *ast.FieldDefinition
+	// keys are the fields of the type passed to the query, keyed by the arguments
+	keys map[string]string
+}
+
+// composition is the public schema composed of the schemas of the services
+type composition struct {
+	types      map[string]*ast.Definition
+	directives map[string]*ast.DirectiveDefinition
+	// roots are the services of the root fields keyed by Query.field or Mutation.field
+	roots map[string]*Service
+	// links are keyed by Type.field
+	links map[string]*link
+}
+
+// compose merges the types of the services into the SDL of the public schema. A root field is sent to the service defining it, and a type defined by several services has the fields of all of them
+func compose(services []*Service, links []config.GraphQLLink) (string, *composition, error) {
+	c := &composition{
+		types:      make(map[string]*ast.Definition),
+		directives: make(map[string]*ast.DirectiveDefinition),
+		roots:      make(map[string]*Service),
+		links:      make(map[string]*link),
+	}
+	byName := make(map[string]*Service, len(services))
+	for _, s := range services {
+		if byName[s.Name] != nil {
+			return "", nil, fmt.Errorf("service(%s) is defined twice", s.Name)
+		}
+		byName[s.Name] = s
+		if err := c.add(s); err != nil {
+			return "", nil, err
+		}
+	}
+	for _, l := range links {
+		if err := c.link(byName, l); err != nil {
+			return "", nil, err
+		}
+	}
+
+	var sdl strings.Builder
+	formatter.NewFormatter(&sdl).FormatSchema(&ast.Schema{
+		Types:      c.types,
+		Directives: c.directives,
+	})
+	return sdl.String(), c, nil
+}
+
+// add merges the types and the custom directives of the service
+func (c *composition) add(s *Service) error {
+	if s.Schema.Subscription != nil {
+		log.Warnf("subscriptions of service(%s) are not stitched", s.Name)
+	}
+	for _, def := range s.Schema.Types {
+		if def.BuiltIn || def == s.Schema.Subscription {
+			continue
+		}
+		name := def.Name
+		isRoot := true
+		switch def {
+		case s.Schema.Query:
+			name = "Query"
+		case s.Schema.Mutation:
+			name = "Mutation"
+		default:
+			isRoot = false
+		}
+
+		merged, ok := c.types[name]
+		if !ok {
+			merged = &ast.Definition{
+				Kind:        def.Kind,
+				Description: def.Description,
+				Name:        name,
+				Directives:  def.Directives,
+				Position:    def.Position,
+			}
+			c.types[name] = merged
+		} else if merged.Kind != def.Kind {
+			return fmt.Errorf("type(%s) of service(%s) is a %s, but it's a %s in another service", name, s.Name, def.Kind, merged.Kind)
+		}
+
+		for _, f := range def.Fields {
+			// __schema and __type are added to the query type by the parser
+			if strings.HasPrefix(f.Name, "__") {
+				continue
+			}
+			if isRoot {
+				key := name + "." + f.Name
+				if owner := c.roots[key]; owner != nil {
+					return fmt.Errorf("%s is defined by both service(%s) and service(%s)", key, owner.Name, s.Name)
+				}
+				c.roots[key] = s
+			}
+			if existing := merged.Fields.ForName(f.Name); existing != nil {
+				if existing.Type.String() != f.Type.String() {
+					return fmt.Errorf("%s.%s of service(%s) is %s, but it's %s in another service", name, f.Name, s.Name, f.Type, existing.Type)
+				}
+				continue
+			}
+			merged.Fields = append(merged.Fields, f)
+		}
+		merged.Interfaces = union(merged.Interfaces, def.Interfaces)
+		merged.Types = union(merged.Types, def.Types)
+		for _, v := range def.EnumValues {
+			if merged.EnumValues.ForName(v.Name) == nil {
+				merged.EnumValues = append(merged.EnumValues, v)
+			}
+		}
+	}
+	for name, d := range s.Schema.Directives {
+		if d.Position != nil && d.Position.Src != nil && d.Position.Src.BuiltIn {
+			continue
+		}
+		if c.directives[name] == nil {
+			c.directives[name] = d
+		}
+	}
+	return nil
+}
+
+// link adds the field of the link to its type. The field takes the arguments of the query which aren't keys, and it's nullable so that a failure of the service doesn't fail the parent
+func (c *composition) link(services map[string]*Service, l config.GraphQLLink) error {
+	parts := strings.Split(l.Field, ".")
+	if len(parts) != 2 {
+		return fmt.Errorf("link has an invalid field(%s), it should be Type.field", l.Field)
+	}
+	def := c.types[parts[0]]
+	if def == nil || (def.Kind != ast.Object && def.Kind != ast.Interface) {
+		return fmt.Errorf("link(%s) is not on an object type", l.Field)
+	}
+	if def.Fields.ForName(parts[1]) != nil {
+		return fmt.Errorf("link(%s) is a field of a service", l.Field)
+	}
+	s := services[l.Service]
+	if s == nil {
+		return fmt.Errorf("link(%s) has an unknown service(%s)", l.Field, l.Service)
+	}
+	var query *ast.FieldDefinition
+	if s.Schema.Query != nil {
+		query = s.Schema.Query.Fields.ForName(l.Query)
+	}
+	if query == nil {
+		return fmt.Errorf("link(%s) has an unknown query(%s) of service(%s)", l.Field, l.Query, l.Service)
+	}
+
+	keys := make(map[string]string, len(l.Arguments))
+	for _, a := range l.Arguments {
+		arg, field := a, a
+		if i := strings.Index(a, "="); i >= 0 {
+			arg, field = a[:i], a[i+1:]
+		}
+		if query.Arguments.ForName(arg) == nil {
+			return fmt.Errorf("link(%s) has an unknown argument(%s) of the query", l.Field, arg)
+		}
+		if def.Fields.ForName(field) == nil {
+			return fmt.Errorf("link(%s) has an argument(%s) of an unknown field(%s)", l.Field, arg, field)
+		}
+		keys[arg] = field
+	}
+
+	typ := *query.Type
+	typ.NonNull = false
+	field := &ast.FieldDefinition{
+		Description: query.Description,
+		Name:        parts[1],
+		Type:        &typ,
+	}
+	for _, a := range query.Arguments {
+		if _, ok := keys[a.Name]; !ok {
+			field.Arguments = append(field.Arguments, a)
+		}
+	}
+	def.Fields = append(def.Fields, field)
+	c.links[l.Field] = &link{
+		service: s,
+		query:   query,
+		keys:    keys,
+	}
+	return nil
+}
+
+func union(a []string, b []string) []string {
+	for _, s := range b {
+		found := false
+		for _, t := range a {
+			if s == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			a = append(a, s)
+		}
+	}
+	return a
+}
@@ -11,18 +11,41 @@ import (
 )
 
 type FirebaseToken struct {
-	tokenString    *string
-	tokenState     firebaseTokenState
-	firebaseClient *auth.Client
+	tokenString *string
+	tokenState  firebaseTokenState
+	verifier    IDTokenVerifier
 }
 
 type firebaseTokenState struct {
 	sync.Mutex
-	state *string
+	state   *State
+	detail  string
+	idToken *auth.Token
 }
 
-func (ftt *firebaseTokenState) setState(state string) {
+func (ftt *firebaseTokenState) setState(state State, detail string) {
 	ftt.state = &state
+	ftt.detail = detail
+}
+
+// firebaseStateOf maps the error of the verification, by Firebase or locally, to the state. The messages of the errors are not stable and only kept as the detail
+func firebaseStateOf(err error) State {
+	if state, ok := jwtStateOf(err); ok {
+		return state
+	}
+	switch {
+	case err == nil:
+		return OK
+	case errors.Is(err, ErrRevoked), auth.IsIDTokenRevoked(err):
+		return StateRevoked
+	case auth.IsIDTokenExpired(err):
+		return StateExpired
+	case auth.IsCertificateFetchFailed(err):
+		return StateUnverifiable
+	case auth.IsIDTokenInvalid(err), auth.IsUserNotFound(err):
+		return StateInvalid
+	}
+	return StateUnverifiable
 }
 
 func (ft *FirebaseToken) GetTokenString() (string, error) {
@@ -41,18 +64,15 @@ func (ft *FirebaseToken) ExecuteTokenStateUpdate() error {
 		defer ft.tokenState.Unlock()
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		_, err := ft.firebaseClient.VerifyIDTokenAndCheckRevoked(ctx, *ft.tokenString)
-		if err != nil {
-			ft.tokenState.setState(err.Error())
-			return
-		}
-		ft.tokenState.setState(OK)
+		idToken, err := ft.verifier.VerifyIDTokenAndCheckRevoked(ctx, *ft.tokenString)
+		ft.tokenState.setState(firebaseStateOf(err), detailOf(err))
+		ft.tokenState.idToken = idToken
 	}()
 	return nil
 }
 
 // GetTokenState will automatically update state if cached state is nil
-func (ft *FirebaseToken) GetTokenState() string {
+func (ft *FirebaseToken) GetTokenState() State {
 	if ft.tokenState.state == nil {
 		ft.ExecuteTokenStateUpdate()
 	}
@@ -62,26 +82,48 @@ func (ft *FirebaseToken) GetTokenState() string {
 	return *ft.tokenState.state
 }
 
-// NewFirebaseToken creates a token and excute the token state update procedure
-func NewFirebaseToken(authHeader string, client *auth.Client) (Token, error) {
-	if client == nil {
-		return nil, errors.New("client cannot be nil")
+// GetTokenDetail returns the error of the verification by Firebase
+func (ft *FirebaseToken) GetTokenDetail() string {
+	if ft.tokenState.state == nil {
+		ft.ExecuteTokenStateUpdate()
+	}
+
+	ft.tokenState.Lock()
+	defer ft.tokenState.Unlock()
+	return ft.tokenState.detail
+}
+
+// GetIDToken returns the verified ID token, nil unless the state is OK
+func (ft *FirebaseToken) GetIDToken() *auth.Token {
+	if ft.GetTokenState() != OK {
+		return nil
+	}
+	ft.tokenState.Lock()
+	defer ft.tokenState.Unlock()
+	return ft.tokenState.idToken
+}
+
+// NewFirebaseToken creates a token and excute the token state update procedure with the verifier, e.g. a FirebaseVerifier or the *auth.Client
+func NewFirebaseToken(authHeader string, verifier IDTokenVerifier) (*FirebaseToken, error) {
+	if verifier == nil {
+		return nil, errors.New("verifier cannot be nil")
 	}
 	const BearerSchema = "Bearer "
-	var state, tokenString *string
+	var state *State
+	var tokenString *string
 	if authHeader == "" {
-		s := "authorization header is not provided"
+		s := StateNotProvided
 		state = &s
 	} else if !strings.HasPrefix(authHeader, BearerSchema) {
-		s := "Not a Bearer token"
+		s := StateNotBearer
 		state = &s
 	} else {
 		s := (authHeader)[len(BearerSchema):]
 		tokenString = &s
 	}
 	firebaseToken := &FirebaseToken{
-		firebaseClient: client,
-		tokenString:    tokenString,
+		verifier:    verifier,
+		tokenString: tokenString,
 		tokenState: firebaseTokenState{
 			state: state,
 		},
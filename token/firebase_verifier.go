@@ -0,0 +1,286 @@
+package token
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+	"firebase.google.com/go/v4/db"
+	"github.com/dgrijalva/jwt-go/v4"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// GoogleJWKSURL is the JWKS of the keys signing the Firebase ID tokens
+	GoogleJWKSURL        = "https://www.googleapis.com/service_accounts/v1/jwk/securetoken@system.gserviceaccount.com"
+	firebaseIssuerPrefix = "https://securetoken.google.com/"
+	// firebaseClockSkew is the clock skew tolerated by the Firebase SDK as well
+	firebaseClockSkew         = 5 * time.Minute
+	defaultRevocationCacheTTL = time.Minute
+	revocationCacheNamespace  = "mm-apigateway.revocation"
+)
+
+// ErrRevoked is returned when the user signed in before the tokens of the user were revoked
+var ErrRevoked = errors.New("token has been revoked")
+
+// IDTokenVerifier verifies a Firebase ID token and checks whether it's revoked. *auth.Client verifies it remotely
+type IDTokenVerifier interface {
+	VerifyIDTokenAndCheckRevoked(ctx context.Context, idToken string) (*auth.Token, error)
+}
+
+// RevokeTimes reads the time in UTC seconds when the tokens of a user were revoked, 0 if they never were
+type RevokeTimes interface {
+	RevokeTime(ctx context.Context, uid string) (int64, error)
+}
+
+// DatabaseRevokeTimes reads the revoke times saved to metadata/<uid>/revokeTime of the Realtime Database by member.Delete
+type DatabaseRevokeTimes struct {
+	Client *db.Client
+}
+
+// RevokeTime reads the revoke time of the user
+func (d DatabaseRevokeTimes) RevokeTime(ctx context.Context, uid string) (int64, error) {
+	var metadata struct {
+		RevokeTime int64 `json:"revokeTime"`
+	}
+	if err := d.Client.NewRef("metadata/"+uid).Get(ctx, &metadata); err != nil {
+		return 0, errors.Wrapf(err, "fail to read the revoke time of user(%s)", uid)
+	}
+	return metadata.RevokeTime, nil
+}
+
+// RevocationCache caches the revoke times of the users
+type RevocationCache interface {
+	// Get returns the cached revoke time, ok is false if it's not cached
+	Get(ctx context.Context, uid string) (revokeTime int64, ok bool, err error)
+	Set(ctx context.Context, uid string, revokeTime int64, ttl time.Duration) error
+}
+
+type revocationEntry struct {
+	revokeTime int64
+	expiry     time.Time
+}
+
+// MemoryRevocationCache caches the revoke times in the memory of the replica
+type MemoryRevocationCache struct {
+	mu      sync.Mutex
+	entries map[string]revocationEntry
+	// sweepAt is the size at which the expired entries are swept
+	sweepAt int
+}
+
+// NewMemoryRevocationCache creates an empty cache
+func NewMemoryRevocationCache() *MemoryRevocationCache {
+	return &MemoryRevocationCache{
+		entries: make(map[string]revocationEntry),
+		sweepAt: 1024,
+	}
+}
+
+// Get returns the revoke time if it's not expired
+func (m *MemoryRevocationCache) Get(ctx context.Context, uid string) (int64, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[uid]
+	if !ok || !time.Now().Before(e.expiry) {
+		return 0, false, nil
+	}
+	return e.revokeTime, true, nil
+}
+
+// Set caches the revoke time. The expired entries are swept whenever the cache doubles
+func (m *MemoryRevocationCache) Set(ctx context.Context, uid string, revokeTime int64, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if len(m.entries) >= m.sweepAt {
+		for k, e := range m.entries {
+			if !now.Before(e.expiry) {
+				delete(m.entries, k)
+			}
+		}
+		m.sweepAt = 2 * len(m.entries)
+		if m.sweepAt < 1024 {
+			m.sweepAt = 1024
+		}
+	}
+	m.entries[uid] = revocationEntry{
+		revokeTime: revokeTime,
+		expiry:     now.Add(ttl),
+	}
+	return nil
+}
+
+// RedisGetSetter is the part of a redis client used by RedisRevocationCache
+type RedisGetSetter interface {
+	Get(ctx context.Context, key string) *redis.StringCmd
+	Set(ctx context.Context, key string, value interface{}, ttl time.Duration) *redis.StatusCmd
+}
+
+// RedisRevocationCache caches the revoke times in redis, which are shared by the replicas
+type RedisRevocationCache struct {
+	Rdb RedisGetSetter
+}
+
+func revocationKey(uid string) string {
+	return fmt.Sprintf("%s.%s", revocationCacheNamespace, uid)
+}
+
+// Get returns the revoke time cached in redis
+func (r RedisRevocationCache) Get(ctx context.Context, uid string) (int64, bool, error) {
+	v, err := r.Rdb.Get(ctx, revocationKey(uid)).Result()
+	if err == redis.Nil {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	revokeTime, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "cached revoke time of user(%s) is malformed", uid)
+	}
+	return revokeTime, true, nil
+}
+
+// Set caches the revoke time in redis
+func (r RedisRevocationCache) Set(ctx context.Context, uid string, revokeTime int64, ttl time.Duration) error {
+	return r.Rdb.Set(ctx, revocationKey(uid), strconv.FormatInt(revokeTime, 10), ttl).Err()
+}
+
+// FirebaseVerifierOptions describes how the revocation of the tokens is checked
+type FirebaseVerifierOptions struct {
+	// Cache caches the revoke times, default NewMemoryRevocationCache()
+	Cache RevocationCache
+	// CacheTTL is how long a revoke time is cached, default 1m
+	CacheTTL time.Duration
+	// Fallback verifies the token if the revoke time can't be read, the token is unverifiable if it's nil
+	Fallback IDTokenVerifier
+}
+
+// FirebaseVerifier verifies the Firebase ID tokens locally against the cached public keys of Google, and checks the revocation against the cached revoke times instead of calling Firebase for every token
+type FirebaseVerifier struct {
+	verifier    *Verifier
+	revokeTimes RevokeTimes
+	opts        FirebaseVerifierOptions
+}
+
+// NewFirebaseVerifier creates the verifier of the ID tokens of the Firebase project
+func NewFirebaseVerifier(projectID string, keyfunc jwt.Keyfunc, revokeTimes RevokeTimes, opts FirebaseVerifierOptions) *FirebaseVerifier {
+	if opts.Cache == nil {
+		opts.Cache = NewMemoryRevocationCache()
+	}
+	if opts.CacheTTL <= 0 {
+		opts.CacheTTL = defaultRevocationCacheTTL
+	}
+	return &FirebaseVerifier{
+		verifier: NewVerifier(keyfunc, VerifyOptions{
+			Issuer:   firebaseIssuerPrefix + projectID,
+			Audience: projectID,
+			Leeway:   firebaseClockSkew,
+			Methods:  []string{"RS256"},
+		}),
+		revokeTimes: revokeTimes,
+		opts:        opts,
+	}
+}
+
+// VerifyIDToken verifies the signature and the claims of the token the way the Firebase SDK does
+func (v *FirebaseVerifier) VerifyIDToken(idToken string) (*auth.Token, error) {
+	claims := jwt.MapClaims{}
+	if err := v.verifier.Verify(idToken, claims); err != nil {
+		return nil, err
+	}
+	t := &auth.Token{
+		AuthTime: claimSeconds(claims["auth_time"]),
+		Expires:  claimSeconds(claims["exp"]),
+		IssuedAt: claimSeconds(claims["iat"]),
+	}
+	t.Issuer, _ = claims["iss"].(string)
+	t.Subject, _ = claims["sub"].(string)
+	if aud, err := jwt.ParseClaimStrings(claims["aud"]); err == nil && len(aud) > 0 {
+		t.Audience = aud[0]
+	}
+	if firebase, ok := claims["firebase"]; ok {
+		data, err := json.Marshal(firebase)
+		if err == nil {
+			err = json.Unmarshal(data, &t.Firebase)
+		}
+		if err != nil {
+			return nil, &jwt.MalformedTokenError{Message: "couldn't parse 'firebase' value"}
+		}
+	}
+
+	now := time.Now().Add(firebaseClockSkew).Unix()
+	switch {
+	case t.Subject == "":
+		return nil, &jwt.InvalidClaimsError{Message: "token has an empty sub"}
+	case len(t.Subject) > 128:
+		return nil, &jwt.InvalidClaimsError{Message: "token has a sub longer than 128 characters"}
+	case t.IssuedAt > now:
+		return nil, &jwt.InvalidClaimsError{Message: fmt.Sprintf("token is issued in the future at %d", t.IssuedAt)}
+	case t.AuthTime > now:
+		return nil, &jwt.InvalidClaimsError{Message: fmt.Sprintf("token is authenticated in the future at %d", t.AuthTime)}
+	}
+	t.UID = t.Subject
+	for _, standard := range []string{"iss", "aud", "exp", "iat", "sub", "uid"} {
+		delete(claims, standard)
+	}
+	t.Claims = claims
+	return t, nil
+}
+
+// claimSeconds returns the seconds of a numeric date claim, 0 if it's absent
+func claimSeconds(v interface{}) int64 {
+	switch n := v.(type) {
+	case float64:
+		return int64(n)
+	case json.Number:
+		f, _ := n.Float64()
+		return int64(f)
+	}
+	return 0
+}
+
+// VerifyIDTokenAndCheckRevoked verifies the token and rejects it if the user signed in no later than the revocation
+func (v *FirebaseVerifier) VerifyIDTokenAndCheckRevoked(ctx context.Context, idToken string) (*auth.Token, error) {
+	t, err := v.VerifyIDToken(idToken)
+	if err != nil {
+		return nil, err
+	}
+	revokeTime, err := v.revokeTime(ctx, t.UID)
+	if err != nil {
+		if v.opts.Fallback == nil {
+			return nil, err
+		}
+		log.Warnf("checking the revocation of user(%s) remotely: %v", t.UID, err)
+		return v.opts.Fallback.VerifyIDTokenAndCheckRevoked(ctx, idToken)
+	}
+	if revokeTime > 0 && t.AuthTime <= revokeTime {
+		return nil, ErrRevoked
+	}
+	return t, nil
+}
+
+// revokeTime reads the revoke time of the user through the cache. A failing cache doesn't fail the check
+func (v *FirebaseVerifier) revokeTime(ctx context.Context, uid string) (int64, error) {
+	revokeTime, ok, err := v.opts.Cache.Get(ctx, uid)
+	if err != nil {
+		log.Warnf("reading the cached revoke time of user(%s) encountered error: %v", uid, err)
+	} else if ok {
+		return revokeTime, nil
+	}
+
+	revokeTime, err = v.revokeTimes.RevokeTime(ctx, uid)
+	if err != nil {
+		return 0, err
+	}
+	if err := v.opts.Cache.Set(ctx, uid, revokeTime, v.opts.CacheTTL); err != nil {
+		log.Warnf("caching the revoke time of user(%s) encountered error: %v", uid, err)
+	}
+	return revokeTime, nil
+}
@@ -0,0 +1,120 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+	"github.com/dgrijalva/jwt-go/v4"
+)
+
+const testProjectID = "mm-test"
+
+type fakeRevokeTimes struct {
+	times map[string]int64
+	err   error
+	reads int
+}
+
+func (f *fakeRevokeTimes) RevokeTime(ctx context.Context, uid string) (int64, error) {
+	f.reads++
+	return f.times[uid], f.err
+}
+
+type fakeIDTokenVerifier struct {
+	calls int
+}
+
+func (f *fakeIDTokenVerifier) VerifyIDTokenAndCheckRevoked(ctx context.Context, idToken string) (*auth.Token, error) {
+	f.calls++
+	return &auth.Token{UID: "remote"}, nil
+}
+
+type firebaseTestClaims struct {
+	jwt.StandardClaims
+	AuthTime int64 `json:"auth_time"`
+	Admin    bool  `json:"admin,omitempty"`
+}
+
+func signFirebaseToken(t *testing.T, key interface{}, uid string, authTime time.Time) string {
+	now := time.Now()
+	s, err := jwt.NewWithClaims(jwt.SigningMethodRS256, firebaseTestClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    firebaseIssuerPrefix + testProjectID,
+			Audience:  jwt.ClaimStrings{testProjectID},
+			Subject:   uid,
+			IssuedAt:  jwt.At(now),
+			ExpiresAt: jwt.At(now.Add(time.Hour)),
+		},
+		AuthTime: authTime.Unix(),
+		Admin:    true,
+	}).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestFirebaseVerifier(t *testing.T) {
+	key := newTestKey(t)
+	keyfunc, err := NewPEMKeyfunc(pemOf(t, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedIn := time.Now().Add(-time.Hour)
+	revokeTimes := &fakeRevokeTimes{times: map[string]int64{
+		"revoked":    signedIn.Add(time.Minute).Unix(),
+		"signed-in":  signedIn.Add(-time.Minute).Unix(),
+		"never-seen": 0,
+	}}
+	v := NewFirebaseVerifier(testProjectID, keyfunc, revokeTimes, FirebaseVerifierOptions{})
+	ctx := context.Background()
+
+	idToken, err := v.VerifyIDTokenAndCheckRevoked(ctx, signFirebaseToken(t, key, "signed-in", signedIn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idToken.UID != "signed-in" || idToken.Claims["admin"] != true {
+		t.Errorf("got uid %s and claims %v", idToken.UID, idToken.Claims)
+	}
+	if _, err := v.VerifyIDTokenAndCheckRevoked(ctx, signFirebaseToken(t, key, "signed-in", signedIn)); err != nil {
+		t.Fatal(err)
+	}
+	if revokeTimes.reads != 1 {
+		t.Errorf("the revoke time is read %d times, want 1 with the cache", revokeTimes.reads)
+	}
+
+	_, err = v.VerifyIDTokenAndCheckRevoked(ctx, signFirebaseToken(t, key, "revoked", signedIn))
+	if !errors.Is(err, ErrRevoked) || firebaseStateOf(err) != StateRevoked {
+		t.Errorf("got error %v, want ErrRevoked", err)
+	}
+
+	_, err = v.VerifyIDTokenAndCheckRevoked(ctx, signFirebaseToken(t, newTestKey(t), "signed-in", signedIn))
+	if state := firebaseStateOf(err); state != StateInvalidSignature {
+		t.Errorf("got state %s for a token signed by another key, want %s", state, StateInvalidSignature)
+	}
+}
+
+func TestFirebaseVerifierFallback(t *testing.T) {
+	key := newTestKey(t)
+	keyfunc, err := NewPEMKeyfunc(pemOf(t, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokeTimes := &fakeRevokeTimes{err: errors.New("database is unavailable")}
+	idToken := signFirebaseToken(t, key, "uid", time.Now().Add(-time.Hour))
+	ctx := context.Background()
+
+	v := NewFirebaseVerifier(testProjectID, keyfunc, revokeTimes, FirebaseVerifierOptions{})
+	if _, err := v.VerifyIDTokenAndCheckRevoked(ctx, idToken); firebaseStateOf(err) != StateUnverifiable {
+		t.Errorf("got error %v, want an unverifiable token", err)
+	}
+
+	fallback := &fakeIDTokenVerifier{}
+	v = NewFirebaseVerifier(testProjectID, keyfunc, revokeTimes, FirebaseVerifierOptions{Fallback: fallback})
+	if _, err := v.VerifyIDTokenAndCheckRevoked(ctx, idToken); err != nil || fallback.calls != 1 {
+		t.Errorf("got error %v and %d remote verifications, want the remote verification", err, fallback.calls)
+	}
+}
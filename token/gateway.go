@@ -4,29 +4,80 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"strings"
 	"sync"
+	"time"
 
-	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"github.com/dgrijalva/jwt-go/v4"
+	"github.com/machinebox/graphql"
+	"github.com/mirror-media/mm-apigateway/messaging"
+	"github.com/mirror-media/mm-apigateway/secret"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/xerrors"
-	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"golang.org/x/oauth2"
 )
 
+const (
+	defaultRefreshBefore = 5 * time.Minute
+	// minRefreshRetry bounds how often a failed refresh is retried
+	minRefreshRetry = 10 * time.Second
+	maxRefreshRetry = 5 * time.Minute
+)
+
+// MsgAttrKeySecretVersion is the attribute of a rotation message holding the new version of the secret
+const MsgAttrKeySecretVersion = "version"
+
+// ServiceToken is the token of the gateway itself. It keeps itself valid and provides the oauth2 token for the clients of the services
+type ServiceToken interface {
+	Token
+	oauth2.TokenSource
+}
+
+// Refresher exchanges the refresh token for a new token and refresh token
+type Refresher func(ctx context.Context, refreshToken string) (token string, newRefreshToken string, err error)
+
+// gatewaySecret is the payload of a version of the secret
+type gatewaySecret struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// GatewayOptions describes how the gateway token is refreshed
+type GatewayOptions struct {
+	// Refresher exchanges the refresh token when the latest secret version is about to expire as well. The token is only re-read from the secret if it's nil
+	Refresher Refresher
+	// RefreshBefore is how long before the expiry the token is refreshed, default 5m
+	RefreshBefore time.Duration
+	// RotationTopic is where a new secret version added by the refresher is announced, disabled if empty
+	RotationTopic string
+	// Broker announces the rotations and receives them in SubscribeRotation
+	Broker messaging.Broker
+	// Verifier verifies the signature and the claims of the token. Only the time claims of the token are validated if it's nil
+	Verifier *Verifier
+}
+
 type Gateway struct {
 	sync.RWMutex
-	state                  *string
-	secretName             *string
-	secretVersion          *string
-	tokenString            string
-	parser                 jwt.Parser
-	renewTokenTopic        string
-	updateTokenTopic       string
-	renewVersionPubChannel chan string
-	updateTokenSubChannel  chan string
-	// client                 *pubsub.Client
+	state         State
+	detail        string
+	secretName    string
+	secretVersion *string
+	tokenString   string
+	refreshToken  string
+	expiry        time.Time
+	parser        jwt.Parser
+
+	provider secret.Provider
+	opts     GatewayOptions
+	// refreshMu serializes the refreshes
+	refreshMu sync.Mutex
+	// unsaved is the refreshed token in use which couldn't be added as a secret version yet, and unsavedFrom is the version it's refreshed from. They're guarded by refreshMu
+	unsaved     *gatewaySecret
+	unsavedFrom string
+	// wake asks Run to refresh the token now
+	wake chan struct{}
+	// retryMin and retryMax bound the backoff of the failed refreshes
+	retryMin, retryMax time.Duration
+	after              func(time.Duration) <-chan time.Time
 }
 
 func (g *Gateway) GetTokenString() (string, error) {
@@ -35,146 +86,398 @@ func (g *Gateway) GetTokenString() (string, error) {
 	return g.tokenString, nil
 }
 
-var uErr *jwt.UnverfiableTokenError
-var expErr *jwt.TokenExpiredError
-var nbfErr *jwt.TokenNotValidYetError
+// Token returns the current token as an oauth2 token. A token which is about to expire is still returned, and Run is woken up to refresh it in the background
+func (g *Gateway) Token() (*oauth2.Token, error) {
+	g.RLock()
+	defer g.RUnlock()
+	if g.needsRefresh(g.expiry) {
+		select {
+		case g.wake <- struct{}{}:
+		default:
+		}
+	}
+	if !g.expiry.IsZero() && !time.Now().Before(g.expiry) {
+		return nil, fmt.Errorf("gateway token of secret version %s expired at %s", *g.secretVersion, g.expiry)
+	}
+	return &oauth2.Token{
+		AccessToken: g.tokenString,
+		TokenType:   TypeJWT,
+		Expiry:      g.expiry,
+	}, nil
+}
+
+// needsRefresh reports whether a token expiring at the expiry is within the refresh window. A token without expiry never needs a refresh
+func (g *Gateway) needsRefresh(expiry time.Time) bool {
+	return !expiry.IsZero() && !time.Now().Add(g.opts.RefreshBefore).Before(expiry)
+}
+
+// unverifiedValidation validates the time claims of a token whose signature is not verified
+var unverifiedValidation = jwt.NewValidationHelper(jwt.WithoutAudienceValidation())
 
-// ExecuteTokenStateUpdate check the JWT token, but it does not verify the token signature
+// check verifies the token with the verifier if there is one. It returns the state and the error explaining it
+func (g *Gateway) check(tokenString string) (State, error) {
+	claims := &jwt.StandardClaims{}
+	var err error
+	if g.opts.Verifier != nil {
+		err = g.opts.Verifier.Verify(tokenString, claims)
+	} else if _, _, err = g.parser.ParseUnverified(tokenString, claims); err == nil {
+		err = claims.Valid(unverifiedValidation)
+	}
+	return StateOf(err), err
+}
+
+// ExecuteTokenStateUpdate verifies the current token again
 func (g *Gateway) ExecuteTokenStateUpdate() error {
+	g.RLock()
+	tokenString := g.tokenString
+	g.RUnlock()
+	state, err := g.check(tokenString)
 	g.Lock()
-	defer g.Unlock()
-	token, _, err := g.parser.ParseUnverified(g.tokenString, nil)
-	var s string
-	if token.Valid {
-		s = OK
-	} else if xerrors.As(err, &uErr) {
-		s = "that's not even a token"
-	} else if xerrors.As(err, &expErr) {
-		s = ("token has expired")
-	} else if xerrors.As(err, &nbfErr) {
-		s = "token is not valid yet"
-	} else {
-		s = fmt.Sprintf("couldn't handle this token:%s", err.Error())
-	}
-	g.state = &s
-	return nil
-
+	if g.tokenString == tokenString {
+		g.state = state
+		g.detail = detailOf(err)
+	}
+	g.Unlock()
+	return err
 }
 
-func (g *Gateway) GetTokenState() string {
-	if g.state == nil {
+// GetTokenState returns the state of the current token. An OK token becomes expired when its expiry has passed
+func (g *Gateway) GetTokenState() State {
+	g.RLock()
+	state := g.state
+	g.RUnlock()
+	if state == "" {
 		g.ExecuteTokenStateUpdate()
 	}
 	g.RLock()
-	if g.state == nil {
-		return ""
-	}
 	defer g.RUnlock()
-	return *g.state
-}
-
-// TODO
-// func (g *Gateway) pubsub() error {
-
-// 	ctx := context.Background()
-
-// 	updateTopic := g.client.Topic(g.updateTokenTopicID)
-
-// 	sub, _ := g.client.CreateSubscription(ctx, "subName", pubsub.SubscriptionConfig{
-// 		Topic:            updateTopic,
-// 		AckDeadline:      10 * time.Second,
-// 		ExpirationPolicy: 25 * time.Hour,
-// 	})
-
-// 	sub.Receive(ctx, func(c context.Context, msg *pubsub.Message) {
-// 		// TODO update the token
-// 	})
-
-// 	for {
-// 		select {
-// 		case version := <-g.renewVersionPubChannel:
-// 			topic := g.client.Topic(g.renewTokenTopicID)
-// 			message := map[string]string{
-// 				"version":     version,
-// 				"secret_name": *g.secretName,
-// 			}
-
-// 			messageJSON, err := json.Marshal(message)
-// 			if err != nil {
-// 				return err
-// 			}
-
-// 			result := topic.Publish(ctx, &pubsub.Message{
-// 				Data: messageJSON,
-// 			})
-// 			_, err = result.Get(ctx)
-// 			if err != nil {
-// 				return errors.New(fmt.Sprintf("Get: %v", err))
-// 			}
-// 		}
-// 	}
-// }
-
-// func (g *Gateway) UpdateToken() error {
-
-// 	// FIXME
-// 	g.Lock()
-// 	defer g.Unlock()
-// 	g.renewVersionPubChannel <- *g.secretVersion
-// 	return nil
-// }
-
-func NewGatewayToken(tokenSecretName string, projectID string) (*Gateway, error) {
-
-	// Create the client.
-	ctx := context.Background()
-	c, err := secretmanager.NewClient(ctx)
-	if err != nil {
-		err = errors.Wrap(err, "failed to setup client")
-		return nil, err
+	return g.currentState()
+}
+
+// GetTokenDetail returns the error of the verification of the current token
+func (g *Gateway) GetTokenDetail() string {
+	g.RLock()
+	defer g.RUnlock()
+	if g.currentState() == StateExpired && g.state == OK {
+		return fmt.Sprintf("token expired at %s", g.expiry)
 	}
+	return g.detail
+}
 
-	latestSecretVersion := fmt.Sprintf("projects/%s/secrets/%s/versions/latest", projectID, tokenSecretName)
+// currentState returns the state taking the expiry into account. The lock has to be held
+func (g *Gateway) currentState() State {
+	if g.state == OK && !g.expiry.IsZero() && !time.Now().Before(g.expiry) {
+		return StateExpired
+	}
+	return g.state
+}
 
-	req := &secretmanagerpb.GetSecretVersionRequest{
-		Name: latestSecretVersion,
+// setToken replaces the token with the one of the secret version and its state. The lock has to be held
+func (g *Gateway) setToken(version string, payload gatewaySecret, state State, detail string) {
+	g.secretVersion = &version
+	g.tokenString = payload.Token
+	g.refreshToken = payload.RefreshToken
+	g.expiry = time.Time{}
+	claims := &jwt.StandardClaims{}
+	if _, _, err := g.parser.ParseUnverified(payload.Token, claims); err == nil && claims.ExpiresAt != nil {
+		g.expiry = claims.ExpiresAt.Time
 	}
+	g.state = state
+	g.detail = detail
+}
 
-	v, err := c.GetSecretVersion(ctx, req)
+// readLatestSecret reads the latest version of the secret
+func (g *Gateway) readLatestSecret(ctx context.Context) (version string, payload gatewaySecret, err error) {
+	latest, err := g.provider.Latest(ctx, g.secretName)
 	if err != nil {
-		err = errors.Wrapf(err, "failed to get latest secret version of %s: %v", tokenSecretName)
-		return nil, err
+		err = errors.WithMessagef(err, "failed to get latest version of secret data of %s", g.secretName)
+		return "", payload, err
 	}
 
-	getSecretReq := &secretmanagerpb.AccessSecretVersionRequest{
-		Name: latestSecretVersion,
+	err = json.Unmarshal(latest.Data, &payload)
+	if err != nil {
+		err = errors.Wrapf(err, "cannot unmarshal secret data of %s", g.secretName)
+		return "", payload, err
 	}
+	return latest.Version, payload, nil
+}
 
-	secret, err := c.AccessSecretVersion(ctx, getSecretReq)
+// Reload re-reads the latest version of the secret and uses it if it's another version. A version which fails the verification doesn't replace a usable token
+func (g *Gateway) Reload(ctx context.Context) error {
+	version, payload, err := g.readLatestSecret(ctx)
 	if err != nil {
-		err = errors.Wrapf(err, "failed to get latest version of secret data of %s: %v", tokenSecretName)
-		return nil, err
+		return err
+	}
+	g.RLock()
+	same := g.secretVersion != nil && *g.secretVersion == version
+	g.RUnlock()
+	if same {
+		return nil
 	}
 
-	var tokenSecret struct {
-		Token        string `json:"token"`
-		RefreshToken string `json:"refreshToken"`
+	state, err := g.check(payload.Token)
+	g.Lock()
+	defer g.Unlock()
+	if state != OK && g.currentState() == OK {
+		return errors.WithMessagef(err, "gateway token version %s is %s and not used", version, state)
+	}
+	g.setToken(version, payload, state, detailOf(err))
+	if state != OK {
+		log.Errorf("Using gateway token version:%s, which is %s: %v", version, state, err)
+		return nil
 	}
+	log.Infof("Using gateway token version:%s", version)
+	return nil
+}
+
+// Refresh renews the token if it's about to expire. The latest secret version is re-read first in case another replica has refreshed it. Otherwise the refresh token is exchanged, and the new token is added as a new secret version and announced on the rotation topic. A refreshed token which can't be added is used meanwhile, and its addition is retried by the next Refresh
+func (g *Gateway) Refresh(ctx context.Context) error {
+	g.refreshMu.Lock()
+	defer g.refreshMu.Unlock()
 
-	err = json.Unmarshal(secret.GetPayload().GetData(), &tokenSecret)
+	if err := g.Reload(ctx); err != nil {
+		return err
+	}
+	if g.unsaved != nil {
+		g.RLock()
+		superseded := *g.secretVersion != g.unsavedFrom
+		g.RUnlock()
+		// a version added by another replica supersedes the unsaved token
+		if !superseded {
+			return g.save(ctx, *g.unsaved)
+		}
+		g.unsaved = nil
+	}
+
+	g.RLock()
+	expiry, refreshToken := g.expiry, g.refreshToken
+	g.RUnlock()
+	if !g.needsRefresh(expiry) || g.opts.Refresher == nil {
+		return nil
+	}
+	if refreshToken == "" {
+		return fmt.Errorf("secret %s has no refresh token", g.secretName)
+	}
+
+	token, newRefreshToken, err := g.opts.Refresher(ctx, refreshToken)
 	if err != nil {
-		err = errors.Wrapf(err, "cannot unmarshal secret data of %s: %v", tokenSecretName)
-		return nil, err
+		return errors.WithMessage(err, "fail to exchange the refresh token")
+	}
+	if newRefreshToken == "" {
+		newRefreshToken = refreshToken
+	}
+	state, err := g.check(token)
+	if state != OK {
+		return errors.WithMessagef(err, "the refreshed token is %s", state)
+	}
+	refreshed := gatewaySecret{
+		Token:        token,
+		RefreshToken: newRefreshToken,
+	}
+	// the new token is used by this replica even if it can't be saved, and it stays with the version it was refreshed from, so that it isn't replaced by Reload
+	g.Lock()
+	from := *g.secretVersion
+	g.setToken(from, refreshed, state, "")
+	g.Unlock()
+	g.unsavedFrom = from
+	return g.save(ctx, refreshed)
+}
+
+// save adds the refreshed token in use as a new secret version and announces it. The token is kept unsaved if it can't be added. refreshMu has to be held
+func (g *Gateway) save(ctx context.Context, refreshed gatewaySecret) error {
+	version, err := g.addSecretVersion(ctx, refreshed)
+	if err != nil {
+		g.unsaved = &refreshed
+		return errors.WithMessage(err, "the refreshed gateway token is used but not saved")
 	}
+	g.unsaved = nil
+	g.Lock()
+	g.secretVersion = &version
+	g.Unlock()
+	log.Infof("Refreshed gateway token, using version:%s", version)
 
-	versionFragments := strings.Split(v.Name, "/")
-	version := versionFragments[len(versionFragments)-1]
-	log.Infof("Using gateway token version:%s", version)
+	if g.opts.RotationTopic != "" && g.opts.Broker != nil {
+		if err := g.announce(ctx, version); err != nil {
+			log.Errorf("announcing the gateway token version %s encountered error: %v", version, err)
+		}
+	}
+	return nil
+}
 
-	g := Gateway{
-		secretVersion: &version,
-		tokenString:   tokenSecret.Token,
+func (g *Gateway) addSecretVersion(ctx context.Context, payload gatewaySecret) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	v, err := g.provider.Add(ctx, g.secretName, data)
+	if err != nil {
+		return "", errors.WithMessagef(err, "failed to add a version to secret %s", g.secretName)
+	}
+	return v.Version, nil
+}
+
+// announce publishes the new version of the secret to the rotation topic
+func (g *Gateway) announce(ctx context.Context, version string) error {
+	_, err := g.opts.Broker.Publish(ctx, g.opts.RotationTopic, &messaging.Message{
+		Attributes: map[string]string{
+			MsgAttrKeySecretVersion: version,
+		},
+	})
+	return err
+}
+
+// Run refreshes the token before it expires, or when Token finds it about to expire, until the context is done. A failed refresh is retried with backoff
+func (g *Gateway) Run(ctx context.Context) {
+	retry := g.retryMin
+	for {
+		g.RLock()
+		expiry := g.expiry
+		g.RUnlock()
+
+		wait := time.Hour
+		if !expiry.IsZero() {
+			wait = time.Until(expiry.Add(-g.opts.RefreshBefore))
+		}
+		if wait < 0 {
+			wait = 0
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-g.wake:
+			timer.Stop()
+		}
+		// the wait may end together with the context
+		if ctx.Err() != nil {
+			return
+		}
+
+		refreshCTX, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err := g.Refresh(refreshCTX)
+		cancel()
+		if err == nil {
+			g.RLock()
+			expiry = g.expiry
+			g.RUnlock()
+			if !g.needsRefresh(expiry) {
+				retry = g.retryMin
+				continue
+			}
+			err = errors.New("the latest token is about to expire and no refresher is set")
+		}
+
+		log.Errorf("refreshing gateway token encountered error, retrying in %s: %v", retry, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-g.after(retry):
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if retry *= 2; retry > g.retryMax {
+			retry = g.retryMax
+		}
+	}
+}
+
+// SubscribeRotation reloads the secret whenever a rotation message is received from the subscription until the context is done
+func (g *Gateway) SubscribeRotation(ctx context.Context, subscription string) error {
+	if g.opts.Broker == nil {
+		return errors.New("there is no broker to receive the rotations")
+	}
+	log.Infof("Pulling subscription: %s", subscription)
+	return g.opts.Broker.Receive(ctx, subscription, 1, func(ctx context.Context, msg *messaging.Message) bool {
+		log.Infof("Got gateway token rotation to version: %s", msg.Attributes[MsgAttrKeySecretVersion])
+		if err := g.Reload(ctx); err != nil {
+			log.Errorf("reloading gateway token encountered error: %v", err)
+			return false
+		}
+		return true
+	})
+}
+
+// NewGraphQLRefresher exchanges the refresh token with the tokenRefresh mutation of the user service
+func NewGraphQLRefresher(endpoint string) Refresher {
+	client := graphql.NewClient(endpoint)
+	return func(ctx context.Context, refreshToken string) (string, string, error) {
+		req := graphql.NewRequest(`mutation($refreshToken: String!) {
+	tokenRefresh(refreshToken: $refreshToken) {
+		token
+		errors {
+			field
+			message
+		}
+	}
+}`)
+		req.Var("refreshToken", refreshToken)
+
+		var resp struct {
+			TokenRefresh struct {
+				Token  string `json:"token"`
+				Errors []struct {
+					Field   string `json:"field"`
+					Message string `json:"message"`
+				} `json:"errors"`
+			} `json:"tokenRefresh"`
+		}
+		if err := client.Run(ctx, req, &resp); err != nil {
+			return "", "", err
+		}
+		if len(resp.TokenRefresh.Errors) > 0 {
+			return "", "", fmt.Errorf("tokenRefresh failed: %s", resp.TokenRefresh.Errors[0].Message)
+		}
+		if resp.TokenRefresh.Token == "" {
+			return "", "", errors.New("tokenRefresh returned no token")
+		}
+		return resp.TokenRefresh.Token, "", nil
+	}
+}
+
+// WatchSecret reloads the token whenever the secret is changed outside of the gateway until the context is done. It returns immediately if the provider can't watch
+func (g *Gateway) WatchSecret(ctx context.Context) error {
+	watcher, ok := g.provider.(secret.Watcher)
+	if !ok {
+		return nil
+	}
+	return watcher.Watch(ctx, g.secretName, func() {
+		reloadCTX, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		if err := g.Reload(reloadCTX); err != nil {
+			log.Errorf("reloading gateway token encountered error: %v", err)
+		}
+	})
+}
+
+// NewGatewayToken reads the token from the latest version of the secret of the provider. It fails if the token can't be verified, unless an expired token can be refreshed. The token is kept valid only if Run is running
+func NewGatewayToken(ctx context.Context, provider secret.Provider, tokenSecretName string, opts GatewayOptions) (*Gateway, error) {
+	if opts.RefreshBefore <= 0 {
+		opts.RefreshBefore = defaultRefreshBefore
+	}
+	g := &Gateway{
+		secretName: tokenSecretName,
+		provider:   provider,
+		opts:       opts,
+		wake:       make(chan struct{}, 1),
+		retryMin:   minRefreshRetry,
+		retryMax:   maxRefreshRetry,
+		after:      time.After,
+	}
+	if err := g.Reload(ctx); err != nil {
+		return nil, err
+	}
+	if g.GetTokenState() == StateExpired && opts.Refresher != nil {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		if err := g.Refresh(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if state := g.GetTokenState(); state != OK {
+		return nil, fmt.Errorf("gateway token of secret %s is not usable: %s(%s)", tokenSecretName, state, g.GetTokenDetail())
 	}
-	// g.pubsub()
-	return &g, nil
+	return g, nil
 }
@@ -0,0 +1,359 @@
+package token
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go/v4"
+	"github.com/mirror-media/mm-apigateway/secret"
+	"golang.org/x/oauth2"
+)
+
+const testSecretName = "gateway-token"
+
+func newTestKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func pemOf(t *testing.T, key *rsa.PrivateKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func signTestToken(t *testing.T, key *rsa.PrivateKey, claims jwt.StandardClaims) string {
+	s, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func secretOf(t *testing.T, tokenString string) string {
+	data, err := json.Marshal(gatewaySecret{Token: tokenString})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestNewGatewayTokenVerification(t *testing.T) {
+	key, otherKey := newTestKey(t), newTestKey(t)
+	keyfunc, err := NewPEMKeyfunc(pemOf(t, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := NewVerifier(keyfunc, VerifyOptions{
+		Issuer:   "user-service",
+		Audience: "mm-apigateway",
+	})
+	valid := jwt.StandardClaims{
+		Issuer:    "user-service",
+		Audience:  jwt.ClaimStrings{"mm-apigateway"},
+		ExpiresAt: jwt.At(time.Now().Add(time.Hour)),
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		verifier *Verifier
+		wantErr  bool
+	}{
+		{
+			name:     "valid token",
+			token:    signTestToken(t, key, valid),
+			verifier: verifier,
+		},
+		{
+			name:     "signed by another key",
+			token:    signTestToken(t, otherKey, valid),
+			verifier: verifier,
+			wantErr:  true,
+		},
+		{
+			name: "wrong audience",
+			token: signTestToken(t, key, jwt.StandardClaims{
+				Issuer:   "user-service",
+				Audience: jwt.ClaimStrings{"another"},
+			}),
+			verifier: verifier,
+			wantErr:  true,
+		},
+		{
+			name:     "missing audience",
+			token:    signTestToken(t, key, jwt.StandardClaims{Issuer: "user-service"}),
+			verifier: verifier,
+			wantErr:  true,
+		},
+		{
+			name: "expired without refresher",
+			token: signTestToken(t, key, jwt.StandardClaims{
+				ExpiresAt: jwt.At(time.Now().Add(-time.Hour)),
+			}),
+			wantErr: true,
+		},
+		{
+			name:    "not a token",
+			token:   "not-a-token",
+			wantErr: true,
+		},
+		{
+			name:  "unverified token",
+			token: signTestToken(t, otherKey, valid),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			provider := secret.NewMemory(map[string]string{testSecretName: secretOf(t, tc.token)})
+			g, err := NewGatewayToken(context.Background(), provider, testSecretName, GatewayOptions{Verifier: tc.verifier})
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got state %s, want an error", g.GetTokenState())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state := g.GetTokenState(); state != OK {
+				t.Errorf("got state %s, want OK", state)
+			}
+		})
+	}
+}
+
+func TestReloadKeepsUsableToken(t *testing.T) {
+	key := newTestKey(t)
+	keyfunc, err := NewPEMKeyfunc(pemOf(t, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := signTestToken(t, key, jwt.StandardClaims{ExpiresAt: jwt.At(time.Now().Add(time.Hour))})
+	provider := secret.NewMemory(map[string]string{testSecretName: secretOf(t, good)})
+	g, err := NewGatewayToken(context.Background(), provider, testSecretName, GatewayOptions{Verifier: NewVerifier(keyfunc, VerifyOptions{})})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if _, err := provider.Add(ctx, testSecretName, []byte(secretOf(t, signTestToken(t, newTestKey(t), jwt.StandardClaims{})))); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Reload(ctx); err == nil {
+		t.Error("reloading a token signed by another key got no error")
+	}
+	if s, _ := g.GetTokenString(); s != good {
+		t.Error("the usable token is replaced")
+	}
+	if state := g.GetTokenState(); state != OK {
+		t.Errorf("got state %s, want OK", state)
+	}
+}
+
+func TestStateOf(t *testing.T) {
+	tests := []struct {
+		err  error
+		want State
+	}{
+		{nil, OK},
+		{&jwt.TokenExpiredError{}, StateExpired},
+		{&jwt.InvalidIssuerError{}, StateInvalidClaims},
+		{&jwt.UnverfiableTokenError{}, StateUnverifiable},
+		{&jwt.InvalidClaimsError{}, StateInvalid},
+	}
+	for _, tc := range tests {
+		if got := StateOf(tc.err); got != tc.want {
+			t.Errorf("StateOf(%v) = %s, want %s", tc.err, got, tc.want)
+		}
+	}
+}
+
+// unsignedToken returns a token whose signature isn't verified by a gateway without a verifier
+func unsignedToken(t *testing.T, expiry time.Time) string {
+	return signTestToken(t, newTestKey(t), jwt.StandardClaims{ExpiresAt: jwt.At(expiry)})
+}
+
+func TestTokenIsRefreshedInTheBackground(t *testing.T) {
+	current := unsignedToken(t, time.Now().Add(time.Hour))
+	refreshed := unsignedToken(t, time.Now().Add(2*time.Hour))
+	data, _ := json.Marshal(gatewaySecret{Token: current, RefreshToken: "refresh"})
+	provider := secret.NewMemory(map[string]string{testSecretName: string(data)})
+	release := make(chan struct{})
+	g, err := NewGatewayToken(context.Background(), provider, testSecretName, GatewayOptions{
+		Refresher: func(ctx context.Context, refreshToken string) (string, string, error) {
+			<-release
+			return refreshed, "", nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go g.Run(ctx)
+
+	// the token enters the refresh window
+	g.Lock()
+	g.expiry = time.Now().Add(time.Minute)
+	g.Unlock()
+	done := make(chan *oauth2.Token)
+	go func() {
+		tok, err := g.Token()
+		if err != nil {
+			t.Error(err)
+		}
+		done <- tok
+	}()
+	select {
+	case tok := <-done:
+		if tok.AccessToken != current {
+			t.Fatal("the current token is not served during the refresh")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Token waits for the refresh")
+	}
+
+	close(release)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		tok, err := g.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok.AccessToken == refreshed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("token is not refreshed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	latest, err := provider.Latest(context.Background(), testSecretName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved gatewaySecret
+	if err := json.Unmarshal(latest.Data, &saved); err != nil || saved.Token != refreshed || saved.RefreshToken != "refresh" {
+		t.Fatalf("refreshed token is not saved: %+v %v", saved, err)
+	}
+}
+
+func TestFailedRefreshesBackOff(t *testing.T) {
+	data, _ := json.Marshal(gatewaySecret{Token: unsignedToken(t, time.Now().Add(time.Minute)), RefreshToken: "refresh"})
+	provider := secret.NewMemory(map[string]string{testSecretName: string(data)})
+	var refreshes int32
+	g, err := NewGatewayToken(context.Background(), provider, testSecretName, GatewayOptions{
+		Refresher: func(ctx context.Context, refreshToken string) (string, string, error) {
+			atomic.AddInt32(&refreshes, 1)
+			return "", "", errors.New("user service is unavailable")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var retries []time.Duration
+	g.after = func(d time.Duration) <-chan time.Time {
+		c := make(chan time.Time, 1)
+		if retries = append(retries, d); len(retries) == 7 {
+			// the retry doesn't race with the cancellation
+			cancel()
+			return c
+		}
+		c <- time.Now()
+		return c
+	}
+	g.Run(ctx)
+
+	want := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second, 160 * time.Second, 5 * time.Minute, 5 * time.Minute}
+	if len(retries) != len(want) {
+		t.Fatalf("retries are %v, want %v", retries, want)
+	}
+	for i := range want {
+		if retries[i] != want[i] {
+			t.Fatalf("retries are %v, want %v", retries, want)
+		}
+	}
+	if n := atomic.LoadInt32(&refreshes); n != 7 {
+		t.Fatalf("refresher is called %d times", n)
+	}
+}
+
+// failingAdds is a provider whose Add fails the first times
+type failingAdds struct {
+	secret.Provider
+	failures int
+}
+
+func (p *failingAdds) Add(ctx context.Context, name string, data []byte) (secret.Secret, error) {
+	if p.failures > 0 {
+		p.failures--
+		return secret.Secret{}, errors.New("secret manager is unavailable")
+	}
+	return p.Provider.Add(ctx, name, data)
+}
+
+func TestUnsavedRefreshIsRetried(t *testing.T) {
+	data, _ := json.Marshal(gatewaySecret{Token: unsignedToken(t, time.Now().Add(time.Minute)), RefreshToken: "refresh"})
+	provider := &failingAdds{Provider: secret.NewMemory(map[string]string{testSecretName: string(data)}), failures: 2}
+	ctx := context.Background()
+	original, err := provider.Latest(ctx, testSecretName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshed := unsignedToken(t, time.Now().Add(2*time.Hour))
+	var refreshes int32
+	g, err := NewGatewayToken(ctx, provider, testSecretName, GatewayOptions{
+		Refresher: func(ctx context.Context, refreshToken string) (string, string, error) {
+			atomic.AddInt32(&refreshes, 1)
+			return refreshed, "new-refresh", nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := g.Refresh(ctx); err == nil {
+			t.Fatal("unsaved refresh got no error")
+		}
+		if s, _ := g.GetTokenString(); s != refreshed {
+			t.Fatal("the refreshed token is not used")
+		}
+		if *g.secretVersion != original.Version {
+			t.Fatalf("unsaved token is used as version %s", *g.secretVersion)
+		}
+	}
+	if err := g.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&refreshes); n != 1 {
+		t.Fatalf("refresher is called %d times", n)
+	}
+	latest, err := provider.Latest(ctx, testSecretName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved gatewaySecret
+	if err := json.Unmarshal(latest.Data, &saved); err != nil || saved.Token != refreshed || saved.RefreshToken != "new-refresh" {
+		t.Fatalf("refreshed token is not saved: %+v %v", saved, err)
+	}
+	if *g.secretVersion != latest.Version {
+		t.Fatalf("saved token is used as version %s, want %s", *g.secretVersion, latest.Version)
+	}
+}
@@ -1,14 +1,51 @@
 // Package token define the domain of token
 package token
 
+// State is the stable machine readable code of the result of the verification of a token. The clients can rely on the codes, unlike the details
+type State string
+
 const (
-	OK = "OK"
+	OK                    State = "OK"
+	StateNotProvided      State = "NOT_PROVIDED"
+	StateNotBearer        State = "NOT_BEARER"
+	StateMalformed        State = "MALFORMED"
+	StateExpired          State = "EXPIRED"
+	StateNotValidYet      State = "NOT_VALID_YET"
+	StateInvalidSignature State = "INVALID_SIGNATURE"
+	StateInvalidClaims    State = "INVALID_CLAIMS"
+	StateRevoked          State = "REVOKED"
+	StateUnverifiable     State = "UNVERIFIABLE"
+	StateInvalid          State = "INVALID"
 )
 
 const TypeJWT = "JWT"
 
+// Status is the state of a token and the detail explaining it, e.g. the error of the verification. The detail is for the logs and debugging only
+type Status struct {
+	State  State
+	Detail string
+}
+
+// StatusOf returns the state and the detail of the token
+func StatusOf(t Token) Status {
+	return Status{
+		State:  t.GetTokenState(),
+		Detail: t.GetTokenDetail(),
+	}
+}
+
+// detailOf returns the message of the error, empty if it's nil
+func detailOf(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
 type Token interface {
 	ExecuteTokenStateUpdate() error
 	GetTokenString() (string, error)
-	GetTokenState() string
+	GetTokenState() State
+	// GetTokenDetail explains the state, it's empty if there is nothing to explain
+	GetTokenDetail() string
 }
@@ -0,0 +1,328 @@
+package token
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go/v4"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultJWKSTTL = time.Hour
+	// minJWKSRefresh bounds how often the keys are fetched for an unknown kid
+	minJWKSRefresh = time.Minute
+)
+
+// asymmetricMethods are the signing methods accepted by a Verifier. HMAC and none are never accepted with a public key
+var asymmetricMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// NewPEMKeyfunc returns the key function providing the RSA or EC public key in the PEM
+func NewPEMKeyfunc(pem []byte) (jwt.Keyfunc, error) {
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(pem); err == nil {
+		return func(*jwt.Token) (interface{}, error) {
+			return key, nil
+		}, nil
+	}
+	key, err := jwt.ParseECPublicKeyFromPEM(pem)
+	if err != nil {
+		return nil, errors.New("the PEM is neither a RSA nor an EC public key")
+	}
+	return func(*jwt.Token) (interface{}, error) {
+		return key, nil
+	}, nil
+}
+
+// jwk is a public key of a JWKS
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid n")
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid e")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve(%s)", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid x")
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid y")
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type(%s)", k.Kty)
+}
+
+// JWKS provides the keys of a JSON Web Key Set by their kid. The keys are cached for the max-age of the response, default 1h, and fetched again for an unknown kid
+type JWKS struct {
+	url    string
+	client *http.Client
+
+	mu        sync.RWMutex
+	keys      map[string]interface{}
+	expiry    time.Time
+	fetchedAt time.Time
+}
+
+// NewJWKS creates the key set fetched from the url
+func NewJWKS(url string) *JWKS {
+	return &JWKS{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Keyfunc returns the key of the kid of the token
+func (s *JWKS) Keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	s.mu.RLock()
+	key, ok := s.keys[kid]
+	stale := time.Now().After(s.expiry)
+	throttled := time.Since(s.fetchedAt) < minJWKSRefresh
+	s.mu.RUnlock()
+	if ok && !stale {
+		return key, nil
+	}
+	if !ok && !stale && throttled {
+		return nil, fmt.Errorf("no key of kid(%s) in the JWKS", kid)
+	}
+
+	if err := s.Fetch(context.Background()); err != nil {
+		if ok {
+			// the stale key is better than failing every token while the JWKS is unavailable
+			return key, nil
+		}
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if key, ok = s.keys[kid]; !ok {
+		return nil, fmt.Errorf("no key of kid(%s) in the JWKS", kid)
+	}
+	return key, nil
+}
+
+// Fetch replaces the cached keys with the ones of the url
+func (s *JWKS) Fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return errors.Wrap(err, "fail to create the JWKS request")
+	}
+	s.mu.Lock()
+	s.fetchedAt = time.Now()
+	s.mu.Unlock()
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "fail to fetch the JWKS of %s", s.url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching the JWKS of %s got status %d", s.url, resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "fail to read the JWKS of %s", s.url)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err = json.Unmarshal(body, &set); err != nil {
+		return errors.Wrapf(err, "the JWKS of %s is malformed", s.url)
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			// keys for other uses don't invalidate the set
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("the JWKS of %s has no usable key", s.url)
+	}
+
+	ttl := defaultJWKSTTL
+	if maxAge := maxAge(resp.Header); maxAge > 0 {
+		ttl = maxAge
+	}
+	s.mu.Lock()
+	s.keys = keys
+	s.expiry = time.Now().Add(ttl)
+	s.mu.Unlock()
+	return nil
+}
+
+// maxAge returns the max-age of the Cache-Control header, or 0 if it has none
+func maxAge(h http.Header) time.Duration {
+	for _, value := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			i := strings.IndexByte(directive, '=')
+			if i < 0 || !strings.EqualFold(strings.TrimSpace(directive[:i]), "max-age") {
+				continue
+			}
+			if seconds, err := strconv.Atoi(strings.Trim(strings.TrimSpace(directive[i+1:]), `"`)); err == nil {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return 0
+}
+
+// VerifyOptions describes the claims a Verifier checks besides the time claims
+type VerifyOptions struct {
+	// Issuer is the expected iss, not checked if empty
+	Issuer string
+	// Audience has to be in the aud, not checked if empty
+	Audience string
+	// Leeway is the tolerated clock skew of the time claims
+	Leeway time.Duration
+	// Methods are the accepted signing methods, default every RSA and ECDSA method
+	Methods []string
+}
+
+// Verifier verifies the signature and the claims of tokens
+type Verifier struct {
+	keyfunc jwt.Keyfunc
+	parser  *jwt.Parser
+	opts    VerifyOptions
+}
+
+// NewVerifier creates a verifier getting the keys from the keyfunc
+func NewVerifier(keyfunc jwt.Keyfunc, opts VerifyOptions) *Verifier {
+	methods := opts.Methods
+	if len(methods) == 0 {
+		methods = asymmetricMethods
+	}
+	parserOpts := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithLeeway(opts.Leeway),
+	}
+	if opts.Issuer != "" {
+		parserOpts = append(parserOpts, jwt.WithIssuer(opts.Issuer))
+	}
+	if opts.Audience != "" {
+		parserOpts = append(parserOpts, jwt.WithAudience(opts.Audience))
+	} else {
+		parserOpts = append(parserOpts, jwt.WithoutAudienceValidation())
+	}
+	return &Verifier{
+		keyfunc: keyfunc,
+		parser:  jwt.NewParser(parserOpts...),
+		opts:    opts,
+	}
+}
+
+// Verify verifies the token and decodes its claims, e.g. jwt.StandardClaims or jwt.MapClaims. Unlike the jwt parser, a token without aud is rejected when an audience is expected
+func (v *Verifier) Verify(tokenString string, claims jwt.Claims) error {
+	t, err := v.parser.ParseWithClaims(tokenString, claims, v.keyfunc)
+	if err != nil {
+		return err
+	}
+	if v.opts.Audience == "" {
+		return nil
+	}
+	var payload struct {
+		Audience jwt.ClaimStrings `json:"aud"`
+	}
+	parts := strings.Split(t.Raw, ".")
+	segment, err := jwt.DecodeSegment(parts[1])
+	if err == nil {
+		err = json.Unmarshal(segment, &payload)
+	}
+	if err != nil || len(payload.Audience) == 0 {
+		return &jwt.InvalidAudienceError{Message: "token has no aud claim"}
+	}
+	return nil
+}
+
+// StateOf maps the error of the verification of a JWT to the state
+func StateOf(err error) State {
+	if err == nil {
+		return OK
+	}
+	if state, ok := jwtStateOf(err); ok {
+		return state
+	}
+	return StateInvalid
+}
+
+// jwtStateOf maps the errors of the jwt parser to the states. ok is false for the other errors
+func jwtStateOf(err error) (state State, ok bool) {
+	var (
+		malformedErr   *jwt.MalformedTokenError
+		unverifiedErr  *jwt.UnverfiableTokenError
+		signatureErr   *jwt.InvalidSignatureError
+		expiredErr     *jwt.TokenExpiredError
+		notValidYetErr *jwt.TokenNotValidYetError
+		audienceErr    *jwt.InvalidAudienceError
+		issuerErr      *jwt.InvalidIssuerError
+		claimsErr      *jwt.InvalidClaimsError
+	)
+	switch {
+	case errors.As(err, &malformedErr):
+		return StateMalformed, true
+	case errors.As(err, &unverifiedErr):
+		return StateUnverifiable, true
+	case errors.As(err, &signatureErr):
+		return StateInvalidSignature, true
+	case errors.As(err, &expiredErr):
+		return StateExpired, true
+	case errors.As(err, &notValidYetErr):
+		return StateNotValidYet, true
+	case errors.As(err, &audienceErr), errors.As(err, &issuerErr):
+		return StateInvalidClaims, true
+	case errors.As(err, &claimsErr):
+		return StateInvalid, true
+	}
+	return "", false
+}
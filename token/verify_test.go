@@ -0,0 +1,25 @@
+package token
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMaxAge(t *testing.T) {
+	tests := []struct {
+		header []string
+		want   time.Duration
+	}{
+		{header: nil, want: 0},
+		{header: []string{"public, max-age=21600, must-revalidate"}, want: 6 * time.Hour},
+		{header: []string{"no-cache", `Max-Age="60"`}, want: time.Minute},
+		{header: []string{"s-maxage=60"}, want: 0},
+		{header: []string{"max-age=soon"}, want: 0},
+	}
+	for _, tt := range tests {
+		if got := maxAge(http.Header{"Cache-Control": tt.header}); got != tt.want {
+			t.Errorf("max-age of %q = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
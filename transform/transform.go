@@ -0,0 +1,361 @@
+// Package transform edits a JSON body in a single pass. The transformers only locate the values to change in the original body, and all the edits are spliced together with one copy of the body when the result is built
+package transform
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// Node is a value of the document with its position in the body
+type Node struct {
+	gjson.Result
+	// Offset is the position of Raw in the body
+	Offset int
+}
+
+// Get returns the value of the path relative to the node. The path is a dot separated path of gjson without wildcards
+func (n Node) Get(path string) Node {
+	r := gjson.Get(n.Raw, path)
+	if !r.Exists() || r.Index == 0 {
+		return Node{Result: r, Offset: -1}
+	}
+	return Node{Result: r, Offset: n.Offset + r.Index}
+}
+
+// Located reports whether the node exists and its position is known
+func (n Node) Located() bool {
+	return n.Exists() && n.Offset >= 0
+}
+
+// edit replaces the bytes between start and end of the body with value. An insertion has the same start and end. The seq orders the edits as they are recorded, and a removal supersedes every edit inside it
+type edit struct {
+	start, end int
+	value      []byte
+	seq        int
+	removal    bool
+}
+
+// Document collects the edits of a body
+type Document struct {
+	body       []byte
+	json       string
+	items      map[string][]Node
+	edits      []edit
+	insertions []insertion
+	deletions  []deletion
+	// insertionOf and deletionOf map the offset of an object to its insertion and its deletion
+	insertionOf map[int]int
+	deletionOf  map[int]int
+	// seq counts the recorded edits
+	seq int
+}
+
+// NewDocument parses the body lazily. The body must not be modified until Bytes is called
+func NewDocument(body []byte) *Document {
+	return &Document{
+		body: body,
+		json: string(body),
+	}
+}
+
+// Root returns the node of the whole body
+func (d *Document) Root() Node {
+	raw := strings.TrimLeft(d.json, " \t\r\n")
+	return Node{Result: gjson.Result{Type: gjson.JSON, Raw: raw}, Offset: len(d.json) - len(raw)}
+}
+
+// Items returns the elements of the array at the path of the body. The elements are parsed once and shared by all transformers
+func (d *Document) Items(path string) []Node {
+	if items, ok := d.items[path]; ok {
+		return items
+	}
+	var items []Node
+	array := d.Root().Get(path)
+	if array.Located() && array.IsArray() {
+		array.ForEach(func(_, value gjson.Result) bool {
+			items = append(items, Node{Result: value, Offset: array.Offset + value.Index})
+			return true
+		})
+	}
+	if d.items == nil {
+		d.items = make(map[string][]Node)
+	}
+	d.items[path] = items
+	return items
+}
+
+// Replace sets the value of the node to the raw JSON
+func (d *Document) Replace(n Node, raw []byte) error {
+	if !n.Located() {
+		return fmt.Errorf("value of %s can't be located", n.Raw)
+	}
+	d.seq++
+	d.edits = append(d.edits, edit{start: n.Offset, end: n.Offset + len(n.Raw), value: raw, seq: d.seq})
+	return nil
+}
+
+// Set sets the value of the path relative to the object node to the raw JSON. The missing objects of the path are created, and setting a missing path again replaces the value set before
+func (d *Document) Set(n Node, path string, raw []byte) error {
+	if field := n.Get(path); field.Exists() {
+		return d.Replace(field, raw)
+	}
+
+	// find the deepest existing object of the path and insert the rest of the path into it
+	keys := strings.Split(path, ".")
+	parent, depth := n, 0
+	for depth < len(keys)-1 {
+		next := parent.Get(keys[depth])
+		if !next.Exists() {
+			break
+		}
+		parent, depth = next, depth+1
+	}
+	if !parent.Located() || !parent.IsObject() {
+		return fmt.Errorf("parent of %s is not an object", path)
+	}
+
+	// the members inserted into an object are resolved together, so that a path set twice is inserted once and the comma after them depends on the members left by the deletions
+	d.seq++
+	i, ok := d.insertionOf[parent.Offset]
+	if !ok {
+		if d.insertionOf == nil {
+			d.insertionOf = make(map[int]int)
+		}
+		i = len(d.insertions)
+		d.insertionOf[parent.Offset] = i
+		d.insertions = append(d.insertions, insertion{parent: parent, members: &insertedObject{}})
+	}
+	d.insertions[i].seq = d.seq
+	object := d.insertions[i].members
+	for _, key := range keys[depth : len(keys)-1] {
+		v := object.member(key)
+		if v.raw != nil {
+			return fmt.Errorf("%s is set to a value which is not an object before", key)
+		}
+		if v.object == nil {
+			v.object = &insertedObject{}
+		}
+		object = v.object
+	}
+	last := object.member(keys[len(keys)-1])
+	last.raw, last.object = raw, nil
+	return nil
+}
+
+// insertion is the members to insert right after the opening brace of an object
+type insertion struct {
+	parent  Node
+	members *insertedObject
+	seq     int
+}
+
+// insertedObject is the members of an inserted object in the order they are first set
+type insertedObject struct {
+	keys   []string
+	values map[string]*insertedValue
+}
+
+// insertedValue is either the raw JSON or an object of inserted members
+type insertedValue struct {
+	raw    []byte
+	object *insertedObject
+}
+
+// member returns the value of the key, which is added if it's missing
+func (o *insertedObject) member(key string) *insertedValue {
+	if v, ok := o.values[key]; ok {
+		return v
+	}
+	if o.values == nil {
+		o.values = make(map[string]*insertedValue)
+	}
+	v := &insertedValue{}
+	o.keys = append(o.keys, key)
+	o.values[key] = v
+	return v
+}
+
+// members returns the members separated by commas
+func (o *insertedObject) members() string {
+	members := make([]string, 0, len(o.keys))
+	for _, key := range o.keys {
+		v := o.values[key]
+		value := string(v.raw)
+		if v.object != nil {
+			value = "{" + v.object.members() + "}"
+		}
+		members = append(members, strconv.Quote(key)+":"+value)
+	}
+	return strings.Join(members, ",")
+}
+
+// Delete removes the member at the path relative to the object node together with its separating comma. It does nothing if the member doesn't exist
+func (d *Document) Delete(n Node, path string) error {
+	parent := n
+	key := path
+	if i := strings.LastIndexByte(path, '.'); i >= 0 {
+		parent, key = n.Get(path[:i]), path[i+1:]
+	}
+	if !parent.Exists() || !parent.IsObject() {
+		return nil
+	}
+	if !parent.Located() {
+		return fmt.Errorf("parent of %s can't be located", path)
+	}
+	// the deletions of an object are resolved together, so that the commas of adjacent members are removed correctly
+	d.seq++
+	if i, ok := d.deletionOf[parent.Offset]; ok {
+		d.deletions[i].keys = append(d.deletions[i].keys, key)
+		d.deletions[i].seq = d.seq
+		return nil
+	}
+	if d.deletionOf == nil {
+		d.deletionOf = make(map[int]int)
+	}
+	d.deletionOf[parent.Offset] = len(d.deletions)
+	d.deletions = append(d.deletions, deletion{parent: parent, keys: []string{key}, seq: d.seq})
+	return nil
+}
+
+// deletion is the members to remove from an object
+type deletion struct {
+	parent Node
+	keys   []string
+	seq    int
+}
+
+// removes reports whether the key is one of the members to remove
+func (del deletion) removes(key string) bool {
+	for _, k := range del.keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// edits returns the ranges removing the members. A run of removed members takes the comma after it, or the comma before it if it ends the object
+func (del deletion) edits() []edit {
+	type member struct {
+		start, end int
+		removed    bool
+	}
+	var members []member
+	del.parent.ForEach(func(k, v gjson.Result) bool {
+		m := member{start: k.Index, end: v.Index + len(v.Raw), removed: del.removes(k.Str)}
+		members = append(members, m)
+		return true
+	})
+
+	var edits []edit
+	for i := 0; i < len(members); i++ {
+		if !members[i].removed {
+			continue
+		}
+		first := i
+		for i+1 < len(members) && members[i+1].removed {
+			i++
+		}
+		start, end := members[first].start, members[i].end
+		switch {
+		case i+1 < len(members):
+			end = members[i+1].start
+		case first > 0:
+			start = members[first-1].end
+		}
+		edits = append(edits, edit{start: del.parent.Offset + start, end: del.parent.Offset + end, seq: del.seq, removal: true})
+	}
+	return edits
+}
+
+// Changed reports whether there's any edit
+func (d *Document) Changed() bool {
+	return len(d.edits) > 0 || len(d.insertions) > 0 || len(d.deletions) > 0
+}
+
+// keepsMembers reports whether the object has a member left by its deletion
+func (d *Document) keepsMembers(object Node) bool {
+	var del deletion
+	if i, ok := d.deletionOf[object.Offset]; ok {
+		del = d.deletions[i]
+	}
+	kept := false
+	object.ForEach(func(k, _ gjson.Result) bool {
+		kept = !del.removes(k.Str)
+		return !kept
+	})
+	return kept
+}
+
+// insertionEdits returns the edits inserting the members. The inserted members are followed by a comma if the deletions leave a member after them
+func (d *Document) insertionEdits() []edit {
+	edits := make([]edit, 0, len(d.insertions))
+	for _, ins := range d.insertions {
+		members := ins.members.members()
+		if d.keepsMembers(ins.parent) {
+			members += ","
+		}
+		start := ins.parent.Offset + strings.IndexByte(ins.parent.Raw, '{') + 1
+		edits = append(edits, edit{start: start, end: start, value: []byte(members), seq: ins.seq})
+	}
+	return edits
+}
+
+// Bytes splices the edits into the body. The later of two edits of the same range wins, and an edit inside the range of a later edit or of a deletion is superseded by it, e.g. a deletion inside a replaced object. An edit inside an earlier edit, whose value has replaced the range, or overlapping another edit fails. The insertions at an offset come before the edit starting there. The body is returned as is if there's no edit
+func (d *Document) Bytes() ([]byte, error) {
+	if !d.Changed() {
+		return d.body, nil
+	}
+	d.edits = append(d.edits, d.insertionEdits()...)
+	for _, del := range d.deletions {
+		d.edits = append(d.edits, del.edits()...)
+	}
+	d.insertions, d.deletions, d.insertionOf, d.deletionOf = nil, nil, nil, nil
+	sort.SliceStable(d.edits, func(i, j int) bool {
+		if d.edits[i].start != d.edits[j].start {
+			return d.edits[i].start < d.edits[j].start
+		}
+		// an insertion isn't inside the edit starting at its offset
+		if insertI, insertJ := d.edits[i].start == d.edits[i].end, d.edits[j].start == d.edits[j].end; insertI != insertJ {
+			return insertI
+		}
+		if d.edits[i].end != d.edits[j].end {
+			return d.edits[i].end > d.edits[j].end
+		}
+		return d.edits[i].seq > d.edits[j].seq
+	})
+
+	kept := d.edits[:0]
+	size := len(d.body)
+	for _, e := range d.edits {
+		if len(kept) > 0 {
+			last := kept[len(kept)-1]
+			// an insertion at the end of the last edit is next to it rather than inside it
+			inside := e.start >= last.start && e.end <= last.end && e.start < last.end
+			if inside && (last.removal || e.seq < last.seq) {
+				continue
+			}
+			if inside {
+				return nil, fmt.Errorf("edit of [%d,%d) is inside the earlier edit of [%d,%d)", e.start, e.end, last.start, last.end)
+			}
+			if e.start < last.end {
+				return nil, fmt.Errorf("edits of [%d,%d) and [%d,%d) overlap", last.start, last.end, e.start, e.end)
+			}
+		}
+		kept = append(kept, e)
+		size += len(e.value) - (e.end - e.start)
+	}
+
+	b := make([]byte, 0, size)
+	pos := 0
+	for _, e := range kept {
+		b = append(b, d.body[pos:e.start]...)
+		b = append(b, e.value...)
+		pos = e.end
+	}
+	return append(b, d.body[pos:]...), nil
+}
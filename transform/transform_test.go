@@ -0,0 +1,169 @@
+package transform
+
+import (
+	"testing"
+)
+
+func TestDocumentBytesRejectsAnEditInsideAnEarlierEdit(t *testing.T) {
+	d := NewDocument([]byte(`{"_items":[{"content":{"html":"<p></p>","apiData":[1]}}]}`))
+	item := d.Items("_items")[0]
+	if err := d.Replace(item.Get("content"), []byte(`{"teaser":true}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Replace(item.Get("content.apiData"), []byte(`[]`)); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := d.Bytes(); err == nil {
+		t.Fatalf("edit inside the replaced content is spliced into %s", b)
+	}
+}
+
+func TestDocumentBytes(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		edit func(d *Document) error
+		want string
+	}{
+		{
+			name: "no edit returns the body",
+			body: `{"_items":[{"a":1}]}`,
+			edit: func(d *Document) error { return nil },
+			want: `{"_items":[{"a":1}]}`,
+		},
+		{
+			name: "replace a nested value",
+			body: `{"_items":[{"content":{"apiData":[1,2,3]}},{"content":{"apiData":[4]}}]}`,
+			edit: func(d *Document) error {
+				item := d.Items("_items")[0]
+				return d.Replace(item.Get("content.apiData"), []byte(`[1]`))
+			},
+			want: `{"_items":[{"content":{"apiData":[1]}},{"content":{"apiData":[4]}}]}`,
+		},
+		{
+			name: "delete the first, middle and last members",
+			body: `{"_items":[{"html":1,"b":2},{"a":1,"html":2,"b":3},{"a":1, "html": 2}]}`,
+			edit: func(d *Document) error {
+				for _, item := range d.Items("_items") {
+					if err := d.Delete(item, "html"); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			want: `{"_items":[{"b":2},{"a":1,"b":3},{"a":1}]}`,
+		},
+		{
+			name: "delete the two last members",
+			body: `{"_items":[{"x":0,"html":1,"apiData":2}]}`,
+			edit: func(d *Document) error {
+				item := d.Items("_items")[0]
+				if err := d.Delete(item, "html"); err != nil {
+					return err
+				}
+				return d.Delete(item, "apiData")
+			},
+			want: `{"_items":[{"x":0}]}`,
+		},
+		{
+			name: "delete a missing member",
+			body: `{"_items":[{"a":1}]}`,
+			edit: func(d *Document) error {
+				return d.Delete(d.Items("_items")[0], "content.html")
+			},
+			want: `{"_items":[{"a":1}]}`,
+		},
+		{
+			name: "set creates the missing objects",
+			body: `{"_items":[{"a":1},{}]}`,
+			edit: func(d *Document) error {
+				for _, item := range d.Items("_items") {
+					if err := d.Set(item, "content.apiData", []byte(`[]`)); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			want: `{"_items":[{"content":{"apiData":[]},"a":1},{"content":{"apiData":[]}}]}`,
+		},
+		{
+			name: "set and delete the first member",
+			body: `{"_items":[{"html":1,"b":2},{"html":1},{}]}`,
+			edit: func(d *Document) error {
+				for _, item := range d.Items("_items") {
+					if err := d.Set(item, "teaser", []byte(`true`)); err != nil {
+						return err
+					}
+					if err := d.Delete(item, "html"); err != nil {
+						return err
+					}
+					if err := d.Set(item, "locked", []byte(`false`)); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			want: `{"_items":[{"teaser":true,"locked":false,"b":2},{"teaser":true,"locked":false},{"teaser":true,"locked":false}]}`,
+		},
+		{
+			name: "set a missing path twice",
+			body: `{"_items":[{"a":1},{}]}`,
+			edit: func(d *Document) error {
+				for _, item := range d.Items("_items") {
+					for _, set := range []struct{ path, value string }{
+						{"teaser", `"T1"`},
+						{"content.apiData", `[]`},
+						{"teaser", `"T2"`},
+						{"content.html", `""`},
+					} {
+						if err := d.Set(item, set.path, []byte(set.value)); err != nil {
+							return err
+						}
+					}
+				}
+				return nil
+			},
+			want: `{"_items":[{"teaser":"T2","content":{"apiData":[],"html":""},"a":1},{"teaser":"T2","content":{"apiData":[],"html":""}}]}`,
+		},
+		{
+			name: "later replace of the same value wins",
+			body: `{"_items":[{"content":{"apiData":[1,2,3]}}]}`,
+			edit: func(d *Document) error {
+				apiData := d.Items("_items")[0].Get("content.apiData")
+				// the truncate rule and then the teaser rule
+				if err := d.Replace(apiData, []byte(`[1]`)); err != nil {
+					return err
+				}
+				return d.Replace(apiData, []byte(`[]`))
+			},
+			want: `{"_items":[{"content":{"apiData":[]}}]}`,
+		},
+		{
+			name: "edit inside a replaced value is superseded",
+			body: `{"_items":[{"content":{"html":"<p></p>","apiData":[1]},"a":1}]}`,
+			edit: func(d *Document) error {
+				item := d.Items("_items")[0]
+				if err := d.Delete(item, "content.html"); err != nil {
+					return err
+				}
+				return d.Replace(item.Get("content"), []byte(`{"teaser":true}`))
+			},
+			want: `{"_items":[{"content":{"teaser":true},"a":1}]}`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewDocument([]byte(tc.body))
+			if err := tc.edit(d); err != nil {
+				t.Fatal(err)
+			}
+			got, err := d.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
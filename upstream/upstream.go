@@ -0,0 +1,378 @@
+// Package upstream balances the proxied requests among the targets of an upstream and keeps track of their health
+package upstream
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mirror-media/mm-apigateway/config"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	PolicyRoundRobin     = "roundRobin"
+	PolicyLeastInFlight  = "leastInFlight"
+	PolicyConsistentHash = "consistentHash"
+)
+
+const (
+	defaultInterval           = 10
+	defaultTimeout            = 2
+	defaultHealthyThreshold   = 2
+	defaultUnhealthyThreshold = 3
+	// virtualNodes is the number of points of a target on the hash ring
+	virtualNodes = 64
+)
+
+// ErrNoHealthyTarget is returned when every target of an upstream is ejected
+var ErrNoHealthyTarget = errors.New("no healthy target is available")
+
+// Target is a backend of an upstream
+type Target struct {
+	URL      *url.URL
+	inFlight int64
+	healthy  int32
+
+	mu          sync.Mutex
+	successes   int
+	failures    int
+	lastError   string
+	lastChecked time.Time
+}
+
+// Acquire marks a request in flight to the target. The returned func has to be called when the request finishes
+func (t *Target) Acquire() (release func()) {
+	atomic.AddInt64(&t.inFlight, 1)
+	return func() {
+		atomic.AddInt64(&t.inFlight, -1)
+	}
+}
+
+// InFlight returns the number of requests in flight to the target
+func (t *Target) InFlight() int64 {
+	return atomic.LoadInt64(&t.inFlight)
+}
+
+// Healthy reports whether the target is admitted
+func (t *Target) Healthy() bool {
+	return atomic.LoadInt32(&t.healthy) == 1
+}
+
+func (t *Target) setHealthy(healthy bool) {
+	var v int32
+	if healthy {
+		v = 1
+	}
+	atomic.StoreInt32(&t.healthy, v)
+}
+
+// report records the result of a probe and ejects or re-admits the target according to the thresholds
+func (t *Target) report(err error, hc config.UpstreamHealthCheck) (changed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastChecked = time.Now()
+	if err == nil {
+		t.lastError = ""
+		t.failures = 0
+		t.successes++
+		if !t.Healthy() && t.successes >= hc.HealthyThreshold {
+			t.setHealthy(true)
+			return true
+		}
+		return false
+	}
+	t.lastError = err.Error()
+	t.successes = 0
+	t.failures++
+	if t.Healthy() && t.failures >= hc.UnhealthyThreshold {
+		t.setHealthy(false)
+		return true
+	}
+	return false
+}
+
+// TargetStatus is the state of a target reported on /health
+type TargetStatus struct {
+	URL         string     `json:"url"`
+	Healthy     bool       `json:"healthy"`
+	InFlight    int64      `json:"inFlight"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastChecked *time.Time `json:"lastChecked,omitempty"`
+}
+
+// PoolStatus is the state of an upstream reported on /health
+type PoolStatus struct {
+	Name    string         `json:"name"`
+	Policy  string         `json:"policy"`
+	Healthy bool           `json:"healthy"`
+	Targets []TargetStatus `json:"targets"`
+}
+
+type ringPoint struct {
+	hash   uint32
+	target *Target
+}
+
+// Pool selects a healthy target of an upstream for every request
+type Pool struct {
+	name        string
+	policy      string
+	healthCheck config.UpstreamHealthCheck
+	targets     []*Target
+	ring        []ringPoint
+	next        uint64
+	client      *http.Client
+}
+
+// NewPool validates the upstream and admits all its targets
+func NewPool(c config.Upstream) (*Pool, error) {
+	if len(c.Targets) == 0 {
+		return nil, fmt.Errorf("upstream(%s) has no target", c.Name)
+	}
+	if c.Policy == "" {
+		c.Policy = PolicyRoundRobin
+	}
+	switch c.Policy {
+	case PolicyRoundRobin, PolicyLeastInFlight, PolicyConsistentHash:
+	default:
+		return nil, fmt.Errorf("upstream(%s) has an unsupported policy(%s)", c.Name, c.Policy)
+	}
+
+	hc := c.HealthCheck
+	if hc.Interval <= 0 {
+		hc.Interval = defaultInterval
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = defaultTimeout
+	}
+	if hc.HealthyThreshold <= 0 {
+		hc.HealthyThreshold = defaultHealthyThreshold
+	}
+	if hc.UnhealthyThreshold <= 0 {
+		hc.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+
+	p := &Pool{
+		name:        c.Name,
+		policy:      c.Policy,
+		healthCheck: hc,
+		targets:     make([]*Target, 0, len(c.Targets)),
+		client:      &http.Client{Timeout: time.Duration(hc.Timeout) * time.Second},
+	}
+	for _, t := range c.Targets {
+		u, err := url.Parse(t)
+		if err != nil {
+			return nil, errors.Wrapf(err, "upstream(%s) has an invalid target(%s)", c.Name, t)
+		}
+		target := &Target{URL: u}
+		target.setHealthy(true)
+		p.targets = append(p.targets, target)
+	}
+
+	if p.policy == PolicyConsistentHash {
+		p.ring = make([]ringPoint, 0, len(p.targets)*virtualNodes)
+		for _, t := range p.targets {
+			for i := 0; i < virtualNodes; i++ {
+				p.ring = append(p.ring, ringPoint{hash: hash(t.URL.String() + "#" + strconv.Itoa(i)), target: t})
+			}
+		}
+		sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+	}
+	return p, nil
+}
+
+func hash(s string) uint32 {
+	sum := md5.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// Name returns the name of the upstream
+func (p *Pool) Name() string {
+	return p.name
+}
+
+// Pick selects a healthy target according to the policy. The key is only used by consistentHash
+func (p *Pool) Pick(key string) (*Target, error) {
+	switch p.policy {
+	case PolicyLeastInFlight:
+		var picked *Target
+		for _, t := range p.targets {
+			if t.Healthy() && (picked == nil || t.InFlight() < picked.InFlight()) {
+				picked = t
+			}
+		}
+		if picked == nil {
+			return nil, ErrNoHealthyTarget
+		}
+		return picked, nil
+	case PolicyConsistentHash:
+		h := hash(key)
+		start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+		for i := 0; i < len(p.ring); i++ {
+			point := p.ring[(start+i)%len(p.ring)]
+			if point.target.Healthy() {
+				return point.target, nil
+			}
+		}
+		return nil, ErrNoHealthyTarget
+	default:
+		n := uint64(len(p.targets))
+		start := atomic.AddUint64(&p.next, 1) - 1
+		for i := uint64(0); i < n; i++ {
+			t := p.targets[(start+i)%n]
+			if t.Healthy() {
+				return t, nil
+			}
+		}
+		return nil, ErrNoHealthyTarget
+	}
+}
+
+// Status returns the state of the upstream and its targets
+func (p *Pool) Status() PoolStatus {
+	s := PoolStatus{
+		Name:    p.name,
+		Policy:  p.policy,
+		Targets: make([]TargetStatus, 0, len(p.targets)),
+	}
+	for _, t := range p.targets {
+		t.mu.Lock()
+		ts := TargetStatus{
+			URL:       t.URL.String(),
+			Healthy:   t.Healthy(),
+			InFlight:  t.InFlight(),
+			LastError: t.lastError,
+		}
+		if !t.lastChecked.IsZero() {
+			lastChecked := t.lastChecked
+			ts.LastChecked = &lastChecked
+		}
+		t.mu.Unlock()
+		s.Healthy = s.Healthy || ts.Healthy
+		s.Targets = append(s.Targets, ts)
+	}
+	return s
+}
+
+// Run probes the targets until the context is done. It returns immediately if the health check has no path
+func (p *Pool) Run(ctx context.Context) {
+	if p.healthCheck.Path == "" {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(p.healthCheck.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, t := range p.targets {
+			wg.Add(1)
+			go func(t *Target) {
+				defer wg.Done()
+				p.probe(ctx, t)
+			}(t)
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pool) probe(ctx context.Context, t *Target) {
+	probeURL := *t.URL
+	probeURL.Path = singleJoiningSlash(probeURL.Path, p.healthCheck.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL.String(), nil)
+	if err == nil {
+		var resp *http.Response
+		resp, err = p.client.Do(req)
+		if err == nil {
+			_ = resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+				err = fmt.Errorf("probe responded with status %d", resp.StatusCode)
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	if t.report(err, p.healthCheck) {
+		logger := log.WithFields(log.Fields{
+			"upstream": p.name,
+			"target":   t.URL.String(),
+		})
+		if t.Healthy() {
+			logger.Info("target is re-admitted")
+		} else {
+			logger.Warnf("target is ejected: %v", err)
+		}
+	}
+}
+
+func singleJoiningSlash(a, b string) string {
+	switch aslash, bslash := len(a) > 0 && a[len(a)-1] == '/', len(b) > 0 && b[0] == '/'; {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// Registry holds the pools of all upstreams
+type Registry struct {
+	pools map[string]*Pool
+	names []string
+}
+
+// NewRegistry creates a pool for every upstream
+func NewRegistry(upstreams []config.Upstream) (*Registry, error) {
+	r := &Registry{
+		pools: make(map[string]*Pool, len(upstreams)),
+	}
+	for _, u := range upstreams {
+		if _, ok := r.pools[u.Name]; ok {
+			return nil, fmt.Errorf("upstream(%s) is defined more than once", u.Name)
+		}
+		p, err := NewPool(u)
+		if err != nil {
+			return nil, err
+		}
+		r.pools[u.Name] = p
+		r.names = append(r.names, u.Name)
+	}
+	return r, nil
+}
+
+// Get returns the pool of the upstream
+func (r *Registry) Get(name string) (*Pool, bool) {
+	p, ok := r.pools[name]
+	return p, ok
+}
+
+// Start runs the health checks of all pools in the background until the context is done
+func (r *Registry) Start(ctx context.Context) {
+	for _, name := range r.names {
+		go r.pools[name].Run(ctx)
+	}
+}
+
+// Status returns the state of all upstreams in the order they are defined
+func (r *Registry) Status() []PoolStatus {
+	s := make([]PoolStatus, 0, len(r.names))
+	for _, name := range r.names {
+		s = append(s, r.pools[name].Status())
+	}
+	return s
+}
@@ -0,0 +1,210 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mirror-media/mm-apigateway/config"
+)
+
+// newTarget serves the health path with the status of the returned value, 200 at first
+func newTarget(t *testing.T) (*httptest.Server, *int32) {
+	status := int32(http.StatusOK)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/base/healthz" {
+			t.Errorf("probed path is %s", r.URL.Path)
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	t.Cleanup(s.Close)
+	return s, &status
+}
+
+func pickURLs(t *testing.T, p *Pool, n int) []string {
+	t.Helper()
+	urls := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		target, err := p.Pick("/api/v0/posts")
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, target.URL.String())
+	}
+	return urls
+}
+
+func TestProbesEjectAndReadmitTargets(t *testing.T) {
+	a, aStatus := newTarget(t)
+	b, _ := newTarget(t)
+	p, err := NewPool(config.Upstream{
+		Name:    "v0",
+		Targets: []string{a.URL + "/base", b.URL + "/base"},
+		HealthCheck: config.UpstreamHealthCheck{
+			Path:               "/healthz",
+			HealthyThreshold:   2,
+			UnhealthyThreshold: 2,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	ta := p.targets[0]
+
+	atomic.StoreInt32(aStatus, http.StatusServiceUnavailable)
+	p.probe(ctx, ta)
+	if !ta.Healthy() {
+		t.Fatal("target is ejected before the threshold")
+	}
+	p.probe(ctx, ta)
+	if ta.Healthy() {
+		t.Fatal("target is not ejected")
+	}
+	for _, u := range pickURLs(t, p, 4) {
+		if u != b.URL+"/base" {
+			t.Fatalf("ejected target is picked: %s", u)
+		}
+	}
+	if s := p.Status(); !s.Healthy || s.Targets[0].Healthy || s.Targets[0].LastError == "" || s.Targets[0].LastChecked == nil {
+		t.Fatalf("status is %+v", s)
+	}
+
+	atomic.StoreInt32(aStatus, http.StatusOK)
+	p.probe(ctx, ta)
+	if ta.Healthy() {
+		t.Fatal("target is re-admitted before the threshold")
+	}
+	p.probe(ctx, ta)
+	if !ta.Healthy() {
+		t.Fatal("target is not re-admitted")
+	}
+	if s := p.Status(); s.Targets[0].LastError != "" {
+		t.Fatalf("status is %+v", s)
+	}
+}
+
+func TestUnreachableTargetIsEjected(t *testing.T) {
+	a, _ := newTarget(t)
+	a.Close()
+	p, err := NewPool(config.Upstream{
+		Name:        "v0",
+		Targets:     []string{a.URL + "/base"},
+		HealthCheck: config.UpstreamHealthCheck{Path: "/healthz", UnhealthyThreshold: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.probe(context.Background(), p.targets[0])
+	if _, err := p.Pick(""); err != ErrNoHealthyTarget {
+		t.Fatalf("pick of no healthy target returns %v", err)
+	}
+	if p.Status().Healthy {
+		t.Fatal("upstream of no healthy target is healthy")
+	}
+}
+
+func TestPickFailsOver(t *testing.T) {
+	targets := []string{"http://a", "http://b", "http://c"}
+	for _, policy := range []string{PolicyRoundRobin, PolicyLeastInFlight, PolicyConsistentHash} {
+		t.Run(policy, func(t *testing.T) {
+			p, err := NewPool(config.Upstream{Name: "v0", Targets: targets, Policy: policy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			picked := pickURLs(t, p, 1)[0]
+			for _, target := range p.targets {
+				if target.URL.String() == picked {
+					target.setHealthy(false)
+				}
+			}
+			for _, u := range pickURLs(t, p, 6) {
+				if u == picked {
+					t.Fatalf("ejected target(%s) is picked", u)
+				}
+			}
+		})
+	}
+}
+
+func TestPickPolicies(t *testing.T) {
+	targets := []string{"http://a", "http://b", "http://c"}
+
+	p, _ := NewPool(config.Upstream{Name: "v0", Targets: targets})
+	if got := pickURLs(t, p, 4); got[0] != "http://a" || got[1] != "http://b" || got[2] != "http://c" || got[3] != "http://a" {
+		t.Fatalf("round robin picks %v", got)
+	}
+
+	p, _ = NewPool(config.Upstream{Name: "v0", Targets: targets, Policy: PolicyLeastInFlight})
+	releaseA := p.targets[0].Acquire()
+	p.targets[1].Acquire()
+	if got := pickURLs(t, p, 1)[0]; got != "http://c" {
+		t.Fatalf("least in flight picks %s", got)
+	}
+	releaseA()
+	if got := pickURLs(t, p, 1)[0]; got != "http://a" {
+		t.Fatalf("least in flight picks %s after the release", got)
+	}
+
+	p, _ = NewPool(config.Upstream{Name: "v0", Targets: targets, Policy: PolicyConsistentHash})
+	first, _ := p.Pick("/api/v0/posts?page=1")
+	for i := 0; i < 5; i++ {
+		if target, _ := p.Pick("/api/v0/posts?page=1"); target != first {
+			t.Fatal("consistent hash picks another target for the same key")
+		}
+	}
+}
+
+func TestRunStopsWithTheContext(t *testing.T) {
+	a, _ := newTarget(t)
+	r, err := NewRegistry([]config.Upstream{{
+		Name:        "v0",
+		Targets:     []string{a.URL + "/base"},
+		HealthCheck: config.UpstreamHealthCheck{Path: "/healthz", Interval: 1},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := r.Get("v0")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for p.Status().Targets[0].LastChecked == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("target is not probed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("probes don't stop with the context")
+	}
+}
+
+func TestNewRegistryRejectsInvalidUpstreams(t *testing.T) {
+	tests := []struct {
+		name      string
+		upstreams []config.Upstream
+	}{
+		{name: "no target", upstreams: []config.Upstream{{Name: "v0"}}},
+		{name: "unknown policy", upstreams: []config.Upstream{{Name: "v0", Targets: []string{"http://a"}, Policy: "random"}}},
+		{name: "invalid target", upstreams: []config.Upstream{{Name: "v0", Targets: []string{"http://a b:x"}}}},
+		{name: "duplicate", upstreams: []config.Upstream{{Name: "v0", Targets: []string{"http://a"}}, {Name: "v0", Targets: []string{"http://b"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRegistry(tt.upstreams); err == nil {
+				t.Fatal("invalid upstream is accepted")
+			}
+		})
+	}
+}